@@ -6,14 +6,18 @@ import (
 	"math/rand"
 	"net/http"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/go-hclog"
 )
 
 type ExchangeRates struct {
-	log   hclog.Logger
-	rates map[string]float64
+	log         hclog.Logger
+	mu          sync.RWMutex // guards rates, lastUpdated and updates
+	rates       map[string]float64
+	lastUpdated time.Time
+	updates     uint64
 }
 
 func NewRates(l hclog.Logger) (*ExchangeRates, error) {
@@ -25,6 +29,9 @@ func NewRates(l hclog.Logger) (*ExchangeRates, error) {
 }
 
 func (e *ExchangeRates) GetRate(base, dest string) (float64, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
 	br, ok := e.rates[base]
 	if !ok {
 		return 0, fmt.Errorf("Rate not found for currency %s", base)
@@ -39,20 +46,27 @@ func (e *ExchangeRates) GetRate(base, dest string) (float64, error) {
 }
 
 // MonitorRates checks the rates in the ECB API every interval and sends a message to the
-// returned channel when there are changes
+// returned channel when there are changes, monitoring stops and the channel is closed
+// when done is closed
 //
 // Note: the ECB API only returns data once a day, this function only simulates the changes
 // in rates for demonstration purposes
-func (e *ExchangeRates) MonitorRates(interval time.Duration) chan struct{} {
+func (e *ExchangeRates) MonitorRates(interval time.Duration, done <-chan struct{}) chan struct{} {
 	ret := make(chan struct{})
 
 	go func() {
 		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		defer close(ret)
+
 		for {
 			select {
+			case <-done:
+				return
 			case <-ticker.C:
 				// just add a random difference to the rate and return it
 				// this simulates the fluctuations in currency rates
+				e.mu.Lock()
 				for k, v := range e.rates {
 					// change can be 10% of original value
 					change := (rand.Float64() / 10)
@@ -71,8 +85,17 @@ func (e *ExchangeRates) MonitorRates(interval time.Duration) chan struct{} {
 					e.rates[k] = v * change
 				}
 
+				e.lastUpdated = time.Now()
+				e.updates++
+				e.mu.Unlock()
+
 				// notify updates, this will block unless there is a listener on the other end
-				ret <- struct{}{}
+				// or monitoring is stopped
+				select {
+				case ret <- struct{}{}:
+				case <-done:
+					return
+				}
 			}
 		}
 	}()
@@ -94,6 +117,9 @@ func (e *ExchangeRates) getRates() error {
 	md := Cubes{}
 	xml.NewDecoder(resp.Body).Decode(&md)
 
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
 	for _, c := range md.CubeData {
 		r, err := strconv.ParseFloat(c.Rate, 64)
 		if err != nil {
@@ -104,10 +130,27 @@ func (e *ExchangeRates) getRates() error {
 	}
 
 	e.rates["EUR"] = 1
+	e.lastUpdated = time.Now()
 
 	return nil
 }
 
+// LastUpdated returns the time the rates were last changed
+func (e *ExchangeRates) LastUpdated() time.Time {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.lastUpdated
+}
+
+// Updates returns the number of simulated rate changes made by MonitorRates
+func (e *ExchangeRates) Updates() uint64 {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	return e.updates
+}
+
 type Cubes struct {
 	CubeData []Cube `xml:"Cube>Cube>Cube"`
 }
@@ -3,6 +3,7 @@ package data
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
 )
@@ -16,3 +17,23 @@ func TestNewRates(t *testing.T) {
 
 	fmt.Printf("Rates %#v", tr.rates)
 }
+
+func TestMonitorRatesStopsWhenDone(t *testing.T) {
+	tr := &ExchangeRates{log: hclog.Default(), rates: map[string]float64{"USD": 1.1}}
+	done := make(chan struct{})
+
+	ru := tr.MonitorRates(time.Millisecond, done)
+
+	// wait until an update is blocked on the send before stopping
+	time.Sleep(10 * time.Millisecond)
+	close(done)
+
+	select {
+	case _, ok := <-ru:
+		for ok {
+			_, ok = <-ru
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected the updates channel to be closed")
+	}
+}
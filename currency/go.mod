@@ -7,5 +7,11 @@ require (
 	github.com/golang/protobuf v1.3.5
 	github.com/google/martian v2.1.0+incompatible
 	github.com/hashicorp/go-hclog v0.12.1
+	github.com/nicholasjackson/building-microservices-youtube/shared v0.0.0
+	github.com/nicholasjackson/env v0.6.0
+	github.com/prometheus/client_golang v1.5.1
+	github.com/stretchr/testify v1.8.2
 	google.golang.org/grpc v1.28.0
 )
+
+replace github.com/nicholasjackson/building-microservices-youtube/shared => ../shared
@@ -1,29 +1,105 @@
 package main
 
 import (
-	"fmt"
+	"context"
 	"net"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/nicholasjackson/building-microservices-youtube/currency/data"
 	protos "github.com/nicholasjackson/building-microservices-youtube/currency/protos/currency"
 	"github.com/nicholasjackson/building-microservices-youtube/currency/server"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/lifecycle"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/logging"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/tlsconfig"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/tracing"
+	"github.com/nicholasjackson/env"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/reflection"
 )
 
+var bindAddress = env.String("BIND_ADDRESS", false, ":9092", "Bind address for the gRPC server")
+var shutdownTimeout = env.Duration("SHUTDOWN_TIMEOUT", false, 30*time.Second, "Max time to wait for requests to complete on shutdown")
+var metricsAddress = env.String("METRICS_BIND_ADDRESS", false, ":9093", "Bind address for the Prometheus metrics endpoint")
+var traceExporter = env.String("TRACE_EXPORTER", false, "none", "Exporter for OpenTelemetry spans [none, stdout, file]")
+var traceFile = env.String("TRACE_FILE", false, "./traces.json", "File spans are written to when TRACE_EXPORTER is file")
+var traceSampleRatio = env.Float64("TRACE_SAMPLE_RATIO", false, 1, "Fraction of new traces which are sampled")
+var tlsCertFile = env.String("TLS_CERT_FILE", false, "", "PEM encoded certificate for the gRPC server, enables TLS")
+var tlsKeyFile = env.String("TLS_KEY_FILE", false, "", "PEM encoded private key for the gRPC server")
+var tlsClientCAFile = env.String("TLS_CLIENT_CA_FILE", false, "", "PEM encoded CA used to verify client certificates, enables mutual TLS")
+var tlsReloadInterval = env.Duration("TLS_RELOAD_INTERVAL", false, time.Minute, "Interval between checks for changed certificates")
+
 func main() {
+	env.Parse()
+
 	log := hclog.Default()
 
+	// shutdown hooks run in reverse order when the process receives SIGINT
+	// or SIGTERM
+	lc := lifecycle.New(log, *shutdownTimeout)
+
+	// configure OpenTelemetry tracing, spans are flushed after the servers
+	// have stopped
+	shutdownTracing, err := tracing.Setup("currency", *traceExporter, *traceFile, *traceSampleRatio)
+	if err != nil {
+		log.Error("Unable to configure tracing", "error", err)
+		os.Exit(1)
+	}
+
+	lc.OnShutdown("tracing", lifecycle.ShutdownFunc(shutdownTracing))
+
 	rates, err := data.NewRates(log)
 	if err != nil {
 		log.Error("Unable to generate rates", "error", err)
 		os.Exit(1)
 	}
 
-	// create a new gRPC server, use WithInsecure to allow http connections
-	gs := grpc.NewServer()
+	// create the metrics for the gRPC server
+	m, err := server.NewMetrics(prometheus.DefaultRegisterer, rates)
+	if err != nil {
+		log.Error("Unable to create metrics", "error", err)
+		os.Exit(1)
+	}
+
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(tracing.UnaryServerInterceptor, logging.UnaryServerInterceptor(log), m.UnaryInterceptor),
+		grpc.ChainStreamInterceptor(tracing.StreamServerInterceptor, logging.StreamServerInterceptor(log), m.StreamInterceptor),
+	}
+
+	// enable TLS when a certificate is configured, certificates are reloaded
+	// when the files change
+	if *tlsCertFile != "" {
+		r, err := tlsconfig.NewReloader(log, tlsconfig.Files{CAFile: *tlsClientCAFile, CertFile: *tlsCertFile, KeyFile: *tlsKeyFile})
+		if err != nil {
+			log.Error("Unable to load TLS certificates", "error", err)
+			os.Exit(1)
+		}
+
+		wctx, wcancel := context.WithCancel(context.Background())
+		lc.OnShutdown("tls", func(context.Context) error {
+			wcancel()
+			return nil
+		})
+
+		r.Watch(wctx, *tlsReloadInterval)
+
+		opts = append(opts, grpc.Creds(credentials.NewTLS(r.ServerConfig())))
+		log.Info("TLS enabled", "mutual_tls", *tlsClientCAFile != "")
+	} else if *tlsClientCAFile != "" {
+		log.Error("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+		os.Exit(1)
+	}
+
+	// create a new gRPC server, without credentials the server accepts plain
+	// text connections
+	gs := grpc.NewServer(opts...)
 
 	// create an instance of the Currency server
 	c := server.NewCurrency(rates, log)
@@ -31,17 +107,45 @@ func main() {
 	// register the currency server
 	protos.RegisterCurrencyServer(gs, c)
 
+	// register the gRPC health service, clients such as product-api use it to
+	// check the currency service is able to handle requests
+	hs := health.NewServer()
+	hs.SetServingStatus("Currency", healthpb.HealthCheckResponse_SERVING)
+	healthpb.RegisterHealthServer(gs, hs)
+
 	// register the reflection service which allows clients to determine the methods
 	// for this gRPC service
 	reflection.Register(gs)
 
 	// create a TCP socket for inbound server connections
-	l, err := net.Listen("tcp", fmt.Sprintf(":%d", 9092))
+	l, err := net.Listen("tcp", *bindAddress)
 	if err != nil {
 		log.Error("Unable to create listener", "error", err)
 		os.Exit(1)
 	}
 
+	// serve the Prometheus metrics on a separate HTTP port, the metrics
+	// server stops last so the final scrape includes the shutdown
+	ms := &http.Server{Addr: *metricsAddress, Handler: promhttp.Handler()}
+	log.Info("Starting metrics server", "bind_address", *metricsAddress)
+	lc.ServeHTTP("metrics", ms, ms.ListenAndServe)
+
 	// listen for requests
-	gs.Serve(l)
+	log.Info("Starting server", "bind_address", *bindAddress)
+	lc.ServeGRPC("grpc", gs, l)
+
+	// on shutdown report not serving to health checks and end the rate
+	// subscriptions so that clients move to another instance, the gRPC
+	// server can only stop gracefully once the streams are closed
+	lc.OnShutdown("subscriptions", func(context.Context) error {
+		c.Close()
+		return nil
+	})
+
+	lc.OnShutdown("health", func(context.Context) error {
+		hs.Shutdown()
+		return nil
+	})
+
+	os.Exit(lc.Wait())
 }
@@ -3,33 +3,64 @@ package server
 import (
 	"context"
 	"io"
+	"sync"
 	"time"
 
 	"github.com/hashicorp/go-hclog"
 	"github.com/nicholasjackson/building-microservices-youtube/currency/data"
 	protos "github.com/nicholasjackson/building-microservices-youtube/currency/protos/currency"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/logging"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // Currency is a gRPC server it implements the methods defined by the CurrencyServer interface
 type Currency struct {
 	rates         *data.ExchangeRates
 	log           hclog.Logger
+	mu            sync.Mutex // guards subscriptions
 	subscriptions map[protos.Currency_SubscribeRatesServer][]*protos.RateRequest
+	done          chan struct{}
+	closed        sync.Once
 }
 
 // NewCurrency creates a new Currency server
 func NewCurrency(r *data.ExchangeRates, l hclog.Logger) *Currency {
-	c := &Currency{r, l, make(map[protos.Currency_SubscribeRatesServer][]*protos.RateRequest)}
+	c := &Currency{
+		rates:         r,
+		log:           l,
+		subscriptions: make(map[protos.Currency_SubscribeRatesServer][]*protos.RateRequest),
+		done:          make(chan struct{}),
+	}
+
 	go c.handleUpdates()
 
 	return c
 }
 
+// Close ends all rate subscriptions, clients receive an Unavailable error
+// and can subscribe to another instance. Close must be called before the
+// gRPC server is stopped gracefully as streams never end on their own
+func (c *Currency) Close() {
+	c.closed.Do(func() { close(c.done) })
+}
+
 func (c *Currency) handleUpdates() {
-	ru := c.rates.MonitorRates(5 * time.Second)
-	for range ru {
+	ru := c.rates.MonitorRates(5*time.Second, c.done)
+	for {
+		select {
+		case <-c.done:
+			return
+		case _, ok := <-ru:
+			if !ok {
+				return
+			}
+		}
+
 		c.log.Info("Got Updated rates")
 
+		c.mu.Lock()
+
 		// loop over subscribed clients
 		for k, v := range c.subscriptions {
 
@@ -47,13 +78,14 @@ func (c *Currency) handleUpdates() {
 			}
 		}
 
+		c.mu.Unlock()
 	}
 }
 
 // GetRate implements the CurrencyServer GetRate method and returns the currency exchange rate
 // for the two given currencies.
 func (c *Currency) GetRate(ctx context.Context, rr *protos.RateRequest) (*protos.RateResponse, error) {
-	c.log.Info("Handle request for GetRate", "base", rr.GetBase(), "dest", rr.GetDestination())
+	logging.Logger(ctx, c.log).Info("Handle request for GetRate", "base", rr.GetBase(), "dest", rr.GetDestination())
 
 	rate, err := c.rates.GetRate(rr.GetBase().String(), rr.GetDestination().String())
 	if err != nil {
@@ -65,36 +97,48 @@ func (c *Currency) GetRate(ctx context.Context, rr *protos.RateRequest) (*protos
 
 // SubscribeRates implments the gRPC bidirection streaming method for the server
 func (c *Currency) SubscribeRates(src protos.Currency_SubscribeRatesServer) error {
+	l := logging.Logger(src.Context(), c.log)
+
+	// remove the client from the subscribers when the stream ends
+	defer func() {
+		c.mu.Lock()
+		delete(c.subscriptions, src)
+		c.mu.Unlock()
+	}()
+
+	errc := make(chan error, 1)
+	go func() { errc <- c.receive(src, l) }()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-c.done:
+		l.Info("Server is shutting down, closing subscription")
+		return status.Error(codes.Unavailable, "Server is shutting down")
+	}
+}
 
-	// handle client messages
+// receive handles the subscription requests from the client until the
+// client closes the stream
+func (c *Currency) receive(src protos.Currency_SubscribeRatesServer, l hclog.Logger) error {
 	for {
 		rr, err := src.Recv() // Recv is a blocking method which returns on client data
 		// io.EOF signals that the client has closed the connection
 		if err == io.EOF {
-			c.log.Info("Client has closed connection")
-			// if connection closed, then we remove clinet from subscribers
-			delete(c.subscriptions, src)
-			break
+			l.Info("Client has closed connection")
+			return nil
 		}
 
 		// any other error means the transport between the server and client is unavailable
 		if err != nil {
-			c.log.Error("Unable to read from client", "error", err)
-			// if get any kind of error, then we remove clinet from subscribers
-			delete(c.subscriptions, src)
+			l.Error("Unable to read from client", "error", err)
 			return err
 		}
 
-		c.log.Info("Handle client request", "request_base", rr.GetBase(), "request_dest", rr.GetDestination())
+		l.Info("Handle client request", "request_base", rr.GetBase(), "request_dest", rr.GetDestination())
 
-		rrs, ok := c.subscriptions[src]
-		if !ok {
-			rrs = []*protos.RateRequest{}
-		}
-
-		rrs = append(rrs, rr)
-		c.subscriptions[src] = rrs
+		c.mu.Lock()
+		c.subscriptions[src] = append(c.subscriptions[src], rr)
+		c.mu.Unlock()
 	}
-
-	return nil
 }
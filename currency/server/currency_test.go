@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/nicholasjackson/building-microservices-youtube/currency/data"
+	protos "github.com/nicholasjackson/building-microservices-youtube/currency/protos/currency"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCloseEndsSubscriptionsAndAllowsGracefulStop(t *testing.T) {
+	r, err := data.NewRates(hclog.NewNullLogger())
+	require.NoError(t, err)
+
+	c := NewCurrency(r, hclog.NewNullLogger())
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	gs := grpc.NewServer()
+	protos.RegisterCurrencyServer(gs, c)
+	go gs.Serve(l)
+
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	sub, err := protos.NewCurrencyClient(conn).SubscribeRates(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, sub.Send(&protos.RateRequest{Base: protos.Currencies_EUR, Destination: protos.Currencies_GBP}))
+
+	c.Close()
+
+	_, err = sub.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+
+	// without open streams the server stops gracefully
+	stopped := make(chan struct{})
+	go func() {
+		gs.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for server to stop")
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/nicholasjackson/building-microservices-youtube/currency/data"
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Metrics records Prometheus metrics for the gRPC server
+type Metrics struct {
+	latency       *prometheus.HistogramVec
+	activeStreams *prometheus.GaugeVec
+}
+
+// NewMetrics creates the gRPC server metrics and registers them with the given registerer
+// rates is used to report the age of the exchange rates and the number of simulated updates
+func NewMetrics(reg prometheus.Registerer, rates *data.ExchangeRates) (*Metrics, error) {
+	m := &Metrics{
+		latency: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "currency",
+				Name:      "grpc_request_duration_seconds",
+				Help:      "Latency of gRPC requests by method and status code, for streams this is the lifetime of the stream",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"method", "code"},
+		),
+		activeStreams: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "currency",
+				Name:      "grpc_active_streams",
+				Help:      "Number of open gRPC streams by method, i.e. SubscribeRates",
+			},
+			[]string{"method"},
+		),
+	}
+
+	age := prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace: "currency",
+			Name:      "rate_age_seconds",
+			Help:      "Time since the exchange rates were last updated",
+		},
+		func() float64 {
+			return time.Since(rates.LastUpdated()).Seconds()
+		},
+	)
+
+	updates := prometheus.NewCounterFunc(
+		prometheus.CounterOpts{
+			Namespace: "currency",
+			Name:      "rate_updates_total",
+			Help:      "Total number of simulated exchange rate updates",
+		},
+		func() float64 {
+			return float64(rates.Updates())
+		},
+	)
+
+	for _, c := range []prometheus.Collector{m.latency, m.activeStreams, age, updates} {
+		err := reg.Register(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// UnaryInterceptor records the latency of unary gRPC requests
+func (m *Metrics) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	st := time.Now()
+
+	resp, err := handler(ctx, req)
+
+	m.latency.WithLabelValues(info.FullMethod, status.Code(err).String()).Observe(time.Since(st).Seconds())
+
+	return resp, err
+}
+
+// StreamInterceptor records the number of open streams and the lifetime of each stream
+func (m *Metrics) StreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	st := time.Now()
+
+	g := m.activeStreams.WithLabelValues(info.FullMethod)
+	g.Inc()
+	defer g.Dec()
+
+	err := handler(srv, ss)
+
+	m.latency.WithLabelValues(info.FullMethod, status.Code(err).String()).Observe(time.Since(st).Seconds())
+
+	return err
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/nicholasjackson/building-microservices-youtube/currency/data"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+)
+
+func setupMetrics(t *testing.T) *Metrics {
+	r, err := data.NewRates(hclog.NewNullLogger())
+	require.NoError(t, err)
+
+	m, err := NewMetrics(prometheus.NewRegistry(), r)
+	require.NoError(t, err)
+
+	return m
+}
+
+func TestUnaryInterceptorRecordsStatusCode(t *testing.T) {
+	m := setupMetrics(t)
+	info := &grpc.UnaryServerInfo{FullMethod: "/Currency/GetRate"}
+
+	m.UnaryInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, fmt.Errorf("boom")
+	})
+
+	assert.Equal(t, 1, testutil.CollectAndCount(m.latency))
+}
+
+func TestStreamInterceptorTracksActiveStreams(t *testing.T) {
+	m := setupMetrics(t)
+	info := &grpc.StreamServerInfo{FullMethod: "/Currency/SubscribeRates"}
+	g := m.activeStreams.WithLabelValues(info.FullMethod)
+
+	m.StreamInterceptor(nil, nil, info, func(srv interface{}, ss grpc.ServerStream) error {
+		// the stream is active while the handler is running
+		assert.Equal(t, float64(1), testutil.ToFloat64(g))
+		return nil
+	})
+
+	assert.Equal(t, float64(0), testutil.ToFloat64(g))
+}
@@ -0,0 +1,174 @@
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+// Action is the type of change made to a product
+type Action string
+
+const (
+	// ActionCreate is recorded when a product is added
+	ActionCreate Action = "create"
+	// ActionUpdate is recorded when a product is updated
+	ActionUpdate Action = "update"
+	// ActionDelete is recorded when a product is deleted
+	ActionDelete Action = "delete"
+	// ActionRestore is recorded when a deleted product is restored
+	ActionRestore Action = "restore"
+	// ActionPurge is recorded when a deleted product is permanently removed
+	ActionPurge Action = "purge"
+)
+
+// Change is the old and new value for a single field
+type Change struct {
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// Entry is a single record in the audit log
+// swagger:model
+type Entry struct {
+	// the time the change was made
+	Timestamp time.Time `json:"timestamp"`
+
+	// the type of change, create, update, delete, restore or purge
+	Action Action `json:"action"`
+
+	// the id of the product which was changed
+	ProductID int `json:"product_id"`
+
+	// the subject of the caller who made the change
+	Actor string `json:"actor"`
+
+	// the id of the request which made the change
+	RequestID string `json:"request_id,omitempty"`
+
+	// the product before the change, empty for create
+	Before json.RawMessage `json:"before,omitempty"`
+
+	// the product after the change, empty for purge
+	After json.RawMessage `json:"after,omitempty"`
+
+	// the fields which were modified by the change
+	Changes map[string]Change `json:"changes,omitempty"`
+}
+
+// Sink defines the behavior for storing audit entries
+// Sinks are append only, entries can not be modified once written
+type Sink interface {
+	// Write appends the entry to the sink
+	Write(e Entry) error
+	// History returns all entries for the given product in the order they were written
+	History(productID int) ([]Entry, error)
+}
+
+// ContextFunc returns a value from the context of the request which
+// made the change, i.e. the actor or request id
+type ContextFunc func(ctx context.Context) string
+
+// Log records changes to products
+type Log struct {
+	sink      Sink
+	actor     ContextFunc
+	requestID ContextFunc
+	now       func() time.Time
+}
+
+// NewLog creates a new audit Log which writes to the given sink
+// actor and requestID are used to fetch the caller details from the
+// context of the request
+func NewLog(s Sink, actor, requestID ContextFunc) *Log {
+	return &Log{sink: s, actor: actor, requestID: requestID, now: time.Now}
+}
+
+// Record writes an entry for a change to a product to the sink
+// before and after are the state of the product before and after the change
+// either can be nil
+func (l *Log) Record(ctx context.Context, a Action, productID int, before, after interface{}) error {
+	e := Entry{
+		Timestamp: l.now().UTC(),
+		Action:    a,
+		ProductID: productID,
+		Actor:     l.actor(ctx),
+		RequestID: l.requestID(ctx),
+	}
+
+	var err error
+	var bm, am map[string]interface{}
+
+	if !isNil(before) {
+		e.Before, bm, err = marshal(before)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !isNil(after) {
+		e.After, am, err = marshal(after)
+		if err != nil {
+			return err
+		}
+	}
+
+	e.Changes = diff(bm, am)
+
+	return l.sink.Write(e)
+}
+
+// History returns the audit entries for the given product
+func (l *Log) History(productID int) ([]Entry, error) {
+	return l.sink.History(productID)
+}
+
+// marshal returns the JSON representation of the item and a map of its fields
+func marshal(i interface{}) (json.RawMessage, map[string]interface{}, error) {
+	d, err := json.Marshal(i)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to serialize audit entry: %s", err)
+	}
+
+	m := map[string]interface{}{}
+	err = json.Unmarshal(d, &m)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to serialize audit entry: %s", err)
+	}
+
+	return d, m, nil
+}
+
+// diff returns the fields which differ between before and after
+func diff(before, after map[string]interface{}) map[string]Change {
+	c := map[string]Change{}
+
+	for k, v := range before {
+		if av, ok := after[k]; !ok || !reflect.DeepEqual(v, av) {
+			c[k] = Change{From: v, To: after[k]}
+		}
+	}
+
+	for k, v := range after {
+		if _, ok := before[k]; !ok {
+			c[k] = Change{From: nil, To: v}
+		}
+	}
+
+	if len(c) == 0 {
+		return nil
+	}
+
+	return c
+}
+
+func isNil(i interface{}) bool {
+	if i == nil {
+		return true
+	}
+
+	v := reflect.ValueOf(i)
+	return v.Kind() == reflect.Ptr && v.IsNil()
+}
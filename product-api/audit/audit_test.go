@@ -0,0 +1,93 @@
+package audit
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testProduct struct {
+	ID    int     `json:"id"`
+	Name  string  `json:"name"`
+	Price float64 `json:"price"`
+}
+
+func setupLog(s Sink) *Log {
+	return NewLog(
+		s,
+		func(ctx context.Context) string { return "nic" },
+		func(ctx context.Context) string { return "req-1" },
+	)
+}
+
+func TestRecordUpdateWritesDiff(t *testing.T) {
+	m := NewMemory()
+	l := setupLog(m)
+
+	err := l.Record(
+		context.Background(),
+		ActionUpdate,
+		1,
+		&testProduct{ID: 1, Name: "Latte", Price: 2.45},
+		&testProduct{ID: 1, Name: "Latte", Price: 2.99},
+	)
+	require.NoError(t, err)
+
+	es, err := m.History(1)
+	require.NoError(t, err)
+	require.Len(t, es, 1)
+
+	assert.Equal(t, "nic", es[0].Actor)
+	assert.Equal(t, "req-1", es[0].RequestID)
+	assert.Equal(t, ActionUpdate, es[0].Action)
+	assert.Len(t, es[0].Changes, 1)
+	assert.Equal(t, 2.45, es[0].Changes["price"].From)
+	assert.Equal(t, 2.99, es[0].Changes["price"].To)
+}
+
+func TestRecordDeleteHasNoAfter(t *testing.T) {
+	m := NewMemory()
+	l := setupLog(m)
+
+	var after *testProduct
+	err := l.Record(context.Background(), ActionDelete, 1, &testProduct{ID: 1, Name: "Latte"}, after)
+	require.NoError(t, err)
+
+	es, _ := m.History(1)
+	require.Len(t, es, 1)
+	assert.NotEmpty(t, es[0].Before)
+	assert.Empty(t, es[0].After)
+}
+
+func TestFileSinkAppendsAndReadsHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	p := filepath.Join(dir, "audit.jsonl")
+
+	f, err := NewFile(p)
+	require.NoError(t, err)
+
+	l := setupLog(f)
+	require.NoError(t, l.Record(context.Background(), ActionCreate, 1, nil, &testProduct{ID: 1}))
+	require.NoError(t, l.Record(context.Background(), ActionCreate, 2, nil, &testProduct{ID: 2}))
+	require.NoError(t, l.Record(context.Background(), ActionDelete, 1, &testProduct{ID: 1}, nil))
+	require.NoError(t, f.Close())
+
+	// reopen the file to ensure existing entries are preserved
+	f, err = NewFile(p)
+	require.NoError(t, err)
+	defer f.Close()
+
+	es, err := f.History(1)
+	require.NoError(t, err)
+	require.Len(t, es, 2)
+	assert.Equal(t, ActionCreate, es[0].Action)
+	assert.Equal(t, ActionDelete, es[1].Action)
+}
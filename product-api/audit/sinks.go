@@ -0,0 +1,121 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Memory is an in memory implementation of the Sink interface,
+// entries are lost when the process exits
+type Memory struct {
+	mu      sync.RWMutex
+	entries []Entry
+}
+
+// NewMemory creates a new in memory Sink
+func NewMemory() *Memory {
+	return &Memory{entries: []Entry{}}
+}
+
+// Write appends the entry to the sink
+func (m *Memory) Write(e Entry) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.entries = append(m.entries, e)
+	return nil
+}
+
+// History returns all entries for the given product
+func (m *Memory) History(productID int) ([]Entry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	es := []Entry{}
+	for _, e := range m.entries {
+		if e.ProductID == productID {
+			es = append(es, e)
+		}
+	}
+
+	return es, nil
+}
+
+// File is an implementation of the Sink interface which appends
+// entries to a file on the local disk, one JSON document per line
+type File struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+// NewFile creates a new File sink, the file at path is created if it
+// does not exist, existing entries are preserved
+func NewFile(path string) (*File, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open audit log: %s", err)
+	}
+
+	return &File{path: path, f: f}, nil
+}
+
+// Write appends the entry to the file and flushes it to disk
+func (fs *File) Write(e Entry) error {
+	d, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("Unable to serialize audit entry: %s", err)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	_, err = fs.f.Write(append(d, '\n'))
+	if err != nil {
+		return fmt.Errorf("Unable to write audit entry: %s", err)
+	}
+
+	return fs.f.Sync()
+}
+
+// History reads the file and returns all entries for the given product
+func (fs *File) History(productID int) ([]Entry, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	f, err := os.Open(fs.path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open audit log: %s", err)
+	}
+	defer f.Close()
+
+	es := []Entry{}
+
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for s.Scan() {
+		e := Entry{}
+		err := json.Unmarshal(s.Bytes(), &e)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read audit entry: %s", err)
+		}
+
+		if e.ProductID == productID {
+			es = append(es, e)
+		}
+	}
+
+	return es, s.Err()
+}
+
+// Close closes the underlying file
+func (fs *File) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return fs.f.Close()
+}
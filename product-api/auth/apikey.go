@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"github.com/nicholasjackson/building-microservices-youtube/shared/apikey"
+)
+
+// APIKey defines a static key which can be used to authenticate with the API
+type APIKey = apikey.Key
+
+// APIKeys is a collection of static API keys
+type APIKeys struct {
+	keys *apikey.Keys
+}
+
+// NewAPIKeys creates a new collection from the given keys
+func NewAPIKeys(keys []APIKey) (*APIKeys, error) {
+	ks, err := apikey.New(keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return &APIKeys{keys: ks}, nil
+}
+
+// LoadAPIKeys loads a JSON encoded list of APIKey from the given file
+func LoadAPIKeys(path string) (*APIKeys, error) {
+	ks, err := apikey.Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &APIKeys{keys: ks}, nil
+}
+
+// Verify returns the Identity for the given key or an ErrInvalidCredentials
+// error if the key is not known
+func (a *APIKeys) Verify(key string) (*Identity, error) {
+	k, err := a.keys.Verify(key)
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &Identity{
+		Subject: k.Subject,
+		Method:  "apikey",
+		Roles:   parseRoles(k.Roles),
+	}, nil
+}
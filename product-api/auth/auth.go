@@ -0,0 +1,96 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+)
+
+// ErrNoCredentials is returned when a request does not contain an API key or bearer token
+var ErrNoCredentials = fmt.Errorf("No credentials provided")
+
+// ErrInvalidCredentials is returned when the API key or token in a request can not be verified
+var ErrInvalidCredentials = fmt.Errorf("Invalid credentials")
+
+// Role defines a permission level which can be granted to an Identity
+type Role string
+
+const (
+	// RoleReader allows read only access to the API
+	RoleReader Role = "reader"
+	// RoleEditor allows products to be created and updated
+	RoleEditor Role = "editor"
+	// RoleAdmin allows full access to the API including deleting products
+	RoleAdmin Role = "admin"
+)
+
+// roleLevel defines the ordering of roles, a higher level role is granted
+// all the permissions of the roles below it
+var roleLevel = map[Role]int{
+	RoleReader: 1,
+	RoleEditor: 2,
+	RoleAdmin:  3,
+}
+
+// Identity is the authenticated caller of the API
+type Identity struct {
+	// Subject is the unique name for the caller, for JWTs this is the sub claim
+	Subject string
+	// Method is the method used to authenticate the caller, apikey or jwt
+	Method string
+	// Roles are the roles granted to the caller
+	Roles []Role
+}
+
+// HasRole returns true when the identity has been granted the given role
+// or a role with a higher level
+func (i *Identity) HasRole(r Role) bool {
+	if i == nil {
+		return false
+	}
+
+	for _, ir := range i.Roles {
+		if roleLevel[ir] >= roleLevel[r] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// KeyIdentity is a key used for the Identity object in the context
+type KeyIdentity struct{}
+
+// WithIdentity returns a copy of the context containing the given Identity
+func WithIdentity(ctx context.Context, i *Identity) context.Context {
+	return context.WithValue(ctx, KeyIdentity{}, i)
+}
+
+// IdentityFromContext returns the Identity stored in the context,
+// nil is returned when the request has not been authenticated
+func IdentityFromContext(ctx context.Context) *Identity {
+	i, _ := ctx.Value(KeyIdentity{}).(*Identity)
+	return i
+}
+
+// Subject returns the subject for the identity stored in the context,
+// anonymous is returned when the request has not been authenticated
+func Subject(ctx context.Context) string {
+	i := IdentityFromContext(ctx)
+	if i == nil {
+		return "anonymous"
+	}
+
+	return i.Subject
+}
+
+// parseRoles converts a slice of strings into Roles ignoring any unknown values
+func parseRoles(rs []string) []Role {
+	roles := []Role{}
+	for _, r := range rs {
+		if _, ok := roleLevel[Role(r)]; ok {
+			roles = append(roles, Role(r))
+		}
+	}
+
+	return roles
+}
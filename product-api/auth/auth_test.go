@@ -0,0 +1,272 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/ratelimit"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testSecret = []byte("01234567890123456789012345678901")
+
+func signToken(t *testing.T, alg, kid string, claims map[string]interface{}, key interface{}) string {
+	h, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT", "kid": kid})
+	c, _ := json.Marshal(claims)
+
+	s := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+
+	var sig []byte
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(s))
+		sig = mac.Sum(nil)
+	case "RS256":
+		d := sha256.Sum256([]byte(s))
+		var err error
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, d[:])
+		require.NoError(t, err)
+	}
+
+	return s + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func validClaims(roles ...string) map[string]interface{} {
+	return map[string]interface{}{
+		"sub":   "nic",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"roles": roles,
+	}
+}
+
+func TestAPIKeyReturnsIdentity(t *testing.T) {
+	k, err := NewAPIKeys([]APIKey{{Key: "abc123", Subject: "ci", Roles: []string{"editor"}}})
+	require.NoError(t, err)
+
+	i, err := k.Verify("abc123")
+	assert.NoError(t, err)
+	assert.Equal(t, "ci", i.Subject)
+	assert.True(t, i.HasRole(RoleReader))
+	assert.True(t, i.HasRole(RoleEditor))
+	assert.False(t, i.HasRole(RoleAdmin))
+}
+
+func TestInvalidAPIKeyReturnsErr(t *testing.T) {
+	k, err := NewAPIKeys([]APIKey{{Key: "abc123", Subject: "ci"}})
+	require.NoError(t, err)
+
+	_, err = k.Verify("abc124")
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestHS256TokenReturnsIdentity(t *testing.T) {
+	v := NewJWTVerifier("", "")
+	v.SetHMACSecret(testSecret)
+
+	i, err := v.Verify(signToken(t, "HS256", "", validClaims("admin"), testSecret))
+	assert.NoError(t, err)
+	assert.Equal(t, "nic", i.Subject)
+	assert.True(t, i.HasRole(RoleAdmin))
+}
+
+func TestHS256TokenWithWrongSecretReturnsErr(t *testing.T) {
+	v := NewJWTVerifier("", "")
+	v.SetHMACSecret(testSecret)
+
+	_, err := v.Verify(signToken(t, "HS256", "", validClaims("admin"), []byte("wrong")))
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestExpiredTokenReturnsErr(t *testing.T) {
+	v := NewJWTVerifier("", "")
+	v.SetHMACSecret(testSecret)
+
+	c := validClaims()
+	c["exp"] = time.Now().Add(-time.Hour).Unix()
+
+	_, err := v.Verify(signToken(t, "HS256", "", c, testSecret))
+	assert.Equal(t, ErrTokenExpired, err)
+}
+
+func TestUnsignedTokenReturnsErr(t *testing.T) {
+	v := NewJWTVerifier("", "")
+	v.SetHMACSecret(testSecret)
+
+	_, err := v.Verify(signToken(t, "none", "", validClaims("admin"), nil))
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestTokenWithWrongAudienceReturnsErr(t *testing.T) {
+	v := NewJWTVerifier("", "product-api")
+	v.SetHMACSecret(testSecret)
+
+	c := validClaims()
+	c["aud"] = []string{"other"}
+
+	_, err := v.Verify(signToken(t, "HS256", "", c, testSecret))
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestRS256TokenFromJWKSReturnsIdentity(t *testing.T) {
+	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	dir, err := ioutil.TempDir("", "auth")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	jwks, _ := json.Marshal(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": "key1",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(pk.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pk.E)).Bytes()),
+			},
+		},
+	})
+
+	p := filepath.Join(dir, "jwks.json")
+	require.NoError(t, ioutil.WriteFile(p, jwks, 0600))
+
+	v := NewJWTVerifier("", "")
+	require.NoError(t, v.LoadJWKS(p))
+
+	i, err := v.Verify(signToken(t, "RS256", "key1", validClaims("reader"), pk))
+	assert.NoError(t, err)
+	assert.Equal(t, "nic", i.Subject)
+
+	// unknown key ids must be rejected
+	_, err = v.Verify(signToken(t, "RS256", "key2", validClaims("reader"), pk))
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func TestRS256TokenFromPEMKeyReturnsIdentity(t *testing.T) {
+	pk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	d, err := x509.MarshalPKIXPublicKey(&pk.PublicKey)
+	require.NoError(t, err)
+
+	p := filepath.Join(t.TempDir(), "key.pem")
+	require.NoError(t, ioutil.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: d}), 0600))
+
+	v := NewJWTVerifier("", "")
+	require.NoError(t, v.LoadRSAPublicKey(p))
+
+	// the PEM key has no id so tokens with or without a kid are verified
+	for _, kid := range []string{"", "issuer-key-1"} {
+		i, err := v.Verify(signToken(t, "RS256", kid, validClaims("reader"), pk))
+		assert.NoError(t, err, kid)
+		assert.Equal(t, "nic", i.Subject)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	_, err = v.Verify(signToken(t, "RS256", "issuer-key-1", validClaims("reader"), other))
+	assert.Equal(t, ErrInvalidCredentials, err)
+}
+
+func setupAuthenticator(t *testing.T) (*Authenticator, http.Handler) {
+	k, err := NewAPIKeys([]APIKey{
+		{Key: "reader-key", Subject: "reader", Roles: []string{"reader"}},
+		{Key: "editor-key", Subject: "editor", Roles: []string{"editor"}},
+	})
+	require.NoError(t, err)
+
+	a := NewAuthenticator(hclog.NewNullLogger(), k, NewJWTVerifier("", ""))
+
+	h := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Write([]byte(Subject(r.Context())))
+	})
+
+	return a, a.MiddlewareAuthenticate(a.MiddlewareRequireRole(RoleEditor)(h))
+}
+
+func TestMiddlewareWithoutCredentialsReturns401(t *testing.T) {
+	_, h := setupAuthenticator(t)
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/products", nil))
+
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("WWW-Authenticate"))
+}
+
+func TestMiddlewareWithInsufficientRoleReturns403(t *testing.T) {
+	_, h := setupAuthenticator(t)
+
+	r := httptest.NewRequest(http.MethodPost, "/products", nil)
+	r.Header.Set("X-API-Key", "reader-key")
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestMiddlewareWithRoleCallsNextWithIdentity(t *testing.T) {
+	_, h := setupAuthenticator(t)
+
+	r := httptest.NewRequest(http.MethodPost, "/products", nil)
+	r.Header.Set("X-API-Key", "editor-key")
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "editor", rr.Body.String())
+}
+
+func TestMiddlewareLimitsFailedAttempts(t *testing.T) {
+	a, h := setupAuthenticator(t)
+	a.LimitFailures(ratelimit.NewLimiter(0.001, 2), ratelimit.KeyByIP(false))
+
+	send := func(key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/products", nil)
+		r.Header.Set("X-API-Key", key)
+
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, r)
+
+		return rr
+	}
+
+	// successful attempts are not counted
+	assert.Equal(t, http.StatusOK, send("editor-key").Code)
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, http.StatusUnauthorized, send("guess").Code)
+	}
+
+	// once limited valid keys are also rejected so that guesses can not
+	// be confirmed
+	rr := send("editor-key")
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.NotEmpty(t, rr.Header().Get("Retry-After"))
+
+	// requests without credentials are not limited
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/products", nil))
+	assert.Equal(t, http.StatusUnauthorized, rr.Code)
+}
@@ -0,0 +1,285 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// ErrTokenExpired is returned when the exp claim of a token is in the past
+var ErrTokenExpired = fmt.Errorf("Token has expired")
+
+// JWTVerifier verifies HS256 and RS256 signed JSON Web Tokens
+type JWTVerifier struct {
+	hmacSecret []byte
+	rsaKeys    map[string]*rsa.PublicKey // RSA public keys indexed by key id
+	issuer     string
+	audience   string
+	leeway     time.Duration
+	now        func() time.Time
+}
+
+// NewJWTVerifier creates a new verifier, keys must be added with the
+// Set and Load methods before tokens can be verified
+// issuer and audience are optional, when set the iss and aud claims of
+// the token must match
+func NewJWTVerifier(issuer, audience string) *JWTVerifier {
+	return &JWTVerifier{
+		rsaKeys:  map[string]*rsa.PublicKey{},
+		issuer:   issuer,
+		audience: audience,
+		leeway:   30 * time.Second,
+		now:      time.Now,
+	}
+}
+
+// HasKeys returns true when the verifier has at least one key configured
+func (j *JWTVerifier) HasKeys() bool {
+	return len(j.hmacSecret) > 0 || len(j.rsaKeys) > 0
+}
+
+// SetHMACSecret sets the shared secret used to verify HS256 tokens
+func (j *JWTVerifier) SetHMACSecret(secret []byte) {
+	j.hmacSecret = secret
+}
+
+// SetRSAPublicKey adds a RSA public key used to verify RS256 tokens,
+// kid is the key id, a key with an empty kid verifies tokens whose key id
+// does not match any other key, i.e. a single key loaded from a PEM file
+func (j *JWTVerifier) SetRSAPublicKey(kid string, k *rsa.PublicKey) {
+	j.rsaKeys[kid] = k
+}
+
+// LoadHMACSecret reads the HS256 shared secret from the given file,
+// leading and trailing whitespace is removed
+func (j *JWTVerifier) LoadHMACSecret(path string) error {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Unable to read HMAC secret: %s", err)
+	}
+
+	s := strings.TrimSpace(string(d))
+	if len(s) < 32 {
+		return fmt.Errorf("HMAC secret must be at least 32 characters")
+	}
+
+	j.SetHMACSecret([]byte(s))
+	return nil
+}
+
+// LoadRSAPublicKey reads a PEM encoded RSA public key from the given file,
+// the key verifies tokens with any key id which is not in a JWKS
+func (j *JWTVerifier) LoadRSAPublicKey(path string) error {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Unable to read RSA public key: %s", err)
+	}
+
+	b, _ := pem.Decode(d)
+	if b == nil {
+		return fmt.Errorf("Unable to decode RSA public key, expected PEM format")
+	}
+
+	pk, err := x509.ParsePKIXPublicKey(b.Bytes)
+	if err != nil {
+		// fall back to PKCS1 encoded keys
+		rk, perr := x509.ParsePKCS1PublicKey(b.Bytes)
+		if perr != nil {
+			return fmt.Errorf("Unable to parse RSA public key: %s", err)
+		}
+
+		pk = rk
+	}
+
+	rk, ok := pk.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("Public key is not a RSA key")
+	}
+
+	j.SetRSAPublicKey("", rk)
+	return nil
+}
+
+// jwk is a single JSON Web Key as defined in RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// LoadJWKS reads the RSA keys from a JSON Web Key Set file, keys which are not
+// RSA signing keys are ignored
+func (j *JWTVerifier) LoadJWKS(path string) error {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Unable to read JWKS file: %s", err)
+	}
+
+	ks := struct {
+		Keys []jwk `json:"keys"`
+	}{}
+
+	err = json.Unmarshal(d, &ks)
+	if err != nil {
+		return fmt.Errorf("Unable to decode JWKS file: %s", err)
+	}
+
+	for _, k := range ks.Keys {
+		if k.Kty != "RSA" || (k.Use != "" && k.Use != "sig") {
+			continue
+		}
+
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return fmt.Errorf("Unable to decode modulus for key '%s': %s", k.Kid, err)
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return fmt.Errorf("Unable to decode exponent for key '%s': %s", k.Kid, err)
+		}
+
+		j.SetRSAPublicKey(k.Kid, &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		})
+	}
+
+	return nil
+}
+
+// jwtHeader is the JOSE header of a token
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// jwtClaims are the claims used by the API
+type jwtClaims struct {
+	Subject   string      `json:"sub"`
+	Issuer    string      `json:"iss"`
+	Audience  interface{} `json:"aud"`
+	ExpiresAt int64       `json:"exp"`
+	NotBefore int64       `json:"nbf"`
+	Roles     []string    `json:"roles"`
+}
+
+// hasAudience checks the aud claim which can be either a string or an array
+func (c *jwtClaims) hasAudience(aud string) bool {
+	switch a := c.Audience.(type) {
+	case string:
+		return a == aud
+	case []interface{}:
+		for _, v := range a {
+			if s, ok := v.(string); ok && s == aud {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Verify checks the signature and claims of the given token and returns
+// the Identity of the caller
+func (j *JWTVerifier) Verify(token string) (*Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidCredentials
+	}
+
+	h := jwtHeader{}
+	if err := decodeSegment(parts[0], &h); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+
+	switch h.Alg {
+	case "HS256":
+		if len(j.hmacSecret) == 0 {
+			return nil, ErrInvalidCredentials
+		}
+
+		mac := hmac.New(sha256.New, j.hmacSecret)
+		mac.Write(signed)
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, ErrInvalidCredentials
+		}
+	case "RS256":
+		k, ok := j.rsaKeys[h.Kid]
+		if !ok {
+			// issuers set a kid even when there is only one key
+			k, ok = j.rsaKeys[""]
+		}
+
+		if !ok {
+			return nil, ErrInvalidCredentials
+		}
+
+		d := sha256.Sum256(signed)
+		if rsa.VerifyPKCS1v15(k, crypto.SHA256, d[:], sig) != nil {
+			return nil, ErrInvalidCredentials
+		}
+	default:
+		// never accept unsigned tokens or algorithms we do not support
+		return nil, ErrInvalidCredentials
+	}
+
+	c := jwtClaims{}
+	if err := decodeSegment(parts[1], &c); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+
+	now := j.now()
+	if c.ExpiresAt == 0 || now.After(time.Unix(c.ExpiresAt, 0).Add(j.leeway)) {
+		return nil, ErrTokenExpired
+	}
+
+	if c.NotBefore != 0 && now.Add(j.leeway).Before(time.Unix(c.NotBefore, 0)) {
+		return nil, ErrInvalidCredentials
+	}
+
+	if j.issuer != "" && c.Issuer != j.issuer {
+		return nil, ErrInvalidCredentials
+	}
+
+	if j.audience != "" && !c.hasAudience(j.audience) {
+		return nil, ErrInvalidCredentials
+	}
+
+	if c.Subject == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	return &Identity{Subject: c.Subject, Method: "jwt", Roles: parseRoles(c.Roles)}, nil
+}
+
+// decodeSegment decodes a base64 URL encoded JSON segment of a token
+func decodeSegment(s string, i interface{}) error {
+	d, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(d, i)
+}
@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/nicholasjackson/building-microservices-youtube/product-api/data"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/logging"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/ratelimit"
+)
+
+// Authenticator is a HTTP middleware which authenticates requests using
+// either a static API key or a JSON Web Token
+type Authenticator struct {
+	log  hclog.Logger
+	keys *APIKeys
+	jwt  *JWTVerifier
+
+	failures   *ratelimit.Limiter
+	failureKey ratelimit.KeyFunc
+}
+
+// NewAuthenticator creates a new Authenticator, keys and jwt are optional
+// when nil the authentication method is disabled
+func NewAuthenticator(l hclog.Logger, keys *APIKeys, jwt *JWTVerifier) *Authenticator {
+	return &Authenticator{log: l, keys: keys, jwt: jwt}
+}
+
+// LimitFailures limits the rate of failed authentication attempts for each
+// client identified by key, once a client has used all the tokens in l
+// requests with credentials are rejected before they are checked so that
+// keys and tokens can not be guessed
+func (a *Authenticator) LimitFailures(l *ratelimit.Limiter, key ratelimit.KeyFunc) {
+	a.failures = l
+	a.failureKey = key
+}
+
+// genericError is returned to the client when authentication fails
+type genericError struct {
+	Message string `json:"message"`
+}
+
+// Authenticate returns the Identity for the credentials in the request
+// ErrNoCredentials is returned when the request does not contain any credentials
+func (a *Authenticator) Authenticate(r *http.Request) (*Identity, error) {
+	if k := r.Header.Get("X-API-Key"); k != "" {
+		if a.keys == nil {
+			return nil, ErrInvalidCredentials
+		}
+
+		return a.keys.Verify(k)
+	}
+
+	ah := r.Header.Get("Authorization")
+	if ah == "" {
+		return nil, ErrNoCredentials
+	}
+
+	if len(ah) < 7 || !strings.EqualFold(ah[:7], "bearer ") {
+		return nil, ErrInvalidCredentials
+	}
+
+	if a.jwt == nil || !a.jwt.HasKeys() {
+		return nil, ErrInvalidCredentials
+	}
+
+	return a.jwt.Verify(strings.TrimSpace(ah[7:]))
+}
+
+// MiddlewareAuthenticate authenticates the request and adds the Identity
+// to the request context, requests without credentials are passed to the
+// next handler anonymously, access is controlled by MiddlewareRequireRole
+func (a *Authenticator) MiddlewareAuthenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		var key string
+		if a.failures != nil && hasCredentials(r) {
+			key = a.failureKey(r)
+
+			if wait := a.failures.Wait(key); wait > 0 {
+				logging.Logger(r.Context(), a.log).Error("Too many failed authentication attempts", "method", r.Method, "path", r.URL.Path, "client", key)
+
+				rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+				writeError(rw, http.StatusTooManyRequests, "Too many failed authentication attempts")
+				return
+			}
+		}
+
+		i, err := a.Authenticate(r)
+
+		switch err {
+		case nil:
+			r = r.WithContext(WithIdentity(r.Context(), i))
+		case ErrNoCredentials:
+		default:
+			if key != "" {
+				a.failures.Take(key, 1)
+			}
+
+			logging.Logger(r.Context(), a.log).Error("Unable to authenticate request", "method", r.Method, "path", r.URL.Path, "error", err)
+
+			writeError(rw, http.StatusUnauthorized, err.Error())
+			return
+		}
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// MiddlewareRequireRole returns middleware which only calls next when the
+// authenticated identity has been granted the given role
+func (a *Authenticator) MiddlewareRequireRole(role Role) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			i := IdentityFromContext(r.Context())
+			if i == nil {
+				writeError(rw, http.StatusUnauthorized, ErrNoCredentials.Error())
+				return
+			}
+
+			if !i.HasRole(role) {
+				logging.Logger(r.Context(), a.log).Error("Identity does not have the required role", "subject", i.Subject, "role", role, "path", r.URL.Path)
+
+				writeError(rw, http.StatusForbidden, "Forbidden, requires role "+string(role))
+				return
+			}
+
+			next.ServeHTTP(rw, r)
+		})
+	}
+}
+
+// hasCredentials returns true when the request contains an API key or an
+// Authorization header
+func hasCredentials(r *http.Request) bool {
+	return r.Header.Get("X-API-Key") != "" || r.Header.Get("Authorization") != ""
+}
+
+func writeError(rw http.ResponseWriter, status int, message string) {
+	rw.Header().Set("Content-Type", "application/json")
+
+	if status == http.StatusUnauthorized {
+		rw.Header().Set("WWW-Authenticate", `Bearer realm="product-api"`)
+	}
+
+	rw.WriteHeader(status)
+	data.ToJSON(&genericError{Message: message}, rw)
+}
@@ -0,0 +1,473 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/hcl"
+	"github.com/nicholasjackson/building-microservices-youtube/product-api/discovery"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/compress"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the configuration for the product-api
+// Values are read from the defaults, then the optional configuration file
+// and finally from environment variables, later sources take precedence
+type Config struct {
+	BindAddress string      `yaml:"bind_address"`
+	Log         Log         `yaml:"log"`
+	HTTP        HTTP        `yaml:"http"`
+	Currency    Currency    `yaml:"currency"`
+	Storage     Storage     `yaml:"storage"`
+	Auth        Auth        `yaml:"auth"`
+	Audit       Audit       `yaml:"audit"`
+	RateLimit   RateLimit   `yaml:"rate_limit"`
+	Compression Compression `yaml:"compression"`
+	Tracing     Tracing     `yaml:"tracing"`
+}
+
+// Log configures the application logger
+type Log struct {
+	// Level is one of trace, debug, info, warn or error
+	Level string `yaml:"level"`
+	// Format is either text or json
+	Format string `yaml:"format"`
+}
+
+// HTTP configures the HTTP server
+type HTTP struct {
+	ReadTimeout     time.Duration `yaml:"read_timeout"`
+	WriteTimeout    time.Duration `yaml:"write_timeout"`
+	IdleTimeout     time.Duration `yaml:"idle_timeout"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	CORSOrigins     []string      `yaml:"cors_origins"`
+	TLS             TLS           `yaml:"tls"`
+	// HealthTimeout is the max time for each health check
+	HealthTimeout time.Duration `yaml:"health_timeout"`
+	// DrainDelay is the time readiness fails before the server stops
+	// accepting connections on shutdown
+	DrainDelay time.Duration `yaml:"drain_delay"`
+}
+
+// Currency configures the connection to the currency service
+type Currency struct {
+	// Address is either host:port or a discovery target
+	// static:///host1:port,host2:port, srv:///name or file:///path
+	Address string `yaml:"address"`
+	// RefreshInterval is the time between lookups for srv and file targets
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+	TLS             TLS           `yaml:"tls"`
+}
+
+// TLS contains the certificates used for a TLS connection
+// For a server CertFile and KeyFile enable TLS and CAFile requires clients to
+// present a certificate, for a client Enabled enables TLS, CAFile verifies
+// the server and CertFile and KeyFile are an optional client certificate.
+// Certificates are reloaded when the files change
+type TLS struct {
+	Enabled        bool          `yaml:"enabled"`
+	CAFile         string        `yaml:"ca_file"`
+	CertFile       string        `yaml:"cert_file"`
+	KeyFile        string        `yaml:"key_file"`
+	ServerName     string        `yaml:"server_name"`
+	ReloadInterval time.Duration `yaml:"reload_interval"`
+}
+
+// Storage configures where products are stored
+type Storage struct {
+	// Backend is the store used for products, only memory is supported
+	Backend string `yaml:"backend"`
+}
+
+// Auth configures authentication for the API
+type Auth struct {
+	APIKeysFile      string `yaml:"api_keys_file"`
+	JWTSecretFile    string `yaml:"jwt_secret_file"`
+	JWTPublicKeyFile string `yaml:"jwt_public_key_file"`
+	JWKSFile         string `yaml:"jwks_file"`
+	JWTIssuer        string `yaml:"jwt_issuer"`
+	JWTAudience      string `yaml:"jwt_audience"`
+	AnonymousRead    bool   `yaml:"anonymous_read"`
+}
+
+// Audit configures the audit log and purging of deleted products
+type Audit struct {
+	LogFile        string        `yaml:"log_file"`
+	PurgeRetention time.Duration `yaml:"purge_retention"`
+	PurgeInterval  time.Duration `yaml:"purge_interval"`
+}
+
+// RateLimit configures the per client rate limits
+type RateLimit struct {
+	Read           float64 `yaml:"read"`
+	ReadBurst      int     `yaml:"read_burst"`
+	Write          float64 `yaml:"write"`
+	WriteBurst     int     `yaml:"write_burst"`
+	TrustForwarded bool    `yaml:"trust_x_forwarded_for"`
+	// AuthFailures is the sustained rate of failed authentication attempts
+	// per second for a client IP address, checked before authentication
+	AuthFailures     float64 `yaml:"auth_failures"`
+	AuthFailureBurst int     `yaml:"auth_failure_burst"`
+}
+
+// Compression configures the compression of responses
+type Compression struct {
+	// Encodings in order of preference [br, gzip, deflate], empty disables
+	// compression
+	Encodings []string `yaml:"encodings"`
+	// MinSize is the smallest response in bytes which is compressed
+	MinSize int `yaml:"min_size"`
+	// Types are the content types which are compressed, type/* matches all
+	// subtypes
+	Types []string `yaml:"types"`
+}
+
+// Tracing configures the OpenTelemetry exporter
+type Tracing struct {
+	Exporter    string  `yaml:"exporter"`
+	File        string  `yaml:"file"`
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// Default returns the default configuration
+func Default() *Config {
+	return &Config{
+		BindAddress: ":9090",
+		Log: Log{
+			Level:  "info",
+			Format: "text",
+		},
+		HTTP: HTTP{
+			ReadTimeout:     5 * time.Second,
+			WriteTimeout:    10 * time.Second,
+			IdleTimeout:     120 * time.Second,
+			ShutdownTimeout: 30 * time.Second,
+			CORSOrigins:     []string{"*"},
+			TLS:             TLS{ReloadInterval: time.Minute},
+			HealthTimeout:   2 * time.Second,
+			DrainDelay:      5 * time.Second,
+		},
+		Currency: Currency{
+			Address:         "localhost:9092",
+			RefreshInterval: 30 * time.Second,
+			TLS:             TLS{ReloadInterval: time.Minute},
+		},
+		Storage: Storage{
+			Backend: "memory",
+		},
+		Auth: Auth{
+			AnonymousRead: true,
+		},
+		Audit: Audit{
+			PurgeRetention: 30 * 24 * time.Hour,
+			PurgeInterval:  time.Hour,
+		},
+		RateLimit: RateLimit{
+			Read:       10,
+			ReadBurst:  20,
+			Write:      1,
+			WriteBurst: 5,
+			// 10 attempts then one a minute
+			AuthFailures:     1.0 / 60,
+			AuthFailureBurst: 10,
+		},
+		Compression: Compression{
+			Encodings: append([]string{}, compress.DefaultEncodings...),
+			MinSize:   compress.DefaultMinSize,
+			Types:     append([]string{}, compress.DefaultTypes...),
+		},
+		Tracing: Tracing{
+			Exporter:    "none",
+			File:        "./traces.json",
+			SampleRatio: 1,
+		},
+	}
+}
+
+// Load returns the validated configuration, values from the file at path
+// are applied to the defaults followed by any environment variables which
+// have been set. When path is empty only the environment is used.
+// env.Parse must be called before Load
+func Load(path string) (*Config, error) {
+	c := Default()
+
+	if path != "" {
+		err := c.LoadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	applyEnv(c)
+
+	err := c.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// LoadFile reads the configuration file at path over the current values,
+// files with the extension .hcl are parsed as HCL all others as YAML
+func (c *Config) LoadFile(path string) error {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("Unable to read config file %s: %s", path, err)
+	}
+
+	if strings.ToLower(filepath.Ext(path)) == ".hcl" {
+		d, err = hclToYAML(d)
+		if err != nil {
+			return fmt.Errorf("Unable to parse config file %s: %s", path, err)
+		}
+	}
+
+	err = yaml.UnmarshalStrict(d, c)
+	if err != nil {
+		return fmt.Errorf("Unable to parse config file %s: %s", path, err)
+	}
+
+	return nil
+}
+
+// Write writes the configuration to w as YAML, durations are written as
+// strings, i.e. 30s, so that the output can be loaded with LoadFile
+func (c *Config) Write(w io.Writer) error {
+	d, err := yaml.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("Unable to encode config: %s", err)
+	}
+
+	_, err = w.Write(d)
+	return err
+}
+
+// Validate checks the configuration, all problems are returned in a
+// single error so they can be fixed at once
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	v.address("bind_address", c.BindAddress)
+
+	v.oneOf("log.level", c.Log.Level, "trace", "debug", "info", "warn", "error")
+	v.oneOf("log.format", c.Log.Format, "text", "json")
+
+	v.positive("http.read_timeout", c.HTTP.ReadTimeout)
+	v.positive("http.write_timeout", c.HTTP.WriteTimeout)
+	v.positive("http.idle_timeout", c.HTTP.IdleTimeout)
+	v.positive("http.shutdown_timeout", c.HTTP.ShutdownTimeout)
+	v.positive("http.health_timeout", c.HTTP.HealthTimeout)
+	if c.HTTP.DrainDelay < 0 || c.HTTP.DrainDelay >= c.HTTP.ShutdownTimeout {
+		v.add("http.drain_delay", fmt.Sprintf("must be at least 0 and less than http.shutdown_timeout, got %s", c.HTTP.DrainDelay))
+	}
+	v.origins("http.cors_origins", c.HTTP.CORSOrigins)
+	v.tls("http.tls", c.HTTP.TLS)
+	if c.HTTP.TLS.CAFile != "" && c.HTTP.TLS.CertFile == "" {
+		v.add("http.tls", "ca_file requires cert_file and key_file")
+	}
+
+	v.target("currency.address", c.Currency.Address)
+	v.positive("currency.refresh_interval", c.Currency.RefreshInterval)
+	v.tls("currency.tls", c.Currency.TLS)
+
+	// the server name can not be inferred when there are multiple addresses
+	if c.Currency.TLS.Enabled && c.Currency.TLS.ServerName == "" && strings.Contains(c.Currency.Address, "://") {
+		v.add("currency.tls.server_name", "is required when currency.address is a discovery target")
+	}
+
+	v.oneOf("storage.backend", c.Storage.Backend, "memory")
+
+	v.file("auth.api_keys_file", c.Auth.APIKeysFile)
+	v.file("auth.jwt_secret_file", c.Auth.JWTSecretFile)
+	v.file("auth.jwt_public_key_file", c.Auth.JWTPublicKeyFile)
+	v.file("auth.jwks_file", c.Auth.JWKSFile)
+
+	if c.Audit.PurgeRetention < 0 {
+		v.add("audit.purge_retention", "must not be negative")
+	}
+
+	if c.Audit.PurgeRetention > 0 {
+		v.positive("audit.purge_interval", c.Audit.PurgeInterval)
+	}
+
+	v.rate("rate_limit.read", c.RateLimit.Read, "rate_limit.read_burst", c.RateLimit.ReadBurst)
+	v.rate("rate_limit.write", c.RateLimit.Write, "rate_limit.write_burst", c.RateLimit.WriteBurst)
+	v.rate("rate_limit.auth_failures", c.RateLimit.AuthFailures, "rate_limit.auth_failure_burst", c.RateLimit.AuthFailureBurst)
+
+	for _, e := range c.Compression.Encodings {
+		v.oneOf("compression.encodings", e, compress.DefaultEncodings...)
+	}
+
+	if c.Compression.MinSize < 0 {
+		v.add("compression.min_size", "must not be negative")
+	}
+
+	v.oneOf("tracing.exporter", c.Tracing.Exporter, "none", "stdout", "file")
+	if c.Tracing.Exporter == "file" && c.Tracing.File == "" {
+		v.add("tracing.file", "is required when tracing.exporter is file")
+	}
+
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		v.add("tracing.sample_ratio", "must be between 0 and 1")
+	}
+
+	return v.err()
+}
+
+// validator collects validation errors for the configuration
+type validator struct {
+	errors []string
+}
+
+func (v *validator) add(field, msg string) {
+	v.errors = append(v.errors, field+" "+msg)
+}
+
+func (v *validator) err() error {
+	if len(v.errors) == 0 {
+		return nil
+	}
+
+	return fmt.Errorf("Invalid configuration:\n  %s", strings.Join(v.errors, "\n  "))
+}
+
+func (v *validator) oneOf(field, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+
+	v.add(field, fmt.Sprintf("must be one of [%s], got %q", strings.Join(allowed, ", "), value))
+}
+
+func (v *validator) positive(field string, d time.Duration) {
+	if d <= 0 {
+		v.add(field, fmt.Sprintf("must be greater than 0, got %s", d))
+	}
+}
+
+func (v *validator) address(field, addr string) {
+	if addr == "" {
+		v.add(field, "is required")
+		return
+	}
+
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil || port == "" {
+		v.add(field, fmt.Sprintf("must be in the format host:port, got %q", addr))
+	}
+}
+
+// target validates an address which may use one of the discovery schemes
+func (v *validator) target(field, addr string) {
+	i := strings.Index(addr, "://")
+	if i == -1 {
+		v.address(field, addr)
+		return
+	}
+
+	scheme, endpoint := addr[:i], strings.TrimPrefix(addr[i+3:], "/")
+
+	switch scheme {
+	case discovery.SchemeStatic:
+		_, err := discovery.LookupStatic(endpoint)
+		if err != nil {
+			v.add(field, err.Error())
+		}
+	case discovery.SchemeSRV, discovery.SchemeFile:
+		if endpoint == "" {
+			v.add(field, fmt.Sprintf("must contain a name or path after %s:///", scheme))
+		}
+	default:
+		v.add(field, fmt.Sprintf("scheme must be one of [static, srv, file], got %q", scheme))
+	}
+}
+
+func (v *validator) file(field, path string) {
+	if path == "" {
+		return
+	}
+
+	_, err := os.Stat(path)
+	if err != nil {
+		v.add(field, fmt.Sprintf("file %q is not readable: %s", path, err))
+	}
+}
+
+func (v *validator) tls(field string, t TLS) {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		v.add(field, "cert_file and key_file must be set together")
+	}
+
+	v.positive(field+".reload_interval", t.ReloadInterval)
+	v.file(field+".ca_file", t.CAFile)
+	v.file(field+".cert_file", t.CertFile)
+	v.file(field+".key_file", t.KeyFile)
+}
+
+func (v *validator) origins(field string, origins []string) {
+	if len(origins) == 0 {
+		v.add(field, "must contain at least one origin")
+		return
+	}
+
+	for _, o := range origins {
+		if o == "*" {
+			continue
+		}
+
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+			v.add(field, fmt.Sprintf("origin %q must be * or scheme://host[:port]", o))
+		}
+	}
+}
+
+func (v *validator) rate(field string, rate float64, burstField string, burst int) {
+	if rate < 0 {
+		v.add(field, "must not be negative")
+	}
+
+	if rate > 0 && burst < 1 {
+		v.add(burstField, "must be at least 1")
+	}
+}
+
+// hclToYAML converts a HCL document to YAML so that a single set of struct
+// tags and the YAML duration parsing can be used for both formats
+func hclToYAML(d []byte) ([]byte, error) {
+	m := map[string]interface{}{}
+
+	err := hcl.Unmarshal(d, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	return yaml.Marshal(flattenHCL(m))
+}
+
+// flattenHCL replaces the lists of objects HCL creates for blocks
+// with the object
+func flattenHCL(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		for k, e := range t {
+			t[k] = flattenHCL(e)
+		}
+	case []map[string]interface{}:
+		if len(t) == 1 {
+			return flattenHCL(t[0])
+		}
+	}
+
+	return v
+}
@@ -0,0 +1,155 @@
+package config
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nicholasjackson/env"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	p := filepath.Join(t.TempDir(), name)
+	require.NoError(t, ioutil.WriteFile(p, []byte(content), 0644))
+
+	return p
+}
+
+func TestDefaultIsValid(t *testing.T) {
+	assert.NoError(t, Default().Validate())
+}
+
+func TestLoadYAMLFile(t *testing.T) {
+	p := writeFile(t, "config.yaml", `
+log:
+  level: debug
+http:
+  read_timeout: 2s
+  cors_origins: ["https://shop.example.com"]
+currency:
+  address: currency:9092
+`)
+
+	c, err := Load(p)
+	require.NoError(t, err)
+
+	assert.Equal(t, "debug", c.Log.Level)
+	assert.Equal(t, 2*time.Second, c.HTTP.ReadTimeout)
+	assert.Equal(t, []string{"https://shop.example.com"}, c.HTTP.CORSOrigins)
+	assert.Equal(t, "currency:9092", c.Currency.Address)
+
+	// values not in the file keep their defaults
+	assert.Equal(t, 10*time.Second, c.HTTP.WriteTimeout)
+}
+
+func TestLoadHCLFile(t *testing.T) {
+	p := writeFile(t, "config.hcl", `
+log {
+  format = "json"
+}
+
+http {
+  write_timeout = "20s"
+}
+
+currency {
+  address = "currency:9092"
+}
+`)
+
+	c, err := Load(p)
+	require.NoError(t, err)
+
+	assert.Equal(t, "json", c.Log.Format)
+	assert.Equal(t, 20*time.Second, c.HTTP.WriteTimeout)
+	assert.Equal(t, "currency:9092", c.Currency.Address)
+}
+
+func TestLoadUnknownKeyReturnsErr(t *testing.T) {
+	p := writeFile(t, "config.yaml", "currency:\n  addr: currency:9092\n")
+
+	_, err := Load(p)
+	assert.Error(t, err)
+}
+
+func TestEnvOverridesFile(t *testing.T) {
+	p := writeFile(t, "config.yaml", "currency:\n  address: currency:9092\n")
+
+	t.Setenv("CURRENCY_ADDRESS", "localhost:19092")
+	t.Setenv("CORS_ALLOWED_ORIGINS", "https://a.example.com, https://b.example.com")
+	require.NoError(t, env.Parse())
+
+	c, err := Load(p)
+	require.NoError(t, err)
+
+	assert.Equal(t, "localhost:19092", c.Currency.Address)
+	assert.Equal(t, []string{"https://a.example.com", "https://b.example.com"}, c.HTTP.CORSOrigins)
+}
+
+func TestValidateReturnsAllErrors(t *testing.T) {
+	c := Default()
+	c.Log.Level = "loud"
+	c.HTTP.ReadTimeout = 0
+	c.HTTP.CORSOrigins = []string{"shop.example.com"}
+	c.HTTP.DrainDelay = time.Minute
+	c.Currency.Address = "localhost"
+	c.Currency.TLS.CertFile = "client.pem"
+	c.Storage.Backend = "postgres"
+	c.Compression.Encodings = []string{"gzip", "zstd"}
+
+	err := c.Validate()
+	require.Error(t, err)
+
+	assert.Contains(t, err.Error(), "log.level must be one of")
+	assert.Contains(t, err.Error(), "http.read_timeout must be greater than 0")
+	assert.Contains(t, err.Error(), `origin "shop.example.com"`)
+	assert.Contains(t, err.Error(), "http.drain_delay must be at least 0 and less than http.shutdown_timeout")
+	assert.Contains(t, err.Error(), "currency.address must be in the format host:port")
+	assert.Contains(t, err.Error(), "currency.tls cert_file and key_file must be set together")
+	assert.Contains(t, err.Error(), "storage.backend must be one of [memory]")
+	assert.Contains(t, err.Error(), `compression.encodings must be one of [br, gzip, deflate], got "zstd"`)
+}
+
+func TestWriteCanBeLoaded(t *testing.T) {
+	c := Default()
+	c.Currency.Address = "currency:9092"
+
+	b := bytes.NewBuffer(nil)
+	require.NoError(t, c.Write(b))
+
+	// durations are written in the form they are configured
+	assert.Contains(t, b.String(), "read_timeout: 5s")
+	assert.Contains(t, b.String(), "drain_delay: 5s")
+	assert.Contains(t, b.String(), "purge_retention: 720h0m0s")
+	assert.NotContains(t, b.String(), "5000000000")
+
+	p := writeFile(t, "config.yaml", b.String())
+	l := Default()
+	require.NoError(t, l.LoadFile(p))
+	assert.Equal(t, c, l)
+}
+
+func TestValidateDiscoveryTargets(t *testing.T) {
+	c := Default()
+
+	c.Currency.Address = "static:///currency-1:9092,currency-2:9092"
+	assert.NoError(t, c.Validate())
+
+	c.Currency.Address = "srv:///_grpc._tcp.currency.service.consul"
+	assert.NoError(t, c.Validate())
+
+	c.Currency.Address = "static:///currency-1"
+	assert.Error(t, c.Validate())
+
+	c.Currency.Address = "consul:///currency"
+	assert.Error(t, c.Validate())
+
+	// TLS needs an explicit server name for discovery targets
+	c.Currency.Address = "file:///etc/currency.txt"
+	c.Currency.TLS.Enabled = true
+	assert.Contains(t, c.Validate().Error(), "currency.tls.server_name")
+}
@@ -0,0 +1,127 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/nicholasjackson/env"
+)
+
+// binding copies the value of an environment variable into the Config
+type binding struct {
+	name  string
+	apply func(c *Config)
+}
+
+// bindings contains all the environment variables which can override
+// values in the Config
+var bindings []binding
+
+func init() {
+	stringVar("BIND_ADDRESS", "Bind address for the server", func(c *Config) *string { return &c.BindAddress })
+
+	stringVar("LOG_LEVEL", "Log level [trace, debug, info, warn, error]", func(c *Config) *string { return &c.Log.Level })
+	stringVar("LOG_FORMAT", "Log format [text, json]", func(c *Config) *string { return &c.Log.Format })
+
+	durationVar("HTTP_READ_TIMEOUT", "Max time to read a request from the client", func(c *Config) *time.Duration { return &c.HTTP.ReadTimeout })
+	durationVar("HTTP_WRITE_TIMEOUT", "Max time to write a response to the client", func(c *Config) *time.Duration { return &c.HTTP.WriteTimeout })
+	durationVar("HTTP_IDLE_TIMEOUT", "Max time for connections using TCP Keep-Alive", func(c *Config) *time.Duration { return &c.HTTP.IdleTimeout })
+	durationVar("HTTP_SHUTDOWN_TIMEOUT", "Max time to wait for requests to complete on shutdown", func(c *Config) *time.Duration { return &c.HTTP.ShutdownTimeout })
+	durationVar("HTTP_DRAIN_DELAY", "Time readiness fails before the server stops accepting connections on shutdown", func(c *Config) *time.Duration { return &c.HTTP.DrainDelay })
+	durationVar("HEALTH_CHECK_TIMEOUT", "Max time for each health check", func(c *Config) *time.Duration { return &c.HTTP.HealthTimeout })
+	listVar("CORS_ALLOWED_ORIGINS", "Comma separated list of origins allowed to make cross origin requests", func(c *Config) *[]string { return &c.HTTP.CORSOrigins })
+	stringVar("TLS_CERT_FILE", "PEM encoded certificate for the HTTP server, enables TLS", func(c *Config) *string { return &c.HTTP.TLS.CertFile })
+	stringVar("TLS_KEY_FILE", "PEM encoded private key for the HTTP server", func(c *Config) *string { return &c.HTTP.TLS.KeyFile })
+	stringVar("TLS_CLIENT_CA_FILE", "PEM encoded CA used to verify client certificates for the HTTP server", func(c *Config) *string { return &c.HTTP.TLS.CAFile })
+	durationVar("TLS_RELOAD_INTERVAL", "Interval between checks for changed HTTP server certificates", func(c *Config) *time.Duration { return &c.HTTP.TLS.ReloadInterval })
+
+	stringVar("CURRENCY_ADDRESS", "Address of the currency service host:port, static:///host:port,host:port, srv:///name or file:///path", func(c *Config) *string { return &c.Currency.Address })
+	durationVar("CURRENCY_REFRESH_INTERVAL", "Interval between lookups of currency addresses for srv and file targets", func(c *Config) *time.Duration { return &c.Currency.RefreshInterval })
+	boolVar("CURRENCY_TLS", "Connect to the currency service using TLS", func(c *Config) *bool { return &c.Currency.TLS.Enabled })
+	stringVar("CURRENCY_TLS_CA_FILE", "PEM encoded CA used to verify the currency service, system roots are used when empty", func(c *Config) *string { return &c.Currency.TLS.CAFile })
+	stringVar("CURRENCY_TLS_CERT_FILE", "PEM encoded client certificate for the currency service", func(c *Config) *string { return &c.Currency.TLS.CertFile })
+	stringVar("CURRENCY_TLS_KEY_FILE", "PEM encoded client private key for the currency service", func(c *Config) *string { return &c.Currency.TLS.KeyFile })
+	stringVar("CURRENCY_TLS_SERVER_NAME", "Server name used to verify the currency service certificate", func(c *Config) *string { return &c.Currency.TLS.ServerName })
+	durationVar("CURRENCY_TLS_RELOAD_INTERVAL", "Interval between checks for changed currency client certificates", func(c *Config) *time.Duration { return &c.Currency.TLS.ReloadInterval })
+
+	stringVar("STORAGE_BACKEND", "Storage backend for products [memory]", func(c *Config) *string { return &c.Storage.Backend })
+
+	stringVar("AUTH_API_KEYS_FILE", "Path to a JSON file containing static API keys", func(c *Config) *string { return &c.Auth.APIKeysFile })
+	stringVar("AUTH_JWT_SECRET_FILE", "Path to a file containing the shared secret for HS256 JWTs", func(c *Config) *string { return &c.Auth.JWTSecretFile })
+	stringVar("AUTH_JWT_PUBLIC_KEY_FILE", "Path to a PEM encoded RSA public key for RS256 JWTs", func(c *Config) *string { return &c.Auth.JWTPublicKeyFile })
+	stringVar("AUTH_JWKS_FILE", "Path to a JSON Web Key Set file containing RSA keys for RS256 JWTs", func(c *Config) *string { return &c.Auth.JWKSFile })
+	stringVar("AUTH_JWT_ISSUER", "Expected iss claim for JWTs, not checked when empty", func(c *Config) *string { return &c.Auth.JWTIssuer })
+	stringVar("AUTH_JWT_AUDIENCE", "Expected aud claim for JWTs, not checked when empty", func(c *Config) *string { return &c.Auth.JWTAudience })
+	boolVar("AUTH_ANONYMOUS_READ", "Allow unauthenticated clients to read products", func(c *Config) *bool { return &c.Auth.AnonymousRead })
+
+	stringVar("AUDIT_LOG_FILE", "Path to the append only audit log, when empty the audit log is kept in memory", func(c *Config) *string { return &c.Audit.LogFile })
+	durationVar("PURGE_RETENTION", "Time a deleted product is kept before it is permanently removed, 0 disables purging", func(c *Config) *time.Duration { return &c.Audit.PurgeRetention })
+	durationVar("PURGE_INTERVAL", "Interval between checks for deleted products to purge", func(c *Config) *time.Duration { return &c.Audit.PurgeInterval })
+
+	floatVar("RATE_LIMIT_READ", "Sustained read requests per second for a client, 0 disables the limit", func(c *Config) *float64 { return &c.RateLimit.Read })
+	intVar("RATE_LIMIT_READ_BURST", "Number of read requests a client can make in a burst", func(c *Config) *int { return &c.RateLimit.ReadBurst })
+	floatVar("RATE_LIMIT_WRITE", "Sustained write requests per second for a client, 0 disables the limit", func(c *Config) *float64 { return &c.RateLimit.Write })
+	intVar("RATE_LIMIT_WRITE_BURST", "Number of write requests a client can make in a burst", func(c *Config) *int { return &c.RateLimit.WriteBurst })
+	floatVar("RATE_LIMIT_AUTH_FAILURES", "Sustained failed authentication attempts per second for a client IP address, 0 disables the limit", func(c *Config) *float64 { return &c.RateLimit.AuthFailures })
+	intVar("RATE_LIMIT_AUTH_FAILURE_BURST", "Number of failed authentication attempts a client IP address can make in a burst", func(c *Config) *int { return &c.RateLimit.AuthFailureBurst })
+	boolVar("TRUST_X_FORWARDED_FOR", "Identify clients using the X-Forwarded-For header, only enable behind a trusted proxy", func(c *Config) *bool { return &c.RateLimit.TrustForwarded })
+
+	listVar("COMPRESSION_ENCODINGS", "Comma separated list of encodings for compressed responses in order of preference [br, gzip, deflate]", func(c *Config) *[]string { return &c.Compression.Encodings })
+	intVar("COMPRESSION_MIN_SIZE", "Min size in bytes of a response before it is compressed", func(c *Config) *int { return &c.Compression.MinSize })
+	listVar("COMPRESSION_TYPES", "Comma separated list of content types which are compressed, type/* matches all subtypes", func(c *Config) *[]string { return &c.Compression.Types })
+
+	stringVar("TRACE_EXPORTER", "Exporter for OpenTelemetry spans [none, stdout, file]", func(c *Config) *string { return &c.Tracing.Exporter })
+	stringVar("TRACE_FILE", "File spans are written to when TRACE_EXPORTER is file", func(c *Config) *string { return &c.Tracing.File })
+	floatVar("TRACE_SAMPLE_RATIO", "Fraction of new traces which are sampled", func(c *Config) *float64 { return &c.Tracing.SampleRatio })
+}
+
+// applyEnv overrides the values in c with the environment variables which
+// have been set, unset variables do not replace values from the config file
+func applyEnv(c *Config) {
+	for _, b := range bindings {
+		if os.Getenv(b.name) != "" {
+			b.apply(c)
+		}
+	}
+}
+
+func stringVar(name, help string, field func(c *Config) *string) {
+	v := env.String(name, false, *field(Default()), help)
+	bindings = append(bindings, binding{name, func(c *Config) { *field(c) = *v }})
+}
+
+func boolVar(name, help string, field func(c *Config) *bool) {
+	v := env.Bool(name, false, *field(Default()), help)
+	bindings = append(bindings, binding{name, func(c *Config) { *field(c) = *v }})
+}
+
+func intVar(name, help string, field func(c *Config) *int) {
+	v := env.Int(name, false, *field(Default()), help)
+	bindings = append(bindings, binding{name, func(c *Config) { *field(c) = *v }})
+}
+
+func floatVar(name, help string, field func(c *Config) *float64) {
+	v := env.Float64(name, false, *field(Default()), help)
+	bindings = append(bindings, binding{name, func(c *Config) { *field(c) = *v }})
+}
+
+func durationVar(name, help string, field func(c *Config) *time.Duration) {
+	v := env.Duration(name, false, *field(Default()), help)
+	bindings = append(bindings, binding{name, func(c *Config) { *field(c) = *v }})
+}
+
+// listVar binds a comma separated environment variable to a list
+func listVar(name, help string, field func(c *Config) *[]string) {
+	v := env.String(name, false, strings.Join(*field(Default()), ","), help)
+	bindings = append(bindings, binding{name, func(c *Config) {
+		l := []string{}
+		for _, s := range strings.Split(*v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				l = append(l, s)
+			}
+		}
+
+		*field(c) = l
+	}})
+}
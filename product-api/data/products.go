@@ -3,14 +3,24 @@ package data
 import (
 	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/go-hclog"
 	protos "github.com/nicholasjackson/building-microservices-youtube/currency/protos/currency"
+	"github.com/nicholasjackson/building-microservices-youtube/product-api/audit"
+	"google.golang.org/grpc"
 )
 
 // ErrProductNotFound is an error raised when a product can not be found in the database
 var ErrProductNotFound = fmt.Errorf("Product not found")
 
+// ErrProductNotDeleted is an error raised when restoring a product which has not been deleted
+var ErrProductNotDeleted = fmt.Errorf("Product has not been deleted")
+
+// ErrNoSubscription is returned when there is no subscription for rate updates
+var ErrNoSubscription = fmt.Errorf("No subscription for rate updates")
+
 // Product defines the structure for an API product
 // swagger:model
 type Product struct {
@@ -43,6 +53,13 @@ type Product struct {
 	// required: true
 	// pattern: [a-z]+-[a-z]+-[a-z]+
 	SKU string `json:"sku" validate:"sku"`
+
+	// the time the product was deleted, deleted products are purged
+	// after the retention period
+	//
+	// required: false
+	// read only: true
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
 // Products defines a slice of Product
@@ -51,53 +68,164 @@ type Products []*Product
 type ProductsDB struct {
 	currency protos.CurrencyClient
 	log      hclog.Logger
+	audit    *audit.Log
 	rates    map[string]float64
 	client   protos.Currency_SubscribeRatesClient
+	ratesMu  sync.Mutex // guards rates and client
+	ctx      context.Context
+	cancel   context.CancelFunc
+	mu       sync.RWMutex // guards productList and nextID
+	nextID   int
+	now      func() time.Time
 }
 
-func NewProductsDB(c protos.CurrencyClient, l hclog.Logger) *ProductsDB {
-	pb := &ProductsDB{c, l, make(map[string]float64), nil}
+func NewProductsDB(c protos.CurrencyClient, l hclog.Logger, a *audit.Log) *ProductsDB {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	pb := &ProductsDB{
+		currency: c,
+		log:      l,
+		audit:    a,
+		rates:    make(map[string]float64),
+		ctx:      ctx,
+		cancel:   cancel,
+		now:      time.Now,
+	}
+
+	// ids are never reused, even when a product has been purged
+	for _, p := range productList {
+		if p.ID >= pb.nextID {
+			pb.nextID = p.ID + 1
+		}
+	}
 
 	go pb.handleUpdates()
 
 	return pb
 }
 
+// subscribeMinBackoff and subscribeMaxBackoff bound the time between
+// attempts to re-establish the rate subscription
+const subscribeMinBackoff = 500 * time.Millisecond
+const subscribeMaxBackoff = 30 * time.Second
+
+// handleUpdates subscribes for rate changes from the currency service
+// When the stream is disconnected a new stream is created, the load balancer
+// places it on a healthy currency instance, and the currencies in the cache
+// are subscribed again
 func (p *ProductsDB) handleUpdates() {
-	sub, err := p.currency.SubscribeRates(context.Background())
+	backoff := subscribeMinBackoff
+
+	for {
+		connected, err := p.subscribe()
+		if connected {
+			backoff = subscribeMinBackoff
+		}
+
+		if p.ctx.Err() != nil {
+			p.log.Info("Rate subscription closed")
+			return
+		}
+
+		p.log.Error("Rate subscription closed, retrying", "error", err, "backoff", backoff)
+
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+
+		backoff *= 2
+		if backoff > subscribeMaxBackoff {
+			backoff = subscribeMaxBackoff
+		}
+	}
+}
+
+// subscribe creates a rate subscription and processes updates until the
+// stream fails, connected is true when the stream was established
+func (p *ProductsDB) subscribe() (bool, error) {
+	sub, err := p.currency.SubscribeRates(p.ctx, grpc.WaitForReady(true))
 	if err != nil {
-		p.log.Error("Unable to subscribe for rates", "error", err)
+		return false, err
 	}
 
+	p.ratesMu.Lock()
 	p.client = sub
 
+	// resubscribe for the currencies which were subscribed on the old stream
+	for d := range p.rates {
+		err := sub.Send(rateRequest(d))
+		if err != nil {
+			p.client = nil
+			p.ratesMu.Unlock()
+
+			return true, err
+		}
+	}
+	p.ratesMu.Unlock()
+
+	p.log.Info("Subscribed for rate updates")
+
 	for {
 		rr, err := sub.Recv()
-		p.log.Info("Recieved updated rate from server", "dest", rr.GetDestination().String())
-
 		if err != nil {
-			p.log.Error("Error receiving message", "error", err)
-			return
+			p.ratesMu.Lock()
+			p.client = nil
+			p.ratesMu.Unlock()
+
+			return true, err
 		}
 
+		p.log.Info("Recieved updated rate from server", "dest", rr.GetDestination().String())
+
+		p.ratesMu.Lock()
 		p.rates[rr.Destination.String()] = rr.Rate
+		p.ratesMu.Unlock()
 	}
 }
 
-// GetProducts returns all products from the database
-func (p *ProductsDB) GetProducts(currency string) (Products, error) {
-	if currency == "" {
-		return productList, nil
+// Close ends the subscription for rate updates
+func (p *ProductsDB) Close() {
+	p.cancel()
+}
+
+// CheckSubscription returns an error when there is no live subscription
+// for rate updates from the currency service
+func (p *ProductsDB) CheckSubscription(ctx context.Context) error {
+	p.ratesMu.Lock()
+	defer p.ratesMu.Unlock()
+
+	if p.client == nil {
+		return ErrNoSubscription
 	}
 
-	rate, err := p.getRate(currency)
-	if err != nil {
-		p.log.Error("Unable to get rate", "currency", currency, "error", err)
-		return nil, err
+	return nil
+}
+
+// GetProducts returns all products from the database
+// deleted products are only returned when includeDeleted is true
+func (p *ProductsDB) GetProducts(ctx context.Context, currency string, includeDeleted bool) (Products, error) {
+	rate := 1.0
+
+	if currency != "" {
+		var err error
+		rate, err = p.getRate(ctx, currency)
+		if err != nil {
+			p.log.Error("Unable to get rate", "currency", currency, "error", err)
+			return nil, err
+		}
 	}
 
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
 	pr := Products{}
 	for _, p := range productList {
+		if p.DeletedAt != nil && !includeDeleted {
+			continue
+		}
+
 		np := *p
 		np.Price = np.Price * rate
 		pr = append(pr, &np)
@@ -109,23 +237,27 @@ func (p *ProductsDB) GetProducts(currency string) (Products, error) {
 // GetProductByID returns a single product which matches the id from the
 // database.
 // If a product is not found this function returns a ProductNotFound error
-func (p *ProductsDB) GetProductByID(id int, currency string) (*Product, error) {
+func (p *ProductsDB) GetProductByID(ctx context.Context, id int, currency string) (*Product, error) {
+	p.mu.RLock()
 	i := findIndexByProductID(id)
-	if id == -1 {
+	if i == -1 || productList[i].DeletedAt != nil {
+		p.mu.RUnlock()
 		return nil, ErrProductNotFound
 	}
 
+	np := *productList[i]
+	p.mu.RUnlock()
+
 	if currency == "" {
-		return productList[i], nil
+		return &np, nil
 	}
 
-	rate, err := p.getRate(currency)
+	rate, err := p.getRate(ctx, currency)
 	if err != nil {
 		p.log.Error("Unable to get rate", "currency", currency, "error", err)
 		return nil, err
 	}
 
-	np := *productList[i]
 	np.Price = np.Price * rate
 
 	return &np, nil
@@ -135,12 +267,25 @@ func (p *ProductsDB) GetProductByID(id int, currency string) (*Product, error) {
 // item.
 // If a product with the given id does not exist in the database
 // this function returns a ProductNotFound error
-func (p *ProductsDB) UpdateProduct(pr Product) error {
+func (p *ProductsDB) UpdateProduct(ctx context.Context, pr Product) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	i := findIndexByProductID(pr.ID)
-	if i == -1 {
+	if i == -1 || productList[i].DeletedAt != nil {
 		return ErrProductNotFound
 	}
 
+	// deleted_at can only be changed by DeleteProduct and RestoreProduct
+	pr.DeletedAt = nil
+
+	// record the change before modifying the DB so that no change
+	// is made without an audit entry
+	err := p.audit.Record(ctx, audit.ActionUpdate, pr.ID, productList[i], &pr)
+	if err != nil {
+		return err
+	}
+
 	// update the product in the DB
 	productList[i] = &pr
 
@@ -148,27 +293,161 @@ func (p *ProductsDB) UpdateProduct(pr Product) error {
 }
 
 // AddProduct adds a new product to the database
-func (p *ProductsDB) AddProduct(pr Product) {
+func (p *ProductsDB) AddProduct(ctx context.Context, pr Product) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	// get the next id in sequence
-	maxID := productList[len(productList)-1].ID
-	pr.ID = maxID + 1
+	pr.ID = p.nextID
+	pr.DeletedAt = nil
+
+	err := p.audit.Record(ctx, audit.ActionCreate, pr.ID, nil, &pr)
+	if err != nil {
+		return err
+	}
+
+	p.nextID++
 	productList = append(productList, &pr)
+
+	return nil
+}
+
+// DeleteProduct soft deletes a product from the database, the product is
+// no longer returned by GetProducts and GetProductByID but can be restored
+// until it is purged
+func (p *ProductsDB) DeleteProduct(ctx context.Context, id int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	i := findIndexByProductID(id)
+	if i == -1 || productList[i].DeletedAt != nil {
+		return ErrProductNotFound
+	}
+
+	now := p.now().UTC()
+	np := *productList[i]
+	np.DeletedAt = &now
+
+	err := p.audit.Record(ctx, audit.ActionDelete, id, productList[i], &np)
+	if err != nil {
+		return err
+	}
+
+	productList[i] = &np
+
+	return nil
 }
 
-// DeleteProduct deletes a product from the database
-func (p *ProductsDB) DeleteProduct(id int) error {
+// RestoreProduct restores a product which has been deleted
+// If a product with the given id does not exist in the database
+// this function returns a ProductNotFound error, if the product
+// has not been deleted a ProductNotDeleted error is returned
+func (p *ProductsDB) RestoreProduct(ctx context.Context, id int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	i := findIndexByProductID(id)
 	if i == -1 {
 		return ErrProductNotFound
 	}
 
-	productList = append(productList[:i], productList[i+1])
+	if productList[i].DeletedAt == nil {
+		return ErrProductNotDeleted
+	}
+
+	np := *productList[i]
+	np.DeletedAt = nil
+
+	err := p.audit.Record(ctx, audit.ActionRestore, id, productList[i], &np)
+	if err != nil {
+		return err
+	}
+
+	productList[i] = &np
 
 	return nil
 }
 
+// PurgeDeleted permanently removes products which were deleted before
+// the given time, returns the number of products removed
+func (p *ProductsDB) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	kept := Products{}
+	purged := 0
+
+	for i, pr := range productList {
+		if pr.DeletedAt == nil || !pr.DeletedAt.Before(before) {
+			kept = append(kept, pr)
+			continue
+		}
+
+		err := p.audit.Record(ctx, audit.ActionPurge, pr.ID, pr, nil)
+		if err != nil {
+			// keep the remaining products, they will be purged on the next run
+			kept = append(kept, productList[i:]...)
+			productList = kept
+			return purged, err
+		}
+
+		purged++
+	}
+
+	productList = kept
+
+	return purged, nil
+}
+
+// MonitorPurge permanently removes deleted products once they have been
+// deleted for longer than the retention period, the check runs every interval
+// until the context is cancelled
+func (p *ProductsDB) MonitorPurge(ctx context.Context, interval, retention time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				n, err := p.PurgeDeleted(ctx, p.now().Add(-retention))
+				if err != nil {
+					p.log.Error("Unable to purge deleted products", "error", err)
+				}
+
+				if n > 0 {
+					p.log.Info("Purged deleted products", "count", n)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// GetProductHistory returns the audit entries for the product with the given id,
+// the history of deleted products is still returned.
+// If no changes have been recorded and the product does not exist
+// this function returns a ProductNotFound error
+func (p *ProductsDB) GetProductHistory(id int) ([]audit.Entry, error) {
+	es, err := p.audit.History(id)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if len(es) == 0 && findIndexByProductID(id) == -1 {
+		return nil, ErrProductNotFound
+	}
+
+	return es, nil
+}
+
 // findIndex finds the index of a product in the database
 // returns -1 when no product can be found
+// the caller must hold the ProductsDB lock
 func findIndexByProductID(id int) int {
 	for i, p := range productList {
 		if p.ID == id {
@@ -179,25 +458,47 @@ func findIndexByProductID(id int) int {
 	return -1
 }
 
-func (p *ProductsDB) getRate(destination string) (float64, error) {
+func (p *ProductsDB) getRate(ctx context.Context, destination string) (float64, error) {
 	// if cached return
-	if r, ok := p.rates[destination]; ok {
+	p.ratesMu.Lock()
+	r, ok := p.rates[destination]
+	p.ratesMu.Unlock()
+
+	if ok {
 		return r, nil
 	}
 
-	rr := &protos.RateRequest{
-		Base:        protos.Currencies(protos.Currencies_value["EUR"]),
-		Destination: protos.Currencies(protos.Currencies_value[destination]),
-	}
+	rr := rateRequest(destination)
 
 	// get initial rate
-	resp, err := p.currency.GetRate(context.Background(), rr)
+	resp, err := p.currency.GetRate(ctx, rr)
+	if err != nil {
+		return 0, err
+	}
+
+	p.ratesMu.Lock()
+	defer p.ratesMu.Unlock()
+
 	p.rates[destination] = resp.Rate // update cache
 
-	// subscribe for updates
-	p.client.Send(rr)
+	// subscribe for updates, when there is no stream the currency is
+	// subscribed when the stream is re-established
+	if p.client != nil {
+		err := p.client.Send(rr)
+		if err != nil {
+			p.log.Error("Unable to subscribe for rate updates", "dest", destination, "error", err)
+		}
+	}
+
+	return resp.Rate, nil
+}
 
-	return resp.Rate, err
+// rateRequest returns a request for the rate from EUR to destination
+func rateRequest(destination string) *protos.RateRequest {
+	return &protos.RateRequest{
+		Base:        protos.Currencies(protos.Currencies_value["EUR"]),
+		Destination: protos.Currencies(protos.Currencies_value[destination]),
+	}
 }
 
 var productList = []*Product{
@@ -2,14 +2,23 @@ package data
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/go-hclog"
+	protos "github.com/nicholasjackson/building-microservices-youtube/currency/protos/currency"
+	"github.com/nicholasjackson/building-microservices-youtube/product-api/audit"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
 )
 
 func TestProductMissingNameReturnsErr(t *testing.T) {
 	p := Product{
 		Price: 1.22,
+		SKU:   "abc-efg-hji",
 	}
 
 	v := NewValidation()
@@ -21,6 +30,7 @@ func TestProductMissingPriceReturnsErr(t *testing.T) {
 	p := Product{
 		Name:  "abc",
 		Price: -1,
+		SKU:   "abc-efg-hji",
 	}
 
 	v := NewValidation()
@@ -49,7 +59,7 @@ func TestValidProductDoesNOTReturnsErr(t *testing.T) {
 
 	v := NewValidation()
 	err := v.Validate(p)
-	assert.Len(t, err, 1)
+	assert.Len(t, err, 0)
 }
 
 func TestProductsToJSON(t *testing.T) {
@@ -63,3 +73,209 @@ func TestProductsToJSON(t *testing.T) {
 	err := ToJSON(ps, b)
 	assert.NoError(t, err)
 }
+
+// mockCurrency is a CurrencyClient which is always unavailable
+type mockCurrency struct{}
+
+func (m *mockCurrency) GetRate(ctx context.Context, in *protos.RateRequest, opts ...grpc.CallOption) (*protos.RateResponse, error) {
+	return nil, fmt.Errorf("unavailable")
+}
+
+func (m *mockCurrency) SubscribeRates(ctx context.Context, opts ...grpc.CallOption) (protos.Currency_SubscribeRatesClient, error) {
+	return nil, fmt.Errorf("unavailable")
+}
+
+func setupProductsDB(t *testing.T) (*ProductsDB, *audit.Memory) {
+	// reset the product list after the test
+	original := productList
+	productList = Products{
+		&Product{ID: 1, Name: "Latte", Price: 2.45, SKU: "abc-abc-abc"},
+		&Product{ID: 2, Name: "Esspresso", Price: 1.99, SKU: "abc-abc-abd"},
+		&Product{ID: 3, Name: "Mocha", Price: 2.99, SKU: "abc-abc-abe"},
+	}
+
+	t.Cleanup(func() { productList = original })
+
+	m := audit.NewMemory()
+	al := audit.NewLog(
+		m,
+		func(ctx context.Context) string { return "test" },
+		func(ctx context.Context) string { return "" },
+	)
+
+	return NewProductsDB(&mockCurrency{}, hclog.NewNullLogger(), al), m
+}
+
+func TestDeleteProductHidesProduct(t *testing.T) {
+	db, _ := setupProductsDB(t)
+
+	err := db.DeleteProduct(context.Background(), 2)
+	require.NoError(t, err)
+
+	ps, err := db.GetProducts(context.Background(), "", false)
+	require.NoError(t, err)
+	assert.Len(t, ps, 2)
+	assert.Equal(t, 1, ps[0].ID)
+	assert.Equal(t, 3, ps[1].ID)
+
+	ps, err = db.GetProducts(context.Background(), "", true)
+	require.NoError(t, err)
+	assert.Len(t, ps, 3)
+	assert.NotNil(t, ps[1].DeletedAt)
+
+	_, err = db.GetProductByID(context.Background(), 2, "")
+	assert.Equal(t, ErrProductNotFound, err)
+}
+
+func TestRestoreProductReturnsProduct(t *testing.T) {
+	db, m := setupProductsDB(t)
+
+	require.NoError(t, db.DeleteProduct(context.Background(), 2))
+	require.NoError(t, db.RestoreProduct(context.Background(), 2))
+
+	p, err := db.GetProductByID(context.Background(), 2, "")
+	require.NoError(t, err)
+	assert.Nil(t, p.DeletedAt)
+
+	es, _ := m.History(2)
+	require.Len(t, es, 2)
+	assert.Equal(t, audit.ActionRestore, es[1].Action)
+}
+
+func TestRestoreProductNotDeletedReturnsErr(t *testing.T) {
+	db, _ := setupProductsDB(t)
+
+	err := db.RestoreProduct(context.Background(), 1)
+	assert.Equal(t, ErrProductNotDeleted, err)
+}
+
+func TestPurgeDeletedRemovesExpiredProducts(t *testing.T) {
+	db, _ := setupProductsDB(t)
+
+	require.NoError(t, db.DeleteProduct(context.Background(), 3))
+
+	// products deleted after the cutoff are kept
+	n, err := db.PurgeDeleted(context.Background(), time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	n, err = db.PurgeDeleted(context.Background(), time.Now().Add(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	ps, _ := db.GetProducts(context.Background(), "", true)
+	assert.Len(t, ps, 2)
+
+	// ids of purged products are not reused
+	require.NoError(t, db.AddProduct(context.Background(), Product{Name: "Flat White"}))
+	ps, _ = db.GetProducts(context.Background(), "", false)
+	assert.Equal(t, 4, ps[2].ID)
+}
+
+// failingPurgeSink is an audit sink which fails to record purges
+type failingPurgeSink struct {
+	*audit.Memory
+}
+
+func (s failingPurgeSink) Write(e audit.Entry) error {
+	if e.Action == audit.ActionPurge {
+		return fmt.Errorf("sink unavailable")
+	}
+
+	return s.Memory.Write(e)
+}
+
+func TestPurgeDeletedKeepsProductsWhenAuditFails(t *testing.T) {
+	db, m := setupProductsDB(t)
+	db.audit = audit.NewLog(
+		failingPurgeSink{m},
+		func(ctx context.Context) string { return "test" },
+		func(ctx context.Context) string { return "" },
+	)
+
+	require.NoError(t, db.DeleteProduct(context.Background(), 1))
+
+	n, err := db.PurgeDeleted(context.Background(), time.Now().Add(time.Second))
+	assert.Error(t, err)
+	assert.Equal(t, 0, n)
+
+	// products after the failed purge are not lost
+	ps, _ := db.GetProducts(context.Background(), "", true)
+	require.Len(t, ps, 3)
+	assert.Equal(t, 3, ps[2].ID)
+}
+
+// fakeStream is a rate subscription which returns the responses sent
+// on the updates channel and fails when the channel is closed
+type fakeStream struct {
+	grpc.ClientStream
+	sent    chan *protos.RateRequest
+	updates chan *protos.RateResponse
+}
+
+func (f *fakeStream) Send(rr *protos.RateRequest) error {
+	f.sent <- rr
+	return nil
+}
+
+func (f *fakeStream) Recv() (*protos.RateResponse, error) {
+	rr, ok := <-f.updates
+	if !ok {
+		return nil, fmt.Errorf("connection reset")
+	}
+
+	return rr, nil
+}
+
+// fakeCurrency returns a new stream from the streams channel for every
+// call to SubscribeRates
+type fakeCurrency struct {
+	streams chan *fakeStream
+}
+
+func (f *fakeCurrency) GetRate(ctx context.Context, in *protos.RateRequest, opts ...grpc.CallOption) (*protos.RateResponse, error) {
+	return &protos.RateResponse{Base: in.Base, Destination: in.Destination, Rate: 1.5}, nil
+}
+
+func (f *fakeCurrency) SubscribeRates(ctx context.Context, opts ...grpc.CallOption) (protos.Currency_SubscribeRatesClient, error) {
+	return <-f.streams, nil
+}
+
+func newFakeStream() *fakeStream {
+	return &fakeStream{sent: make(chan *protos.RateRequest, 10), updates: make(chan *protos.RateResponse)}
+}
+
+func TestSubscriptionFailsOverAndResubscribes(t *testing.T) {
+	fc := &fakeCurrency{streams: make(chan *fakeStream)}
+	db := NewProductsDB(fc, hclog.NewNullLogger(), nil)
+
+	first := newFakeStream()
+	fc.streams <- first
+
+	// subscribe to GBP on the first stream
+	r, err := db.getRate(context.Background(), "GBP")
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, r)
+	assert.Equal(t, protos.Currencies_GBP, (<-first.sent).Destination)
+
+	// disconnect the first stream, the subscription is re-established and
+	// GBP is subscribed on the new stream
+	second := newFakeStream()
+	close(first.updates)
+	fc.streams <- second
+
+	select {
+	case rr := <-second.sent:
+		assert.Equal(t, protos.Currencies_GBP, rr.Destination)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timeout waiting for resubscription")
+	}
+
+	// updates on the new stream are applied
+	second.updates <- &protos.RateResponse{Destination: protos.Currencies_GBP, Rate: 2.5}
+
+	assert.Eventually(t, func() bool {
+		r, _ := db.getRate(context.Background(), "GBP")
+		return r == 2.5
+	}, time.Second, 10*time.Millisecond)
+}
@@ -66,8 +66,13 @@ func NewValidation() *Validation {
 //			fmt.Println()
 //	}
 func (v *Validation) Validate(i interface{}) ValidationErrors {
-	errs := v.validate.Struct(i).(validator.ValidationErrors)
+	// a valid struct returns a nil error which can not be cast
+	err := v.validate.Struct(i)
+	if err == nil {
+		return nil
+	}
 
+	errs := err.(validator.ValidationErrors)
 	if len(errs) == 0 {
 		return nil
 	}
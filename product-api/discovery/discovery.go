@@ -0,0 +1,269 @@
+package discovery
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// SchemeStatic resolves a comma separated list of addresses
+	// static:///currency-1:9092,currency-2:9092
+	SchemeStatic = "static"
+	// SchemeSRV resolves addresses from a DNS SRV record
+	// srv:///_grpc._tcp.currency.service.consul
+	SchemeSRV = "srv"
+	// SchemeFile resolves addresses from a file containing one address per
+	// line, the file is watched for changes
+	// file:///etc/product-api/currency.txt or file:///./currency.txt
+	SchemeFile = "file"
+)
+
+// ServiceConfig is the gRPC service config which balances requests
+// between all the resolved addresses, the retry policy of a service config
+// is ignored by this version of gRPC unless GRPC_GO_RETRY=on is set so
+// failed requests are retried by UnaryClientInterceptor
+const ServiceConfig = `{"loadBalancingPolicy":"round_robin"}`
+
+// RetryAttempts is the number of times a request is attempted when the
+// instance handling it is unavailable
+const RetryAttempts = 3
+
+// UnaryClientInterceptor retries requests which fail because the instance
+// became unavailable, i.e. it was stopped while the connection was in use,
+// the next attempt is balanced to another instance
+// the currency service requests are reads so they are safe to retry
+func UnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	var err error
+
+	for i := 0; i < RetryAttempts; i++ {
+		err = invoker(ctx, method, req, reply, cc, opts...)
+		if status.Code(err) != codes.Unavailable || ctx.Err() != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+// LookupFunc returns the addresses for the endpoint of a target
+type LookupFunc func(endpoint string) ([]string, error)
+
+// Builder creates resolvers for a scheme, the addresses are looked up when
+// the resolver is built and then every refresh interval or when gRPC asks
+// for the target to be resolved again
+type Builder struct {
+	scheme  string
+	log     hclog.Logger
+	refresh time.Duration
+	lookup  LookupFunc
+}
+
+// NewBuilder creates a Builder for scheme which resolves addresses with the
+// given lookup function, a refresh of 0 only resolves addresses on request
+func NewBuilder(scheme string, l hclog.Logger, refresh time.Duration, lookup LookupFunc) *Builder {
+	return &Builder{scheme: scheme, log: l, refresh: refresh, lookup: lookup}
+}
+
+// NewBuilders returns the builders for the static, srv and file schemes,
+// pass the builders to grpc.WithResolvers
+func NewBuilders(l hclog.Logger, refresh time.Duration) []resolver.Builder {
+	return []resolver.Builder{
+		NewBuilder(SchemeStatic, l, 0, LookupStatic),
+		NewBuilder(SchemeSRV, l, refresh, LookupSRV),
+		NewBuilder(SchemeFile, l, refresh, LookupFile),
+	}
+}
+
+// Scheme returns the scheme handled by the builder
+func (b *Builder) Scheme() string {
+	return b.scheme
+}
+
+// Build creates a resolver for the target, when the initial lookup fails
+// the error is reported to gRPC which retries with backoff
+func (b *Builder) Build(target resolver.Target, cc resolver.ClientConn, opts resolver.BuildOptions) (resolver.Resolver, error) {
+	r := &watcher{
+		log:      b.log.With("scheme", b.scheme, "endpoint", target.Endpoint),
+		endpoint: target.Endpoint,
+		lookup:   b.lookup,
+		cc:       cc,
+		resolve:  make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+
+	go r.watch(b.refresh)
+
+	return r, nil
+}
+
+// watcher is a resolver which updates the ClientConn when the addresses
+// for the endpoint change
+type watcher struct {
+	log      hclog.Logger
+	endpoint string
+	lookup   LookupFunc
+	cc       resolver.ClientConn
+	resolve  chan struct{}
+	done     chan struct{}
+	close    sync.Once
+	current  []string
+}
+
+// ResolveNow triggers a lookup of the addresses
+func (w *watcher) ResolveNow(resolver.ResolveNowOptions) {
+	select {
+	case w.resolve <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops watching the endpoint
+func (w *watcher) Close() {
+	w.close.Do(func() { close(w.done) })
+}
+
+func (w *watcher) watch(refresh time.Duration) {
+	w.resolveNow()
+
+	var tick <-chan time.Time
+	if refresh > 0 {
+		t := time.NewTicker(refresh)
+		defer t.Stop()
+
+		tick = t.C
+	}
+
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-w.resolve:
+		case <-tick:
+		}
+
+		w.resolveNow()
+	}
+}
+
+func (w *watcher) resolveNow() {
+	err := w.update()
+	if err != nil {
+		w.log.Error("Unable to resolve addresses", "error", err)
+		w.cc.ReportError(err)
+	}
+}
+
+// update looks up the addresses and updates the ClientConn when they change
+func (w *watcher) update() error {
+	addrs, err := w.lookup(w.endpoint)
+	if err != nil {
+		return err
+	}
+
+	if len(addrs) == 0 {
+		return fmt.Errorf("No addresses found for %s", w.endpoint)
+	}
+
+	sort.Strings(addrs)
+	if reflect.DeepEqual(addrs, w.current) {
+		return nil
+	}
+
+	w.current = addrs
+	w.log.Info("Resolved addresses", "addresses", strings.Join(addrs, ","))
+
+	s := resolver.State{}
+	for _, a := range addrs {
+		s.Addresses = append(s.Addresses, resolver.Address{Addr: a})
+	}
+
+	w.cc.UpdateState(s)
+
+	return nil
+}
+
+// LookupStatic returns the comma separated addresses in the endpoint
+func LookupStatic(endpoint string) ([]string, error) {
+	return parseAddresses(strings.Split(endpoint, ","))
+}
+
+// LookupSRV returns the addresses for the DNS SRV record named endpoint
+func LookupSRV(endpoint string) ([]string, error) {
+	_, srvs, err := net.LookupSRV("", "", endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := []string{}
+	for _, s := range srvs {
+		addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(s.Target, "."), strconv.Itoa(int(s.Port))))
+	}
+
+	return addrs, nil
+}
+
+// LookupFile returns the addresses in the file at path, one per line
+// blank lines and lines starting with # are ignored
+func LookupFile(path string) ([]string, error) {
+	// gRPC removes the leading slash from absolute paths in the target
+	// file:///etc/currency.txt, relative paths start with a dot
+	// file:///./currency.txt
+	if !strings.HasPrefix(path, ".") && !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := []string{}
+	s := bufio.NewScanner(bytes.NewReader(d))
+	for s.Scan() {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+
+		lines = append(lines, l)
+	}
+
+	return parseAddresses(lines)
+}
+
+// parseAddresses checks each address is in the format host:port
+func parseAddresses(in []string) ([]string, error) {
+	addrs := []string{}
+
+	for _, a := range in {
+		a = strings.TrimSpace(a)
+		if a == "" {
+			continue
+		}
+
+		_, port, err := net.SplitHostPort(a)
+		if err != nil || port == "" {
+			return nil, fmt.Errorf("Invalid address %q, expected host:port", a)
+		}
+
+		addrs = append(addrs, a)
+	}
+
+	return addrs, nil
+}
@@ -0,0 +1,176 @@
+package discovery
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/resolver"
+)
+
+// testClientConn records the states sent by a resolver
+type testClientConn struct {
+	resolver.ClientConn
+
+	mu     sync.Mutex
+	states []resolver.State
+}
+
+func (t *testClientConn) UpdateState(s resolver.State) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.states = append(t.states, s)
+}
+
+func (t *testClientConn) ReportError(error) {}
+
+func (t *testClientConn) addresses() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.states) == 0 {
+		return nil
+	}
+
+	addrs := []string{}
+	for _, a := range t.states[len(t.states)-1].Addresses {
+		addrs = append(addrs, a.Addr)
+	}
+
+	return addrs
+}
+
+func TestLookupStaticReturnsAddresses(t *testing.T) {
+	addrs, err := LookupStatic("currency-1:9092, currency-2:9092")
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"currency-1:9092", "currency-2:9092"}, addrs)
+}
+
+func TestLookupStaticInvalidAddressReturnsErr(t *testing.T) {
+	_, err := LookupStatic("currency-1")
+	assert.Error(t, err)
+}
+
+func TestLookupFileIgnoresComments(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "currency.txt")
+	require.NoError(t, ioutil.WriteFile(p, []byte("# currency instances\ncurrency-1:9092\n\ncurrency-2:9092\n"), 0644))
+
+	// gRPC removes the leading slash from the target endpoint
+	addrs, err := LookupFile(p[1:])
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"currency-1:9092", "currency-2:9092"}, addrs)
+}
+
+func TestResolverUpdatesWhenFileChanges(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "currency.txt")
+	require.NoError(t, ioutil.WriteFile(p, []byte("currency-1:9092\n"), 0644))
+
+	cc := &testClientConn{}
+	b := NewBuilder(SchemeFile, hclog.NewNullLogger(), 10*time.Millisecond, LookupFile)
+
+	r, err := b.Build(resolver.Target{Scheme: SchemeFile, Endpoint: p}, cc, resolver.BuildOptions{})
+	require.NoError(t, err)
+	defer r.Close()
+
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"currency-1:9092"}, cc.addresses())
+	}, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, ioutil.WriteFile(p, []byte("currency-2:9092\ncurrency-1:9092\n"), 0644))
+
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"currency-1:9092", "currency-2:9092"}, cc.addresses())
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestResolverSRVUsesLookup(t *testing.T) {
+	cc := &testClientConn{}
+	lookup := func(endpoint string) ([]string, error) {
+		assert.Equal(t, "_grpc._tcp.currency.service.consul", endpoint)
+		return []string{"10.0.0.2:9092", "10.0.0.1:9092"}, nil
+	}
+
+	b := NewBuilder(SchemeSRV, hclog.NewNullLogger(), time.Minute, lookup)
+
+	r, err := b.Build(resolver.Target{Scheme: SchemeSRV, Endpoint: "_grpc._tcp.currency.service.consul"}, cc, resolver.BuildOptions{})
+	require.NoError(t, err)
+	defer r.Close()
+
+	assert.Eventually(t, func() bool {
+		return assert.ObjectsAreEqual([]string{"10.0.0.1:9092", "10.0.0.2:9092"}, cc.addresses())
+	}, time.Second, 10*time.Millisecond)
+}
+
+// startServer starts a gRPC health server and counts the requests it handles
+func startServer(t *testing.T, count *int32, mu *sync.Mutex) (string, *grpc.Server) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	gs := grpc.NewServer(grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		mu.Lock()
+		*count++
+		mu.Unlock()
+
+		return handler(ctx, req)
+	}))
+
+	healthpb.RegisterHealthServer(gs, health.NewServer())
+
+	go gs.Serve(l)
+	t.Cleanup(gs.Stop)
+
+	return l.Addr().String(), gs
+}
+
+func TestRoundRobinBalancesAndFailsOver(t *testing.T) {
+	var mu sync.Mutex
+	var c1, c2 int32
+
+	a1, s1 := startServer(t, &c1, &mu)
+	a2, _ := startServer(t, &c2, &mu)
+
+	conn, err := grpc.Dial(
+		"static:///"+a1+","+a2,
+		grpc.WithInsecure(),
+		grpc.WithResolvers(NewBuilders(hclog.NewNullLogger(), time.Minute)...),
+		grpc.WithDefaultServiceConfig(ServiceConfig),
+		grpc.WithUnaryInterceptor(UnaryClientInterceptor),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	hc := healthpb.NewHealthClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 10; i++ {
+		_, err := hc.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true))
+		require.NoError(t, err)
+	}
+
+	mu.Lock()
+	assert.NotZero(t, c1)
+	assert.NotZero(t, c2)
+	mu.Unlock()
+
+	// requests continue to succeed when an instance is stopped
+	s1.Stop()
+
+	for i := 0; i < 10; i++ {
+		_, err := hc.Check(ctx, &healthpb.HealthCheckRequest{}, grpc.WaitForReady(true))
+		require.NoError(t, err)
+	}
+}
@@ -4,6 +4,7 @@ go 1.13
 
 require (
 	github.com/PacktPublishing/Building-Microservices-with-Go-Second-Edition/product-api v0.0.0-20200205074745-5ec21a886558
+	github.com/andybalholm/brotli v1.1.1 // indirect
 	github.com/go-openapi/errors v0.19.2
 	github.com/go-openapi/runtime v0.19.11
 	github.com/go-openapi/strfmt v0.19.3
@@ -13,11 +14,17 @@ require (
 	github.com/gorilla/handlers v1.4.2
 	github.com/gorilla/mux v1.7.3
 	github.com/hashicorp/go-hclog v0.12.1
+	github.com/hashicorp/hcl v1.0.0
 	github.com/nicholasjackson/building-microservices-youtube/currency v0.0.0-20200329100342-3c14bf3f378d
+	github.com/nicholasjackson/building-microservices-youtube/shared v0.0.0
 	github.com/nicholasjackson/env v0.6.0
-	github.com/stretchr/testify v1.4.0
+	github.com/prometheus/client_golang v1.5.1
+	github.com/stretchr/testify v1.8.2
 	google.golang.org/grpc v1.28.0
 	gopkg.in/go-playground/assert.v1 v1.2.1 // indirect
+	gopkg.in/yaml.v2 v2.2.5
 )
 
 replace github.com/nicholasjackson/building-microservices-youtube/currency => ../currency
+
+replace github.com/nicholasjackson/building-microservices-youtube/shared => ../shared
@@ -3,27 +3,30 @@ package handlers
 import (
 	"net/http"
 
+	"github.com/nicholasjackson/building-microservices-youtube/product-api/auth"
 	"github.com/nicholasjackson/building-microservices-youtube/product-api/data"
 )
 
 // swagger:route DELETE /products/{id} products deleteProduct
-// Update a products details
+// Delete a product, deleted products can be restored until they are purged
 //
 // responses:
 //	201: noContentResponse
 //  404: errorResponse
+//  401: errorResponse
+//  403: errorResponse
 //  501: errorResponse
 
-// Delete handles DELETE requests and removes items from the database
+// Delete handles DELETE requests and soft deletes items from the database
 func (p *Products) Delete(rw http.ResponseWriter, r *http.Request) {
 	rw.Header().Add("Content-Type", "application/json")
 	id := getProductID(r)
 
-	p.l.Debug("Deleting record", "id", id)
+	p.logger(r).Info("Deleting record", "id", id, "subject", auth.Subject(r.Context()))
 
-	err := p.productDB.DeleteProduct(id)
+	err := p.productDB.DeleteProduct(r.Context(), id)
 	if err == data.ErrProductNotFound {
-		p.l.Error("Unable to delete record id does not exist")
+		p.logger(r).Error("Unable to delete record id does not exist")
 
 		rw.WriteHeader(http.StatusNotFound)
 		data.ToJSON(&GenericError{Message: err.Error()}, rw)
@@ -31,7 +34,7 @@ func (p *Products) Delete(rw http.ResponseWriter, r *http.Request) {
 	}
 
 	if err != nil {
-		p.l.Error("Unable to delete record", "error", err)
+		p.logger(r).Error("Unable to delete record", "error", err)
 
 		rw.WriteHeader(http.StatusInternalServerError)
 		data.ToJSON(&GenericError{Message: err.Error()}, rw)
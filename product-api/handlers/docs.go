@@ -15,7 +15,10 @@
 // swagger:meta
 package handlers
 
-import "github.com/PacktPublishing/Building-Microservices-with-Go-Second-Edition/product-api/8_validation/data"
+import (
+	"github.com/PacktPublishing/Building-Microservices-with-Go-Second-Edition/product-api/8_validation/data"
+	"github.com/nicholasjackson/building-microservices-youtube/product-api/audit"
+)
 
 //
 // NOTE: Types defined here are purely for documentation purposes
@@ -53,6 +56,14 @@ type productResponseWrapper struct {
 	Body data.Product
 }
 
+// The history of changes made to a product
+// swagger:response historyResponse
+type historyResponseWrapper struct {
+	// Audit entries in the order the changes were made
+	// in: body
+	Body []audit.Entry
+}
+
 // No content is returned by this API endpoint
 // swagger:response noContentResponse
 type noContentResponseWrapper struct {
@@ -76,7 +87,15 @@ type productQueryParam struct {
 	Currency string
 }
 
-// swagger:parameters listSingleProduct deleteProduct
+// swagger:parameters listProducts
+type productDeletedQueryParam struct {
+	// Include deleted products in the list
+	// in: query
+	// required: false
+	IncludeDeleted bool `json:"include_deleted"`
+}
+
+// swagger:parameters listSingleProduct deleteProduct listProductHistory restoreProduct
 type productIDParamsWrapper struct {
 	// The id of the product for which the operation relates
 	// in: path
@@ -13,12 +13,13 @@ import (
 
 // ListAll handles GET requests and returns all current products
 func (p *Products) ListAll(rw http.ResponseWriter, r *http.Request) {
-	p.l.Debug("Get all records")
+	p.logger(r).Debug("Get all records")
 	rw.Header().Add("Content-Type", "application/json")
 
 	cur := r.URL.Query().Get("currency")
+	del := r.URL.Query().Get("include_deleted") == "true"
 
-	prods, err := p.productDB.GetProducts(cur)
+	prods, err := p.productDB.GetProducts(r.Context(), cur, del)
 	if err != nil {
 		rw.WriteHeader(http.StatusInternalServerError)
 		data.ToJSON(&GenericError{Message: err.Error()}, rw)
@@ -28,7 +29,7 @@ func (p *Products) ListAll(rw http.ResponseWriter, r *http.Request) {
 	err = data.ToJSON(prods, rw)
 	if err != nil {
 		// we should never be here but log the error just incase
-		p.l.Error("Unable to serializing product", "error", err)
+		p.logger(r).Error("Unable to serializing product", "error", err)
 	}
 }
 
@@ -45,21 +46,21 @@ func (p *Products) ListSingle(rw http.ResponseWriter, r *http.Request) {
 	id := getProductID(r)
 	cur := r.URL.Query().Get("currency")
 
-	p.l.Debug("Get record", "id", id)
+	p.logger(r).Debug("Get record", "id", id)
 
-	prod, err := p.productDB.GetProductByID(id, cur)
+	prod, err := p.productDB.GetProductByID(r.Context(), id, cur)
 
 	switch err {
 	case nil:
 
 	case data.ErrProductNotFound:
-		p.l.Error("Unable to fetch product", "error", err)
+		p.logger(r).Error("Unable to fetch product", "error", err)
 
 		rw.WriteHeader(http.StatusNotFound)
 		data.ToJSON(&GenericError{Message: err.Error()}, rw)
 		return
 	default:
-		p.l.Error("Unable to fetching product", "error", err)
+		p.logger(r).Error("Unable to fetching product", "error", err)
 
 		rw.WriteHeader(http.StatusInternalServerError)
 		data.ToJSON(&GenericError{Message: err.Error()}, rw)
@@ -69,6 +70,6 @@ func (p *Products) ListSingle(rw http.ResponseWriter, r *http.Request) {
 	err = data.ToJSON(prod, rw)
 	if err != nil {
 		// we should never be here but log the error just incase
-		p.l.Error("Unable to serializing product", err)
+		p.logger(r).Error("Unable to serializing product", err)
 	}
 }
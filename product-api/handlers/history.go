@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/nicholasjackson/building-microservices-youtube/product-api/data"
+)
+
+// swagger:route GET /products/{id}/history products listProductHistory
+// Return the history of changes made to a product
+// responses:
+//	200: historyResponse
+//	404: errorResponse
+
+// ListHistory handles GET requests and returns the audit entries for a product
+func (p *Products) ListHistory(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Add("Content-Type", "application/json")
+
+	id := getProductID(r)
+
+	p.logger(r).Debug("Get history", "id", id)
+
+	es, err := p.productDB.GetProductHistory(id)
+
+	switch err {
+	case nil:
+
+	case data.ErrProductNotFound:
+		p.logger(r).Error("Unable to fetch history", "error", err)
+
+		rw.WriteHeader(http.StatusNotFound)
+		data.ToJSON(&GenericError{Message: err.Error()}, rw)
+		return
+	default:
+		p.logger(r).Error("Unable to fetch history", "error", err)
+
+		rw.WriteHeader(http.StatusInternalServerError)
+		data.ToJSON(&GenericError{Message: err.Error()}, rw)
+		return
+	}
+
+	err = data.ToJSON(es, rw)
+	if err != nil {
+		// we should never be here but log the error just incase
+		p.logger(r).Error("Unable to serializing history", "error", err)
+	}
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"net/http"
 
+	"github.com/nicholasjackson/building-microservices-youtube/product-api/auth"
 	"github.com/nicholasjackson/building-microservices-youtube/product-api/data"
 )
 
@@ -12,13 +13,23 @@ import (
 // responses:
 //	200: productResponse
 //  422: errorValidation
+//  401: errorResponse
+//  403: errorResponse
 //  501: errorResponse
 
 // Create handles POST requests to add new products
 func (p *Products) Create(rw http.ResponseWriter, r *http.Request) {
 	// fetch the product from the context
-	prod := r.Context().Value(KeyProduct{}).(data.Product)
+	prod := r.Context().Value(KeyProduct{}).(*data.Product)
 
-	p.l.Debug("Inserting product: %#v\n", prod)
-	p.productDB.AddProduct(prod)
+	p.logger(r).Info("Inserting product", "name", prod.Name, "subject", auth.Subject(r.Context()))
+
+	err := p.productDB.AddProduct(r.Context(), *prod)
+	if err != nil {
+		p.logger(r).Error("Unable to insert product", "error", err)
+
+		rw.WriteHeader(http.StatusInternalServerError)
+		data.ToJSON(&GenericError{Message: err.Error()}, rw)
+		return
+	}
 }
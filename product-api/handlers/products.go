@@ -8,6 +8,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/hashicorp/go-hclog"
 	"github.com/nicholasjackson/building-microservices-youtube/product-api/data"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/logging"
 )
 
 // KeyProduct is a key used for the Product object in the context
@@ -25,6 +26,12 @@ func NewProducts(l hclog.Logger, v *data.Validation, pdb *data.ProductsDB) *Prod
 	return &Products{l, v, pdb}
 }
 
+// logger returns the request scoped logger which includes the request id,
+// when the request does not have a logger the handler logger is returned
+func (p *Products) logger(r *http.Request) hclog.Logger {
+	return logging.Logger(r.Context(), p.l)
+}
+
 // ErrInvalidProductPath is an error message when the product path is not valid
 var ErrInvalidProductPath = fmt.Errorf("Invalid Path, path should be /products/[id]")
 
@@ -3,6 +3,7 @@ package handlers
 import (
 	"net/http"
 
+	"github.com/nicholasjackson/building-microservices-youtube/product-api/auth"
 	"github.com/nicholasjackson/building-microservices-youtube/product-api/data"
 )
 
@@ -11,6 +12,8 @@ import (
 //
 // responses:
 //	201: noContentResponse
+//  401: errorResponse
+//  403: errorResponse
 //  404: errorResponse
 //  422: errorValidation
 
@@ -19,18 +22,26 @@ func (p *Products) Update(rw http.ResponseWriter, r *http.Request) {
 	rw.Header().Add("Content-Type", "application/json")
 
 	// fetch the product from the context
-	prod := r.Context().Value(KeyProduct{}).(data.Product)
-	p.l.Debug("Updating record id", prod.ID)
+	prod := r.Context().Value(KeyProduct{}).(*data.Product)
+	p.logger(r).Info("Updating record", "id", prod.ID, "subject", auth.Subject(r.Context()))
 
-	err := p.productDB.UpdateProduct(prod)
+	err := p.productDB.UpdateProduct(r.Context(), *prod)
 	if err == data.ErrProductNotFound {
-		p.l.Error("Product not found", err)
+		p.logger(r).Error("Product not found", "error", err)
 
 		rw.WriteHeader(http.StatusNotFound)
 		data.ToJSON(&GenericError{Message: "Product not found in database"}, rw)
 		return
 	}
 
+	if err != nil {
+		p.logger(r).Error("Unable to update product", "error", err)
+
+		rw.WriteHeader(http.StatusInternalServerError)
+		data.ToJSON(&GenericError{Message: err.Error()}, rw)
+		return
+	}
+
 	// write the no content success header
 	rw.WriteHeader(http.StatusNoContent)
 }
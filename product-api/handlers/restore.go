@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/nicholasjackson/building-microservices-youtube/product-api/auth"
+	"github.com/nicholasjackson/building-microservices-youtube/product-api/data"
+)
+
+// swagger:route POST /products/{id}/restore products restoreProduct
+// Restore a deleted product
+//
+// responses:
+//	204: noContentResponse
+//  400: errorResponse
+//  401: errorResponse
+//  403: errorResponse
+//  404: errorResponse
+//  501: errorResponse
+
+// Restore handles POST requests and restores deleted items in the database
+func (p *Products) Restore(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Add("Content-Type", "application/json")
+	id := getProductID(r)
+
+	p.logger(r).Info("Restoring record", "id", id, "subject", auth.Subject(r.Context()))
+
+	err := p.productDB.RestoreProduct(r.Context(), id)
+	switch err {
+	case nil:
+
+	case data.ErrProductNotFound:
+		p.logger(r).Error("Unable to restore record id does not exist")
+
+		rw.WriteHeader(http.StatusNotFound)
+		data.ToJSON(&GenericError{Message: err.Error()}, rw)
+		return
+	case data.ErrProductNotDeleted:
+		p.logger(r).Error("Unable to restore record", "error", err)
+
+		rw.WriteHeader(http.StatusBadRequest)
+		data.ToJSON(&GenericError{Message: err.Error()}, rw)
+		return
+	default:
+		p.logger(r).Error("Unable to restore record", "error", err)
+
+		rw.WriteHeader(http.StatusInternalServerError)
+		data.ToJSON(&GenericError{Message: err.Error()}, rw)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -2,52 +2,208 @@ package main
 
 import (
 	"context"
-	"log"
+	"flag"
+	"fmt"
+	"io"
 	"net/http"
 	"os"
-	"os/signal"
-	"time"
 
 	"github.com/go-openapi/runtime/middleware"
 	"github.com/hashicorp/go-hclog"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
 	gohandlers "github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	protos "github.com/nicholasjackson/building-microservices-youtube/currency/protos/currency"
+	"github.com/nicholasjackson/building-microservices-youtube/product-api/audit"
+	"github.com/nicholasjackson/building-microservices-youtube/product-api/auth"
+	"github.com/nicholasjackson/building-microservices-youtube/product-api/config"
 	"github.com/nicholasjackson/building-microservices-youtube/product-api/data"
+	"github.com/nicholasjackson/building-microservices-youtube/product-api/discovery"
 	"github.com/nicholasjackson/building-microservices-youtube/product-api/handlers"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/compress"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/health"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/lifecycle"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/logging"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/metrics"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/ratelimit"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/tlsconfig"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/tracing"
 	"github.com/nicholasjackson/env"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var bindAddress = env.String("BIND_ADDRESS", false, ":9090", "Bind address for the server")
+var configFile = env.String("CONFIG_FILE", false, "", "Path to a YAML or HCL configuration file, environment variables override values in the file")
+var printConfig = flag.Bool("print-config", false, "Print the configuration and exit")
 
 func main() {
 
-	env.Parse()
+	err := env.Parse()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if *printConfig {
+		err := cfg.Write(os.Stdout)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	}
+
+	l := hclog.New(&hclog.LoggerOptions{
+		Name:       "product-api",
+		Level:      hclog.LevelFromString(cfg.Log.Level),
+		JSONFormat: cfg.Log.Format == "json",
+	})
 
-	l := hclog.Default()
 	v := data.NewValidation()
 
-	conn, err := grpc.Dial("localhost:9092", grpc.WithInsecure())
+	// shutdown hooks run in reverse order when the process receives SIGINT
+	// or SIGTERM
+	lc := lifecycle.New(l, cfg.HTTP.ShutdownTimeout)
+
+	// configure OpenTelemetry tracing, spans are flushed after the server
+	// has stopped
+	shutdownTracing, err := tracing.Setup("product-api", cfg.Tracing.Exporter, cfg.Tracing.File, cfg.Tracing.SampleRatio)
 	if err != nil {
-		panic(err)
+		l.Error("Unable to configure tracing", "error", err)
+		os.Exit(1)
 	}
 
-	defer conn.Close()
+	lc.OnShutdown("tracing", lifecycle.ShutdownFunc(shutdownTracing))
+
+	// certificates are watched for changes until the server exits
+	tctx, tcancel := context.WithCancel(context.Background())
+	lc.OnShutdown("tls", func(context.Context) error {
+		tcancel()
+		return nil
+	})
+
+	creds, err := currencyCredentials(tctx, l, cfg.Currency.TLS)
+	if err != nil {
+		l.Error("Unable to configure TLS for the currency service", "error", err)
+		os.Exit(1)
+	}
+
+	// currency instances are found using the discovery resolvers and
+	// requests are balanced between all instances
+	conn, err := grpc.Dial(
+		cfg.Currency.Address,
+		creds,
+		grpc.WithResolvers(discovery.NewBuilders(l, cfg.Currency.RefreshInterval)...),
+		grpc.WithDefaultServiceConfig(discovery.ServiceConfig),
+		grpc.WithChainUnaryInterceptor(tracing.UnaryClientInterceptor, logging.UnaryClientInterceptor, discovery.UnaryClientInterceptor),
+		grpc.WithChainStreamInterceptor(tracing.StreamClientInterceptor, logging.StreamClientInterceptor),
+	)
+	if err != nil {
+		l.Error("Unable to connect to the currency service", "address", cfg.Currency.Address, "error", err)
+		os.Exit(1)
+	}
+
+	lc.OnShutdown("currency", func(context.Context) error {
+		return conn.Close()
+	})
 
 	// create client
 	cc := protos.NewCurrencyClient(conn)
 
-	// create database instance
-	db := data.NewProductsDB(cc, l)
+	// create the audit log
+	as, err := newAuditSink(cfg.Audit)
+	if err != nil {
+		l.Error("Unable to create audit log", "error", err)
+		os.Exit(1)
+	}
+
+	if c, ok := as.(io.Closer); ok {
+		lc.OnShutdown("audit", func(context.Context) error {
+			return c.Close()
+		})
+	}
+
+	al := audit.NewLog(as, auth.Subject, logging.RequestID)
+
+	// create database instance, the rate subscription ends before the
+	// connection to the currency service is closed
+	db := data.NewProductsDB(cc, l, al)
+	lc.OnShutdown("subscriptions", func(context.Context) error {
+		db.Close()
+		return nil
+	})
+
+	// permanently remove deleted products after the retention period
+	if cfg.Audit.PurgeRetention > 0 {
+		pctx, pcancel := context.WithCancel(context.Background())
+		lc.OnShutdown("purge", func(context.Context) error {
+			pcancel()
+			return nil
+		})
+
+		db.MonitorPurge(pctx, cfg.Audit.PurgeInterval, cfg.Audit.PurgeRetention)
+	}
 
 	// create the handlers
 	ph := handlers.NewProducts(l, v, db)
 
+	// create the authenticator
+	authn, err := newAuthenticator(l, cfg.Auth)
+	if err != nil {
+		l.Error("Unable to configure authentication", "error", err)
+		os.Exit(1)
+	}
+
+	// failed attempts are limited by IP address before the credentials are
+	// checked, the request limits below apply once the caller is known
+	if cfg.RateLimit.AuthFailures > 0 {
+		authn.LimitFailures(
+			ratelimit.NewLimiter(cfg.RateLimit.AuthFailures, cfg.RateLimit.AuthFailureBurst),
+			ratelimit.KeyByIP(cfg.RateLimit.TrustForwarded),
+		)
+	}
+
+	// create the metrics for the HTTP handlers
+	hm, err := metrics.NewHTTP("product_api", prometheus.DefaultRegisterer)
+	if err != nil {
+		l.Error("Unable to create metrics", "error", err)
+		os.Exit(1)
+	}
+
 	// create a new serve mux and register the handlers
 	sm := mux.NewRouter()
 
+	// trace and record metrics for all requests including those rejected by
+	// authentication or rate limiting
+	sm.Use(tracing.Middleware)
+	sm.Use(hm.Middleware)
+
+	// add a request id and access log to all requests and authenticate
+	// the caller, access for each route is controlled by role
+	lm := logging.NewMiddleware(l)
+	sm.Use(lm.MiddlewareRequestID)
+	sm.Use(lm.MiddlewareAccessLog)
+	sm.Use(authn.MiddlewareAuthenticate)
+	sm.Use(newRateLimit(cfg.RateLimit).MiddlewareRateLimit)
+
+	// compress large JSON responses, validation has checked the encodings
+	cm, err := compress.New(cfg.Compression.Encodings, cfg.Compression.MinSize, cfg.Compression.Types)
+	if err != nil {
+		l.Error("Unable to create compression middleware", "error", err)
+		os.Exit(1)
+	}
+
+	sm.Use(cm.MiddlewareCompress)
+
 	// handlers for API
 	getR := sm.Methods(http.MethodGet).Subrouter()
 	getR.HandleFunc("/products", ph.ListAll).Queries("currency", "{[A-Z]{3}}")
@@ -55,59 +211,186 @@ func main() {
 
 	getR.HandleFunc("/products/{id:[0-9]+}", ph.ListSingle).Queries("currency", "{[A-Z]{3}}")
 	getR.HandleFunc("/products/{id:[0-9]+}", ph.ListSingle)
+	getR.HandleFunc("/products/{id:[0-9]+}/history", ph.ListHistory)
+
+	if !cfg.Auth.AnonymousRead {
+		getR.Use(authn.MiddlewareRequireRole(auth.RoleReader))
+	}
 
 	putR := sm.Methods(http.MethodPut).Subrouter()
 	putR.HandleFunc("/products", ph.Update)
+	putR.Use(authn.MiddlewareRequireRole(auth.RoleEditor))
 	putR.Use(ph.MiddlewareValidateProduct)
 
 	postR := sm.Methods(http.MethodPost).Subrouter()
 	postR.HandleFunc("/products", ph.Create)
+	postR.Use(authn.MiddlewareRequireRole(auth.RoleEditor))
 	postR.Use(ph.MiddlewareValidateProduct)
 
 	deleteR := sm.Methods(http.MethodDelete).Subrouter()
 	deleteR.HandleFunc("/products/{id:[0-9]+}", ph.Delete)
+	deleteR.Use(authn.MiddlewareRequireRole(auth.RoleAdmin))
+
+	restoreR := sm.Methods(http.MethodPost).Subrouter()
+	restoreR.HandleFunc("/products/{id:[0-9]+}/restore", ph.Restore)
+	restoreR.Use(authn.MiddlewareRequireRole(auth.RoleAdmin))
 
-	// handler for documentation
+	// handler for documentation, the docs are public even when reading
+	// products requires a role
 	opts := middleware.RedocOpts{SpecURL: "/swagger.yaml"}
 	sh := middleware.Redoc(opts, nil)
 
-	getR.Handle("/docs", sh)
-	getR.Handle("/swagger.yaml", http.FileServer(http.Dir("./")))
+	docsR := sm.Methods(http.MethodGet).Subrouter()
+	docsR.Handle("/docs", sh)
+	docsR.Handle("/swagger.yaml", http.FileServer(http.Dir("./")))
+
+	// handler for metrics
+	sm.Methods(http.MethodGet).Path("/metrics").Handler(promhttp.Handler())
+
+	// handlers for liveness and readiness, product-api is ready when the
+	// currency service is healthy and rates are being received
+	hc := health.New(l, cfg.HTTP.HealthTimeout)
+	hc.AddReadinessCheck("currency", health.GRPC(conn, "Currency"))
+	hc.AddReadinessCheck("currency_subscription", db.CheckSubscription)
+
+	sm.Methods(http.MethodGet).Path("/healthz").HandlerFunc(hc.LiveHandler)
+	sm.Methods(http.MethodGet).Path("/readyz").HandlerFunc(hc.ReadyHandler)
 
 	// CORS
-	ch := gohandlers.CORS(gohandlers.AllowedOrigins([]string{"*"}))
+	ch := gohandlers.CORS(gohandlers.AllowedOrigins(cfg.HTTP.CORSOrigins))
 
 	// create a new server
 	s := http.Server{
-		Addr:         *bindAddress,                                     // configure the bind address
+		Addr:         cfg.BindAddress,                                  // configure the bind address
 		Handler:      ch(sm),                                           // set the default handler
 		ErrorLog:     l.StandardLogger(&hclog.StandardLoggerOptions{}), // set the logger for the server
-		ReadTimeout:  5 * time.Second,                                  // max time to read request from the client
-		WriteTimeout: 10 * time.Second,                                 // max time to write response to the client
-		IdleTimeout:  120 * time.Second,                                // max time for connections using TCP Keep-Alive
+		ReadTimeout:  cfg.HTTP.ReadTimeout,                             // max time to read request from the client
+		WriteTimeout: cfg.HTTP.WriteTimeout,                            // max time to write response to the client
+		IdleTimeout:  cfg.HTTP.IdleTimeout,                             // max time for connections using TCP Keep-Alive
 	}
 
-	// start the server
-	go func() {
-		l.Info("Starting server on port 9090")
-
-		err := s.ListenAndServe()
+	// serve HTTPS when a certificate is configured
+	if cfg.HTTP.TLS.CertFile != "" {
+		r, err := tlsconfig.NewReloader(l, tlsconfig.Files{CAFile: cfg.HTTP.TLS.CAFile, CertFile: cfg.HTTP.TLS.CertFile, KeyFile: cfg.HTTP.TLS.KeyFile})
 		if err != nil {
-			l.Error("Error starting server", "error", err)
+			l.Error("Unable to load TLS certificates", "error", err)
 			os.Exit(1)
 		}
-	}()
 
-	// trap sigterm or interupt and gracefully shutdown the server
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	signal.Notify(c, os.Kill)
+		r.Watch(tctx, cfg.HTTP.TLS.ReloadInterval)
+		s.TLSConfig = r.ServerConfig()
+	}
+
+	// start the server, on shutdown the server waits for current operations
+	// to complete
+	l.Info("Starting server", "bind_address", cfg.BindAddress, "tls", s.TLSConfig != nil)
+	lc.ServeHTTP("http", &s, func() error {
+		if s.TLSConfig != nil {
+			return s.ListenAndServeTLS("", "")
+		}
+
+		return s.ListenAndServe()
+	})
+
+	// fail readiness checks and wait for load balancers to stop sending
+	// traffic before the server stops accepting connections
+	lc.OnShutdown("health", func(ctx context.Context) error {
+		return hc.Drain(ctx, cfg.HTTP.DrainDelay)
+	})
+
+	os.Exit(lc.Wait())
+}
+
+// newAuthenticator creates an Authenticator from the API key and JWT configuration
+func newAuthenticator(l hclog.Logger, cfg config.Auth) (*auth.Authenticator, error) {
+	var keys *auth.APIKeys
+	if cfg.APIKeysFile != "" {
+		k, err := auth.LoadAPIKeys(cfg.APIKeysFile)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = k
+	}
+
+	jv := auth.NewJWTVerifier(cfg.JWTIssuer, cfg.JWTAudience)
+
+	if cfg.JWTSecretFile != "" {
+		err := jv.LoadHMACSecret(cfg.JWTSecretFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.JWTPublicKeyFile != "" {
+		err := jv.LoadRSAPublicKey(cfg.JWTPublicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.JWKSFile != "" {
+		err := jv.LoadJWKS(cfg.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if keys == nil && !jv.HasKeys() {
+		l.Warn("No API keys or JWT keys configured, requests which modify products will be rejected")
+	}
+
+	return auth.NewAuthenticator(l, keys, jv), nil
+}
+
+// newAuditSink creates a file sink when a log file is configured, otherwise
+// entries are stored in memory
+func newAuditSink(cfg config.Audit) (audit.Sink, error) {
+	if cfg.LogFile == "" {
+		return audit.NewMemory(), nil
+	}
+
+	return audit.NewFile(cfg.LogFile)
+}
+
+// newRateLimit creates the rate limiting middleware, authenticated clients are
+// limited by subject and anonymous clients by IP address
+func newRateLimit(cfg config.RateLimit) *ratelimit.Middleware {
+	var rl, wl *ratelimit.Limiter
+
+	if cfg.Read > 0 {
+		rl = ratelimit.NewLimiter(cfg.Read, cfg.ReadBurst)
+	}
+
+	if cfg.Write > 0 {
+		wl = ratelimit.NewLimiter(cfg.Write, cfg.WriteBurst)
+	}
+
+	ip := ratelimit.KeyByIP(cfg.TrustForwarded)
+	key := func(r *http.Request) string {
+		if i := auth.IdentityFromContext(r.Context()); i != nil {
+			return "sub:" + i.Subject
+		}
+
+		return ip(r)
+	}
+
+	return ratelimit.New(rl, wl, key)
+}
+
+// currencyCredentials returns the transport credentials for the connection
+// to the currency service
+func currencyCredentials(ctx context.Context, l hclog.Logger, cfg config.TLS) (grpc.DialOption, error) {
+	if !cfg.Enabled {
+		return grpc.WithInsecure(), nil
+	}
+
+	r, err := tlsconfig.NewReloader(l, tlsconfig.Files{CAFile: cfg.CAFile, CertFile: cfg.CertFile, KeyFile: cfg.KeyFile})
+	if err != nil {
+		return nil, err
+	}
 
-	// Block until a signal is received.
-	sig := <-c
-	log.Println("Got signal:", sig)
+	r.Watch(ctx, cfg.ReloadInterval)
 
-	// gracefully shutdown the server, waiting max 30 seconds for current operations to complete
-	ctx, _ := context.WithTimeout(context.Background(), 30*time.Second)
-	s.Shutdown(ctx)
+	return grpc.WithTransportCredentials(credentials.NewTLS(r.ClientConfig(cfg.ServerName))), nil
 }
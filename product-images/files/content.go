@@ -0,0 +1,265 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"golang.org/x/xerrors"
+)
+
+const (
+	// blobsPath is the directory in the underlying store for the contents
+	// of files, blobs are named by the SHA-256 hash of their contents
+	blobsPath = "blobs"
+	// indexPath is the directory in the underlying store which maps the path
+	// of a file to the hash of its contents
+	indexPath = "index"
+)
+
+// ContentAddressed is an implementation of the Storage interface which
+// stores the contents of files in another Storage by their SHA-256 hash,
+// files with the same contents share a single blob
+type ContentAddressed struct {
+	store Storage
+
+	// gc prevents blobs being deleted while a file which references them is
+	// being saved
+	gc sync.RWMutex
+}
+
+// indexEntry is the record stored in the index for each file
+type indexEntry struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// NewContentAddressed creates a ContentAddressed store which saves blobs and
+// the index in s
+func NewContentAddressed(s Storage) *ContentAddressed {
+	return &ContentAddressed{store: s}
+}
+
+// Save the contents of the reader to the given path, files with the same
+// contents share a blob, the blob is written again when it already exists
+// so that its modification time is refreshed and GC running in another
+// instance does not delete it before the index entry is written
+func (c *ContentAddressed) Save(p string, contents io.Reader) error {
+	// the hash is needed before the blob can be named so the contents are
+	// written to a temporary file
+	tmp, err := ioutil.TempFile("", "product-images-")
+	if err != nil {
+		return xerrors.Errorf("Unable to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), contents)
+	if err != nil {
+		return xerrors.Errorf("Unable to write to file: %w", err)
+	}
+
+	e := indexEntry{Hash: hex.EncodeToString(h.Sum(nil)), Size: n}
+
+	_, err = tmp.Seek(0, io.SeekStart)
+	if err != nil {
+		return xerrors.Errorf("Unable to read temporary file: %w", err)
+	}
+
+	c.gc.RLock()
+	defer c.gc.RUnlock()
+
+	err = c.store.Save(blobPath(e.Hash), tmp)
+	if err != nil {
+		return err
+	}
+
+	d, err := json.Marshal(e)
+	if err != nil {
+		return xerrors.Errorf("Unable to encode index: %w", err)
+	}
+
+	return c.store.Save(entryPath(p), bytes.NewReader(d))
+}
+
+// Open the file at the given path for reading
+// the calling function is responsible for closing the file
+func (c *ContentAddressed) Open(p string) (File, FileInfo, error) {
+	fi, err := c.Stat(p)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+
+	f, _, err := c.store.Open(blobPath(fi.Hash))
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+
+	return f, fi, nil
+}
+
+// Stat returns the details of the file at the given path, the modification
+// time is the time the file was saved
+func (c *ContentAddressed) Stat(p string) (FileInfo, error) {
+	f, ifi, err := c.store.Open(entryPath(p))
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer f.Close()
+
+	e := indexEntry{}
+	err = json.NewDecoder(f).Decode(&e)
+	if err != nil {
+		return FileInfo{}, xerrors.Errorf("Unable to decode index for %s: %w", p, err)
+	}
+
+	p = strings.TrimPrefix(p, "/")
+
+	return FileInfo{
+		Path:        p,
+		Size:        e.Size,
+		ModTime:     ifi.ModTime,
+		ContentType: contentType(p),
+		Hash:        e.Hash,
+	}, nil
+}
+
+// Delete the file at the given path, the blob is removed by GC once no
+// files reference it
+func (c *ContentAddressed) Delete(p string) error {
+	return c.store.Delete(entryPath(p))
+}
+
+// List returns the files whose path starts with prefix
+func (c *ContentAddressed) List(prefix string) ([]FileInfo, error) {
+	ifis, err := c.store.List(entryPath(prefix))
+	if err != nil {
+		return nil, err
+	}
+
+	fis := []FileInfo{}
+	for _, ifi := range ifis {
+		fi, err := c.Stat(strings.TrimPrefix(ifi.Path, indexPath+"/"))
+		if xerrors.Is(err, ErrNotFound) {
+			// deleted since the index was listed
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		fis = append(fis, fi)
+	}
+
+	return fis, nil
+}
+
+// Exists returns true when a file is stored at the given path
+func (c *ContentAddressed) Exists(p string) (bool, error) {
+	return c.store.Exists(entryPath(p))
+}
+
+// GC deletes the blobs which are not referenced by any file and returns the
+// number deleted, blobs modified within grace are kept as they may belong to
+// a file which is being saved by another instance of the service
+func (c *ContentAddressed) GC(grace time.Duration) (int, error) {
+	// list the blobs before the index so that a blob saved during the GC is
+	// either too new to delete or referenced
+	blobs, err := c.store.List(blobsPath + "/")
+	if err != nil {
+		return 0, err
+	}
+
+	c.gc.Lock()
+	defer c.gc.Unlock()
+
+	entries, err := c.List("")
+	if err != nil {
+		return 0, err
+	}
+
+	refs := map[string]bool{}
+	for _, e := range entries {
+		refs[e.Hash] = true
+	}
+
+	n := 0
+	cutoff := time.Now().Add(-grace)
+
+	for _, b := range blobs {
+		if refs[path.Base(b.Path)] || b.ModTime.After(cutoff) {
+			continue
+		}
+
+		// the blob may have been reused by another instance since the blobs
+		// were listed, check the modification time again before deleting it
+		fi, err := c.store.Stat(b.Path)
+		if xerrors.Is(err, ErrNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return n, err
+		}
+
+		if fi.ModTime.After(cutoff) {
+			continue
+		}
+
+		err = c.store.Delete(b.Path)
+		if err != nil && !xerrors.Is(err, ErrNotFound) {
+			return n, err
+		}
+
+		n++
+	}
+
+	return n, nil
+}
+
+// MonitorGC runs GC every interval until ctx is done
+func (c *ContentAddressed) MonitorGC(ctx context.Context, interval, grace time.Duration, l hclog.Logger) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				n, err := c.GC(grace)
+				if err != nil {
+					l.Error("Unable to delete unreferenced blobs", "error", err)
+				}
+
+				if n > 0 {
+					l.Info("Deleted unreferenced blobs", "count", n)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// blobPath returns the path of the blob for the hash, blobs are split into
+// directories by the first two characters of the hash
+func blobPath(hash string) string {
+	return path.Join(blobsPath, hash[:2], hash)
+}
+
+// entryPath returns the path of the index entry for the file at p
+func entryPath(p string) string {
+	return indexPath + "/" + strings.TrimPrefix(p, "/")
+}
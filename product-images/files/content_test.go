@@ -0,0 +1,135 @@
+package files
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupContentAddressed(t *testing.T) (*ContentAddressed, *Local) {
+	l, err := NewLocal(t.TempDir(), 1024)
+	require.NoError(t, err)
+
+	return NewContentAddressed(l), l
+}
+
+func hashOf(s string) string {
+	h := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(h[:])
+}
+
+func TestContentAddressedSavesBlobAndIndex(t *testing.T) {
+	c, l := setupContentAddressed(t)
+	require.NoError(t, c.Save("1/test.png", bytes.NewBufferString("Hello World")))
+
+	f, fi, err := c.Open("1/test.png")
+	require.NoError(t, err)
+	defer f.Close()
+
+	d, err := ioutil.ReadAll(f)
+	require.NoError(t, err)
+
+	assert.Equal(t, "Hello World", string(d))
+	assert.Equal(t, "1/test.png", fi.Path)
+	assert.Equal(t, int64(11), fi.Size)
+	assert.Equal(t, "image/png", fi.ContentType)
+	assert.Equal(t, hashOf("Hello World"), fi.Hash)
+
+	ok, err := l.Exists("blobs/" + fi.Hash[:2] + "/" + fi.Hash)
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestContentAddressedDeduplicatesContents(t *testing.T) {
+	c, l := setupContentAddressed(t)
+	require.NoError(t, c.Save("1/test.png", bytes.NewBufferString("Hello World")))
+	require.NoError(t, c.Save("2/other.png", bytes.NewBufferString("Hello World")))
+
+	blobs, err := l.List("blobs/")
+	require.NoError(t, err)
+	assert.Len(t, blobs, 1)
+
+	fis, err := c.List("")
+	require.NoError(t, err)
+	require.Len(t, fis, 2)
+	assert.Equal(t, "1/test.png", fis[0].Path)
+	assert.Equal(t, "2/other.png", fis[1].Path)
+	assert.Equal(t, fis[0].Hash, fis[1].Hash)
+}
+
+func TestContentAddressedMissingFileReturnsNotFound(t *testing.T) {
+	c, _ := setupContentAddressed(t)
+
+	_, _, err := c.Open("1/test.png")
+	assert.Equal(t, ErrNotFound, err)
+
+	ok, err := c.Exists("1/test.png")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestContentAddressedGCDeletesUnreferencedBlobs(t *testing.T) {
+	c, l := setupContentAddressed(t)
+	require.NoError(t, c.Save("1/test.png", bytes.NewBufferString("Hello World")))
+	require.NoError(t, c.Save("2/test.png", bytes.NewBufferString("Hello World")))
+
+	// replacing a file leaves the old blob unreferenced
+	require.NoError(t, c.Save("1/test.png", bytes.NewBufferString("Goodbye World")))
+	require.NoError(t, c.Delete("2/test.png"))
+
+	// new blobs are kept for the grace period
+	n, err := c.GC(time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	n, err = c.GC(0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	blobs, err := l.List("blobs/")
+	require.NoError(t, err)
+	require.Len(t, blobs, 1)
+	assert.Contains(t, blobs[0].Path, hashOf("Goodbye World"))
+
+	_, fi, err := c.Open("1/test.png")
+	require.NoError(t, err)
+	assert.Equal(t, int64(13), fi.Size)
+}
+
+func TestContentAddressedGCKeepsReusedBlobs(t *testing.T) {
+	c, l := setupContentAddressed(t)
+	require.NoError(t, c.Save("1/test.png", bytes.NewBufferString("Hello World")))
+	require.NoError(t, c.Delete("1/test.png"))
+
+	// the unreferenced blob is listed by GC in another instance
+	old := time.Now().Add(-2 * time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(l.basePath, blobPath(hashOf("Hello World"))), old, old))
+
+	blobs, err := l.List("blobs/")
+	require.NoError(t, err)
+	require.Len(t, blobs, 1)
+	assert.True(t, blobs[0].ModTime.Before(time.Now().Add(-time.Hour)))
+
+	// reusing the blob refreshes its modification time
+	require.NoError(t, c.Save("2/test.png", bytes.NewBufferString("Hello World")))
+
+	blobs, err = l.List("blobs/")
+	require.NoError(t, err)
+	require.Len(t, blobs, 1)
+	assert.True(t, blobs[0].ModTime.After(time.Now().Add(-time.Hour)))
+
+	n, err := c.GC(time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	_, _, err = c.Open("2/test.png")
+	assert.NoError(t, err)
+}
@@ -2,17 +2,30 @@ package files
 
 import (
 	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
 
 	"golang.org/x/xerrors"
 )
 
+const (
+	// tempPrefix is the prefix for the names of files which are being saved
+	tempPrefix = ".tmp-"
+	// filePerm is the permissions for saved files
+	filePerm = 0644
+)
+
 // Local is an implementation of the Storage interface which works with the
 // local disk on the current machine
 type Local struct {
-	maxFileSize int // maximum numbber of bytes for files
+	maxFileSize int // maximum number of bytes for files, 0 is unlimited
 	basePath    string
+	locks       *pathLocks
 }
 
 // NewLocal creates a new Local filesytem with the given base path
@@ -24,68 +37,420 @@ func NewLocal(basePath string, maxSize int) (*Local, error) {
 		return nil, err
 	}
 
-	return &Local{basePath: p}, nil
+	return &Local{basePath: p, maxFileSize: maxSize, locks: newPathLocks()}, nil
 }
 
 // Save the contents of the Writer to the given path
 // path is a relative path, basePath will be appended
+// the contents are written to a temporary file which replaces the existing
+// file once it is complete so readers never see a partial file
 func (l *Local) Save(path string, contents io.Reader) error {
 	// get the full path for the file
-	fp := l.fullPath(path)
+	fp, err := l.fullPath(path)
+	if err != nil {
+		return err
+	}
+
+	// concurrent saves to the same path are applied one at a time
+	unlock := l.locks.lock(fp)
+	defer unlock()
 
-	// get the directory and make sure it exists
+	// create the temporary file in the same directory so that it can be
+	// renamed, a rename is atomic within a file system
 	d := filepath.Dir(fp)
-	err := os.MkdirAll(d, os.ModePerm)
+	f, err := createTemp(d)
 	if err != nil {
-		return xerrors.Errorf("Unable to create directory: %w", err)
+		return err
 	}
 
-	// if the file exists delete it
-	_, err = os.Stat(fp)
+	err = l.write(f, contents)
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	err = f.Close()
 	if err == nil {
-		err = os.Remove(fp)
-		if err != nil {
-			return xerrors.Errorf("Unable to delete file: %w", err)
-		}
-	} else if !os.IsNotExist(err) {
-		// if this is anything other than a not exists error
-		return xerrors.Errorf("Unable to get file info: %w", err)
+		err = os.Rename(f.Name(), fp)
 	}
 
-	// create a new file at the path
-	f, err := os.Create(fp)
 	if err != nil {
-		return xerrors.Errorf("Unable to create file: %w", err)
+		os.Remove(f.Name())
+		return xerrors.Errorf("Unable to replace file: %w", err)
 	}
-	defer f.Close()
 
-	// write the contents to the new file
+	// sync the directory so that the rename survives a crash
+	return syncDir(d)
+}
+
+// write copies the contents to the temporary file and flushes it to disk
+func (l *Local) write(f *os.File, contents io.Reader) error {
 	// ensure that we are not writing greater than max bytes
-	_, err = io.Copy(f, contents)
+	if l.maxFileSize > 0 {
+		contents = io.LimitReader(contents, int64(l.maxFileSize)+1)
+	}
+
+	n, err := io.Copy(f, contents)
 	if err != nil {
 		return xerrors.Errorf("Unable to write to file: %w", err)
 	}
 
+	if l.maxFileSize > 0 && n > int64(l.maxFileSize) {
+		return ErrFileTooLarge
+	}
+
+	// temporary files are only readable by the owner
+	err = f.Chmod(filePerm)
+	if err != nil {
+		return xerrors.Errorf("Unable to set file permissions: %w", err)
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return xerrors.Errorf("Unable to sync file: %w", err)
+	}
+
 	return nil
 }
 
-// Get the file at the given path and return a Reader
-// the calling function is responsible for closing the reader
-func (l *Local) Get(path string) (*os.File, error) {
+// Sweep removes temporary files left by saves which did not complete, i.e.
+// when the process crashed, it returns the number of files removed and must
+// be called before the store is used
+func (l *Local) Sweep() (int, error) {
+	n := 0
+
+	err := filepath.Walk(l.basePath, func(fp string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// the base path has not been created yet
+			if fp == l.basePath && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+
+			return err
+		}
+
+		if fi.IsDir() || !isTemp(fp) {
+			return nil
+		}
+
+		err = os.Remove(fp)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		n++
+		return nil
+	})
+
+	if err != nil {
+		return n, xerrors.Errorf("Unable to remove temporary files: %w", err)
+	}
+
+	return n, nil
+}
+
+// Open the file at the given path for reading
+// the calling function is responsible for closing the file
+func (l *Local) Open(path string) (File, FileInfo, error) {
 	// get the full path for the file
-	fp := l.fullPath(path)
+	fp, err := l.fullPath(path)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
 
 	// open the file
 	f, err := os.Open(fp)
 	if err != nil {
-		return nil, xerrors.Errorf("Unable to open file: %w", err)
+		return nil, FileInfo{}, l.pathError("Unable to open file", err)
 	}
 
-	return f, nil
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, FileInfo{}, xerrors.Errorf("Unable to get file info: %w", err)
+	}
+
+	if fi.IsDir() {
+		f.Close()
+		return nil, FileInfo{}, ErrNotFound
+	}
+
+	info := l.fileInfo(strings.TrimPrefix(fp, l.basePath), fi)
+
+	// when the extension does not give the type detect it from the content
+	if info.ContentType == "application/octet-stream" {
+		info.ContentType, err = sniff(f)
+		if err != nil {
+			f.Close()
+			return nil, FileInfo{}, xerrors.Errorf("Unable to read file: %w", err)
+		}
+	}
+
+	return f, info, nil
+}
+
+// Stat returns the details of the file at the given path
+func (l *Local) Stat(path string) (FileInfo, error) {
+	fp, err := l.fullPath(path)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	fi, err := os.Stat(fp)
+	if err != nil {
+		return FileInfo{}, l.pathError("Unable to get file info", err)
+	}
+
+	if fi.IsDir() {
+		return FileInfo{}, ErrNotFound
+	}
+
+	return l.fileInfo(strings.TrimPrefix(fp, l.basePath), fi), nil
+}
+
+// Delete the file at the given path, empty directories containing the
+// file are removed
+func (l *Local) Delete(path string) error {
+	fp, err := l.fullPath(path)
+	if err != nil {
+		return err
+	}
+
+	unlock := l.locks.lock(fp)
+	err = os.Remove(fp)
+	unlock()
+
+	if err != nil {
+		return l.pathError("Unable to delete file", err)
+	}
+
+	// os.Remove fails when a directory is not empty
+	for d := filepath.Dir(fp); d != l.basePath && strings.HasPrefix(d, l.basePath); d = filepath.Dir(d) {
+		if os.Remove(d) != nil {
+			break
+		}
+	}
+
+	return nil
 }
 
-// returns the absolute path
-func (l *Local) fullPath(path string) string {
+// List returns the files whose path starts with prefix, i.e. "1/" returns
+// the files for product 1, files are sorted by path
+func (l *Local) List(prefix string) ([]FileInfo, error) {
+	prefix = strings.TrimPrefix(prefix, "/")
+	fis := []FileInfo{}
+
+	// only the directory containing the prefix is walked, i.e. "1/" walks
+	// 1 and "index/1/a" walks index/1, so the cost does not grow with the
+	// size of the store
+	dir := prefix
+	if !strings.HasSuffix(dir, "/") {
+		dir = path.Dir(dir)
+	}
+
+	root := l.basePath
+	if dir = strings.TrimSuffix(dir, "/"); dir != "" && dir != "." {
+		fp, err := l.fullPath(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		root = fp
+	}
+
+	err := filepath.Walk(root, func(fp string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// nothing has been saved with the prefix
+			if fp == root && os.IsNotExist(err) {
+				return filepath.SkipDir
+			}
+
+			return err
+		}
+
+		// files which are being saved and symlinks are not listed
+		if fi.IsDir() || isTemp(fp) || fi.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+
+		rp, err := filepath.Rel(l.basePath, fp)
+		if err != nil {
+			return err
+		}
+
+		rp = filepath.ToSlash(rp)
+		if strings.HasPrefix(rp, prefix) {
+			fis = append(fis, l.fileInfo(rp, fi))
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, xerrors.Errorf("Unable to list files: %w", err)
+	}
+
+	return fis, nil
+}
+
+// Exists returns true when a file is stored at the given path
+func (l *Local) Exists(path string) (bool, error) {
+	_, err := l.Stat(path)
+	if xerrors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// returns the absolute path, ErrInvalidPath is returned when the path is
+// not valid or would resolve outside of the base path
+func (l *Local) fullPath(path string) (string, error) {
+	p, err := CleanPath(path)
+	if err != nil {
+		return "", err
+	}
+
 	// append the given path to the base path
-	return filepath.Join(l.basePath, path)
+	fp := filepath.Join(l.basePath, filepath.FromSlash(p))
+
+	err = checkSymlinks(l.basePath, fp)
+	if err != nil {
+		return "", err
+	}
+
+	return fp, nil
+}
+
+// fileInfo converts the os file info for path
+func (l *Local) fileInfo(path string, fi os.FileInfo) FileInfo {
+	path = strings.TrimPrefix(filepath.ToSlash(path), "/")
+
+	return FileInfo{
+		Path:        path,
+		Size:        fi.Size(),
+		ModTime:     fi.ModTime(),
+		ContentType: contentType(path),
+	}
+}
+
+// pathError returns ErrNotFound when err is a not exists error, otherwise
+// err is wrapped with msg
+func (l *Local) pathError(msg string, err error) error {
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+
+	return xerrors.Errorf("%s: %w", msg, err)
+}
+
+// sniff detects the content type from the first 512 bytes of the file and
+// returns to the start of the file
+func sniff(r io.ReadSeeker) (string, error) {
+	buf := make([]byte, 512)
+
+	n, err := io.ReadFull(r, buf)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	_, err = r.Seek(0, io.SeekStart)
+	if err != nil {
+		return "", err
+	}
+
+	return http.DetectContentType(buf[:n]), nil
+}
+
+// createTemp creates a temporary file in the directory d, the directory is
+// created when it does not exist
+func createTemp(d string) (*os.File, error) {
+	// Delete removes empty directories so the directory is created again
+	// when it is removed before the file is created
+	for i := 0; ; i++ {
+		err := os.MkdirAll(d, os.ModePerm)
+		if err != nil {
+			return nil, xerrors.Errorf("Unable to create directory: %w", err)
+		}
+
+		f, err := ioutil.TempFile(d, tempPrefix)
+		if os.IsNotExist(err) && i < 3 {
+			continue
+		}
+
+		if err != nil {
+			return nil, xerrors.Errorf("Unable to create file: %w", err)
+		}
+
+		return f, nil
+	}
+}
+
+// isTemp returns true when the file at fp is a temporary file
+func isTemp(fp string) bool {
+	return strings.HasPrefix(filepath.Base(fp), tempPrefix)
+}
+
+// syncDir flushes the directory entries for d to disk
+func syncDir(d string) error {
+	f, err := os.Open(d)
+	if err != nil {
+		return xerrors.Errorf("Unable to open directory: %w", err)
+	}
+	defer f.Close()
+
+	err = f.Sync()
+	if err != nil {
+		return xerrors.Errorf("Unable to sync directory: %w", err)
+	}
+
+	return nil
+}
+
+// pathLocks serialises operations on the same path
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+// pathLock is the lock for a path, it is removed when no operations hold or
+// are waiting for it
+type pathLock struct {
+	sync.Mutex
+	refs int
+}
+
+func newPathLocks() *pathLocks {
+	return &pathLocks{locks: map[string]*pathLock{}}
+}
+
+// lock blocks until the lock for path is held and returns a function which
+// releases it
+func (p *pathLocks) lock(path string) func() {
+	p.mu.Lock()
+	pl, ok := p.locks[path]
+	if !ok {
+		pl = &pathLock{}
+		p.locks[path] = pl
+	}
+	pl.refs++
+	p.mu.Unlock()
+
+	pl.Lock()
+
+	return func() {
+		pl.Unlock()
+
+		p.mu.Lock()
+		pl.refs--
+		if pl.refs == 0 {
+			delete(p.locks, path)
+		}
+		p.mu.Unlock()
+	}
 }
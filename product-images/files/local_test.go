@@ -2,12 +2,17 @@ package files
 
 import (
 	"bytes"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/xerrors"
 )
 
 func setupLocal(t *testing.T) (*Local, string, func()) {
@@ -58,11 +63,213 @@ func TestGetsContentsAndWritesToWriter(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Read the file back
-	r, err := l.Get(savePath)
+	r, fi, err := l.Open(savePath)
 	assert.NoError(t, err)
 	defer r.Close()
 
+	assert.Equal(t, int64(len(fileContents)), fi.Size)
+	assert.Equal(t, "image/png", fi.ContentType)
+
 	// read the full contents of the reader
 	d, err := ioutil.ReadAll(r)
 	assert.Equal(t, fileContents, string(d))
 }
+
+func TestOpenMissingFileReturnsNotFound(t *testing.T) {
+	l, _, cleanup := setupLocal(t)
+	defer cleanup()
+
+	_, _, err := l.Open("/1/missing.png")
+	assert.True(t, xerrors.Is(err, ErrNotFound))
+
+	_, err = l.Stat("/1/missing.png")
+	assert.True(t, xerrors.Is(err, ErrNotFound))
+}
+
+func TestOpenDetectsContentTypeWithoutExtension(t *testing.T) {
+	l, _, cleanup := setupLocal(t)
+	defer cleanup()
+
+	err := l.Save("/1/test", bytes.NewBufferString("<html><body>Hello</body></html>"))
+	assert.NoError(t, err)
+
+	r, fi, err := l.Open("/1/test")
+	assert.NoError(t, err)
+	defer r.Close()
+
+	assert.Equal(t, "text/html; charset=utf-8", fi.ContentType)
+
+	// the file is read from the start after detecting the type
+	d, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "<html><body>Hello</body></html>", string(d))
+}
+
+func TestListReturnsFilesWithPrefix(t *testing.T) {
+	l, _, cleanup := setupLocal(t)
+	defer cleanup()
+
+	for _, p := range []string{"/1/a.png", "/1/b.jpg", "/2/a.png", "/10/a.png"} {
+		assert.NoError(t, l.Save(p, bytes.NewBufferString("Hello World")))
+	}
+
+	fis, err := l.List("1/")
+	assert.NoError(t, err)
+	assert.Len(t, fis, 2)
+	assert.Equal(t, "1/a.png", fis[0].Path)
+	assert.Equal(t, "1/b.jpg", fis[1].Path)
+	assert.Equal(t, "image/jpeg", fis[1].ContentType)
+
+	fis, err = l.List("")
+	assert.NoError(t, err)
+	assert.Len(t, fis, 4)
+}
+
+func TestListWalksOnlyPrefixDirectory(t *testing.T) {
+	l, _, cleanup := setupLocal(t)
+	defer cleanup()
+
+	for _, p := range []string{"/1/a.png", "/1/ab.png", "/1/b.png", "/2/a.png"} {
+		assert.NoError(t, l.Save(p, bytes.NewBufferString("Hello World")))
+	}
+
+	// a partial prefix lists the matching files in its directory
+	fis, err := l.List("1/a")
+	assert.NoError(t, err)
+	assert.Len(t, fis, 2)
+	assert.Equal(t, "1/a.png", fis[0].Path)
+	assert.Equal(t, "1/ab.png", fis[1].Path)
+
+	// a directory which does not exist is empty
+	fis, err = l.List("3/")
+	assert.NoError(t, err)
+	assert.Empty(t, fis)
+
+	fis, err = l.List("3/thumb/")
+	assert.NoError(t, err)
+	assert.Empty(t, fis)
+}
+
+func TestDeleteRemovesFile(t *testing.T) {
+	l, dir, cleanup := setupLocal(t)
+	defer cleanup()
+
+	assert.NoError(t, l.Save("/1/test.png", bytes.NewBufferString("Hello World")))
+
+	ok, err := l.Exists("/1/test.png")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	assert.NoError(t, l.Delete("/1/test.png"))
+
+	ok, err = l.Exists("/1/test.png")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	// the empty product directory is removed but not the base path
+	_, err = os.Stat(filepath.Join(dir, "1"))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(dir)
+	assert.NoError(t, err)
+
+	assert.True(t, xerrors.Is(l.Delete("/1/test.png"), ErrNotFound))
+}
+
+func TestSaveRejectsFilesLargerThanMaxSize(t *testing.T) {
+	l, _, cleanup := setupLocal(t)
+	defer cleanup()
+
+	err := l.Save("/1/test.png", bytes.NewReader(make([]byte, 10001)))
+	assert.True(t, xerrors.Is(err, ErrFileTooLarge))
+
+	// the partial file is removed
+	ok, err := l.Exists("/1/test.png")
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	assert.NoError(t, l.Save("/1/test.png", bytes.NewReader(make([]byte, 10000))))
+}
+
+// errorReader returns an error after the contents have been read
+type errorReader struct {
+	r io.Reader
+}
+
+func (e *errorReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err == io.EOF {
+		return n, xerrors.New("Connection reset")
+	}
+
+	return n, err
+}
+
+func TestFailedSaveKeepsExistingFile(t *testing.T) {
+	l, dir, cleanup := setupLocal(t)
+	defer cleanup()
+
+	assert.NoError(t, l.Save("/1/test.png", bytes.NewBufferString("Hello World")))
+
+	err := l.Save("/1/test.png", &errorReader{r: bytes.NewBufferString("Goodbye")})
+	assert.Error(t, err)
+
+	err = l.Save("/1/test.png", bytes.NewReader(make([]byte, 10001)))
+	assert.True(t, xerrors.Is(err, ErrFileTooLarge))
+
+	d, err := ioutil.ReadFile(filepath.Join(dir, "1", "test.png"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello World", string(d))
+
+	// the temporary files are removed
+	fs, err := ioutil.ReadDir(filepath.Join(dir, "1"))
+	assert.NoError(t, err)
+	assert.Len(t, fs, 1)
+}
+
+func TestConcurrentSavesWriteCompleteFiles(t *testing.T) {
+	l, dir, cleanup := setupLocal(t)
+	defer cleanup()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, l.Save("/1/test.png", strings.NewReader(strings.Repeat(fmt.Sprint(i%10), 1000))))
+		}(i)
+	}
+
+	wg.Wait()
+
+	// the file contains the contents of a single save
+	d, err := ioutil.ReadFile(filepath.Join(dir, "1", "test.png"))
+	assert.NoError(t, err)
+	assert.Len(t, d, 1000)
+	assert.Equal(t, strings.Repeat(string(d[0]), 1000), string(d))
+	assert.Empty(t, l.locks.locks)
+}
+
+func TestSweepRemovesTemporaryFiles(t *testing.T) {
+	l, dir, cleanup := setupLocal(t)
+	defer cleanup()
+
+	assert.NoError(t, l.Save("/1/test.png", bytes.NewBufferString("Hello World")))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "1", tempPrefix+"123"), []byte("Hello"), 0644))
+
+	// temporary files are not listed
+	fis, err := l.List("")
+	assert.NoError(t, err)
+	assert.Len(t, fis, 1)
+
+	n, err := l.Sweep()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	_, err = os.Stat(filepath.Join(dir, "1", tempPrefix+"123"))
+	assert.True(t, os.IsNotExist(err))
+
+	ok, err := l.Exists("/1/test.png")
+	assert.NoError(t, err)
+	assert.True(t, ok)
+}
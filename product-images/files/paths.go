@@ -0,0 +1,93 @@
+package files
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+	"golang.org/x/xerrors"
+)
+
+// maxPathLength is the longest path accepted by CleanPath
+const maxPathLength = 1024
+
+// ErrInvalidPath is returned when a path could escape the root of the store
+var ErrInvalidPath = xerrors.New("Invalid path")
+
+// CleanPath checks that p is a relative path within the store and returns
+// it in a normal form, / separated with Unicode NFC normalisation, a
+// leading / is removed
+// paths containing . or .. elements, empty elements, backslashes or control
+// characters are rejected rather than cleaned so that two different paths
+// never refer to the same file
+func CleanPath(p string) (string, error) {
+	p = norm.NFC.String(strings.TrimPrefix(p, "/"))
+
+	if p == "" || len(p) > maxPathLength {
+		return "", ErrInvalidPath
+	}
+
+	for _, r := range p {
+		if r == '\\' || r == unicode.ReplacementChar || unicode.IsControl(r) {
+			return "", ErrInvalidPath
+		}
+	}
+
+	for _, e := range strings.Split(p, "/") {
+		if e == "" || e == "." || e == ".." {
+			return "", ErrInvalidPath
+		}
+	}
+
+	return p, nil
+}
+
+// within returns true when the file path fp is base or inside base
+func within(base, fp string) bool {
+	rel, err := filepath.Rel(base, fp)
+	if err != nil {
+		return false
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
+}
+
+// checkSymlinks returns ErrInvalidPath when the part of fp which exists
+// resolves to a location outside of base by following symlinks
+func checkSymlinks(base, fp string) error {
+	rb, err := filepath.EvalSymlinks(base)
+	if os.IsNotExist(err) {
+		// nothing has been saved yet
+		return nil
+	}
+
+	if err != nil {
+		return xerrors.Errorf("Unable to resolve base path: %w", err)
+	}
+
+	// resolve the deepest directory or file in the path which exists
+	for p := fp; within(base, p); p = filepath.Dir(p) {
+		rp, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			if !within(rb, rp) {
+				return ErrInvalidPath
+			}
+
+			return nil
+		}
+
+		if !os.IsNotExist(err) {
+			return xerrors.Errorf("Unable to resolve path: %w", err)
+		}
+
+		// a symlink whose target does not exist could be created outside
+		// the base path
+		if _, err := os.Lstat(p); err == nil {
+			return ErrInvalidPath
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package files
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestCleanPath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"1/test.png", "1/test.png"},
+		{"/1/test.png", "1/test.png"},
+		// decomposed é is normalised to the composed form
+		{"1/cafe\u0301.png", "1/caf\u00e9.png"},
+		{"", ""},
+		{"/", ""},
+		{"../test.png", ""},
+		{"1/../../test.png", ""},
+		{"1/./test.png", ""},
+		{"1//test.png", ""},
+		{"1/test.png/", ""},
+		{"//etc/passwd", ""},
+		{"1\\..\\test.png", ""},
+		{"1/test\x00.png", ""},
+		{"1/test\n.png", ""},
+		{"1/\xff.png", ""},
+		{strings.Repeat("a", maxPathLength+1), ""},
+	}
+
+	for _, tc := range tests {
+		p, err := CleanPath(tc.path)
+		if tc.want == "" {
+			assert.True(t, xerrors.Is(err, ErrInvalidPath), tc.path)
+			continue
+		}
+
+		assert.NoError(t, err, tc.path)
+		assert.Equal(t, tc.want, p, tc.path)
+	}
+}
+
+func TestLocalRejectsSymlinksOutsideBasePath(t *testing.T) {
+	outside := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(outside, "secret.png"), []byte("secret"), 0644))
+
+	l, dir, cleanup := setupLocal(t)
+	defer cleanup()
+
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "2"), 0755))
+	require.NoError(t, os.Symlink(outside, filepath.Join(dir, "1")))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "secret.png"), filepath.Join(dir, "2", "link.png")))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "missing"), filepath.Join(dir, "3")))
+
+	_, _, err := l.Open("1/secret.png")
+	assert.True(t, xerrors.Is(err, ErrInvalidPath))
+
+	_, _, err = l.Open("2/link.png")
+	assert.True(t, xerrors.Is(err, ErrInvalidPath))
+
+	err = l.Save("1/new.png", bytes.NewBufferString("Hello"))
+	assert.True(t, xerrors.Is(err, ErrInvalidPath))
+
+	err = l.Save("3/new.png", bytes.NewBufferString("Hello"))
+	assert.True(t, xerrors.Is(err, ErrInvalidPath))
+
+	assert.True(t, xerrors.Is(l.Delete("1/secret.png"), ErrInvalidPath))
+
+	_, err = os.Stat(filepath.Join(outside, "secret.png"))
+	assert.NoError(t, err)
+	_, err = os.Stat(filepath.Join(outside, "new.png"))
+	assert.True(t, os.IsNotExist(err))
+
+	// symlinks are not listed
+	fis, err := l.List("")
+	assert.NoError(t, err)
+	assert.Empty(t, fis)
+}
+
+func TestLocalAllowsSymlinkedBasePath(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "store"), 0755))
+	require.NoError(t, os.Symlink(filepath.Join(dir, "store"), filepath.Join(dir, "link")))
+
+	l, err := NewLocal(filepath.Join(dir, "link"), 1024)
+	require.NoError(t, err)
+
+	assert.NoError(t, l.Save("1/test.png", bytes.NewBufferString("Hello")))
+
+	_, err = os.Stat(filepath.Join(dir, "store", "1", "test.png"))
+	assert.NoError(t, err)
+}
+
+func FuzzLocalFullPath(f *testing.F) {
+	for _, s := range []string{"1/test.png", "../x", "/1/../../x", "1/é.png", "a/./b", "..\\x", "1//x", "..00"} {
+		f.Add(s)
+	}
+
+	l, err := NewLocal(f.TempDir(), 1024)
+	require.NoError(f, err)
+
+	f.Fuzz(func(t *testing.T, p string) {
+		fp, err := l.fullPath(p)
+		if err != nil {
+			assert.True(t, xerrors.Is(err, ErrInvalidPath), p)
+			return
+		}
+
+		// valid paths are always inside the base path
+		assert.True(t, strings.HasPrefix(fp, l.basePath+string(filepath.Separator)), fp)
+
+		rel, err := filepath.Rel(l.basePath, fp)
+		assert.NoError(t, err)
+		assert.False(t, rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)), fp)
+
+		// cleaning is idempotent
+		cp, err := CleanPath(p)
+		assert.NoError(t, err)
+		cp2, err := CleanPath(cp)
+		assert.NoError(t, err)
+		assert.Equal(t, cp, cp2)
+	})
+}
@@ -0,0 +1,622 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// minPartSize is the smallest part S3 accepts for all but the last part of
+// a multipart upload
+const minPartSize = 5 * 1024 * 1024
+
+// defaultS3Timeout is the max time for a request when S3Options.Timeout is
+// not set
+const defaultS3Timeout = 30 * time.Second
+
+// S3Options configure the S3 storage backend
+type S3Options struct {
+	// Endpoint is the URL of the S3 compatible service, i.e.
+	// https://s3.eu-west-1.amazonaws.com or http://localhost:9000 for MinIO
+	Endpoint string
+	// Bucket files are stored in, the bucket must exist
+	Bucket string
+	// Region used to sign requests, defaults to us-east-1
+	Region string
+
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// PartSize is the size of each part when uploading, files larger than
+	// PartSize are sent using a multipart upload, defaults to 5MB
+	PartSize int
+
+	// Timeout is the max time for each request, reading the contents of a
+	// file is only limited by the time to receive the response headers as
+	// large files are streamed to slow clients, defaults to 30s
+	Timeout time.Duration
+
+	// Client is the HTTP client used for requests, defaults to a client
+	// which waits at most Timeout for the response headers
+	Client *http.Client
+}
+
+// S3 is an implementation of the Storage interface which stores files in an
+// S3 compatible object store, requests are signed with AWS Signature Version
+// 4 and use path style URLs, i.e. http://localhost:9000/bucket/1/test.png
+type S3 struct {
+	endpoint *url.URL
+	bucket   string
+	partSize int
+	timeout  time.Duration
+	client   *http.Client
+	signer   *signer
+	now      func() time.Time
+}
+
+// NewS3 creates a new S3 storage backend
+func NewS3(o S3Options) (*S3, error) {
+	u, err := url.Parse(o.Endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, xerrors.Errorf("Invalid S3 endpoint %q", o.Endpoint)
+	}
+
+	if o.Bucket == "" {
+		return nil, xerrors.New("S3 bucket must be set")
+	}
+
+	if o.Region == "" {
+		o.Region = "us-east-1"
+	}
+
+	if o.PartSize == 0 {
+		o.PartSize = minPartSize
+	}
+
+	if o.PartSize < minPartSize {
+		return nil, xerrors.Errorf("S3 part size must be at least %d bytes", minPartSize)
+	}
+
+	if o.Timeout == 0 {
+		o.Timeout = defaultS3Timeout
+	}
+
+	if o.Client == nil {
+		t := http.DefaultTransport.(*http.Transport).Clone()
+		t.ResponseHeaderTimeout = o.Timeout
+
+		o.Client = &http.Client{Transport: t}
+	}
+
+	return &S3{
+		endpoint: u,
+		bucket:   o.Bucket,
+		partSize: o.PartSize,
+		timeout:  o.Timeout,
+		client:   o.Client,
+		signer: &signer{
+			accessKey: o.AccessKeyID,
+			secretKey: o.SecretAccessKey,
+			region:    o.Region,
+			service:   "s3",
+		},
+		now: time.Now,
+	}, nil
+}
+
+// Save the contents of the reader to the given path, files larger than the
+// part size are uploaded in parts so only one part is held in memory
+func (s *S3) Save(path string, contents io.Reader) error {
+	buf, err := readPart(contents, s.partSize)
+	if err == io.EOF {
+		// the file fits in a single request
+		return s.put(path, buf)
+	}
+
+	if err != nil {
+		return xerrors.Errorf("Unable to read file: %w", err)
+	}
+
+	return s.multipartUpload(path, buf, contents)
+}
+
+// readPart reads up to size bytes from r, the buffer grows as data is read
+// so that small files do not allocate a whole part, io.EOF is returned when
+// r ends before size bytes are read
+func readPart(r io.Reader, size int) ([]byte, error) {
+	buf := make([]byte, 0, 512)
+
+	for len(buf) < size {
+		if len(buf) == cap(buf) {
+			c := 2 * cap(buf)
+			if c > size {
+				c = size
+			}
+
+			nb := make([]byte, len(buf), c)
+			copy(nb, buf)
+			buf = nb
+		}
+
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+
+		if err != nil {
+			return buf, err
+		}
+	}
+
+	return buf, nil
+}
+
+// put uploads the file in a single request
+func (s *S3) put(path string, d []byte) error {
+	h := http.Header{}
+	h.Set("Content-Type", contentType(path))
+
+	resp, err := s.do(context.Background(), http.MethodPut, path, nil, h, d)
+	if err != nil {
+		return xerrors.Errorf("Unable to save file: %w", err)
+	}
+
+	resp.Body.Close()
+
+	return nil
+}
+
+type completedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// multipartUpload uploads first followed by the remaining contents in parts,
+// the upload is aborted on error so that S3 does not keep the parts
+func (s *S3) multipartUpload(path string, first []byte, contents io.Reader) error {
+	h := http.Header{}
+	h.Set("Content-Type", contentType(path))
+
+	resp, err := s.do(context.Background(), http.MethodPost, path, url.Values{"uploads": {""}}, h, nil)
+	if err != nil {
+		return xerrors.Errorf("Unable to start multipart upload: %w", err)
+	}
+
+	init := struct {
+		UploadID string `xml:"UploadId"`
+	}{}
+
+	err = decodeXML(resp, &init)
+	if err != nil {
+		return xerrors.Errorf("Unable to start multipart upload: %w", err)
+	}
+
+	parts, err := s.uploadParts(path, init.UploadID, first, contents)
+	if err != nil {
+		s.abortUpload(path, init.UploadID)
+		return err
+	}
+
+	complete := struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts}
+
+	d, err := xml.Marshal(complete)
+	if err != nil {
+		s.abortUpload(path, init.UploadID)
+		return xerrors.Errorf("Unable to complete multipart upload: %w", err)
+	}
+
+	resp, err = s.do(context.Background(), http.MethodPost, path, url.Values{"uploadId": {init.UploadID}}, nil, d)
+	if err != nil {
+		s.abortUpload(path, init.UploadID)
+		return xerrors.Errorf("Unable to complete multipart upload: %w", err)
+	}
+
+	// S3 can return an error in the body of a 200 response when completing
+	// an upload
+	result := struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}{}
+
+	err = decodeXML(resp, &result)
+	if err != nil {
+		return xerrors.Errorf("Unable to complete multipart upload: %w", err)
+	}
+
+	if result.XMLName.Local == "Error" {
+		return xerrors.Errorf("Unable to complete multipart upload: %s %s", result.Code, result.Message)
+	}
+
+	return nil
+}
+
+// uploadParts sends first and then reads and sends the rest of contents in
+// parts, the buffer for first is reused for each part
+func (s *S3) uploadParts(path, uploadID string, buf []byte, contents io.Reader) ([]completedPart, error) {
+	parts := []completedPart{}
+	part := buf
+
+	for n := 1; len(part) > 0; n++ {
+		q := url.Values{
+			"partNumber": {strconv.Itoa(n)},
+			"uploadId":   {uploadID},
+		}
+
+		resp, err := s.do(context.Background(), http.MethodPut, path, q, nil, part)
+		if err != nil {
+			return nil, xerrors.Errorf("Unable to upload part %d: %w", n, err)
+		}
+
+		resp.Body.Close()
+		parts = append(parts, completedPart{PartNumber: n, ETag: resp.Header.Get("ETag")})
+
+		// read the next part
+		size, err := io.ReadFull(contents, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, xerrors.Errorf("Unable to read file: %w", err)
+		}
+
+		part = buf[:size]
+	}
+
+	return parts, nil
+}
+
+// abortUpload removes the parts of a failed upload
+func (s *S3) abortUpload(path, uploadID string) {
+	resp, err := s.do(context.Background(), http.MethodDelete, path, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err == nil {
+		resp.Body.Close()
+	}
+}
+
+// Open the file at the given path for reading, the contents are streamed
+// from S3 as the file is read
+// the calling function is responsible for closing the file
+func (s *S3) Open(path string) (File, FileInfo, error) {
+	fi, err := s.Stat(path)
+	if err != nil {
+		return nil, FileInfo{}, err
+	}
+
+	return &s3File{s: s, path: path, size: fi.Size}, fi, nil
+}
+
+// Stat returns the details of the file at the given path
+func (s *S3) Stat(path string) (FileInfo, error) {
+	resp, err := s.do(context.Background(), http.MethodHead, path, nil, nil, nil)
+	if err != nil {
+		return FileInfo{}, s.pathError("Unable to get file info", err)
+	}
+	resp.Body.Close()
+
+	mt, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+
+	ct := resp.Header.Get("Content-Type")
+	if ct == "" {
+		ct = contentType(path)
+	}
+
+	return FileInfo{
+		Path:        s.key(path),
+		Size:        resp.ContentLength,
+		ModTime:     mt,
+		ContentType: ct,
+	}, nil
+}
+
+// Delete the file at the given path
+func (s *S3) Delete(path string) error {
+	// S3 does not return an error when deleting a missing object
+	_, err := s.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do(context.Background(), http.MethodDelete, path, nil, nil, nil)
+	if err != nil {
+		return xerrors.Errorf("Unable to delete file: %w", err)
+	}
+	resp.Body.Close()
+
+	return nil
+}
+
+// List returns the files whose path starts with prefix, i.e. "1/" returns
+// the files for product 1, files are sorted by path
+func (s *S3) List(prefix string) ([]FileInfo, error) {
+	fis := []FileInfo{}
+	token := ""
+
+	for {
+		q := url.Values{
+			"list-type": {"2"},
+			"prefix":    {strings.TrimPrefix(prefix, "/")},
+		}
+
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(context.Background(), http.MethodGet, "", q, nil, nil)
+		if err != nil {
+			return nil, xerrors.Errorf("Unable to list files: %w", err)
+		}
+
+		res := struct {
+			Contents []struct {
+				Key          string
+				LastModified time.Time
+				Size         int64
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}{}
+
+		err = decodeXML(resp, &res)
+		if err != nil {
+			return nil, xerrors.Errorf("Unable to list files: %w", err)
+		}
+
+		for _, c := range res.Contents {
+			fis = append(fis, FileInfo{
+				Path:        c.Key,
+				Size:        c.Size,
+				ModTime:     c.LastModified,
+				ContentType: contentType(c.Key),
+			})
+		}
+
+		if !res.IsTruncated {
+			return fis, nil
+		}
+
+		token = res.NextContinuationToken
+	}
+}
+
+// Exists returns true when a file is stored at the given path
+func (s *S3) Exists(path string) (bool, error) {
+	_, err := s.Stat(path)
+	if xerrors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Check returns an error when the bucket can not be reached with the
+// configured credentials, it can be used as a health check
+func (s *S3) Check(ctx context.Context) error {
+	resp, err := s.do(ctx, http.MethodHead, "", nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// s3Error is returned when S3 responds with an error status
+type s3Error struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("S3 returned status %d", e.Status)
+	}
+
+	return fmt.Sprintf("S3 returned status %d: %s %s", e.Status, e.Code, e.Message)
+}
+
+// pathError returns ErrNotFound when S3 returned not found, otherwise err is
+// wrapped with msg
+func (s *S3) pathError(msg string, err error) error {
+	se := &s3Error{}
+	if xerrors.As(err, &se) && se.Status == http.StatusNotFound {
+		return ErrNotFound
+	}
+
+	return xerrors.Errorf("%s: %w", msg, err)
+}
+
+// do sends a signed request for the object at path which must complete
+// within the timeout, including reading the body, an error is returned when
+// the status is not 2xx
+func (s *S3) do(ctx context.Context, method, path string, q url.Values, h http.Header, body []byte) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+
+	req, err := s.newRequest(ctx, method, path, q, h, body)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp, err := s.send(req, body)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+
+	return resp, nil
+}
+
+// cancelBody cancels the context of the request when the body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+
+	return err
+}
+
+// newRequest creates a request for the object at path, an empty path is the
+// bucket
+func (s *S3) newRequest(ctx context.Context, method, path string, q url.Values, h http.Header, body []byte) (*http.Request, error) {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket
+	if path != "" {
+		u.Path += "/" + s.key(path)
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = strings.Replace(q.Encode(), "+", "%20", -1)
+
+	var br io.Reader
+	if body != nil {
+		br = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), br)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range h {
+		req.Header[k] = v
+	}
+
+	return req, nil
+}
+
+// send signs and sends the request
+func (s *S3) send(req *http.Request, body []byte) (*http.Response, error) {
+	ph := emptyPayloadHash
+	if len(body) > 0 {
+		ph = hexSHA256(body)
+	}
+
+	s.signer.sign(req, ph, s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+
+		se := &s3Error{Status: resp.StatusCode}
+		d, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		xml.Unmarshal(d, se)
+
+		return nil, se
+	}
+
+	return resp, nil
+}
+
+// key returns the object key for a path
+func (s *S3) key(path string) string {
+	return strings.TrimPrefix(path, "/")
+}
+
+// decodeXML decodes and closes the response body
+func decodeXML(resp *http.Response, v interface{}) error {
+	defer resp.Body.Close()
+
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+// s3File streams the contents of an object, a request is made when the file
+// is first read and again after seeking
+type s3File struct {
+	s      *S3
+	path   string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+// Read the file from the current offset
+func (f *s3File) Read(p []byte) (int, error) {
+	if f.offset >= f.size {
+		return 0, io.EOF
+	}
+
+	if f.body == nil {
+		h := http.Header{}
+		h.Set("Range", fmt.Sprintf("bytes=%d-", f.offset))
+
+		// the contents are streamed without a timeout, the client limits the
+		// time to receive the response headers
+		req, err := f.s.newRequest(context.Background(), http.MethodGet, f.path, nil, h, nil)
+		if err != nil {
+			return 0, xerrors.Errorf("Unable to read file: %w", err)
+		}
+
+		resp, err := f.s.send(req, nil)
+		if err != nil {
+			return 0, xerrors.Errorf("Unable to read file: %w", err)
+		}
+
+		f.body = resp.Body
+	}
+
+	n, err := f.body.Read(p)
+	f.offset += int64(n)
+
+	return n, err
+}
+
+// Seek sets the offset for the next Read, the current response is closed
+// when the offset changes
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size
+	default:
+		return 0, xerrors.New("Invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, xerrors.New("Negative position")
+	}
+
+	if offset != f.offset && f.body != nil {
+		f.body.Close()
+		f.body = nil
+	}
+
+	f.offset = offset
+
+	return offset, nil
+}
+
+// Close the current response
+func (f *s3File) Close() error {
+	if f.body == nil {
+		return nil
+	}
+
+	err := f.body.Close()
+	f.body = nil
+
+	return err
+}
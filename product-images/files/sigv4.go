@@ -0,0 +1,183 @@
+package files
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	amzDateFormat = "20060102T150405Z"
+	amzAlgorithm  = "AWS4-HMAC-SHA256"
+
+	// emptyPayloadHash is the SHA-256 of an empty request body
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+// signer signs requests using AWS Signature Version 4
+// https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+type signer struct {
+	accessKey string
+	secretKey string
+	region    string
+	service   string
+}
+
+// sign adds the authorization headers to r, payloadHash is the hex encoded
+// SHA-256 of the request body, all headers set on r before signing and the
+// host are included in the signature
+func (s *signer) sign(r *http.Request, payloadHash string, t time.Time) {
+	t = t.UTC()
+
+	r.Header.Set("X-Amz-Date", t.Format(amzDateFormat))
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := []string{"host"}
+	for k := range r.Header {
+		lk := strings.ToLower(k)
+		if lk == "authorization" {
+			continue
+		}
+
+		headers = append(headers, lk)
+	}
+	sort.Strings(headers)
+
+	signature := s.signature(r, headers, payloadHash, t)
+
+	r.Header.Set("Authorization", fmt.Sprintf(
+		"%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		amzAlgorithm,
+		s.accessKey,
+		s.scope(t),
+		strings.Join(headers, ";"),
+		signature,
+	))
+}
+
+// signature calculates the signature for r using the named headers
+func (s *signer) signature(r *http.Request, headers []string, payloadHash string, t time.Time) string {
+	cr := strings.Join([]string{
+		r.Method,
+		canonicalURI(r.URL),
+		canonicalQuery(r.URL.Query()),
+		canonicalHeaders(r, headers),
+		strings.Join(headers, ";"),
+		payloadHash,
+	}, "\n")
+
+	sts := strings.Join([]string{
+		amzAlgorithm,
+		t.Format(amzDateFormat),
+		s.scope(t),
+		hexSHA256([]byte(cr)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), t.Format("20060102"))
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, s.service)
+	key = hmacSHA256(key, "aws4_request")
+
+	return hex.EncodeToString(hmacSHA256(key, sts))
+}
+
+// scope is the credential scope for requests signed at t
+func (s *signer) scope(t time.Time) string {
+	return fmt.Sprintf("%s/%s/%s/aws4_request", t.Format("20060102"), s.region, s.service)
+}
+
+// canonicalURI returns the URI encoded path, S3 paths are only encoded once
+func canonicalURI(u *url.URL) string {
+	p := u.Path
+	if p == "" {
+		return "/"
+	}
+
+	return uriEncode(p, false)
+}
+
+// canonicalQuery returns the query sorted by key with encoded keys and values
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := []string{}
+	for _, k := range keys {
+		vs := append([]string{}, q[k]...)
+		sort.Strings(vs)
+
+		for _, v := range vs {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// canonicalHeaders returns the lower case header names and trimmed values,
+// one per line
+func canonicalHeaders(r *http.Request, headers []string) string {
+	sb := strings.Builder{}
+
+	for _, h := range headers {
+		v := ""
+		if h == "host" {
+			v = r.Host
+			if v == "" {
+				v = r.URL.Host
+			}
+		} else {
+			v = strings.Join(r.Header[http.CanonicalHeaderKey(h)], ",")
+		}
+
+		sb.WriteString(h)
+		sb.WriteString(":")
+		sb.WriteString(strings.Join(strings.Fields(v), " "))
+		sb.WriteString("\n")
+	}
+
+	return sb.String()
+}
+
+// uriEncode encodes every byte except the unreserved characters, / is only
+// encoded when encodeSlash is true
+func uriEncode(s string, encodeSlash bool) string {
+	sb := strings.Builder{}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			sb.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			sb.WriteByte(c)
+		default:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+
+	return sb.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+func hexSHA256(d []byte) string {
+	h := sha256.Sum256(d)
+	return hex.EncodeToString(h[:])
+}
@@ -1,9 +1,71 @@
 package files
 
-import "io"
+import (
+	"io"
+	"mime"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/xerrors"
+)
+
+// ErrNotFound is returned when a file does not exist in the store
+var ErrNotFound = xerrors.New("File not found")
+
+// ErrFileTooLarge is returned when a file is larger than the max size for
+// the store
+var ErrFileTooLarge = xerrors.New("File too large")
 
 // Storage defines the behavior for file operations
 // Implementations may be of the time local disk, or cloud storage, etc
+// paths are relative to the root of the store and use / as the separator
 type Storage interface {
+	// Save the contents of the reader to the given path, an existing
+	// file is replaced
 	Save(path string, file io.Reader) error
+
+	// Open the file at path for reading, the caller is responsible for
+	// closing the file
+	Open(path string) (File, FileInfo, error)
+
+	// Stat returns the details of the file at path
+	Stat(path string) (FileInfo, error)
+
+	// Delete the file at path
+	Delete(path string) error
+
+	// List returns the files whose path starts with prefix
+	List(prefix string) ([]FileInfo, error)
+
+	// Exists returns true when a file is stored at path
+	Exists(path string) (bool, error)
+}
+
+// File is a stored file opened for reading, files are seekable so that
+// handlers can serve partial content
+type File interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// FileInfo describes a stored file
+type FileInfo struct {
+	Path        string
+	Size        int64
+	ModTime     time.Time
+	ContentType string
+
+	// Hash is the hex encoded SHA-256 hash of the contents, it is only set
+	// by stores which address files by their contents
+	Hash string
+}
+
+// contentType returns the MIME type for a file based on its extension
+func contentType(path string) string {
+	ct := mime.TypeByExtension(filepath.Ext(path))
+	if ct == "" {
+		return "application/octet-stream"
+	}
+
+	return ct
 }
@@ -4,11 +4,20 @@ go 1.13
 
 require (
 	github.com/PacktPublishing/Building-Microservices-with-Go-Second-Edition/product-images v0.0.0-20200215163039-51c246241383
+	github.com/andybalholm/brotli v1.1.1 // indirect
 	github.com/gorilla/handlers v1.4.2
 	github.com/gorilla/mux v1.7.3
-	github.com/hashicorp/go-hclog v0.11.0
+	github.com/hashicorp/go-hclog v0.12.1
+	github.com/nicholasjackson/building-microservices-youtube/shared v0.0.0
 	github.com/nicholasjackson/env v0.6.0
+	github.com/prometheus/client_golang v1.5.1
 	github.com/prometheus/common v0.9.1
-	github.com/stretchr/testify v1.3.0
+	github.com/stretchr/testify v1.8.2
+	go.opentelemetry.io/otel v1.14.0
+	golang.org/x/image v0.18.0
+	golang.org/x/sync v0.10.0
+	golang.org/x/text v0.16.0
 	golang.org/x/xerrors v0.0.0-20191204190536-9bdfabe68543
 )
+
+replace github.com/nicholasjackson/building-microservices-youtube/shared => ../shared
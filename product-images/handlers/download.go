@@ -0,0 +1,45 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/files"
+)
+
+// serveContent writes the file described by fi, the response includes the
+// ETag, Last-Modified and Cache-Control headers so that clients can cache
+// images, http.ServeContent handles conditional requests, If-None-Match,
+// If-Modified-Since, If-Match and If-Unmodified-Since, and Range requests
+// including If-Range, cc is the Cache-Control header, empty omits it
+func (f *Files) serveContent(rw http.ResponseWriter, r *http.Request, name string, fi files.FileInfo, content io.ReadSeeker, cc string) {
+	rw.Header().Set("Content-Type", fi.ContentType)
+	rw.Header().Set("ETag", etag(fi))
+
+	if cc != "" {
+		rw.Header().Set("Cache-Control", cc)
+	}
+
+	http.ServeContent(rw, r, name, fi.ModTime, content)
+}
+
+// etag returns a strong ETag from the hash of the contents when the store
+// provides one, otherwise a weak ETag from the size and modification time
+// weak ETags are not used for If-Range so a range request for a file which
+// may have changed returns the full file
+func etag(fi files.FileInfo) string {
+	if fi.Hash != "" {
+		return `"` + fi.Hash + `"`
+	}
+
+	return `W/"` + strconv.FormatInt(fi.Size, 16) + "-" + strconv.FormatInt(fi.ModTime.UnixNano(), 16) + `"`
+}
+
+// hashBytes returns the hex encoded SHA-256 hash of d
+func hashBytes(d []byte) string {
+	h := sha256.Sum256(d)
+	return hex.EncodeToString(h[:])
+}
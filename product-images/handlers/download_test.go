@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/files"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/images"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/compress"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupDownload(t *testing.T) http.Handler {
+	l, err := files.NewLocal(t.TempDir(), 10000)
+	require.NoError(t, err)
+
+	s := files.NewContentAddressed(l)
+	require.NoError(t, s.Save("1/test.png", bytes.NewBufferString("Hello World")))
+
+	fh := NewFiles(s, nil, images.NewResizer(100, 100, nil), nil, 1024, "public, max-age=60", hclog.NewNullLogger())
+	cm, err := compress.New(compress.DefaultEncodings, 0, compress.DefaultTypes)
+	require.NoError(t, err)
+
+	return cm.MiddlewareCompress(newRouter(fh))
+}
+
+func TestDownloadSetsCacheControl(t *testing.T) {
+	h := setupDownload(t)
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images/1/test.png", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "public, max-age=60", rr.Header().Get("Cache-Control"))
+
+	// errors are not cached
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images/1/missing.png", nil))
+
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Empty(t, rr.Header().Get("Cache-Control"))
+}
+
+func TestDownloadRange(t *testing.T) {
+	h := setupDownload(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/images/1/test.png", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("Range", "bytes=6-")
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusPartialContent, rr.Code)
+	assert.Equal(t, "bytes 6-10/11", rr.Header().Get("Content-Range"))
+	assert.Equal(t, "5", rr.Header().Get("Content-Length"))
+	assert.Empty(t, rr.Header().Get("Content-Encoding"))
+	assert.Equal(t, "World", rr.Body.String())
+
+	// the range is only returned when the ETag matches
+	etag := `"a591a6d40bf420404a011733cfb7b190d62c65bf0bcda32b57b277d9ad9f146e"`
+
+	req.Header.Set("If-Range", etag)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusPartialContent, rr.Code)
+
+	req.Header.Set("If-Range", `"changed"`)
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "Hello World", rr.Body.String())
+
+	// unsatisfiable ranges
+	req = httptest.NewRequest(http.MethodGet, "/images/1/test.png", nil)
+	req.Header.Set("Range", "bytes=20-")
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, rr.Code)
+}
+
+func TestDownloadDoesNotGzipImages(t *testing.T) {
+	h := setupDownload(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/images/1/test.png", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Empty(t, rr.Header().Get("Content-Encoding"))
+	assert.Equal(t, "11", rr.Header().Get("Content-Length"))
+	assert.Equal(t, "bytes", rr.Header().Get("Accept-Ranges"))
+	assert.Equal(t, "Hello World", rr.Body.String())
+}
+
+func TestListImagesIsCompressed(t *testing.T) {
+	h := setupDownload(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/images/1", nil)
+	req.Header.Set("Accept-Encoding", "deflate;q=0.5, gzip")
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "gzip", rr.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", rr.Header().Get("Vary"))
+	assert.Empty(t, rr.Header().Get("Content-Length"))
+
+	gr, err := gzip.NewReader(rr.Body)
+	require.NoError(t, err)
+
+	d, err := ioutil.ReadAll(gr)
+	require.NoError(t, err)
+	assert.Equal(t, "[]\n", string(d))
+
+	// gzip;q=0 refuses gzip
+	req.Header.Set("Accept-Encoding", "gzip;q=0")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	assert.Empty(t, rr.Header().Get("Content-Encoding"))
+}
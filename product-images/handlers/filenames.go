@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/text/unicode/norm"
+	"golang.org/x/xerrors"
+)
+
+// maxFilenameLength is the longest filename which can be uploaded
+const maxFilenameLength = 255
+
+// allowedExtensions are the extensions of files which can be uploaded
+var allowedExtensions = map[string]bool{".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true}
+
+// errInvalidFilename is returned when a filename sent by a client is not
+// valid
+var errInvalidFilename = xerrors.New("Invalid filename, expected a name containing letters, numbers, - or _ and a png, jpg, jpeg, gif or webp extension")
+
+// cleanFilename normalises a filename sent by a client to Unicode NFC and
+// lower case so that names which look the same refer to the same file
+// the filename must be a single path element with an allowed extension
+func cleanFilename(fn string) (string, error) {
+	fn = strings.ToLower(norm.NFC.String(fn))
+
+	if len(fn) > maxFilenameLength {
+		return "", errInvalidFilename
+	}
+
+	ext := path.Ext(fn)
+	name := strings.TrimSuffix(fn, ext)
+
+	if name == "" || !allowedExtensions[ext] {
+		return "", errInvalidFilename
+	}
+
+	for _, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' {
+			return "", errInvalidFilename
+		}
+	}
+
+	return fn, nil
+}
+
+// cleanID returns the product id in its canonical form, i.e. 01 is 1
+func cleanID(id string) (string, error) {
+	i, err := strconv.Atoi(id)
+	if err != nil || i < 0 {
+		return "", xerrors.New("Invalid id, expected a positive integer")
+	}
+
+	return strconv.Itoa(i), nil
+}
+
+// fileVars returns the cleaned product id and filename from the request
+// path, when they are not valid a 400 response is written and ok is false
+func fileVars(rw http.ResponseWriter, r *http.Request) (id, fn string, ok bool) {
+	vars := mux.Vars(r)
+
+	id, err := cleanID(vars["id"])
+	if err == nil {
+		fn, err = cleanFilename(vars["filename"])
+	}
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return "", "", false
+	}
+
+	return id, fn, true
+}
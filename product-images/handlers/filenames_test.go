@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/files"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/images"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanFilename(t *testing.T) {
+	tests := []struct {
+		filename string
+		want     string
+	}{
+		{"test.png", "test.png"},
+		{"Test.PNG", "test.png"},
+		{"my-photo_1.jpeg", "my-photo_1.jpeg"},
+		{"café.webp", "café.webp"},
+		{"", ""},
+		{".png", ""},
+		{"test", ""},
+		{"test.exe", ""},
+		{"test.png.exe", ""},
+		{"test.exe.png", ""},
+		{"../test.png", ""},
+		{"a/test.png", ""},
+		{"a\\test.png", ""},
+		{"test\x00.png", ""},
+		{"te st.png", ""},
+		{strings.Repeat("a", 256) + ".png", ""},
+	}
+
+	for _, tc := range tests {
+		fn, err := cleanFilename(tc.filename)
+		if tc.want == "" {
+			assert.Error(t, err, tc.filename)
+			continue
+		}
+
+		assert.NoError(t, err, tc.filename)
+		assert.Equal(t, tc.want, fn, tc.filename)
+	}
+}
+
+func TestFilenamesAreCaseInsensitive(t *testing.T) {
+	r, s := setupFiles(t)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/images/01/Test.PNG", bytes.NewReader(pngImage(t, 10, 10))))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	ok, err := s.Exists("1/test.png")
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images/1/TEST.png", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func multipartUpload(t *testing.T, r http.Handler, fn string) int {
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	require.NoError(t, mw.WriteField("id", "1"))
+
+	fw, err := mw.CreateFormFile("file", fn)
+	require.NoError(t, err)
+	fw.Write(pngImage(t, 10, 10))
+	require.NoError(t, mw.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	return rr.Code
+}
+
+func TestUploadMultipartRejectsInvalidFilenames(t *testing.T) {
+	s, err := files.NewLocal(t.TempDir(), 10000)
+	require.NoError(t, err)
+
+	v, err := images.NewValidator(images.DefaultTypes, 100, 100)
+	require.NoError(t, err)
+
+	fh := NewFiles(s, v, images.NewResizer(100, 100, nil), nil, 1024, "", hclog.NewNullLogger())
+	r := newRouter(fh)
+	r.Methods(http.MethodPost).Path("/").HandlerFunc(fh.UploadMultipart)
+
+	for _, fn := range []string{"..", "x.sh", "..\\..\\x.png", "x.png\x00"} {
+		assert.Equal(t, http.StatusBadRequest, multipartUpload(t, r, fn), fn)
+	}
+
+	fis, err := s.List("")
+	require.NoError(t, err)
+	assert.Empty(t, fis)
+
+	// directories in the filename are removed when the form is parsed
+	assert.Equal(t, http.StatusOK, multipartUpload(t, r, "../../etc/X.png"))
+
+	fis, err = s.List("")
+	require.NoError(t, err)
+	require.Len(t, fis, 2)
+	assert.Equal(t, "1/x.png", fis[0].Path)
+	assert.Equal(t, "metadata/1/x.png.json", fis[1].Path)
+}
+
+func FuzzCleanFilename(f *testing.F) {
+	for _, s := range []string{"test.png", "../x.png", "a/b.png", "Ä.JPG", ".png", "x.png\x00"} {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		fn, err := cleanFilename(s)
+		if err != nil {
+			return
+		}
+
+		// valid names are a single lower case path element with an
+		// allowed extension
+		assert.Equal(t, fn, path.Base(fn))
+		assert.Equal(t, strings.ToLower(fn), fn)
+		assert.True(t, allowedExtensions[path.Ext(fn)], fn)
+		assert.NotContains(t, fn, "/")
+		assert.NotContains(t, fn, "\\")
+		assert.False(t, strings.HasPrefix(fn, "."), fn)
+
+		for _, r := range fn {
+			assert.False(t, unicode.IsControl(r), fn)
+		}
+
+		// cleaning is idempotent
+		fn2, err := cleanFilename(fn)
+		assert.NoError(t, err)
+		assert.Equal(t, fn, fn2)
+	})
+}
+
+func FuzzDownload(f *testing.F) {
+	for _, s := range []string{"/images/1/test.png", "/images/1/../secret.png", "/images/1/%2e%2e%2fsecret.png", "/images/1/thumb/test.png", "/images/1/..%5csecret.png"} {
+		f.Add(s)
+	}
+
+	// a file outside of the store must never be served
+	dir := f.TempDir()
+	require.NoError(f, os.WriteFile(filepath.Join(dir, "secret.png"), []byte("secret"), 0644))
+
+	l, err := files.NewLocal(filepath.Join(dir, "store"), 1024)
+	require.NoError(f, err)
+	require.NoError(f, l.Save("1/test.png", bytes.NewBufferString("Hello World")))
+
+	fh := NewFiles(l, nil, images.NewResizer(100, 100, nil), nil, 1024, "", hclog.NewNullLogger())
+	r := newRouter(fh)
+
+	f.Fuzz(func(t *testing.T, u string) {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost"+u, nil)
+		if err != nil || !strings.HasPrefix(req.URL.Path, "/") {
+			return
+		}
+
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+
+		assert.NotContains(t, rr.Body.String(), "secret")
+		assert.NotEqual(t, http.StatusInternalServerError, rr.Code, u)
+	})
+}
@@ -1,81 +1,625 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"io"
 	"net/http"
+	"path"
 	"path/filepath"
-	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/hashicorp/go-hclog"
 	"github.com/nicholasjackson/building-microservices-youtube/product-images/files"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/images"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/metadata"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/signing"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/variants"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/apikey"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/logging"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/xerrors"
 )
 
+// multipartOverhead is the space allowed for the form fields and boundaries
+// of a multipart upload in addition to the max file size
+const multipartOverhead = 64 * 1024
+
+// derivativesPath is the directory in the store for resized images
+const derivativesPath = "derivatives"
+
 // Files is a handler for reading and writing files
 type Files struct {
-	log   hclog.Logger
-	store files.Storage
+	log      hclog.Logger
+	store    files.Storage
+	images   *images.Validator
+	resizer  *images.Resizer
+	variants *variants.Pipeline
+	meta     *metadata.Index
+	maxSize  int64
+
+	// cacheControl is the Cache-Control header for downloads
+	cacheControl string
+
+	// signer verifies the URLs of private images, nil disables private
+	// images, callers can sign URLs for up to maxTTL
+	signer  *signing.Signer
+	callers *apikey.Keys
+	maxTTL  time.Duration
+
+	// resizes ensures that concurrent requests for the same derivative
+	// only resize the image once
+	resizes singleflight.Group
+}
+
+// NewFiles creates a new File handler, uploads must be images accepted by v
+// and no larger than maxSize bytes, rz creates resized images on download
+// and vp creates the variants for uploaded images, a nil vp disables variants
+// cacheControl is the Cache-Control header for downloads, empty omits it
+func NewFiles(s files.Storage, v *images.Validator, rz *images.Resizer, vp *variants.Pipeline, maxSize int64, cacheControl string, l hclog.Logger) *Files {
+	return &Files{store: s, images: v, resizer: rz, variants: vp, meta: metadata.New(s), maxSize: maxSize, cacheControl: cacheControl, log: l}
 }
 
-// NewFiles creates a new File handler
-func NewFiles(s files.Storage, l hclog.Logger) *Files {
-	return &Files{store: s, log: l}
+// logger returns the request scoped logger which includes the request id,
+// when the request does not have a logger the handler logger is returned
+func (f *Files) logger(r *http.Request) hclog.Logger {
+	return logging.Logger(r.Context(), f.log)
 }
 
 // UploadREST implements the http.Handler interface
 func (f *Files) UploadREST(rw http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
-	fn := vars["filename"]
+	id, fn, ok := fileVars(rw, r)
+	if !ok {
+		return
+	}
 
-	f.log.Info("Handle POST", "id", id, "filename", fn)
+	private := r.URL.Query().Get("private") == "true"
+	f.logger(r).Info("Handle POST", "id", id, "filename", fn, "private", private)
 
-	// no need to check for invalid id or filename as the mux router will not send requests
-	// here unless they have the correct parameters
-	f.saveFile(id, fn, rw, r.Body)
+	f.saveFile(r.Context(), id, fn, private, rw, r.Body)
 }
 
-// UploadMultipar something
+// UploadMultipart saves an image uploaded as multipart form data, the form
+// contains the product id, the image in the file field and private=true for
+// images which can only be downloaded with a signed URL
 func (f *Files) UploadMultipart(rw http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(rw, r.Body, f.maxSize+multipartOverhead)
+
 	err := r.ParseMultipartForm(128 * 1024)
+	if isTooLarge(err) {
+		f.logger(r).Error("File too large", "error", err)
+		http.Error(rw, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
 	if err != nil {
-		f.log.Error("Bad request", "error", err)
+		f.logger(r).Error("Bad request", "error", err)
 		http.Error(rw, "Expected multipart form data", http.StatusBadRequest)
 		return
 	}
 
-	id, idErr := strconv.Atoi(r.FormValue("id"))
-	f.log.Info("Process form for id", "id", id)
+	id, err := cleanID(r.FormValue("id"))
+	f.logger(r).Info("Process form for id", "id", id)
 
-	if idErr != nil {
-		f.log.Error("Bad request", "error", err)
+	if err != nil {
+		f.logger(r).Error("Bad request", "error", err)
 		http.Error(rw, "Expected expected integer id", http.StatusBadRequest)
 		return
 	}
 
 	ff, mh, err := r.FormFile("file")
 	if err != nil {
-		f.log.Error("Bad request", "error", err)
+		f.logger(r).Error("Bad request", "error", err)
 		http.Error(rw, "Expected file", http.StatusBadRequest)
 		return
 	}
 
-	f.saveFile(r.FormValue("id"), mh.Filename, rw, ff)
+	// the filename is chosen by the client so it is checked before it is
+	// used in the path
+	fn, err := cleanFilename(mh.Filename)
+	if err != nil {
+		f.logger(r).Info("Rejected filename", "filename", mh.Filename)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.saveFile(r.Context(), id, fn, r.FormValue("private") == "true", rw, ff)
+}
+
+// Download serves the file for the product from the store
+func (f *Files) Download(rw http.ResponseWriter, r *http.Request) {
+	id, fn, ok := fileVars(rw, r)
+	if !ok {
+		return
+	}
+
+	l := f.logger(r)
+	l.Debug("Handle GET", "id", id, "filename", fn)
+
+	fp := path.Join(id, fn)
+
+	cc, ok := f.checkAccess(rw, r, "/images/"+fp, id, fn)
+	if !ok {
+		return
+	}
+
+	// resize the image when the query contains resize options
+	o, ok, err := f.resizer.Parse(r.URL.Query())
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if ok {
+		f.serveDerivative(rw, r, fp, o, cc)
+		return
+	}
+
+	f.serveFile(rw, r, fp, cc)
+}
+
+// DownloadVariant serves a variant created by the variants pipeline
+func (f *Files) DownloadVariant(rw http.ResponseWriter, r *http.Request) {
+	id, fn, ok := fileVars(rw, r)
+	if !ok {
+		return
+	}
+
+	vn := mux.Vars(r)["variant"]
+
+	f.logger(r).Debug("Handle GET variant", "id", id, "variant", vn, "filename", fn)
+
+	if f.variants == nil {
+		http.Error(rw, "File not found", http.StatusNotFound)
+		return
+	}
+
+	if _, ok := f.variants.Variant(vn); !ok {
+		http.Error(rw, "Unknown variant", http.StatusNotFound)
+		return
+	}
+
+	vp := variants.Path(vn, path.Join(id, fn))
+
+	cc, ok := f.checkAccess(rw, r, "/images/"+vp, id, fn)
+	if !ok {
+		return
+	}
+
+	f.serveFile(rw, r, vp, cc)
+}
+
+// JobStatus returns the status of the job creating the variants for an
+// uploaded image
+func (f *Files) JobStatus(rw http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["job"]
+
+	if f.variants == nil {
+		http.Error(rw, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	j, ok := f.variants.Job(id)
+	if !ok {
+		http.Error(rw, "Job not found", http.StatusNotFound)
+		return
+	}
+
+	f.writeJob(rw, j)
+}
+
+// ListImages returns the metadata for the images of a product as JSON,
+// private images are only listed for authorised callers
+func (f *Files) ListImages(rw http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	l := f.logger(r)
+	l.Debug("Handle GET images", "id", id)
+
+	imgs, err := f.meta.List(id)
+	if err != nil {
+		l.Error("Unable to list images", "id", id, "error", err)
+		http.Error(rw, "Unable to list images", http.StatusInternalServerError)
+		return
+	}
+
+	if !f.isCaller(r) {
+		public := []metadata.Image{}
+		for _, img := range imgs {
+			if !img.Private {
+				public = append(public, img)
+			}
+		}
+
+		imgs = public
+	}
+
+	for i := range imgs {
+		imgs[i].Variants, err = f.listVariants(id, imgs[i].Filename)
+		if err != nil {
+			l.Error("Unable to list variants", "id", id, "filename", imgs[i].Filename, "error", err)
+			http.Error(rw, "Unable to list images", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+
+	err = json.NewEncoder(rw).Encode(imgs)
+	if err != nil {
+		l.Error("Unable to write images", "error", err)
+	}
+}
+
+// listVariants returns the URLs of the variants which have been created for
+// the image
+func (f *Files) listVariants(id, filename string) (map[string]string, error) {
+	vs := map[string]string{}
+	if f.variants == nil {
+		return vs, nil
+	}
+
+	for _, v := range f.variants.Variants() {
+		vp := variants.Path(v.Name, path.Join(id, filename))
+
+		ok, err := f.store.Exists(vp)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			vs[v.Name] = "/images/" + vp
+		}
+	}
+
+	return vs, nil
 }
 
-func (f *Files) invalidURI(uri string, rw http.ResponseWriter) {
-	f.log.Error("Invalid path", "path", uri)
-	http.Error(rw, "Invalid file path should be in the format: /[id]/[filepath]", http.StatusBadRequest)
+// Delete removes an image of a product along with its variants, resized
+// images and metadata
+func (f *Files) Delete(rw http.ResponseWriter, r *http.Request) {
+	id, fn, ok := fileVars(rw, r)
+	if !ok {
+		return
+	}
+
+	l := f.logger(r)
+	l.Info("Handle DELETE", "id", id, "filename", fn)
+
+	fp := path.Join(id, fn)
+
+	err := f.store.Delete(fp)
+	if xerrors.Is(err, files.ErrNotFound) {
+		http.Error(rw, "File not found", http.StatusNotFound)
+		return
+	}
+
+	// jobs which have not finished would create the variants again
+	if err == nil && f.variants != nil {
+		f.variants.Cancel(fp)
+	}
+
+	if err == nil {
+		err = f.deleteGenerated(id, fn)
+	}
+
+	if err == nil {
+		err = f.meta.Delete(id, fn)
+	}
+
+	if err != nil && !xerrors.Is(err, files.ErrNotFound) {
+		l.Error("Unable to delete file", "path", fp, "error", err)
+		http.Error(rw, "Unable to delete file", http.StatusInternalServerError)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
 }
 
-// saveFile saves the contents of the request to a file
-func (f *Files) saveFile(id, path string, rw http.ResponseWriter, r io.ReadCloser) {
-	f.log.Info("Save file for product", "id", id, "path", path)
+// deleteGenerated removes the variants and resized images for the image
+// id/filename, files which do not exist are ignored
+func (f *Files) deleteGenerated(id, fn string) error {
+	fp := path.Join(id, fn)
+	paths := []string{}
 
-	fp := filepath.Join(id, path)
-	err := f.store.Save(fp, r)
+	if f.variants != nil {
+		for _, v := range f.variants.Variants() {
+			paths = append(paths, variants.Path(v.Name, fp))
+		}
+	}
+
+	dfis, err := f.store.List(path.Join(derivativesPath, fp) + "/")
 	if err != nil {
-		f.log.Error("Unable to save file", "error", err)
-		http.Error(rw, "Unable to save file", http.StatusInternalServerError)
+		return err
+	}
+
+	for _, dfi := range dfis {
+		paths = append(paths, dfi.Path)
+	}
+
+	for _, p := range paths {
+		err := f.store.Delete(p)
+		if err != nil && !xerrors.Is(err, files.ErrNotFound) {
+			return err
+		}
 	}
+
+	return nil
+}
+
+// serveFile serves the file at fp from the store with the Cache-Control
+// header cc
+func (f *Files) serveFile(rw http.ResponseWriter, r *http.Request, fp, cc string) {
+	l := f.logger(r)
+
+	_, span := otel.Tracer("product-images").Start(r.Context(), "files.Open")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("file.path", fp))
+
+	ff, fi, err := f.store.Open(fp)
+	if xerrors.Is(err, files.ErrNotFound) {
+		http.Error(rw, "File not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+
+		l.Error("Unable to open file", "path", fp, "error", err)
+		http.Error(rw, "Unable to open file", http.StatusInternalServerError)
+		return
+	}
+	defer ff.Close()
+
+	f.serveContent(rw, r, path.Base(fp), fi, ff, cc)
+}
+
+// serveDerivative serves the image at fp resized with the options, resized
+// images are stored so that they are only created once for each original
+func (f *Files) serveDerivative(rw http.ResponseWriter, r *http.Request, fp string, o images.Options, cc string) {
+	l := f.logger(r)
+
+	ctx, span := otel.Tracer("product-images").Start(r.Context(), "files.Derivative")
+	defer span.End()
+
+	span.SetAttributes(attribute.String("file.path", fp))
+
+	fi, err := f.store.Stat(fp)
+	if xerrors.Is(err, files.ErrNotFound) {
+		http.Error(rw, "File not found", http.StatusNotFound)
+		return
+	}
+
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+
+		l.Error("Unable to get file info", "path", fp, "error", err)
+		http.Error(rw, "Unable to open file", http.StatusInternalServerError)
+		return
+	}
+
+	// keep the format of the original unless one is requested
+	if o.Format == "" {
+		o.Format = images.FormatFor(fi.ContentType)
+	}
+
+	dp := path.Join(derivativesPath, fp, o.Key())
+	span.SetAttributes(attribute.String("derivative.path", dp))
+
+	// serve the stored derivative unless the original has been replaced
+	df, dfi, err := f.store.Open(dp)
+	if err == nil && !dfi.ModTime.Before(fi.ModTime) {
+		defer df.Close()
+
+		dfi.ContentType = o.ContentType()
+		f.serveContent(rw, r, path.Base(dp), dfi, df, cc)
+		return
+	}
+
+	if err == nil {
+		df.Close()
+	}
+
+	v, err, _ := f.resizes.Do(dp, func() (interface{}, error) {
+		return f.resize(ctx, fp, dp, o)
+	})
+
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+
+		l.Error("Unable to resize image", "path", fp, "error", err)
+		http.Error(rw, "Unable to resize image", http.StatusInternalServerError)
+		return
+	}
+
+	d := v.([]byte)
+	dfi = files.FileInfo{Path: dp, Size: int64(len(d)), ModTime: time.Now(), ContentType: o.ContentType(), Hash: hashBytes(d)}
+	f.serveContent(rw, r, path.Base(dp), dfi, bytes.NewReader(d), cc)
+}
+
+// resize creates the derivative for the image at fp and saves it at dp
+func (f *Files) resize(ctx context.Context, fp, dp string, o images.Options) ([]byte, error) {
+	l := logging.Logger(ctx, f.log)
+	l.Info("Resize image", "path", fp, "derivative", dp)
+
+	src, _, err := f.store.Open(fp)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	buf := &bytes.Buffer{}
+	err = f.resizer.Resize(buf, src, o)
+	if err != nil {
+		return nil, err
+	}
+
+	// the derivative can still be served when it can not be stored
+	err = f.store.Save(dp, bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		l.Error("Unable to save resized image", "path", dp, "error", err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// saveFile saves the contents of the request to a file and writes the
+// response, the error is returned when the file was not saved
+// private images can only be downloaded with a signed URL
+func (f *Files) saveFile(ctx context.Context, id, path string, private bool, rw http.ResponseWriter, r io.ReadCloser) error {
+	l := logging.Logger(ctx, f.log)
+	l.Info("Save file for product", "id", id, "path", path, "private", private)
+
+	if private && f.signer == nil {
+		http.Error(rw, errPrivateDisabled.Error(), http.StatusBadRequest)
+		return errPrivateDisabled
+	}
+
+	_, span := otel.Tracer("product-images").Start(ctx, "files.Save")
+	defer span.End()
+
+	fp := filepath.ToSlash(filepath.Join(id, path))
+	span.SetAttributes(attribute.String("file.path", fp))
+
+	// limit the size of the file regardless of the storage backend
+	r = http.MaxBytesReader(rw, r, f.maxSize)
+
+	// only the image header is read before saving the file
+	ir, info, err := f.images.Validate(r)
+
+	// a private image must not be readable while it is saved
+	restore := func() {}
+	if err == nil && private {
+		restore, err = f.markPrivate(id, path)
+	}
+
+	if err == nil {
+		span.SetAttributes(attribute.String("image.type", info.ContentType))
+		err = f.store.Save(fp, ir)
+	}
+
+	// the variants and resized images of the previous image are removed
+	// before the metadata is updated, otherwise they would be served with
+	// the visibility of the new image until the variants are regenerated
+	if err == nil {
+		err = f.deleteGenerated(id, path)
+	}
+
+	if err == nil {
+		err = f.saveMetadata(id, path, info, private)
+	}
+
+	if err != nil {
+		restore()
+	}
+
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+
+		status, msg := uploadError(err)
+		if status == http.StatusInternalServerError {
+			l.Error("Unable to save file", "error", err)
+		} else {
+			l.Info("Rejected file", "status", status, "error", err)
+		}
+
+		http.Error(rw, msg, status)
+		return err
+	}
+
+	// variants are created in the background, the response contains the
+	// job so that clients can check when they are ready
+	if f.variants != nil {
+		f.writeJob(rw, f.variants.Submit(ctx, fp))
+	}
+
+	return nil
+}
+
+// markPrivate marks the image id/filename as private in the metadata index
+// before it is saved, the returned function restores the previous metadata
+// when the image is not saved
+func (f *Files) markPrivate(id, filename string) (func(), error) {
+	prev, err := f.meta.Get(id, filename)
+	exists := err == nil
+
+	if err != nil && !xerrors.Is(err, files.ErrNotFound) {
+		return func() {}, err
+	}
+
+	err = f.meta.Save(id, metadata.Image{Filename: filename, Private: true})
+	if err != nil {
+		return func() {}, err
+	}
+
+	return func() {
+		var err error
+		if exists {
+			err = f.meta.Save(id, prev)
+		} else {
+			err = f.meta.Delete(id, filename)
+		}
+
+		if err != nil {
+			f.log.Error("Unable to restore metadata", "id", id, "filename", filename, "error", err)
+		}
+	}, nil
+}
+
+// saveMetadata records the details of the image saved at id/filename in the
+// metadata index
+func (f *Files) saveMetadata(id, filename string, info images.Info, private bool) error {
+	fi, err := f.store.Stat(path.Join(id, filename))
+	if err != nil {
+		return err
+	}
+
+	return f.meta.Save(id, metadata.Image{
+		Filename:    filename,
+		Size:        fi.Size,
+		ContentType: info.ContentType,
+		Width:       info.Width,
+		Height:      info.Height,
+		Hash:        fi.Hash,
+		UploadedAt:  fi.ModTime,
+		Private:     private,
+	})
+}
+
+// writeJob writes the job to the response as JSON
+func (f *Files) writeJob(rw http.ResponseWriter, j variants.Job) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Location", "/images/jobs/"+j.ID)
+
+	err := json.NewEncoder(rw).Encode(j)
+	if err != nil {
+		f.log.Error("Unable to write job", "error", err)
+	}
+}
+
+// uploadError returns the status code and message for an upload error
+func uploadError(err error) (int, string) {
+	switch {
+	case isTooLarge(err):
+		return http.StatusRequestEntityTooLarge, "File too large"
+	case xerrors.Is(err, images.ErrUnsupportedType), xerrors.Is(err, images.ErrInvalidImage):
+		return http.StatusUnsupportedMediaType, err.Error()
+	case xerrors.Is(err, images.ErrDimensionsTooBig):
+		return http.StatusUnprocessableEntity, err.Error()
+	}
+
+	return http.StatusInternalServerError, "Unable to save file"
+}
+
+// isTooLarge returns true when the request body or file exceeded the max size
+func isTooLarge(err error) bool {
+	mbe := &http.MaxBytesError{}
+
+	return xerrors.As(err, &mbe) || xerrors.Is(err, files.ErrFileTooLarge)
 }
@@ -0,0 +1,336 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/go-hclog"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/files"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/images"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/metadata"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/variants"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/apikey"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "golang.org/x/image/webp"
+)
+
+func setupFiles(t *testing.T) (*mux.Router, files.Storage) {
+	l, err := files.NewLocal(t.TempDir(), 10000)
+	require.NoError(t, err)
+
+	s := files.NewContentAddressed(l)
+
+	v, err := images.NewValidator(images.DefaultTypes, 100, 100)
+	require.NoError(t, err)
+
+	fh := NewFiles(s, v, images.NewResizer(100, 100, nil), nil, 1024, "", hclog.NewNullLogger())
+
+	return newRouter(fh), s
+}
+
+// deleteRequest returns a DELETE request with the API key of a caller
+func deleteRequest(target string) *http.Request {
+	r := httptest.NewRequest(http.MethodDelete, target, nil)
+	r.Header.Set("X-API-Key", "secret")
+
+	return r
+}
+
+func setupVariants(t *testing.T) (*mux.Router, files.Storage) {
+	l, err := files.NewLocal(t.TempDir(), 10000)
+	require.NoError(t, err)
+
+	s := files.NewContentAddressed(l)
+
+	v, err := images.NewValidator(images.DefaultTypes, 100, 100)
+	require.NoError(t, err)
+
+	rz := images.NewResizer(100, 100, nil)
+	vp := variants.New(hclog.NewNullLogger(), s, rz, []variants.Variant{{Name: "thumb", Width: 10, Height: 10, Fit: images.FitCover}}, 1)
+	vp.Start(1)
+	t.Cleanup(func() { vp.Shutdown(context.Background()) })
+
+	fh := NewFiles(s, v, rz, vp, 1024, "", hclog.NewNullLogger())
+
+	return newRouter(fh), s
+}
+
+func newRouter(fh *Files) *mux.Router {
+	// deletes require the API key of a caller
+	if fh.callers == nil {
+		c, _ := apikey.New([]apikey.Key{{Key: "secret", Subject: "test"}})
+		fh.SetCallers(c)
+	}
+
+	r := mux.NewRouter()
+	r.Methods(http.MethodGet).Path("/images/{id:[0-9]+}/{filename}").HandlerFunc(fh.Download)
+	r.Methods(http.MethodGet).Path("/images/{id:[0-9]+}/{variant:[a-z]+}/{filename}").HandlerFunc(fh.DownloadVariant)
+	r.Methods(http.MethodGet).Path("/images/jobs/{job:[0-9a-f]+}").HandlerFunc(fh.JobStatus)
+	r.Methods(http.MethodGet).Path("/images/{id:[0-9]+}").HandlerFunc(fh.ListImages)
+	r.Methods(http.MethodPost).Path("/images/{id:[0-9]+}/{filename}").HandlerFunc(fh.UploadREST)
+	r.Methods(http.MethodDelete).Path("/images/{id:[0-9]+}/{filename}").Handler(fh.MiddlewareRequireCaller(http.HandlerFunc(fh.Delete)))
+
+	return r
+}
+
+func TestDownloadServesFileFromStorage(t *testing.T) {
+	r, s := setupFiles(t)
+	require.NoError(t, s.Save("1/test.png", bytes.NewBufferString("Hello World")))
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images/1/test.png", nil))
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "image/png", rr.Header().Get("Content-Type"))
+	assert.NotEmpty(t, rr.Header().Get("Last-Modified"))
+	assert.Equal(t, `"a591a6d40bf420404a011733cfb7b190d62c65bf0bcda32b57b277d9ad9f146e"`, rr.Header().Get("ETag"))
+	assert.Equal(t, "Hello World", rr.Body.String())
+
+	// the hash of the contents is a strong ETag
+	req := httptest.NewRequest(http.MethodGet, "/images/1/test.png", nil)
+	req.Header.Set("If-None-Match", rr.Header().Get("ETag"))
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotModified, rr.Code)
+}
+
+func TestDownloadMissingFileReturnsNotFound(t *testing.T) {
+	r, _ := setupFiles(t)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images/1/test.png", nil))
+
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func pngImage(t *testing.T, w, h int) []byte {
+	buf := &bytes.Buffer{}
+	require.NoError(t, png.Encode(buf, image.NewGray(image.Rect(0, 0, w, h))))
+
+	return buf.Bytes()
+}
+
+func TestUploadSavesImage(t *testing.T) {
+	r, s := setupFiles(t)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/images/1/test.png", bytes.NewReader(pngImage(t, 10, 10))))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	ok, err := s.Exists("1/test.png")
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestUploadRejectsInvalidFiles(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   []byte
+		status int
+	}{
+		{"too large", append(pngImage(t, 10, 10), make([]byte, 1024)...), http.StatusRequestEntityTooLarge},
+		{"not an image", []byte("Hello World"), http.StatusUnsupportedMediaType},
+		{"dimensions too large", pngImage(t, 101, 10), http.StatusUnprocessableEntity},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r, s := setupFiles(t)
+
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/images/1/test.png", bytes.NewReader(tc.body)))
+			assert.Equal(t, tc.status, rr.Code)
+
+			// rejected files are not saved
+			ok, err := s.Exists("1/test.png")
+			require.NoError(t, err)
+			assert.False(t, ok)
+		})
+	}
+}
+
+func TestDownloadResizesImage(t *testing.T) {
+	r, s := setupFiles(t)
+	require.NoError(t, s.Save("1/test.png", bytes.NewReader(pngImage(t, 40, 20))))
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images/1/test.png?w=10&format=webp", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "image/webp", rr.Header().Get("Content-Type"))
+
+	cfg, format, err := image.DecodeConfig(rr.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "webp", format)
+	assert.Equal(t, 10, cfg.Width)
+	assert.Equal(t, 5, cfg.Height)
+
+	// the derivative is stored
+	fis, err := s.List("derivatives/1/test.png/")
+	require.NoError(t, err)
+	assert.Len(t, fis, 1)
+
+	// invalid options are rejected
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images/1/test.png?w=1000", nil))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+}
+
+func TestUploadCreatesVariants(t *testing.T) {
+	r, _ := setupVariants(t)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/images/1/test.png", bytes.NewReader(pngImage(t, 40, 20))))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+
+	j := variants.Job{}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&j))
+	assert.Equal(t, "/images/jobs/"+j.ID, rr.Header().Get("Location"))
+	assert.Equal(t, []string{"thumb"}, j.Variants)
+
+	// poll the job until the variants have been created
+	require.Eventually(t, func() bool {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images/jobs/"+j.ID, nil))
+		err := json.NewDecoder(rr.Body).Decode(&j)
+
+		return err == nil && j.Status == variants.StatusComplete
+	}, 5*time.Second, time.Millisecond)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images/1/thumb/test.png", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "image/png", rr.Header().Get("Content-Type"))
+
+	cfg, err := png.DecodeConfig(rr.Body)
+	require.NoError(t, err)
+	assert.Equal(t, 10, cfg.Width)
+	assert.Equal(t, 10, cfg.Height)
+}
+
+func TestUnknownVariantsAndJobsReturnNotFound(t *testing.T) {
+	r, _ := setupVariants(t)
+
+	for _, u := range []string{"/images/1/hero/test.png", "/images/1/thumb/test.png", "/images/jobs/abc"} {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, u, nil))
+		assert.Equal(t, http.StatusNotFound, rr.Code, u)
+	}
+}
+
+func TestListImagesReturnsMetadata(t *testing.T) {
+	r, _ := setupVariants(t)
+
+	for _, fn := range []string{"b.png", "a.png"} {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/images/1/"+fn, bytes.NewReader(pngImage(t, 40, 20))))
+		require.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	var imgs []metadata.Image
+	require.Eventually(t, func() bool {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images/1", nil))
+		err := json.NewDecoder(rr.Body).Decode(&imgs)
+
+		// wait for the variants to be created
+		return err == nil && len(imgs) == 2 && len(imgs[0].Variants) == 1 && len(imgs[1].Variants) == 1
+	}, 5*time.Second, time.Millisecond)
+
+	assert.Equal(t, "a.png", imgs[0].Filename)
+	assert.Equal(t, "b.png", imgs[1].Filename)
+	assert.Equal(t, "image/png", imgs[0].ContentType)
+	assert.Equal(t, 40, imgs[0].Width)
+	assert.Equal(t, 20, imgs[0].Height)
+	assert.NotZero(t, imgs[0].Size)
+	assert.Len(t, imgs[0].Hash, 64)
+	assert.False(t, imgs[0].UploadedAt.IsZero())
+	assert.Equal(t, map[string]string{"thumb": "/images/1/thumb/a.png"}, imgs[0].Variants)
+
+	// products without images return an empty list
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images/2", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "[]\n", rr.Body.String())
+}
+
+func TestDeleteRemovesImageAndGeneratedFiles(t *testing.T) {
+	r, s := setupFiles(t)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/images/1/test.png", bytes.NewReader(pngImage(t, 40, 20))))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images/1/test.png?w=10", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, deleteRequest("/images/1/test.png"))
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+
+	fis, err := s.List("")
+	require.NoError(t, err)
+	assert.Empty(t, fis)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, deleteRequest("/images/1/test.png"))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
+
+func TestDeleteWithoutAPIKeyReturnsUnauthorized(t *testing.T) {
+	r, s := setupFiles(t)
+	require.NoError(t, s.Save("1/test.png", bytes.NewReader(pngImage(t, 10, 10))))
+
+	for _, key := range []string{"", "wrong"} {
+		req := httptest.NewRequest(http.MethodDelete, "/images/1/test.png", nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusUnauthorized, rr.Code)
+	}
+
+	ok, err := s.Exists("1/test.png")
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestUploadRemovesVariantsOfReplacedImage(t *testing.T) {
+	l, err := files.NewLocal(t.TempDir(), 10000)
+	require.NoError(t, err)
+
+	s := files.NewContentAddressed(l)
+
+	v, err := images.NewValidator(images.DefaultTypes, 100, 100)
+	require.NoError(t, err)
+
+	// the pipeline is not started so the variants are not regenerated
+	rz := images.NewResizer(100, 100, nil)
+	vp := variants.New(hclog.NewNullLogger(), s, rz, []variants.Variant{{Name: "thumb", Width: 10, Height: 10, Fit: images.FitCover}}, 1)
+	r := newRouter(NewFiles(s, v, rz, vp, 1024, "", hclog.NewNullLogger()))
+
+	require.NoError(t, s.Save("1/test.png", bytes.NewReader(pngImage(t, 40, 20))))
+	require.NoError(t, s.Save(variants.Path("thumb", "1/test.png"), bytes.NewReader(pngImage(t, 10, 10))))
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/images/1/test.png", bytes.NewReader(pngImage(t, 20, 40))))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	// the variant of the previous image is not served
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images/1/thumb/test.png", nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/files"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/metadata"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/signing"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/variants"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/apikey"
+	"golang.org/x/xerrors"
+)
+
+// defaultSignedURLTTL is the time a signed URL is valid for when the caller
+// does not request a time
+const defaultSignedURLTTL = 15 * time.Minute
+
+// errPrivateDisabled is returned when a private image is uploaded and no
+// signing keys are configured
+var errPrivateDisabled = xerrors.New("Private images are not enabled, signing keys are not configured")
+
+// SetSigning enables private images, s signs and verifies the URLs for
+// private images, signed URLs are valid for at most maxTTL
+func (f *Files) SetSigning(s *signing.Signer, maxTTL time.Duration) {
+	f.signer = s
+	f.maxTTL = maxTTL
+}
+
+// SetCallers sets the API keys of the callers which can delete images,
+// request signed URLs and list private images, without callers these
+// requests are rejected
+func (f *Files) SetCallers(c *apikey.Keys) {
+	f.callers = c
+}
+
+// SignRequest is the body of a request for a signed URL
+type SignRequest struct {
+	ID       int    `json:"id"`
+	Filename string `json:"filename"`
+	// Variant is the name of a variant, empty for the original image
+	Variant string `json:"variant,omitempty"`
+	// ExpiresIn is the time the URL is valid for, i.e. 15m, default 15m
+	ExpiresIn string `json:"expires_in,omitempty"`
+}
+
+// SignResponse contains a signed URL
+type SignResponse struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// SignURL returns a signed URL which can be used to download an image
+// until it expires, the image does not need to be private
+func (f *Files) SignURL(rw http.ResponseWriter, r *http.Request) {
+	l := f.logger(r)
+
+	sr := SignRequest{}
+	err := json.NewDecoder(http.MaxBytesReader(rw, r.Body, 4096)).Decode(&sr)
+	if err != nil {
+		http.Error(rw, "Unable to decode JSON", http.StatusBadRequest)
+		return
+	}
+
+	id, err := cleanID(strconv.Itoa(sr.ID))
+	if err == nil {
+		sr.Filename, err = cleanFilename(sr.Filename)
+	}
+
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ttl := defaultSignedURLTTL
+	if sr.ExpiresIn != "" {
+		ttl, err = time.ParseDuration(sr.ExpiresIn)
+		if err != nil || ttl <= 0 {
+			http.Error(rw, "Invalid expires_in, expected a positive duration i.e. 15m", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if ttl > f.maxTTL {
+		http.Error(rw, "Invalid expires_in, must be at most "+f.maxTTL.String(), http.StatusBadRequest)
+		return
+	}
+
+	fp := path.Join(id, sr.Filename)
+	if sr.Variant != "" {
+		if f.variants == nil {
+			http.Error(rw, "Unknown variant", http.StatusNotFound)
+			return
+		}
+
+		if _, ok := f.variants.Variant(sr.Variant); !ok {
+			http.Error(rw, "Unknown variant", http.StatusNotFound)
+			return
+		}
+	}
+
+	ok, err := f.store.Exists(fp)
+	if err != nil {
+		l.Error("Unable to check file", "path", fp, "error", err)
+		http.Error(rw, "Unable to sign URL", http.StatusInternalServerError)
+		return
+	}
+
+	if !ok {
+		http.Error(rw, "File not found", http.StatusNotFound)
+		return
+	}
+
+	up := "/images/" + fp
+	if sr.Variant != "" {
+		up = "/images/" + variants.Path(sr.Variant, fp)
+	}
+
+	exp := time.Now().Add(ttl).Truncate(time.Second)
+	q := f.signer.Sign(up, exp)
+
+	l.Info("Signed URL", "path", up, "expires", exp, "key", q.Get(signing.ParamKey))
+
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+
+	err = json.NewEncoder(rw).Encode(SignResponse{URL: up + "?" + q.Encode(), Expires: exp.UTC()})
+	if err != nil {
+		l.Error("Unable to write signed URL", "error", err)
+	}
+}
+
+// MiddlewareRequireCaller returns a 401 Unauthorized response unless the
+// request has the X-API-Key header of an authorised caller
+func (f *Files) MiddlewareRequireCaller(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if !f.isCaller(r) {
+			rw.Header().Set("WWW-Authenticate", "APIKey")
+			http.Error(rw, "Invalid API key", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// isCaller returns true when the request has the API key of an authorised
+// caller
+func (f *Files) isCaller(r *http.Request) bool {
+	key := r.Header.Get("X-API-Key")
+	if f.callers == nil || key == "" {
+		return false
+	}
+
+	_, err := f.callers.Verify(key)
+	return err == nil
+}
+
+// checkAccess returns the Cache-Control header for the image id/fn served at
+// the URL path p, private images can only be read with a URL signed for p
+// when the client can not read the image the response is written and ok
+// is false
+// a private image without a signature is not found so that the names of
+// private images are not revealed
+func (f *Files) checkAccess(rw http.ResponseWriter, r *http.Request, p, id, fn string) (cc string, ok bool) {
+	l := f.logger(r)
+
+	signed := false
+	var expires time.Time
+
+	if r.URL.Query().Get(signing.ParamSignature) != "" {
+		if f.signer == nil {
+			http.Error(rw, "Invalid signature", http.StatusForbidden)
+			return "", false
+		}
+
+		var err error
+		expires, err = f.signer.Verify(p, r.URL.Query())
+		if err != nil {
+			l.Info("Rejected signed URL", "path", p, "error", err)
+			http.Error(rw, err.Error(), http.StatusForbidden)
+			return "", false
+		}
+
+		signed = true
+	}
+
+	img, err := f.meta.Get(id, fn)
+	if xerrors.Is(err, files.ErrNotFound) {
+		// images uploaded before the metadata index are public
+		img = metadata.Image{}
+		err = nil
+	}
+
+	if err != nil {
+		l.Error("Unable to read metadata", "id", id, "filename", fn, "error", err)
+		http.Error(rw, "Unable to open file", http.StatusInternalServerError)
+		return "", false
+	}
+
+	if !img.Private {
+		return f.cacheControl, true
+	}
+
+	if !signed {
+		http.Error(rw, "File not found", http.StatusNotFound)
+		return "", false
+	}
+
+	// shared caches must not keep private images and browsers only until
+	// the URL expires
+	age := int(math.Max(0, time.Until(expires).Seconds()))
+	return "private, max-age=" + strconv.Itoa(age), true
+}
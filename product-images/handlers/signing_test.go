@@ -0,0 +1,206 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/go-hclog"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/files"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/images"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/metadata"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/signing"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/apikey"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupSigning(t *testing.T) (*mux.Router, *signing.Signer) {
+	l, err := files.NewLocal(t.TempDir(), 10000)
+	require.NoError(t, err)
+
+	s := files.NewContentAddressed(l)
+
+	v, err := images.NewValidator(images.DefaultTypes, 100, 100)
+	require.NoError(t, err)
+
+	sg, err := signing.New(signing.Keys{Current: "k1", Keys: []signing.Key{{ID: "k1", Secret: "0123456789abcdef0123456789abcdef"}}})
+	require.NoError(t, err)
+
+	sc, err := apikey.New([]apikey.Key{{Key: "secret", Subject: "frontend"}})
+	require.NoError(t, err)
+
+	fh := NewFiles(s, v, images.NewResizer(100, 100, nil), nil, 1024, "public, max-age=60", hclog.NewNullLogger())
+	fh.SetSigning(sg, time.Hour)
+	fh.SetCallers(sc)
+
+	r := newRouter(fh)
+	r.Methods(http.MethodPost).Path("/signed-urls").Handler(fh.MiddlewareRequireCaller(http.HandlerFunc(fh.SignURL)))
+
+	// upload a public and a private image
+	for _, u := range []string{"/images/1/public.png", "/images/1/private.png?private=true"} {
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, u, bytes.NewReader(pngImage(t, 10, 10))))
+		require.Equal(t, http.StatusOK, rr.Code)
+	}
+
+	return r, sg
+}
+
+func signURL(t *testing.T, r http.Handler, body, key string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/signed-urls", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set("X-API-Key", key)
+	}
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestPrivateImagesRequireSignedURL(t *testing.T) {
+	r, _ := setupSigning(t)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images/1/public.png", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "public, max-age=60", rr.Header().Get("Cache-Control"))
+
+	// private images are not found without a signature, including resized
+	// images
+	for _, u := range []string{"/images/1/private.png", "/images/1/private.png?width=5"} {
+		rr = httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, u, nil))
+		assert.Equal(t, http.StatusNotFound, rr.Code, u)
+	}
+
+	rr = signURL(t, r, `{"id":1,"filename":"Private.png","expires_in":"10m"}`, "secret")
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	sr := SignResponse{}
+	require.NoError(t, json.NewDecoder(rr.Body).Decode(&sr))
+	assert.True(t, strings.HasPrefix(sr.URL, "/images/1/private.png?"))
+	assert.WithinDuration(t, time.Now().Add(10*time.Minute), sr.Expires, 2*time.Second)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, sr.URL, nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Regexp(t, `^private, max-age=(599|600)$`, rr.Header().Get("Cache-Control"))
+
+	// resize options can be added to a signed URL
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, sr.URL+"&width=5", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// the signature is only valid for the signed image
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, strings.Replace(sr.URL, "private.png", "public.png", 1), nil))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+}
+
+func TestExpiredSignedURLIsForbidden(t *testing.T) {
+	r, sg := setupSigning(t)
+
+	q := sg.Sign("/images/1/private.png", time.Now().Add(-time.Second))
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images/1/private.png?"+q.Encode(), nil))
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Contains(t, rr.Body.String(), "expired")
+}
+
+func TestSignURLRequiresCaller(t *testing.T) {
+	r, _ := setupSigning(t)
+
+	tests := []struct {
+		name   string
+		body   string
+		key    string
+		status int
+	}{
+		{"no key", `{"id":1,"filename":"private.png"}`, "", http.StatusUnauthorized},
+		{"invalid key", `{"id":1,"filename":"private.png"}`, "wrong", http.StatusUnauthorized},
+		{"missing image", `{"id":1,"filename":"missing.png"}`, "secret", http.StatusNotFound},
+		{"unknown variant", `{"id":1,"filename":"private.png","variant":"thumb"}`, "secret", http.StatusNotFound},
+		{"invalid filename", `{"id":1,"filename":"../private.png"}`, "secret", http.StatusBadRequest},
+		{"ttl too long", `{"id":1,"filename":"private.png","expires_in":"2h"}`, "secret", http.StatusBadRequest},
+		{"invalid ttl", `{"id":1,"filename":"private.png","expires_in":"-1m"}`, "secret", http.StatusBadRequest},
+	}
+
+	for _, tc := range tests {
+		rr := signURL(t, r, tc.body, tc.key)
+		assert.Equal(t, tc.status, rr.Code, tc.name)
+	}
+}
+
+func TestListImagesHidesPrivateImages(t *testing.T) {
+	r, _ := setupSigning(t)
+
+	list := func(key string) []string {
+		req := httptest.NewRequest(http.MethodGet, "/images/1", nil)
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+		require.Equal(t, http.StatusOK, rr.Code)
+
+		imgs := []metadata.Image{}
+		require.NoError(t, json.NewDecoder(rr.Body).Decode(&imgs))
+
+		fns := []string{}
+		for _, img := range imgs {
+			fns = append(fns, img.Filename)
+		}
+
+		return fns
+	}
+
+	assert.Equal(t, []string{"public.png"}, list(""))
+	assert.Equal(t, []string{"private.png", "public.png"}, list("secret"))
+}
+
+func TestPrivateUploadRequiresSigning(t *testing.T) {
+	r, s := setupFiles(t)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/images/1/test.png?private=true", bytes.NewReader(pngImage(t, 10, 10))))
+	assert.Equal(t, http.StatusBadRequest, rr.Code)
+
+	ok, err := s.Exists("1/test.png")
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
+
+func TestFailedPrivateUploadRestoresMetadata(t *testing.T) {
+	r, _ := setupSigning(t)
+
+	// replacing a public image with a private upload which fails while it
+	// is saved leaves it public
+	body := append(pngImage(t, 10, 10), make([]byte, 1024)...)
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/images/1/public.png?private=true", bytes.NewReader(body)))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rr.Code)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images/1/public.png", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+
+	// a new private image which is not saved is not listed
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/images/1/new.png?private=true", bytes.NewReader(body)))
+
+	req := httptest.NewRequest(http.MethodGet, "/images/1", nil)
+	req.Header.Set("X-API-Key", "secret")
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+	assert.NotContains(t, rr.Body.String(), "new.png")
+}
@@ -0,0 +1,249 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/go-hclog"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/uploads"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/logging"
+	"golang.org/x/xerrors"
+)
+
+// tusVersion is the version of the tus resumable upload protocol
+// implemented by the Uploads handler
+const tusVersion = "1.0.0"
+
+// Uploads is a handler for resumable uploads, clients create an upload,
+// send the image in chunks with PATCH requests and then complete the upload
+// to save the image, the progress of an upload can be read with HEAD so
+// that an interrupted upload continues from the last chunk received
+// the requests follow the core tus protocol, https://tus.io
+type Uploads struct {
+	log          hclog.Logger
+	uploads      *uploads.Manager
+	files        *Files
+	maxChunk     int64
+	chunkTimeout time.Duration
+}
+
+// NewUploads creates an Uploads handler, completed uploads are saved by f
+// each chunk can be up to maxChunk bytes and must be received within
+// chunkTimeout
+func NewUploads(m *uploads.Manager, f *Files, maxChunk int64, chunkTimeout time.Duration, l hclog.Logger) *Uploads {
+	return &Uploads{log: l, uploads: m, files: f, maxChunk: maxChunk, chunkTimeout: chunkTimeout}
+}
+
+// Create starts a new upload, the Upload-Length header is the size of the
+// image and the Upload-Metadata header contains the base64 encoded product
+// id and filename, i.e. "id MQ==,filename dGVzdC5wbmc=", private images also
+// have "private dHJ1ZQ=="
+func (u *Uploads) Create(rw http.ResponseWriter, r *http.Request) {
+	l := logging.Logger(r.Context(), u.log)
+	rw.Header().Set("Tus-Resumable", tusVersion)
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 1 {
+		http.Error(rw, "Expected Upload-Length header with the size of the file", http.StatusBadRequest)
+		return
+	}
+
+	if length > u.files.maxSize {
+		http.Error(rw, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	md := parseMetadata(r.Header.Get("Upload-Metadata"))
+
+	id, err := cleanID(md["id"])
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fn, err := cleanFilename(md["filename"])
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	private := md["private"] == "true"
+	if private && u.files.signer == nil {
+		http.Error(rw, errPrivateDisabled.Error(), http.StatusBadRequest)
+		return
+	}
+
+	up, err := u.uploads.Create(id, fn, private, length)
+	if err != nil {
+		l.Error("Unable to create upload", "error", err)
+		http.Error(rw, "Unable to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	l.Info("Created upload", "upload", up.ID, "id", id, "filename", fn, "length", length)
+
+	rw.Header().Set("Location", "/uploads/"+up.ID)
+	rw.Header().Set("Upload-Expires", up.Expires.UTC().Format(http.TimeFormat))
+	rw.WriteHeader(http.StatusCreated)
+}
+
+// Head returns the progress of an upload in the Upload-Offset header
+func (u *Uploads) Head(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Tus-Resumable", tusVersion)
+	rw.Header().Set("Cache-Control", "no-store")
+
+	up, err := u.uploads.Get(mux.Vars(r)["upload"])
+	if err != nil {
+		u.uploadError(rw, r, err)
+		return
+	}
+
+	writeProgress(rw, up)
+}
+
+// Patch saves a chunk of the upload, the Upload-Offset header must be the
+// number of bytes already received
+func (u *Uploads) Patch(rw http.ResponseWriter, r *http.Request) {
+	l := logging.Logger(r.Context(), u.log)
+	rw.Header().Set("Tus-Resumable", tusVersion)
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(rw, "Expected Content-Type application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(rw, "Expected Upload-Offset header", http.StatusBadRequest)
+		return
+	}
+
+	// the server timeouts are too short for large chunks on a slow
+	// connection, when the deadline can not be extended the chunk may be
+	// cut off by the server read timeout
+	if u.chunkTimeout > 0 {
+		err = extendDeadline(rw, u.chunkTimeout)
+		if err != nil {
+			l.Error("Unable to extend deadline for chunk, it may time out", "error", err)
+		}
+	}
+
+	body := http.MaxBytesReader(rw, r.Body, u.maxChunk)
+
+	up, err := u.uploads.Write(mux.Vars(r)["upload"], offset, body)
+	if err != nil {
+		// the part of a chunk received before an error is kept, the offset
+		// tells the client where to resume
+		if up.ID != "" {
+			writeProgress(rw, up)
+		}
+
+		u.uploadError(rw, r, err)
+		return
+	}
+
+	l.Debug("Received chunk", "upload", up.ID, "offset", up.Offset, "length", up.Length)
+
+	writeProgress(rw, up)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// Complete saves the image once all of the chunks have been received, the
+// response is the same as for a single request upload
+func (u *Uploads) Complete(rw http.ResponseWriter, r *http.Request) {
+	l := logging.Logger(r.Context(), u.log)
+	id := mux.Vars(r)["upload"]
+
+	rc, up, err := u.uploads.Open(id)
+	if err != nil {
+		u.uploadError(rw, r, err)
+		return
+	}
+	defer rc.Close()
+
+	err = u.files.saveFile(r.Context(), up.ProductID, up.Filename, up.Private, rw, rc)
+	if err != nil {
+		// the upload is kept until it expires so that the client can retry
+		return
+	}
+
+	err = u.uploads.Delete(id)
+	if err != nil {
+		l.Error("Unable to delete completed upload", "upload", id, "error", err)
+	}
+}
+
+// Delete cancels an upload and removes the chunks which have been received
+func (u *Uploads) Delete(rw http.ResponseWriter, r *http.Request) {
+	rw.Header().Set("Tus-Resumable", tusVersion)
+
+	err := u.uploads.Delete(mux.Vars(r)["upload"])
+	if err != nil {
+		u.uploadError(rw, r, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// uploadError writes the response for an error returned by the uploads
+// manager
+func (u *Uploads) uploadError(rw http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case xerrors.Is(err, uploads.ErrNotFound):
+		http.Error(rw, err.Error(), http.StatusNotFound)
+	case xerrors.Is(err, uploads.ErrOffsetMismatch), xerrors.Is(err, uploads.ErrIncomplete):
+		http.Error(rw, err.Error(), http.StatusConflict)
+	case xerrors.Is(err, uploads.ErrTooLarge), isTooLarge(err):
+		http.Error(rw, "Chunk too large", http.StatusRequestEntityTooLarge)
+	default:
+		logging.Logger(r.Context(), u.log).Error("Unable to process upload", "error", err)
+		http.Error(rw, "Unable to process upload", http.StatusInternalServerError)
+	}
+}
+
+// extendDeadline allows d to read the request and write the response
+func extendDeadline(rw http.ResponseWriter, d time.Duration) error {
+	rc := http.NewResponseController(rw)
+	t := time.Now().Add(d)
+
+	err := rc.SetReadDeadline(t)
+	if err == nil {
+		err = rc.SetWriteDeadline(t)
+	}
+
+	return err
+}
+
+// writeProgress sets the headers for the progress of an upload
+func writeProgress(rw http.ResponseWriter, up uploads.Upload) {
+	rw.Header().Set("Upload-Offset", strconv.FormatInt(up.Offset, 10))
+	rw.Header().Set("Upload-Length", strconv.FormatInt(up.Length, 10))
+	rw.Header().Set("Upload-Expires", up.Expires.UTC().Format(http.TimeFormat))
+}
+
+// parseMetadata decodes the tus Upload-Metadata header, a comma separated
+// list of keys and base64 encoded values, invalid values are ignored
+func parseMetadata(h string) map[string]string {
+	md := map[string]string{}
+
+	for _, kv := range strings.Split(h, ",") {
+		p := strings.Fields(kv)
+		if len(p) != 2 {
+			continue
+		}
+
+		v, err := base64.StdEncoding.DecodeString(p[1])
+		if err != nil {
+			continue
+		}
+
+		md[p[0]] = string(v)
+	}
+
+	return md
+}
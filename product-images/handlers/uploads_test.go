@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/go-hclog"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/files"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/images"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/uploads"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/logging"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/metrics"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupUploads(t *testing.T) (*mux.Router, files.Storage) {
+	l, err := files.NewLocal(t.TempDir(), 10000)
+	require.NoError(t, err)
+
+	v, err := images.NewValidator(images.DefaultTypes, 100, 100)
+	require.NoError(t, err)
+
+	s := files.NewContentAddressed(l)
+	fh := NewFiles(s, v, images.NewResizer(100, 100, nil), nil, 1024, "", hclog.NewNullLogger())
+	uh := NewUploads(uploads.New(l, time.Hour), fh, 100, time.Minute, hclog.NewNullLogger())
+
+	r := newRouter(fh)
+	r.Methods(http.MethodPost).Path("/uploads").HandlerFunc(uh.Create)
+	r.Methods(http.MethodHead).Path("/uploads/{upload:[0-9a-f]+}").HandlerFunc(uh.Head)
+	r.Methods(http.MethodPatch).Path("/uploads/{upload:[0-9a-f]+}").HandlerFunc(uh.Patch)
+	r.Methods(http.MethodPost).Path("/uploads/{upload:[0-9a-f]+}/complete").HandlerFunc(uh.Complete)
+	r.Methods(http.MethodDelete).Path("/uploads/{upload:[0-9a-f]+}").HandlerFunc(uh.Delete)
+
+	return r, s
+}
+
+func createUpload(t *testing.T, r http.Handler, length int, id, fn string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/uploads", nil)
+	req.Header.Set("Upload-Length", strconv.Itoa(length))
+	req.Header.Set("Upload-Metadata", "id "+base64.StdEncoding.EncodeToString([]byte(id))+",filename "+base64.StdEncoding.EncodeToString([]byte(fn)))
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func patchUpload(t *testing.T, r http.Handler, loc string, offset int, chunk []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPatch, loc, bytes.NewReader(chunk))
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	return rr
+}
+
+func TestResumableUploadSavesImage(t *testing.T) {
+	r, s := setupUploads(t)
+	img := pngImage(t, 20, 20)
+
+	rr := createUpload(t, r, len(img), "1", "Test.png")
+	require.Equal(t, http.StatusCreated, rr.Code)
+	assert.Equal(t, tusVersion, rr.Header().Get("Tus-Resumable"))
+
+	loc := rr.Header().Get("Location")
+	require.NotEmpty(t, loc)
+
+	// send the image in chunks of 50 bytes
+	for o := 0; o < len(img); o += 50 {
+		end := o + 50
+		if end > len(img) {
+			end = len(img)
+		}
+
+		// completing before all chunks have been received fails
+		rr = httptest.NewRecorder()
+		r.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, loc+"/complete", nil))
+		require.Equal(t, http.StatusConflict, rr.Code)
+
+		rr = patchUpload(t, r, loc, o, img[o:end])
+		require.Equal(t, http.StatusNoContent, rr.Code)
+		assert.Equal(t, strconv.Itoa(end), rr.Header().Get("Upload-Offset"))
+	}
+
+	// the progress can be read to resume an upload
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodHead, loc, nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, strconv.Itoa(len(img)), rr.Header().Get("Upload-Offset"))
+	assert.Equal(t, strconv.Itoa(len(img)), rr.Header().Get("Upload-Length"))
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, loc+"/complete", nil))
+	require.Equal(t, http.StatusOK, rr.Code)
+
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/images/1/test.png", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, img, rr.Body.Bytes())
+
+	// the chunks are removed once the upload is complete
+	rr = httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodHead, loc, nil))
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+
+	ok, err := s.Exists("1/test.png")
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestResumableUploadExtendsDeadlineBehindMiddleware(t *testing.T) {
+	r, _ := setupUploads(t)
+
+	hm, err := metrics.NewHTTP("test", prometheus.NewRegistry())
+	require.NoError(t, err)
+
+	// the same middleware as main so that the deadline is set through
+	// every wrapped ResponseWriter
+	lm := logging.NewMiddleware(hclog.NewNullLogger())
+	r.Use(tracing.Middleware, hm.Middleware, lm.MiddlewareRequestID, lm.MiddlewareAccessLog)
+
+	s := httptest.NewUnstartedServer(r)
+	s.Config.ReadTimeout = 100 * time.Millisecond
+	s.Start()
+	defer s.Close()
+
+	rr := createUpload(t, r, 10, "1", "test.png")
+	require.Equal(t, http.StatusCreated, rr.Code)
+
+	// the chunk takes longer to send than the server read timeout
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write([]byte("Hello"))
+		time.Sleep(300 * time.Millisecond)
+		pw.Write([]byte("World"))
+		pw.Close()
+	}()
+
+	req, err := http.NewRequest(http.MethodPatch, s.URL+rr.Header().Get("Location"), pr)
+	require.NoError(t, err)
+	req.ContentLength = 10
+	req.Header.Set("Content-Type", "application/offset+octet-stream")
+	req.Header.Set("Upload-Offset", "0")
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Equal(t, "10", resp.Header.Get("Upload-Offset"))
+}
+
+func TestResumableUploadRejectsInvalidRequests(t *testing.T) {
+	r, _ := setupUploads(t)
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, createUpload(t, r, 1025, "1", "test.png").Code)
+	assert.Equal(t, http.StatusBadRequest, createUpload(t, r, 0, "1", "test.png").Code)
+	assert.Equal(t, http.StatusBadRequest, createUpload(t, r, 10, "1", "../test.png").Code)
+	assert.Equal(t, http.StatusBadRequest, createUpload(t, r, 10, "x", "test.png").Code)
+
+	loc := createUpload(t, r, 200, "1", "test.png").Header().Get("Location")
+
+	// chunks must start at the current offset and be no larger than the
+	// max chunk size
+	assert.Equal(t, http.StatusConflict, patchUpload(t, r, loc, 10, []byte("Hello")).Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, patchUpload(t, r, loc, 0, make([]byte, 101)).Code)
+	assert.Equal(t, http.StatusNotFound, patchUpload(t, r, "/uploads/0123456789abcdef0123456789abcdef", 0, []byte("Hello")).Code)
+
+	// the upload can be cancelled
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, httptest.NewRequest(http.MethodDelete, loc, nil))
+	assert.Equal(t, http.StatusNoContent, rr.Code)
+	assert.Equal(t, http.StatusNotFound, patchUpload(t, r, loc, 0, []byte("Hello")).Code)
+}
@@ -0,0 +1,266 @@
+package images
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"net/url"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+// Fit modes control how an image is resized to the requested width and
+// height
+const (
+	// FitContain resizes the image to fit within the width and height
+	// keeping the aspect ratio
+	FitContain = "contain"
+	// FitCover resizes the image to cover the width and height keeping the
+	// aspect ratio, the image is cropped from the center
+	FitCover = "cover"
+	// FitFill stretches the image to the width and height
+	FitFill = "fill"
+)
+
+// Output formats for resized images
+const (
+	FormatPNG  = "png"
+	FormatJPEG = "jpeg"
+	FormatWebP = "webp"
+	// FormatGIF can only be used for variants, GIF images are converted to
+	// PNG when resized on download
+	FormatGIF = "gif"
+)
+
+// defaultQuality is the JPEG quality used when the request does not set q
+const defaultQuality = 80
+
+// Qualities are the allowed values of q, each quality is stored as a
+// separate derivative so only a few values are accepted
+var Qualities = []int{50, 70, 80, 90}
+
+// ErrInvalidOptions is returned when the resize options are not valid
+var ErrInvalidOptions = errors.New("Invalid resize options")
+
+// Options for resizing an image, a zero Width or Height is calculated from
+// the aspect ratio of the image
+type Options struct {
+	Width   int
+	Height  int
+	Fit     string
+	Format  string
+	Quality int
+}
+
+// Key returns a name for the derivative created with the options, options
+// which produce the same image have the same key
+func (o Options) Key() string {
+	// quality only applies to JPEG images
+	q := o.Quality
+	if o.Format != FormatJPEG {
+		q = 0
+	}
+
+	return fmt.Sprintf("w%d-h%d-%s-q%d.%s", o.Width, o.Height, o.Fit, q, o.Format)
+}
+
+// ContentType returns the MIME type for the output format
+func (o Options) ContentType() string {
+	return "image/" + o.Format
+}
+
+// FormatFor returns the default output format for an image of the given
+// content type, GIF images are converted to PNG
+func FormatFor(contentType string) string {
+	switch contentType {
+	case "image/jpeg":
+		return FormatJPEG
+	case "image/webp":
+		return FormatWebP
+	}
+
+	return FormatPNG
+}
+
+// Resizer creates resized images, the size of the output is limited to
+// prevent requests for very large images
+type Resizer struct {
+	maxWidth  int
+	maxHeight int
+	sizes     map[int]bool
+}
+
+// NewResizer creates a Resizer, when sizes is not empty the requested width
+// and height must be one of the sizes so that the number of derivatives
+// stored for each image is limited
+func NewResizer(maxWidth, maxHeight int, sizes []int) *Resizer {
+	rz := &Resizer{maxWidth: maxWidth, maxHeight: maxHeight, sizes: map[int]bool{}}
+	for _, s := range sizes {
+		rz.sizes[s] = true
+	}
+
+	return rz
+}
+
+// Parse reads the options from the query parameters w, h, fit, format and
+// q, ok is false when the query does not contain any resize options
+func (rz *Resizer) Parse(q url.Values) (o Options, ok bool, err error) {
+	for _, k := range []string{"w", "h", "fit", "format", "q"} {
+		if _, set := q[k]; set {
+			ok = true
+		}
+	}
+
+	if !ok {
+		return Options{}, false, nil
+	}
+
+	o = Options{Fit: FitContain, Format: q.Get("format"), Quality: defaultQuality}
+
+	o.Width, err = rz.dimension(q, "w", rz.maxWidth)
+	if err != nil {
+		return Options{}, true, err
+	}
+
+	o.Height, err = rz.dimension(q, "h", rz.maxHeight)
+	if err != nil {
+		return Options{}, true, err
+	}
+
+	if f := q.Get("fit"); f != "" {
+		if f != FitContain && f != FitCover && f != FitFill {
+			return Options{}, true, fmt.Errorf("%w: fit must be one of contain, cover or fill", ErrInvalidOptions)
+		}
+
+		o.Fit = f
+	}
+
+	if (o.Fit == FitCover || o.Fit == FitFill) && (o.Width == 0 || o.Height == 0) {
+		return Options{}, true, fmt.Errorf("%w: fit %s requires w and h", ErrInvalidOptions, o.Fit)
+	}
+
+	if o.Format != "" && o.Format != FormatPNG && o.Format != FormatJPEG && o.Format != FormatWebP {
+		return Options{}, true, fmt.Errorf("%w: format must be one of webp, png or jpeg", ErrInvalidOptions)
+	}
+
+	if v := q.Get("q"); v != "" {
+		o.Quality, err = strconv.Atoi(v)
+		if err != nil || !validQuality(o.Quality) {
+			return Options{}, true, fmt.Errorf("%w: q must be one of %v", ErrInvalidOptions, Qualities)
+		}
+	}
+
+	return o, true, nil
+}
+
+func validQuality(q int) bool {
+	for _, v := range Qualities {
+		if q == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (rz *Resizer) dimension(q url.Values, k string, max int) (int, error) {
+	v := q.Get(k)
+	if v == "" {
+		return 0, nil
+	}
+
+	d, err := strconv.Atoi(v)
+	if err != nil || d < 1 || d > max {
+		return 0, fmt.Errorf("%w: %s must be between 1 and %d", ErrInvalidOptions, k, max)
+	}
+
+	if len(rz.sizes) > 0 && !rz.sizes[d] {
+		return 0, fmt.Errorf("%w: %s is not an allowed size", ErrInvalidOptions, k)
+	}
+
+	return d, nil
+}
+
+// Resize decodes the image from r and writes the resized image to w using
+// the options, the format must be set, images are not enlarged
+func (rz *Resizer) Resize(w io.Writer, r io.Reader, o Options) error {
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidImage, err)
+	}
+
+	sr, width, height := layout(src.Bounds(), o)
+
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, sr, draw.Src, nil)
+
+	switch o.Format {
+	case FormatPNG:
+		return png.Encode(w, dst)
+	case FormatJPEG:
+		return jpeg.Encode(w, dst, &jpeg.Options{Quality: o.Quality})
+	case FormatWebP:
+		return EncodeWebP(w, dst)
+	case FormatGIF:
+		return gif.Encode(w, dst, nil)
+	}
+
+	return fmt.Errorf("%w: unknown format %q", ErrInvalidOptions, o.Format)
+}
+
+// layout returns the area of the source image to scale and the size of the
+// output image
+func layout(b image.Rectangle, o Options) (image.Rectangle, int, int) {
+	sw, sh := float64(b.Dx()), float64(b.Dy())
+
+	// the requested box, a missing dimension keeps the aspect ratio
+	tw, th := float64(o.Width), float64(o.Height)
+	switch {
+	case tw == 0 && th == 0:
+		tw, th = sw, sh
+	case th == 0:
+		th = sh * tw / sw
+	case tw == 0:
+		tw = sw * th / sh
+	}
+
+	switch o.Fit {
+	case FitCover:
+		s := math.Max(tw/sw, th/sh)
+
+		// crop the center of the source to the aspect ratio of the box
+		cw, ch := tw/s, th/s
+		x := b.Min.X + int((sw-cw)/2)
+		y := b.Min.Y + int((sh-ch)/2)
+		sr := image.Rect(x, y, x+round(cw), y+round(ch))
+
+		if s > 1 {
+			return sr, sr.Dx(), sr.Dy()
+		}
+
+		return sr, round(tw), round(th)
+
+	case FitFill:
+		s := math.Min(1, math.Min(sw/tw, sh/th))
+		return b, round(tw * s), round(th * s)
+	}
+
+	s := math.Min(1, math.Min(tw/sw, th/sh))
+	return b, round(sw * s), round(sh * s)
+}
+
+// round returns the nearest integer to f, at least 1
+func round(f float64) int {
+	i := int(math.Round(f))
+	if i < 1 {
+		return 1
+	}
+
+	return i
+}
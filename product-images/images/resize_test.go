@@ -0,0 +1,81 @@
+package images
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseOptions(t *testing.T) {
+	rz := NewResizer(1000, 1000, nil)
+
+	_, ok, err := rz.Parse(url.Values{})
+	assert.NoError(t, err)
+	assert.False(t, ok)
+
+	o, ok, err := rz.Parse(url.Values{"w": {"200"}, "h": {"100"}, "fit": {"cover"}, "format": {"webp"}, "q": {"90"}})
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, Options{Width: 200, Height: 100, Fit: FitCover, Format: FormatWebP, Quality: 90}, o)
+
+	// quality is only part of the key for JPEG
+	assert.Equal(t, "w200-h100-cover-q0.webp", o.Key())
+}
+
+func TestParseRejectsInvalidOptions(t *testing.T) {
+	rz := NewResizer(1000, 1000, []int{100, 200})
+
+	for _, q := range []string{"w=2000", "w=0", "w=abc", "w=150", "fit=stretch", "w=100&fit=cover", "format=gif", "q=101", "q=55"} {
+		v, _ := url.ParseQuery(q)
+
+		_, ok, err := rz.Parse(v)
+		assert.True(t, ok, q)
+		assert.True(t, errors.Is(err, ErrInvalidOptions), q)
+	}
+}
+
+func TestLayout(t *testing.T) {
+	b := image.Rect(0, 0, 400, 200)
+
+	tests := []struct {
+		opts Options
+		src  image.Rectangle
+		w, h int
+	}{
+		{Options{Width: 100, Fit: FitContain}, b, 100, 50},
+		{Options{Width: 100, Height: 100, Fit: FitContain}, b, 100, 50},
+		{Options{Width: 100, Height: 100, Fit: FitCover}, image.Rect(100, 0, 300, 200), 100, 100},
+		{Options{Width: 100, Height: 100, Fit: FitFill}, b, 100, 100},
+		// images are not enlarged
+		{Options{Width: 800, Fit: FitContain}, b, 400, 200},
+		{Options{Width: 800, Height: 800, Fit: FitCover}, image.Rect(100, 0, 300, 200), 200, 200},
+	}
+
+	for _, tc := range tests {
+		src, w, h := layout(b, tc.opts)
+		assert.Equal(t, tc.src, src, "%+v", tc.opts)
+		assert.Equal(t, tc.w, w, "%+v", tc.opts)
+		assert.Equal(t, tc.h, h, "%+v", tc.opts)
+	}
+}
+
+func TestResizeConvertsFormat(t *testing.T) {
+	rz := NewResizer(1000, 1000, nil)
+
+	for _, f := range []string{FormatPNG, FormatJPEG, FormatWebP} {
+		buf := &bytes.Buffer{}
+		err := rz.Resize(buf, bytes.NewReader(encode(t, "png", 40, 20)), Options{Width: 10, Fit: FitContain, Format: f, Quality: 80})
+		require.NoError(t, err, f)
+
+		cfg, format, err := image.DecodeConfig(buf)
+		require.NoError(t, err, f)
+		assert.Equal(t, f, format)
+		assert.Equal(t, 10, cfg.Width)
+		assert.Equal(t, 5, cfg.Height)
+	}
+}
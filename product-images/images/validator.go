@@ -0,0 +1,130 @@
+package images
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"net/http"
+	"strings"
+
+	// register the decoders for the supported formats
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/webp"
+)
+
+// maxHeaderSize is the max number of bytes read to find the dimensions of an
+// image, JPEG files can contain large metadata segments before the frame
+// header
+const maxHeaderSize = 1024 * 1024
+
+// Errors returned when an image is not valid
+var (
+	ErrUnsupportedType  = errors.New("Unsupported image type")
+	ErrInvalidImage     = errors.New("Invalid image")
+	ErrDimensionsTooBig = errors.New("Image dimensions too large")
+)
+
+// DefaultTypes are the image types accepted by default
+var DefaultTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+// formats maps the content type of an image to the name of its decoder
+var formats = map[string]string{
+	"image/png":  "png",
+	"image/jpeg": "jpeg",
+	"image/gif":  "gif",
+	"image/webp": "webp",
+}
+
+// Info describes a validated image
+type Info struct {
+	ContentType string
+	Width       int
+	Height      int
+}
+
+// Validator checks that uploaded files are images of an allowed type and size
+type Validator struct {
+	types     map[string]bool
+	maxWidth  int
+	maxHeight int
+}
+
+// NewValidator creates a Validator which accepts the given content types,
+// images larger than maxWidth or maxHeight are rejected, 0 disables the limit
+func NewValidator(types []string, maxWidth, maxHeight int) (*Validator, error) {
+	v := &Validator{types: map[string]bool{}, maxWidth: maxWidth, maxHeight: maxHeight}
+
+	for _, t := range types {
+		t = strings.TrimSpace(t)
+		if _, ok := formats[t]; !ok {
+			return nil, fmt.Errorf("Unsupported image type %q, supported types are %s", t, strings.Join(DefaultTypes, ", "))
+		}
+
+		v.types[t] = true
+	}
+
+	return v, nil
+}
+
+// Validate detects the type of the image from its content and decodes the
+// image header to check the dimensions, only the header is read from r so
+// large files are not held in memory
+// the returned reader contains the full contents of r
+func (v *Validator) Validate(r io.Reader) (io.Reader, Info, error) {
+	er := &errReader{r: r}
+	head := &bytes.Buffer{}
+	tr := io.TeeReader(io.LimitReader(er, maxHeaderSize), head)
+
+	// sniff the type from the first 512 bytes
+	sniff := make([]byte, 512)
+	n, _ := io.ReadFull(tr, sniff)
+	if er.err != nil {
+		return nil, Info{}, er.err
+	}
+
+	ct := http.DetectContentType(sniff[:n])
+	if !v.types[ct] {
+		return nil, Info{}, fmt.Errorf("%w: %s", ErrUnsupportedType, ct)
+	}
+
+	cfg, format, err := image.DecodeConfig(io.MultiReader(bytes.NewReader(sniff[:n]), tr))
+	if er.err != nil {
+		// errors reading the file, such as the body being too large, are
+		// returned rather than the decode error
+		return nil, Info{}, er.err
+	}
+
+	if err != nil {
+		return nil, Info{}, fmt.Errorf("%w: %s", ErrInvalidImage, err)
+	}
+
+	if format != formats[ct] || cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, Info{}, fmt.Errorf("%w: content does not match %s", ErrInvalidImage, ct)
+	}
+
+	if (v.maxWidth > 0 && cfg.Width > v.maxWidth) || (v.maxHeight > 0 && cfg.Height > v.maxHeight) {
+		return nil, Info{}, fmt.Errorf("%w: %dx%d, max is %dx%d", ErrDimensionsTooBig, cfg.Width, cfg.Height, v.maxWidth, v.maxHeight)
+	}
+
+	return io.MultiReader(head, r), Info{ContentType: ct, Width: cfg.Width, Height: cfg.Height}, nil
+}
+
+// errReader records the first error other than io.EOF returned by r
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+
+	return n, err
+}
@@ -0,0 +1,105 @@
+package images
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lossless 1x1 WebP image
+const webp1x1 = "UklGRhoAAABXRUJQVlA4TA0AAAAvAAAAEAcQERGIiP4HAA=="
+
+func encode(t *testing.T, format string, w, h int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	buf := &bytes.Buffer{}
+
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(buf, img)
+	case "jpeg":
+		err = jpeg.Encode(buf, img, nil)
+	case "gif":
+		err = gif.Encode(buf, img, nil)
+	case "webp":
+		var d []byte
+		d, err = base64.StdEncoding.DecodeString(webp1x1)
+		buf.Write(d)
+	}
+
+	require.NoError(t, err)
+
+	return buf.Bytes()
+}
+
+func TestValidateAcceptsSupportedTypes(t *testing.T) {
+	v, err := NewValidator(DefaultTypes, 100, 100)
+	require.NoError(t, err)
+
+	for _, f := range []string{"png", "jpeg", "gif", "webp"} {
+		d := encode(t, f, 20, 10)
+
+		r, info, err := v.Validate(bytes.NewReader(d))
+		require.NoError(t, err, f)
+		assert.Equal(t, "image/"+f, info.ContentType)
+
+		if f != "webp" {
+			assert.Equal(t, 20, info.Width)
+			assert.Equal(t, 10, info.Height)
+		}
+
+		// the reader returns the full image
+		rd, err := ioutil.ReadAll(r)
+		require.NoError(t, err)
+		assert.Equal(t, d, rd)
+	}
+}
+
+func TestValidateRejectsNonImages(t *testing.T) {
+	v, err := NewValidator(DefaultTypes, 0, 0)
+	require.NoError(t, err)
+
+	_, _, err = v.Validate(bytes.NewBufferString("#!/bin/sh\necho hello"))
+	assert.True(t, errors.Is(err, ErrUnsupportedType))
+}
+
+func TestValidateRejectsCorruptImage(t *testing.T) {
+	v, err := NewValidator(DefaultTypes, 0, 0)
+	require.NoError(t, err)
+
+	// a PNG signature followed by garbage
+	d := append([]byte("\x89PNG\r\n\x1a\n"), bytes.Repeat([]byte{0xff}, 64)...)
+
+	_, _, err = v.Validate(bytes.NewReader(d))
+	assert.True(t, errors.Is(err, ErrInvalidImage))
+}
+
+func TestValidateRejectsTypesNotAllowed(t *testing.T) {
+	v, err := NewValidator([]string{"image/png"}, 0, 0)
+	require.NoError(t, err)
+
+	_, _, err = v.Validate(bytes.NewReader(encode(t, "gif", 10, 10)))
+	assert.True(t, errors.Is(err, ErrUnsupportedType))
+}
+
+func TestValidateRejectsLargeDimensions(t *testing.T) {
+	v, err := NewValidator(DefaultTypes, 100, 50)
+	require.NoError(t, err)
+
+	_, _, err = v.Validate(bytes.NewReader(encode(t, "png", 100, 51)))
+	assert.True(t, errors.Is(err, ErrDimensionsTooBig))
+}
+
+func TestNewValidatorRejectsUnknownTypes(t *testing.T) {
+	_, err := NewValidator([]string{"image/png", "image/tiff"}, 0, 0)
+	assert.Error(t, err)
+}
@@ -0,0 +1,472 @@
+package images
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+)
+
+// EncodeWebP writes img to w as a lossless WebP image
+//
+// golang.org/x/image/webp only decodes WebP so this is a minimal VP8L
+// encoder, https://developers.google.com/speed/webp/docs/webp_lossless_bitstream_specification
+// pixels are coded with the subtract green and predictor transforms followed
+// by a Huffman code for each channel, backward references and color caches
+// are not used
+func EncodeWebP(w io.Writer, img image.Image) error {
+	b := img.Bounds()
+	width, height := b.Dx(), b.Dy()
+
+	if width < 1 || height < 1 || width > 1<<14 || height > 1<<14 {
+		return errors.New("webp: invalid image size")
+	}
+
+	nrgba := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(nrgba, nrgba.Bounds(), img, b.Min, draw.Src)
+	pix := nrgba.Pix
+
+	alpha := false
+	for i := 3; i < len(pix); i += 4 {
+		if pix[i] != 0xff {
+			alpha = true
+			break
+		}
+	}
+
+	bw := &bitWriter{}
+
+	// header
+	bw.write(0x2f, 8)
+	bw.write(uint32(width-1), 14)
+	bw.write(uint32(height-1), 14)
+	bw.write(boolBit(alpha), 1)
+	bw.write(0, 3)
+
+	// transforms, the decoder inverts them in reverse order
+	subtractGreen(pix)
+	bw.write(1, 1)
+	bw.write(transformSubtractGreen, 2)
+
+	residuals := predict(pix, width, height)
+	bw.write(1, 1)
+	bw.write(transformPredictor, 2)
+	writePredictorImage(bw, width, height)
+
+	bw.write(0, 1)
+
+	// main image, no color cache or meta prefix codes
+	bw.write(0, 1)
+	bw.write(0, 1)
+	writePixels(bw, residuals)
+
+	return writeRIFF(w, bw.bytes())
+}
+
+const (
+	transformPredictor     = 0
+	transformSubtractGreen = 2
+
+	// predictorBits is the log-2 size of the predictor tiles, the same
+	// predictor is used for the whole image so the largest tile is used
+	predictorBits = 9
+	// predictorMode is Average2(L, T)
+	predictorMode = 7
+
+	// greenAlphabetSize is the number of literal green values plus the
+	// length prefix codes for backward references
+	greenAlphabetSize    = 256 + 24
+	distanceAlphabetSize = 40
+	maxCodeLength        = 15
+	maxCodeLengthLength  = 7
+)
+
+// codeLengthCodeOrder is the order the lengths of the code length code are
+// written in
+var codeLengthCodeOrder = []int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// subtractGreen subtracts the green value from the red and blue values of
+// each NRGBA pixel
+func subtractGreen(pix []byte) {
+	for i := 0; i < len(pix); i += 4 {
+		pix[i] -= pix[i+1]
+		pix[i+2] -= pix[i+1]
+	}
+}
+
+// predict returns the difference between each pixel and its prediction, the
+// first pixel is predicted as opaque black, the rest of the first row from
+// the left pixel, the first column from the top pixel and all other pixels
+// from the average of the left and top pixels
+func predict(pix []byte, width, height int) []byte {
+	res := make([]byte, len(pix))
+	stride := width * 4
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := y*stride + x*4
+
+			for c := 0; c < 4; c++ {
+				var pred byte
+
+				switch {
+				case x == 0 && y == 0:
+					if c == 3 {
+						pred = 0xff
+					}
+				case y == 0:
+					pred = pix[p-4+c]
+				case x == 0:
+					pred = pix[p-stride+c]
+				default:
+					pred = byte((uint16(pix[p-4+c]) + uint16(pix[p-stride+c])) / 2)
+				}
+
+				res[p+c] = pix[p+c] - pred
+			}
+		}
+	}
+
+	return res
+}
+
+// writePredictorImage writes the sub image which selects the predictor for
+// each tile, every pixel is the same so each channel is coded with zero bits
+func writePredictorImage(bw *bitWriter, width, height int) {
+	bw.write(predictorBits-2, 3)
+
+	// no color cache
+	bw.write(0, 1)
+
+	// the mode is stored in the green channel
+	writeSimpleCode(bw, []int{predictorMode})
+	writeSimpleCode(bw, []int{0})
+	writeSimpleCode(bw, []int{0})
+	writeSimpleCode(bw, []int{0})
+	writeSimpleCode(bw, []int{0})
+}
+
+// writePixels writes the prefix codes for each channel followed by the
+// coded ARGB values of each pixel
+func writePixels(bw *bitWriter, pix []byte) {
+	green := make([]int, greenAlphabetSize)
+	red := make([]int, 256)
+	blue := make([]int, 256)
+	alpha := make([]int, 256)
+
+	for i := 0; i < len(pix); i += 4 {
+		red[pix[i]]++
+		green[pix[i+1]]++
+		blue[pix[i+2]]++
+		alpha[pix[i+3]]++
+	}
+
+	gc := writeCode(bw, green)
+	rc := writeCode(bw, red)
+	bc := writeCode(bw, blue)
+	ac := writeCode(bw, alpha)
+	writeSimpleCode(bw, []int{0})
+
+	for i := 0; i < len(pix); i += 4 {
+		gc.write(bw, int(pix[i+1]))
+		rc.write(bw, int(pix[i]))
+		bc.write(bw, int(pix[i+2]))
+		ac.write(bw, int(pix[i+3]))
+	}
+}
+
+// prefixCode holds the bit reversed canonical codes for an alphabet
+type prefixCode struct {
+	codes   []uint32
+	lengths []uint8
+}
+
+func (p *prefixCode) write(bw *bitWriter, symbol int) {
+	bw.write(p.codes[symbol], uint(p.lengths[symbol]))
+}
+
+// writeCode writes the prefix code for the symbol counts and returns the
+// code, alphabets with one or two literal symbols use a simple code
+func writeCode(bw *bitWriter, counts []int) *prefixCode {
+	used := []int{}
+	for s, c := range counts {
+		if c > 0 {
+			used = append(used, s)
+		}
+	}
+
+	if len(used) <= 2 {
+		return writeSimpleCode(bw, used)
+	}
+
+	lengths := huffmanLengths(counts, maxCodeLength)
+
+	// code the lengths with a Huffman code over the values 0 to 15
+	clCounts := make([]int, len(codeLengthCodeOrder))
+	for _, l := range lengths {
+		clCounts[l]++
+	}
+
+	// a code needs at least two symbols, add an unused symbol when every
+	// length is the same
+	n := 0
+	for _, c := range clCounts {
+		if c > 0 {
+			n++
+		}
+	}
+
+	if n == 1 {
+		if clCounts[0] == 0 {
+			clCounts[0] = 1
+		} else {
+			clCounts[1] = 1
+		}
+	}
+
+	clLengths := huffmanLengths(clCounts, maxCodeLengthLength)
+	clCode := newPrefixCode(clLengths)
+
+	nCodes := 4
+	for i, s := range codeLengthCodeOrder {
+		if clLengths[s] > 0 && i+1 > nCodes {
+			nCodes = i + 1
+		}
+	}
+
+	bw.write(0, 1)
+	bw.write(uint32(nCodes-4), 4)
+	for _, s := range codeLengthCodeOrder[:nCodes] {
+		bw.write(uint32(clLengths[s]), 3)
+	}
+
+	// code lengths are written for every symbol
+	bw.write(0, 1)
+	for _, l := range lengths {
+		clCode.write(bw, int(l))
+	}
+
+	return newPrefixCode(lengths)
+}
+
+// writeSimpleCode writes a code for up to two symbols less than 256, a
+// single symbol is coded with zero bits
+func writeSimpleCode(bw *bitWriter, symbols []int) *prefixCode {
+	if len(symbols) == 0 {
+		symbols = []int{0}
+	}
+
+	bw.write(1, 1)
+	bw.write(uint32(len(symbols)-1), 1)
+
+	if symbols[0] < 2 {
+		bw.write(0, 1)
+		bw.write(uint32(symbols[0]), 1)
+	} else {
+		bw.write(1, 1)
+		bw.write(uint32(symbols[0]), 8)
+	}
+
+	p := &prefixCode{codes: make([]uint32, 256), lengths: make([]uint8, 256)}
+
+	if len(symbols) == 2 {
+		bw.write(uint32(symbols[1]), 8)
+
+		p.codes[symbols[1]] = 1
+		p.lengths[symbols[0]] = 1
+		p.lengths[symbols[1]] = 1
+	}
+
+	return p
+}
+
+// newPrefixCode assigns the canonical codes for the code lengths
+func newPrefixCode(lengths []uint8) *prefixCode {
+	count := make([]uint32, maxCodeLength+1)
+	for _, l := range lengths {
+		count[l]++
+	}
+	count[0] = 0
+
+	next := make([]uint32, maxCodeLength+1)
+	code := uint32(0)
+	for l := 1; l <= maxCodeLength; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+
+	p := &prefixCode{codes: make([]uint32, len(lengths)), lengths: lengths}
+	for s, l := range lengths {
+		if l == 0 {
+			continue
+		}
+
+		p.codes[s] = reverse(next[l], uint(l))
+		next[l]++
+	}
+
+	return p
+}
+
+// reverse returns the first n bits of v in reverse order, codes are read
+// from the most significant bit but the bit stream is least significant bit
+// first
+func reverse(v uint32, n uint) uint32 {
+	r := uint32(0)
+	for i := uint(0); i < n; i++ {
+		r = r<<1 | v&1
+		v >>= 1
+	}
+
+	return r
+}
+
+// huffmanLengths returns the length of the Huffman code for each symbol,
+// when the longest code is over maxLength the small counts are increased
+// until the code fits, counts must contain at least two non zero values
+func huffmanLengths(counts []int, maxLength int) []uint8 {
+	for min := 1; ; min *= 2 {
+		h := &nodeHeap{}
+		nodes := []huffmanNode{}
+
+		for s, c := range counts {
+			if c == 0 {
+				continue
+			}
+
+			if c < min {
+				c = min
+			}
+
+			nodes = append(nodes, huffmanNode{count: c, symbol: s, left: -1, right: -1})
+			heap.Push(h, heapItem{c, len(nodes) - 1})
+		}
+
+		for h.Len() > 1 {
+			a := heap.Pop(h).(heapItem)
+			b := heap.Pop(h).(heapItem)
+
+			nodes = append(nodes, huffmanNode{count: a.count + b.count, symbol: -1, left: a.node, right: b.node})
+			heap.Push(h, heapItem{a.count + b.count, len(nodes) - 1})
+		}
+
+		lengths := make([]uint8, len(counts))
+		if depth(nodes, len(nodes)-1, 0, lengths) <= maxLength {
+			return lengths
+		}
+	}
+}
+
+type huffmanNode struct {
+	count       int
+	symbol      int
+	left, right int
+}
+
+// depth sets the code length for the leaves below node n and returns the
+// maximum depth
+func depth(nodes []huffmanNode, n, d int, lengths []uint8) int {
+	if nodes[n].symbol >= 0 {
+		lengths[nodes[n].symbol] = uint8(d)
+		return d
+	}
+
+	l := depth(nodes, nodes[n].left, d+1, lengths)
+	r := depth(nodes, nodes[n].right, d+1, lengths)
+
+	if l > r {
+		return l
+	}
+
+	return r
+}
+
+type heapItem struct {
+	count int
+	node  int
+}
+
+// nodeHeap is a min heap of nodes ordered by count
+type nodeHeap []heapItem
+
+func (h nodeHeap) Len() int { return len(h) }
+func (h nodeHeap) Less(i, j int) bool {
+	if h[i].count == h[j].count {
+		return h[i].node < h[j].node
+	}
+
+	return h[i].count < h[j].count
+}
+func (h nodeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *nodeHeap) Push(x interface{}) { *h = append(*h, x.(heapItem)) }
+func (h *nodeHeap) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return it
+}
+
+// bitWriter writes values least significant bit first
+type bitWriter struct {
+	buf  []byte
+	acc  uint64
+	nacc uint
+}
+
+func (b *bitWriter) write(v uint32, n uint) {
+	b.acc |= uint64(v) << b.nacc
+	b.nacc += n
+
+	for b.nacc >= 8 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc >>= 8
+		b.nacc -= 8
+	}
+}
+
+func (b *bitWriter) bytes() []byte {
+	if b.nacc > 0 {
+		b.buf = append(b.buf, byte(b.acc))
+		b.acc, b.nacc = 0, 0
+	}
+
+	return b.buf
+}
+
+// writeRIFF writes the VP8L data in a WebP container
+func writeRIFF(w io.Writer, data []byte) error {
+	pad := len(data) % 2
+
+	hdr := make([]byte, 20)
+	copy(hdr[0:], "RIFF")
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(4+8+len(data)+pad))
+	copy(hdr[8:], "WEBPVP8L")
+	binary.LittleEndian.PutUint32(hdr[16:], uint32(len(data)))
+
+	_, err := w.Write(hdr)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(data)
+	if err != nil {
+		return err
+	}
+
+	if pad > 0 {
+		_, err = w.Write([]byte{0})
+	}
+
+	return err
+}
+
+func boolBit(b bool) uint32 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
@@ -0,0 +1,49 @@
+package images
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/image/webp"
+)
+
+func TestEncodeWebPRoundTrips(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	tests := map[string]func(x, y int) color.NRGBA{
+		"gradient": func(x, y int) color.NRGBA { return color.NRGBA{uint8(x), uint8(y), uint8(x + y), 0xff} },
+		"noise": func(x, y int) color.NRGBA {
+			return color.NRGBA{uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256)), uint8(rnd.Intn(256))}
+		},
+		"solid": func(x, y int) color.NRGBA { return color.NRGBA{10, 20, 30, 0xff} },
+		"two colors": func(x, y int) color.NRGBA {
+			if (x+y)%2 == 0 {
+				return color.NRGBA{0, 0, 0, 0xff}
+			}
+			return color.NRGBA{0xff, 0xff, 0xff, 0xff}
+		},
+	}
+
+	for name, fn := range tests {
+		for _, size := range []image.Point{{1, 1}, {37, 5}, {300, 200}} {
+			img := image.NewNRGBA(image.Rect(0, 0, size.X, size.Y))
+			for y := 0; y < size.Y; y++ {
+				for x := 0; x < size.X; x++ {
+					img.SetNRGBA(x, y, fn(x, y))
+				}
+			}
+
+			buf := &bytes.Buffer{}
+			require.NoError(t, EncodeWebP(buf, img), name)
+
+			out, err := webp.Decode(buf)
+			require.NoError(t, err, "%s %v", name, size)
+			assert.Equal(t, img.Pix, out.(*image.NRGBA).Pix, "%s %v", name, size)
+		}
+	}
+}
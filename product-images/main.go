@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"os"
-	"os/signal"
+	"strconv"
+	"strings"
 	"time"
 
 	gohandlers "github.com/gorilla/handlers"
@@ -12,16 +14,82 @@ import (
 	hclog "github.com/hashicorp/go-hclog"
 	"github.com/nicholasjackson/building-microservices-youtube/product-images/files"
 	"github.com/nicholasjackson/building-microservices-youtube/product-images/handlers"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/images"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/signing"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/uploads"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/variants"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/apikey"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/compress"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/health"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/lifecycle"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/logging"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/metrics"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/ratelimit"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/tracing"
 	"github.com/nicholasjackson/env"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 var bindAddress = env.String("BIND_ADDRESS", false, ":9091", "Bind address for the server")
 var logLevel = env.String("LOG_LEVEL", false, "debug", "Log output level for the server [debug, info, trace]")
-var basePath = env.String("BASE_PATH", false, "./imagestore", "Base path to save images")
+var storageBackend = env.String("STORAGE_BACKEND", false, "local", "Storage for images [local, s3]")
+var basePath = env.String("BASE_PATH", false, "./imagestore", "Base path to save images when STORAGE_BACKEND is local")
+var s3Endpoint = env.String("S3_ENDPOINT", false, "", "URL of the S3 compatible service, i.e. http://localhost:9000")
+var s3Bucket = env.String("S3_BUCKET", false, "", "Bucket to save images when STORAGE_BACKEND is s3")
+var s3Region = env.String("S3_REGION", false, "us-east-1", "Region used to sign S3 requests")
+var s3AccessKeyID = env.String("S3_ACCESS_KEY_ID", false, "", "Access key for the S3 service")
+var s3SecretAccessKey = env.String("S3_SECRET_ACCESS_KEY", false, "", "Secret key for the S3 service")
+var s3PartSize = env.Int("S3_PART_SIZE", false, 5*1024*1024, "Size of each part for multipart uploads to S3, minimum 5MB")
+var s3Timeout = env.Duration("S3_TIMEOUT", false, 30*time.Second, "Max time for each request to S3, downloads are limited by the time to receive the response headers")
+var blobGCInterval = env.Duration("BLOB_GC_INTERVAL", false, time.Hour, "Interval between deleting blobs which are not referenced by any image, 0 disables GC")
+var blobGCGrace = env.Duration("BLOB_GC_GRACE", false, time.Hour, "Min age of an unreferenced blob before it is deleted")
+var maxUploadSize = env.Int("MAX_UPLOAD_SIZE", false, 1024*1000*5, "Max size in bytes for uploaded images")
+var allowedTypes = env.String("ALLOWED_IMAGE_TYPES", false, strings.Join(images.DefaultTypes, ","), "Comma separated list of image types which can be uploaded")
+var maxImageWidth = env.Int("MAX_IMAGE_WIDTH", false, 4096, "Max width in pixels for uploaded images, 0 disables the limit")
+var maxImageHeight = env.Int("MAX_IMAGE_HEIGHT", false, 4096, "Max height in pixels for uploaded images, 0 disables the limit")
+var resizeMaxWidth = env.Int("RESIZE_MAX_WIDTH", false, 2048, "Max width in pixels for resized images")
+var resizeMaxHeight = env.Int("RESIZE_MAX_HEIGHT", false, 2048, "Max height in pixels for resized images")
+var resizeSizes = env.String("RESIZE_SIZES", false, "100,200,400,800", "Comma separated list of the allowed widths and heights for resized images, empty allows any size")
+var cacheControl = env.String("CACHE_CONTROL", false, "public, max-age=86400", "Cache-Control header for downloaded images, empty omits the header")
+var signingKeysFile = env.String("SIGNING_KEYS_FILE", false, "", "JSON file containing the keys used to sign URLs for private images, empty disables private images")
+var signingKeysReload = env.Duration("SIGNING_KEYS_RELOAD_INTERVAL", false, time.Minute, "Interval between checks for a changed SIGNING_KEYS_FILE")
+var signingAPIKeysFile = env.String("SIGNING_API_KEYS_FILE", false, "", "JSON file containing the API keys of callers which can delete images and sign URLs, required with SIGNING_KEYS_FILE")
+var signedURLMaxTTL = env.Duration("SIGNED_URL_MAX_TTL", false, 24*time.Hour, "Max time a signed URL is valid for")
+var compressEncodings = env.String("COMPRESSION_ENCODINGS", false, strings.Join(compress.DefaultEncodings, ","), "Comma separated list of encodings for compressed responses in order of preference [br, gzip, deflate], empty disables compression")
+var compressMinSize = env.Int("COMPRESSION_MIN_SIZE", false, compress.DefaultMinSize, "Min size in bytes of a response before it is compressed")
+var compressTypes = env.String("COMPRESSION_TYPES", false, strings.Join(compress.DefaultTypes, ","), "Comma separated list of content types which are compressed, type/* matches all subtypes")
+var variantSizes = env.String("VARIANTS", false, "thumb=150x150:cover,card=400x400:contain,hero=1600x900:cover", "Comma separated list of variants created for uploaded images in the format name=WIDTHxHEIGHT[:fit]")
+var variantWorkers = env.Int("VARIANT_WORKERS", false, 2, "Number of workers creating variants")
+var variantAttempts = env.Int("VARIANT_MAX_ATTEMPTS", false, 3, "Number of times a variant job is attempted before it fails")
+var uploadExpiry = env.Duration("UPLOAD_EXPIRY", false, 24*time.Hour, "Time after the last chunk is received before a resumable upload expires")
+var uploadCleanupInterval = env.Duration("UPLOAD_CLEANUP_INTERVAL", false, 10*time.Minute, "Interval between deleting expired resumable uploads")
+var uploadMaxChunk = env.Int("UPLOAD_MAX_CHUNK_SIZE", false, 1024*1000*5, "Max size in bytes for each chunk of a resumable upload")
+var uploadChunkTimeout = env.Duration("UPLOAD_CHUNK_TIMEOUT", false, time.Minute, "Max time to receive each chunk of a resumable upload")
+var readRateLimit = env.Float64("RATE_LIMIT_READ", false, 50, "Sustained download requests per second for a client, 0 disables the limit")
+var readRateBurst = env.Int("RATE_LIMIT_READ_BURST", false, 100, "Number of download requests a client can make in a burst")
+var writeRateLimit = env.Float64("RATE_LIMIT_WRITE", false, 1, "Sustained upload requests per second for a client, 0 disables the limit")
+var writeRateBurst = env.Int("RATE_LIMIT_WRITE_BURST", false, 5, "Number of upload requests a client can make in a burst")
+var uploadBandwidth = env.Int("UPLOAD_BANDWIDTH_LIMIT", false, 1024*1000*5, "Maximum upload rate in bytes per second for a client, 0 disables the limit, a MAX_UPLOAD_SIZE upload must be readable within the 5s read timeout")
+var traceExporter = env.String("TRACE_EXPORTER", false, "none", "Exporter for OpenTelemetry spans [none, stdout, file]")
+var traceFile = env.String("TRACE_FILE", false, "./traces.json", "File spans are written to when TRACE_EXPORTER is file")
+var traceSampleRatio = env.Float64("TRACE_SAMPLE_RATIO", false, 1, "Fraction of new traces which are sampled")
+var trustForwarded = env.Bool("TRUST_X_FORWARDED_FOR", false, false, "Identify clients using the X-Forwarded-For header, only enable behind a trusted proxy")
+var healthMinFreeDisk = env.Int("HEALTH_MIN_FREE_DISK", false, 100*1024*1024, "Minimum free bytes on the BASE_PATH file system before the service reports it is not ready")
+var healthTimeout = env.Duration("HEALTH_CHECK_TIMEOUT", false, 2*time.Second, "Max time for each health check")
+var shutdownTimeout = env.Duration("SHUTDOWN_TIMEOUT", false, 30*time.Second, "Max time to wait for requests to complete on shutdown")
+var drainDelay = env.Duration("DRAIN_DELAY", false, 5*time.Second, "Time readiness fails before the server stops accepting connections on shutdown, must be less than SHUTDOWN_TIMEOUT")
 
-func main() {
+// readTimeout is the max time to read a request from the client, chunks of
+// resumable uploads extend it with UPLOAD_CHUNK_TIMEOUT
+const readTimeout = 5 * time.Second
 
-	env.Parse()
+func main() {
+	err := env.Parse()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 
 	l := hclog.New(
 		&hclog.LoggerOptions{
@@ -30,70 +98,318 @@ func main() {
 		},
 	)
 
+	// a client sends UPLOAD_BANDWIDTH_LIMIT bytes in a burst, the rest of an
+	// upload is throttled and must be read before the server times out
+	if *uploadBandwidth > 0 && *maxUploadSize > *uploadBandwidth {
+		throttled := time.Duration(*maxUploadSize-*uploadBandwidth) * time.Second / time.Duration(*uploadBandwidth)
+		if throttled >= readTimeout {
+			l.Error("Invalid UPLOAD_BANDWIDTH_LIMIT, an upload of MAX_UPLOAD_SIZE can not be read before the read timeout", "upload_bandwidth_limit", *uploadBandwidth, "max_upload_size", *maxUploadSize, "read_timeout", readTimeout)
+			os.Exit(1)
+		}
+	}
+
 	// create a logger for the server from the default logger
 	sl := l.StandardLogger(&hclog.StandardLoggerOptions{InferLevels: true})
 
-	// create the storage class, use local storage
-	// max filesize 5MB
-	stor, err := files.NewLocal(*basePath, 1024*1000*5)
+	if *drainDelay < 0 || *drainDelay >= *shutdownTimeout {
+		l.Error("Invalid DRAIN_DELAY, must be at least 0 and less than SHUTDOWN_TIMEOUT", "drain_delay", *drainDelay, "shutdown_timeout", *shutdownTimeout)
+		os.Exit(1)
+	}
+
+	// shutdown hooks run in reverse order when the process receives SIGINT
+	// or SIGTERM
+	lc := lifecycle.New(l, *shutdownTimeout)
+
+	// configure OpenTelemetry tracing, spans are flushed after the server
+	// has stopped
+	shutdownTracing, err := tracing.Setup("product-images", *traceExporter, *traceFile, *traceSampleRatio)
+	if err != nil {
+		l.Error("Unable to configure tracing", "error", err)
+		os.Exit(1)
+	}
+
+	lc.OnShutdown("tracing", lifecycle.ShutdownFunc(shutdownTracing))
+
+	// handlers for liveness and readiness, checks for the storage backend are
+	// added when the storage is created
+	hc := health.New(l, *healthTimeout)
+
+	// create the storage class
+	bs, err := newStorage(hc, *maxUploadSize, l)
+	if err != nil {
+		l.Error("Unable to create storage", "backend", *storageBackend, "error", err)
+		os.Exit(1)
+	}
+
+	// files are stored by the hash of their contents so identical images
+	// are only stored once, unreferenced blobs are deleted periodically
+	stor := files.NewContentAddressed(bs)
+
+	if *blobGCInterval > 0 {
+		gctx, gcancel := context.WithCancel(context.Background())
+		lc.OnShutdown("blob_gc", func(context.Context) error {
+			gcancel()
+			return nil
+		})
+
+		stor.MonitorGC(gctx, *blobGCInterval, *blobGCGrace, l.Named("gc"))
+	}
+
+	// uploaded files must be images of an allowed type and size
+	iv, err := images.NewValidator(strings.Split(*allowedTypes, ","), *maxImageWidth, *maxImageHeight)
 	if err != nil {
-		l.Error("Unable to create storage", "error", err)
+		l.Error("Unable to create image validator", "error", err)
 		os.Exit(1)
 	}
 
+	// images are resized on download
+	sizes, err := parseSizes(*resizeSizes)
+	if err != nil {
+		l.Error("Invalid RESIZE_SIZES", "error", err)
+		os.Exit(1)
+	}
+
+	rz := images.NewResizer(*resizeMaxWidth, *resizeMaxHeight, sizes)
+
+	// variants are created in the background after an image is uploaded,
+	// running jobs complete before the process exits
+	vs, err := variants.Parse(*variantSizes)
+	if err != nil {
+		l.Error("Invalid VARIANTS", "error", err)
+		os.Exit(1)
+	}
+
+	vp := variants.New(l.Named("variants"), stor, rz, vs, *variantAttempts)
+	vp.Start(*variantWorkers)
+	lc.OnShutdown("variants", vp.Shutdown)
+
 	// create the handlers
-	fh := handlers.NewFiles(stor, l)
-	mw := handlers.GzipHandler{}
+	fh := handlers.NewFiles(stor, iv, rz, vp, int64(*maxUploadSize), *cacheControl, l)
+
+	// callers can delete images and sign URLs, without API keys these
+	// requests are rejected
+	if *signingAPIKeysFile != "" {
+		sc, err := apikey.Load(*signingAPIKeysFile)
+		if err != nil {
+			l.Error("Unable to load API keys", "error", err)
+			os.Exit(1)
+		}
+
+		fh.SetCallers(sc)
+	}
+
+	// private images are served with signed URLs, the keys are reloaded
+	// when the file changes so that they can be rotated without a restart
+	if *signingKeysFile != "" {
+		sg, err := signing.Load(*signingKeysFile)
+		if err != nil {
+			l.Error("Unable to load signing keys", "error", err)
+			os.Exit(1)
+		}
+
+		if *signingAPIKeysFile == "" {
+			l.Error("SIGNING_API_KEYS_FILE is required when SIGNING_KEYS_FILE is set")
+			os.Exit(1)
+		}
+
+		sctx, scancel := context.WithCancel(context.Background())
+		lc.OnShutdown("signing_keys", func(context.Context) error {
+			scancel()
+			return nil
+		})
+
+		sg.MonitorFile(sctx, *signingKeysFile, *signingKeysReload, l.Named("signing"))
+		fh.SetSigning(sg, *signedURLMaxTTL)
+	}
+
+	// chunks of resumable uploads are stored in the backend until the
+	// upload is complete, abandoned uploads are deleted when they expire
+	um := uploads.New(bs, *uploadExpiry)
+
+	uctx, ucancel := context.WithCancel(context.Background())
+	lc.OnShutdown("uploads_cleanup", func(context.Context) error {
+		ucancel()
+		return nil
+	})
+
+	um.MonitorExpired(uctx, *uploadCleanupInterval, l.Named("uploads"))
+	uh := handlers.NewUploads(um, fh, int64(*uploadMaxChunk), *uploadChunkTimeout, l)
+
+	// images are already compressed, only JSON responses are compressed
+	cm, err := compress.New(strings.Split(*compressEncodings, ","), *compressMinSize, strings.Split(*compressTypes, ","))
+	if err != nil {
+		l.Error("Invalid COMPRESSION_ENCODINGS", "error", err)
+		os.Exit(1)
+	}
+
+	// create the metrics for the HTTP handlers
+	hm, err := metrics.NewHTTP("product_images", prometheus.DefaultRegisterer)
+	if err != nil {
+		l.Error("Unable to create metrics", "error", err)
+		os.Exit(1)
+	}
 
 	// create a new serve mux and register the handlers
 	sm := mux.NewRouter()
+	sm.Use(tracing.Middleware)
+	sm.Use(hm.Middleware)
+
+	// add a request id and access log to all requests
+	lm := logging.NewMiddleware(l)
+	sm.Use(lm.MiddlewareRequestID)
+	sm.Use(lm.MiddlewareAccessLog)
 
 	ch := gohandlers.CORS(gohandlers.AllowedOrigins([]string{"*"}))
 
+	// limit the rate of requests for each client
+	key := ratelimit.KeyByIP(*trustForwarded)
+	sm.Use(newRateLimit(key).MiddlewareRateLimit)
+
 	// upload files
+	// sign URLs for authorised callers
+	if *signingKeysFile != "" {
+		sm.Methods(http.MethodPost).Path("/signed-urls").Handler(fh.MiddlewareRequireCaller(http.HandlerFunc(fh.SignURL)))
+	}
+
 	ph := sm.Methods(http.MethodPost).Subrouter()
-	ph.HandleFunc("/images/{id:[0-9]+}/{filename:[a-zA-Z]+\\.[a-z]{3}}", fh.UploadREST)
+	ph.HandleFunc("/images/{id:[0-9]+}/{filename}", fh.UploadREST)
 	ph.HandleFunc("/", fh.UploadMultipart)
 
+	// resumable uploads
+	rh := sm.PathPrefix("/uploads").Subrouter()
+	rh.Methods(http.MethodPost).Path("").HandlerFunc(uh.Create)
+	rh.Methods(http.MethodHead).Path("/{upload:[0-9a-f]+}").HandlerFunc(uh.Head)
+	rh.Methods(http.MethodPatch).Path("/{upload:[0-9a-f]+}").HandlerFunc(uh.Patch)
+	rh.Methods(http.MethodPost).Path("/{upload:[0-9a-f]+}/complete").HandlerFunc(uh.Complete)
+	rh.Methods(http.MethodDelete).Path("/{upload:[0-9a-f]+}").HandlerFunc(uh.Delete)
+
+	if *uploadBandwidth > 0 {
+		// allow a client to send one second of data in a burst
+		bw := ratelimit.NewBandwidth(*uploadBandwidth, *uploadBandwidth, key)
+		ph.Use(bw.MiddlewareLimitBandwidth)
+		rh.Use(bw.MiddlewareLimitBandwidth)
+	}
+
+	// delete files, only authorised callers can delete images
+	dh := sm.Methods(http.MethodDelete).Subrouter()
+	dh.Handle("/images/{id:[0-9]+}/{filename}", fh.MiddlewareRequireCaller(http.HandlerFunc(fh.Delete)))
+
 	// get files
-	gh := sm.Methods(http.MethodGet).Subrouter()
-	gh.Handle(
-		"/images/{id:[0-9]+}/{filename:[a-zA-Z]+\\.[a-z]{3}}",
-		http.StripPrefix("/images/", http.FileServer(http.Dir(*basePath))),
-	)
-	gh.Use(mw.GzipMiddleware)
+	gh := sm.Methods(http.MethodGet, http.MethodHead).Subrouter()
+	gh.HandleFunc("/images/{id:[0-9]+}", fh.ListImages)
+	gh.HandleFunc("/images/{id:[0-9]+}/{filename}", fh.Download)
+	gh.HandleFunc("/images/{id:[0-9]+}/{variant:[a-z]+}/{filename}", fh.DownloadVariant)
+	gh.HandleFunc("/images/jobs/{job:[0-9a-f]+}", fh.JobStatus)
+	gh.Use(cm.MiddlewareCompress)
+
+	// handler for metrics
+	sm.Methods(http.MethodGet).Path("/metrics").Handler(promhttp.Handler())
+
+	sm.Methods(http.MethodGet).Path("/healthz").HandlerFunc(hc.LiveHandler)
+	sm.Methods(http.MethodGet).Path("/readyz").HandlerFunc(hc.ReadyHandler)
 
 	// create a new server
 	s := http.Server{
 		Addr:         *bindAddress,      // configure the bind address
 		Handler:      ch(sm),            // set the default handler
 		ErrorLog:     sl,                // the logger for the server
-		ReadTimeout:  5 * time.Second,   // max time to read request from the client
+		ReadTimeout:  readTimeout,       // max time to read request from the client
 		WriteTimeout: 10 * time.Second,  // max time to write response to the client
 		IdleTimeout:  120 * time.Second, // max time for connections using TCP Keep-Alive
 	}
 
-	// start the server
-	go func() {
-		l.Info("Starting server", "bind_address", *bindAddress)
+	// start the server, on shutdown the server waits for current operations
+	// to complete
+	l.Info("Starting server", "bind_address", *bindAddress)
+	lc.ServeHTTP("http", &s, s.ListenAndServe)
+
+	// fail readiness checks and wait for load balancers to stop sending
+	// traffic before the server stops accepting connections
+	lc.OnShutdown("health", func(ctx context.Context) error {
+		return hc.Drain(ctx, *drainDelay)
+	})
+
+	os.Exit(lc.Wait())
+}
+
+// newStorage creates the storage backend selected by STORAGE_BACKEND and
+// adds the readiness checks for the backend, product-images is ready when
+// images can be written to the base path or the S3 bucket can be reached
+func newStorage(hc *health.Health, maxSize int, l hclog.Logger) (files.Storage, error) {
+	switch *storageBackend {
+	case "local":
+		hc.AddReadinessCheck("storage_writable", health.Writable(*basePath))
+		hc.AddReadinessCheck("disk_space", health.DiskSpace(*basePath, uint64(*healthMinFreeDisk)))
+
+		lo, err := files.NewLocal(*basePath, maxSize)
+		if err != nil {
+			return nil, err
+		}
+
+		// remove files left by uploads which were interrupted by a crash
+		n, err := lo.Sweep()
+		if err != nil {
+			return nil, err
+		}
+
+		if n > 0 {
+			l.Info("Removed temporary files", "count", n)
+		}
+
+		return lo, nil
+	case "s3":
+		s, err := files.NewS3(files.S3Options{
+			Endpoint:        *s3Endpoint,
+			Bucket:          *s3Bucket,
+			Region:          *s3Region,
+			AccessKeyID:     *s3AccessKeyID,
+			SecretAccessKey: *s3SecretAccessKey,
+			PartSize:        *s3PartSize,
+			Timeout:         *s3Timeout,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		hc.AddReadinessCheck("storage_s3", s.Check)
+
+		return s, nil
+	}
+
+	return nil, fmt.Errorf("Unknown storage backend %q", *storageBackend)
+}
 
-		err := s.ListenAndServe()
+// parseSizes parses a comma separated list of sizes
+func parseSizes(s string) ([]int, error) {
+	sizes := []int{}
+	if s == "" {
+		return sizes, nil
+	}
+
+	for _, v := range strings.Split(s, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(v))
 		if err != nil {
-			l.Error("Unable to start server", "error", err)
-			os.Exit(1)
+			return nil, fmt.Errorf("Invalid size %q", v)
 		}
-	}()
 
-	// trap sigterm or interupt and gracefully shutdown the server
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	signal.Notify(c, os.Kill)
+		sizes = append(sizes, i)
+	}
 
-	// Block until a signal is received.
-	sig := <-c
-	l.Info("Shutting down server with", "signal", sig)
+	return sizes, nil
+}
+
+// newRateLimit creates the rate limiting middleware with separate limits
+// for downloads and uploads
+func newRateLimit(key ratelimit.KeyFunc) *ratelimit.Middleware {
+	var rl, wl *ratelimit.Limiter
+
+	if *readRateLimit > 0 {
+		rl = ratelimit.NewLimiter(*readRateLimit, *readRateBurst)
+	}
+
+	if *writeRateLimit > 0 {
+		wl = ratelimit.NewLimiter(*writeRateLimit, *writeRateBurst)
+	}
 
-	// gracefully shutdown the server, waiting max 30 seconds for current operations to complete
-	ctx, _ := context.WithTimeout(context.Background(), 30*time.Second)
-	s.Shutdown(ctx)
+	return ratelimit.New(rl, wl, key)
 }
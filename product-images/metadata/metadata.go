@@ -0,0 +1,112 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/json"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/files"
+	"golang.org/x/xerrors"
+)
+
+// indexPath is the directory in the store for the metadata of images
+const indexPath = "metadata"
+
+// Image describes an uploaded product image
+type Image struct {
+	Filename    string    `json:"filename"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"content_type"`
+	Width       int       `json:"width"`
+	Height      int       `json:"height"`
+	Hash        string    `json:"hash,omitempty"`
+	UploadedAt  time.Time `json:"uploaded_at"`
+
+	// Private images can only be downloaded with a signed URL
+	Private bool `json:"private,omitempty"`
+
+	// Variants maps the name of each variant which has been created to
+	// its URL, it is not stored in the index
+	Variants map[string]string `json:"variants"`
+}
+
+// Index stores the metadata for images as JSON files alongside the images
+// in the store, i.e. metadata/1/test.png.json
+type Index struct {
+	store files.Storage
+}
+
+// New creates an Index which saves metadata in s
+func New(s files.Storage) *Index {
+	return &Index{store: s}
+}
+
+// Save the metadata for an image of the product with the given id
+func (i *Index) Save(id string, img Image) error {
+	img.Variants = nil
+
+	d, err := json.Marshal(img)
+	if err != nil {
+		return xerrors.Errorf("Unable to encode metadata: %w", err)
+	}
+
+	return i.store.Save(entryPath(id, img.Filename), bytes.NewReader(d))
+}
+
+// Get returns the metadata for an image, files.ErrNotFound is returned when
+// the image has no metadata
+func (i *Index) Get(id, filename string) (Image, error) {
+	f, _, err := i.store.Open(entryPath(id, filename))
+	if err != nil {
+		return Image{}, err
+	}
+	defer f.Close()
+
+	img := Image{}
+	err = json.NewDecoder(f).Decode(&img)
+	if err != nil {
+		return Image{}, xerrors.Errorf("Unable to decode metadata for %s: %w", path.Join(id, filename), err)
+	}
+
+	return img, nil
+}
+
+// List returns the metadata for all images of the product with the given
+// id sorted by filename
+func (i *Index) List(id string) ([]Image, error) {
+	fis, err := i.store.List(path.Join(indexPath, id) + "/")
+	if err != nil {
+		return nil, err
+	}
+
+	imgs := []Image{}
+	for _, fi := range fis {
+		fn := strings.TrimSuffix(path.Base(fi.Path), ".json")
+
+		img, err := i.Get(id, fn)
+		if xerrors.Is(err, files.ErrNotFound) {
+			// deleted since the index was listed
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		imgs = append(imgs, img)
+	}
+
+	return imgs, nil
+}
+
+// Delete the metadata for an image
+func (i *Index) Delete(id, filename string) error {
+	return i.store.Delete(entryPath(id, filename))
+}
+
+// entryPath returns the path of the metadata for an image
+func entryPath(id, filename string) string {
+	return path.Join(indexPath, id, filename+".json")
+}
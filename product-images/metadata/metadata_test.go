@@ -0,0 +1,37 @@
+package metadata
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/files"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexSavesAndListsImages(t *testing.T) {
+	s, err := files.NewLocal(t.TempDir(), 1024)
+	require.NoError(t, err)
+
+	i := New(s)
+	now := time.Now().UTC().Truncate(time.Second)
+
+	require.NoError(t, i.Save("1", Image{Filename: "test.png", Size: 10, ContentType: "image/png", Width: 2, Height: 1, UploadedAt: now}))
+	require.NoError(t, i.Save("1", Image{Filename: "other.jpg", Size: 20, ContentType: "image/jpeg", Width: 1, Height: 1, UploadedAt: now}))
+	require.NoError(t, i.Save("10", Image{Filename: "test.png"}))
+
+	img, err := i.Get("1", "test.png")
+	require.NoError(t, err)
+	assert.Equal(t, Image{Filename: "test.png", Size: 10, ContentType: "image/png", Width: 2, Height: 1, UploadedAt: now}, img)
+
+	imgs, err := i.List("1")
+	require.NoError(t, err)
+	require.Len(t, imgs, 2)
+	assert.Equal(t, "other.jpg", imgs[0].Filename)
+	assert.Equal(t, "test.png", imgs[1].Filename)
+
+	require.NoError(t, i.Delete("1", "test.png"))
+
+	_, err = i.Get("1", "test.png")
+	assert.Equal(t, files.ErrNotFound, err)
+}
@@ -0,0 +1,236 @@
+package signing
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// minSecretLength is the shortest secret accepted for a key, HMAC-SHA256
+// keys shorter than the hash size weaken the signature
+const minSecretLength = 32
+
+// Query parameters of a signed URL
+const (
+	ParamExpires   = "expires"
+	ParamKey       = "key"
+	ParamSignature = "signature"
+)
+
+// Errors returned when verifying a signed URL
+var (
+	ErrInvalidSignature = errors.New("Invalid signature")
+	ErrExpired          = errors.New("Signed URL has expired")
+)
+
+// Key is a secret used to sign URLs
+type Key struct {
+	// ID identifies the key in signed URLs so that the key can be rotated
+	ID string `json:"id"`
+	// Secret is at least 32 bytes
+	Secret string `json:"secret"`
+}
+
+// Keys is the set of keys which are accepted, new URLs are signed with the
+// Current key, keys are rotated by adding a new key, making it current and
+// removing the old key once the URLs signed with it have expired
+type Keys struct {
+	Current string `json:"current"`
+	Keys    []Key  `json:"keys"`
+}
+
+// Signer creates and verifies HMAC-SHA256 signed URLs which expire
+type Signer struct {
+	mu      sync.RWMutex
+	current string
+	keys    map[string][]byte
+
+	now func() time.Time
+}
+
+// New creates a Signer using the keys
+func New(ks Keys) (*Signer, error) {
+	s := &Signer{now: time.Now}
+
+	err := s.SetKeys(ks)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Load creates a Signer using the JSON encoded Keys in the file at path
+func Load(path string) (*Signer, error) {
+	ks, err := readKeys(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(ks)
+}
+
+// SetKeys replaces the keys used by the Signer, the keys are not changed
+// when they are invalid
+func (s *Signer) SetKeys(ks Keys) error {
+	keys := map[string][]byte{}
+
+	for _, k := range ks.Keys {
+		if k.ID == "" {
+			return fmt.Errorf("Signing key must have an id")
+		}
+
+		if len(k.Secret) < minSecretLength {
+			return fmt.Errorf("Secret for signing key '%s' must be at least %d bytes", k.ID, minSecretLength)
+		}
+
+		if _, ok := keys[k.ID]; ok {
+			return fmt.Errorf("Duplicate signing key '%s'", k.ID)
+		}
+
+		keys[k.ID] = []byte(k.Secret)
+	}
+
+	if _, ok := keys[ks.Current]; !ok {
+		return fmt.Errorf("Current signing key '%s' not found", ks.Current)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.current = ks.Current
+	s.keys = keys
+
+	return nil
+}
+
+// Sign returns the query parameters which sign the URL path p until expires
+func (s *Signer) Sign(p string, expires time.Time) url.Values {
+	s.mu.RLock()
+	id, secret := s.current, s.keys[s.current]
+	s.mu.RUnlock()
+
+	exp := strconv.FormatInt(expires.Unix(), 10)
+
+	return url.Values{
+		ParamExpires:   {exp},
+		ParamKey:       {id},
+		ParamSignature: {signature(secret, p, exp, id)},
+	}
+}
+
+// Verify checks that the query q contains a valid signature for the URL
+// path p which has not expired and returns the expiry time
+func (s *Signer) Verify(p string, q url.Values) (time.Time, error) {
+	id, exp := q.Get(ParamKey), q.Get(ParamExpires)
+
+	s.mu.RLock()
+	secret, ok := s.keys[id]
+	s.mu.RUnlock()
+
+	if !ok {
+		return time.Time{}, ErrInvalidSignature
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(q.Get(ParamSignature))
+	if err != nil {
+		return time.Time{}, ErrInvalidSignature
+	}
+
+	want, _ := base64.RawURLEncoding.DecodeString(signature(secret, p, exp, id))
+	if !hmac.Equal(sig, want) {
+		return time.Time{}, ErrInvalidSignature
+	}
+
+	e, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return time.Time{}, ErrInvalidSignature
+	}
+
+	expires := time.Unix(e, 0)
+	if !s.now().Before(expires) {
+		return expires, ErrExpired
+	}
+
+	return expires, nil
+}
+
+// MonitorFile reloads the keys from the file at path every interval when it
+// has changed until ctx is done, invalid files are logged and the current
+// keys are kept
+func (s *Signer) MonitorFile(ctx context.Context, path string, interval time.Duration, l hclog.Logger) {
+	var last time.Time
+	if fi, err := os.Stat(path); err == nil {
+		last = fi.ModTime()
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				fi, err := os.Stat(path)
+				if err != nil {
+					l.Error("Unable to read signing keys", "path", path, "error", err)
+					continue
+				}
+
+				if fi.ModTime().Equal(last) {
+					continue
+				}
+
+				ks, err := readKeys(path)
+				if err == nil {
+					err = s.SetKeys(ks)
+				}
+
+				if err != nil {
+					l.Error("Unable to reload signing keys", "path", path, "error", err)
+					continue
+				}
+
+				last = fi.ModTime()
+				l.Info("Reloaded signing keys", "current", ks.Current, "keys", len(ks.Keys))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func readKeys(path string) (Keys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Keys{}, fmt.Errorf("Unable to open signing keys file: %s", err)
+	}
+	defer f.Close()
+
+	ks := Keys{}
+	err = json.NewDecoder(f).Decode(&ks)
+	if err != nil {
+		return Keys{}, fmt.Errorf("Unable to decode signing keys file: %s", err)
+	}
+
+	return ks, nil
+}
+
+// signature returns the HMAC of the path, expiry and key id
+func signature(secret []byte, p, exp, id string) string {
+	m := hmac.New(sha256.New, secret)
+	m.Write([]byte(p + "\n" + exp + "\n" + id))
+
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
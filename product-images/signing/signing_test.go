@@ -0,0 +1,145 @@
+package signing
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	secret1 = "0123456789abcdef0123456789abcdef"
+	secret2 = "fedcba9876543210fedcba9876543210"
+)
+
+func setupSigner(t *testing.T, current string) *Signer {
+	s, err := New(Keys{Current: current, Keys: []Key{{ID: "k1", Secret: secret1}, {ID: "k2", Secret: secret2}}})
+	require.NoError(t, err)
+
+	return s
+}
+
+func TestSignAndVerify(t *testing.T) {
+	s := setupSigner(t, "k1")
+	exp := time.Now().Add(time.Minute).Truncate(time.Second)
+
+	q := s.Sign("/images/1/test.png", exp)
+	assert.Equal(t, "k1", q.Get(ParamKey))
+
+	e, err := s.Verify("/images/1/test.png", q)
+	require.NoError(t, err)
+	assert.True(t, exp.Equal(e))
+
+	// the signature is only valid for the path
+	_, err = s.Verify("/images/1/other.png", q)
+	assert.Equal(t, ErrInvalidSignature, err)
+
+	// the expiry can not be changed
+	q.Set(ParamExpires, "9999999999")
+	_, err = s.Verify("/images/1/test.png", q)
+	assert.Equal(t, ErrInvalidSignature, err)
+}
+
+func TestVerifyRejectsExpiredURLs(t *testing.T) {
+	s := setupSigner(t, "k1")
+	q := s.Sign("/images/1/test.png", time.Now().Add(time.Minute))
+
+	s.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+
+	_, err := s.Verify("/images/1/test.png", q)
+	assert.Equal(t, ErrExpired, err)
+}
+
+func TestVerifyRejectsInvalidParams(t *testing.T) {
+	s := setupSigner(t, "k1")
+	q := s.Sign("/images/1/test.png", time.Now().Add(time.Minute))
+
+	for _, p := range []string{ParamKey, ParamSignature, ParamExpires} {
+		bad := map[string][]string{}
+		for k, v := range q {
+			bad[k] = v
+		}
+
+		bad[p] = []string{"invalid"}
+
+		_, err := s.Verify("/images/1/test.png", bad)
+		assert.Equal(t, ErrInvalidSignature, err, p)
+	}
+}
+
+func TestRotateKeys(t *testing.T) {
+	s := setupSigner(t, "k1")
+	exp := time.Now().Add(time.Minute)
+	old := s.Sign("/images/1/test.png", exp)
+
+	// URLs signed with the previous key are valid while the key is active
+	require.NoError(t, s.SetKeys(Keys{Current: "k2", Keys: []Key{{ID: "k1", Secret: secret1}, {ID: "k2", Secret: secret2}}}))
+
+	q := s.Sign("/images/1/test.png", exp)
+	assert.Equal(t, "k2", q.Get(ParamKey))
+
+	_, err := s.Verify("/images/1/test.png", old)
+	assert.NoError(t, err)
+
+	// removing the key revokes the URLs signed with it
+	require.NoError(t, s.SetKeys(Keys{Current: "k2", Keys: []Key{{ID: "k2", Secret: secret2}}}))
+
+	_, err = s.Verify("/images/1/test.png", old)
+	assert.Equal(t, ErrInvalidSignature, err)
+
+	_, err = s.Verify("/images/1/test.png", q)
+	assert.NoError(t, err)
+}
+
+func TestInvalidKeysReturnErr(t *testing.T) {
+	tests := map[string]Keys{
+		"no current":   {Current: "k3", Keys: []Key{{ID: "k1", Secret: secret1}}},
+		"short secret": {Current: "k1", Keys: []Key{{ID: "k1", Secret: "secret"}}},
+		"no id":        {Current: "", Keys: []Key{{Secret: secret1}}},
+		"duplicate":    {Current: "k1", Keys: []Key{{ID: "k1", Secret: secret1}, {ID: "k1", Secret: secret2}}},
+	}
+
+	for name, ks := range tests {
+		_, err := New(ks)
+		assert.Error(t, err, name)
+	}
+
+	// invalid keys do not replace the current keys
+	s := setupSigner(t, "k1")
+	assert.Error(t, s.SetKeys(tests["no current"]))
+	assert.Equal(t, "k1", s.Sign("/", time.Now()).Get(ParamKey))
+}
+
+func TestMonitorFileReloadsKeys(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "keys.json")
+	write := func(ks Keys, mt time.Time) {
+		d, err := json.Marshal(ks)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(p, d, 0600))
+		require.NoError(t, os.Chtimes(p, mt, mt))
+	}
+
+	now := time.Now()
+	write(Keys{Current: "k1", Keys: []Key{{ID: "k1", Secret: secret1}}}, now)
+
+	s, err := Load(p)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	s.MonitorFile(ctx, p, 10*time.Millisecond, hclog.NewNullLogger())
+
+	write(Keys{Current: "k2", Keys: []Key{{ID: "k1", Secret: secret1}, {ID: "k2", Secret: secret2}}}, now.Add(time.Second))
+
+	assert.Eventually(t, func() bool {
+		return s.Sign("/", now).Get(ParamKey) == "k2"
+	}, time.Second, 10*time.Millisecond)
+}
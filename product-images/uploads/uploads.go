@@ -0,0 +1,411 @@
+package uploads
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/files"
+	"golang.org/x/xerrors"
+)
+
+// uploadsPath is the directory in the store for uploads in progress, each
+// upload has an info file and a file for each chunk named by its offset
+const uploadsPath = "uploads"
+
+// Errors returned by the Manager
+var (
+	ErrNotFound       = errors.New("Upload not found")
+	ErrOffsetMismatch = errors.New("Upload offset does not match")
+	ErrTooLarge       = errors.New("Chunk is larger than the remaining length of the upload")
+	ErrIncomplete     = errors.New("Upload is not complete")
+)
+
+var idRE = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// Upload is the state of a resumable upload
+type Upload struct {
+	ID        string    `json:"id"`
+	ProductID string    `json:"product_id"`
+	Filename  string    `json:"filename"`
+	Private   bool      `json:"private,omitempty"`
+	Length    int64     `json:"length"`
+	Offset    int64     `json:"offset"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+}
+
+// Complete returns true when all of the chunks have been received
+func (u Upload) Complete() bool {
+	return u.Offset == u.Length
+}
+
+// Manager stores the chunks of resumable uploads, an upload expires when no
+// chunks have been received for the expiry duration
+type Manager struct {
+	store  files.Storage
+	expiry time.Duration
+	now    func() time.Time
+
+	mu    sync.Mutex
+	locks map[string]*uploadLock
+}
+
+// New creates a Manager which stores uploads in s
+func New(s files.Storage, expiry time.Duration) *Manager {
+	return &Manager{store: s, expiry: expiry, now: time.Now, locks: map[string]*uploadLock{}}
+}
+
+// Create starts an upload of length bytes for the image filename of the
+// product, private images can only be downloaded with a signed URL
+func (m *Manager) Create(productID, filename string, private bool, length int64) (Upload, error) {
+	now := m.now()
+
+	u := Upload{
+		ID:        newID(),
+		ProductID: productID,
+		Filename:  filename,
+		Private:   private,
+		Length:    length,
+		Created:   now,
+		Expires:   now.Add(m.expiry),
+	}
+
+	return u, m.save(u)
+}
+
+// newID returns a random 128 bit hex encoded upload id, the id is the only
+// credential for an upload so it must not be guessable
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// Get returns the upload with the given id, ErrNotFound is returned when
+// the upload does not exist or has expired
+func (m *Manager) Get(id string) (Upload, error) {
+	if !idRE.MatchString(id) {
+		return Upload{}, ErrNotFound
+	}
+
+	f, _, err := m.store.Open(infoPath(id))
+	if xerrors.Is(err, files.ErrNotFound) {
+		return Upload{}, ErrNotFound
+	}
+
+	if err != nil {
+		return Upload{}, err
+	}
+	defer f.Close()
+
+	u := Upload{}
+	err = json.NewDecoder(f).Decode(&u)
+	if err != nil {
+		return Upload{}, fmt.Errorf("Unable to decode upload %s: %w", id, err)
+	}
+
+	if !m.now().Before(u.Expires) {
+		return Upload{}, ErrNotFound
+	}
+
+	return u, nil
+}
+
+// Write saves the chunk read from r at offset, the offset must be the
+// number of bytes already received so that chunks are written in order
+// when reading r fails the bytes received before the error are kept and the
+// error is returned with the new offset so that the client can resume
+func (m *Manager) Write(id string, offset int64, r io.Reader) (Upload, error) {
+	unlock := m.lock(id)
+	defer unlock()
+
+	u, err := m.Get(id)
+	if err != nil {
+		return Upload{}, err
+	}
+
+	if offset != u.Offset {
+		return u, ErrOffsetMismatch
+	}
+
+	// read one byte more than remains to detect chunks which are too large
+	remaining := u.Length - u.Offset
+	cr := &countingReader{r: io.LimitReader(r, remaining+1)}
+
+	pp := partPath(id, offset)
+	err = m.store.Save(pp, cr)
+	if err != nil {
+		// the part is written again by the next request for the offset
+		return u, err
+	}
+
+	if cr.n > remaining {
+		m.store.Delete(pp)
+		return u, ErrTooLarge
+	}
+
+	if cr.n == 0 {
+		m.store.Delete(pp)
+		return u, cr.err
+	}
+
+	u.Offset += cr.n
+	u.Expires = m.now().Add(m.expiry)
+
+	err = m.save(u)
+	if err != nil {
+		return u, err
+	}
+
+	return u, cr.err
+}
+
+// Open returns a reader for the contents of a complete upload, the caller
+// is responsible for closing the reader
+func (m *Manager) Open(id string) (io.ReadCloser, Upload, error) {
+	u, err := m.Get(id)
+	if err != nil {
+		return nil, Upload{}, err
+	}
+
+	if !u.Complete() {
+		return nil, u, ErrIncomplete
+	}
+
+	fis, err := m.store.List(path.Join(uploadsPath, id, "parts") + "/")
+	if err != nil {
+		return nil, u, err
+	}
+
+	paths := []string{}
+	for _, fi := range fis {
+		paths = append(paths, fi.Path)
+	}
+
+	return &partsReader{store: m.store, paths: paths}, u, nil
+}
+
+// Delete removes the upload and its chunks
+func (m *Manager) Delete(id string) error {
+	if !idRE.MatchString(id) {
+		return ErrNotFound
+	}
+
+	unlock := m.lock(id)
+	defer unlock()
+
+	fis, err := m.store.List(path.Join(uploadsPath, id) + "/")
+	if err != nil {
+		return err
+	}
+
+	if len(fis) == 0 {
+		return ErrNotFound
+	}
+
+	// the info file is deleted last so a failed delete can be retried
+	for _, fi := range fis {
+		if fi.Path == infoPath(id) {
+			continue
+		}
+
+		err := m.store.Delete(fi.Path)
+		if err != nil && !xerrors.Is(err, files.ErrNotFound) {
+			return err
+		}
+	}
+
+	err = m.store.Delete(infoPath(id))
+	if err != nil && !xerrors.Is(err, files.ErrNotFound) {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteExpired removes uploads which have expired and returns the number
+// removed
+func (m *Manager) DeleteExpired() (int, error) {
+	fis, err := m.store.List(uploadsPath + "/")
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, fi := range fis {
+		if path.Base(fi.Path) != "info.json" {
+			continue
+		}
+
+		id := path.Base(path.Dir(fi.Path))
+
+		_, err := m.Get(id)
+		if err != ErrNotFound {
+			continue
+		}
+
+		err = m.Delete(id)
+		if err != nil && err != ErrNotFound {
+			return n, err
+		}
+
+		n++
+	}
+
+	return n, nil
+}
+
+// MonitorExpired runs DeleteExpired every interval until ctx is done
+func (m *Manager) MonitorExpired(ctx context.Context, interval time.Duration, l hclog.Logger) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				n, err := m.DeleteExpired()
+				if err != nil {
+					l.Error("Unable to delete expired uploads", "error", err)
+				}
+
+				if n > 0 {
+					l.Info("Deleted expired uploads", "count", n)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func (m *Manager) save(u Upload) error {
+	d, err := json.Marshal(u)
+	if err != nil {
+		return fmt.Errorf("Unable to encode upload: %w", err)
+	}
+
+	return m.store.Save(infoPath(u.ID), bytes.NewReader(d))
+}
+
+// lock serialises writes to an upload, it returns a function which releases
+// the lock
+func (m *Manager) lock(id string) func() {
+	m.mu.Lock()
+	l, ok := m.locks[id]
+	if !ok {
+		l = &uploadLock{}
+		m.locks[id] = l
+	}
+	l.refs++
+	m.mu.Unlock()
+
+	l.Lock()
+
+	return func() {
+		l.Unlock()
+
+		m.mu.Lock()
+		l.refs--
+		if l.refs == 0 {
+			delete(m.locks, id)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// uploadLock is removed when no requests hold or are waiting for it
+type uploadLock struct {
+	sync.Mutex
+	refs int
+}
+
+func infoPath(id string) string {
+	return path.Join(uploadsPath, id, "info.json")
+}
+
+// partPath returns the path for the chunk at offset, the offset is padded
+// so that the chunks are listed in order
+func partPath(id string, offset int64) string {
+	return path.Join(uploadsPath, id, "parts", fmt.Sprintf("%020d", offset))
+}
+
+// countingReader counts the bytes read from r, an error reading r ends the
+// chunk early and is kept in err so that the part received is saved
+type countingReader struct {
+	r   io.Reader
+	n   int64
+	err error
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+
+	if err != nil && err != io.EOF {
+		c.err = err
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+// partsReader reads the chunks of an upload in order, each chunk is opened
+// when the previous one has been read
+type partsReader struct {
+	store files.Storage
+	paths []string
+	cur   files.File
+}
+
+func (p *partsReader) Read(b []byte) (int, error) {
+	for {
+		if p.cur == nil {
+			if len(p.paths) == 0 {
+				return 0, io.EOF
+			}
+
+			f, _, err := p.store.Open(p.paths[0])
+			if err != nil {
+				return 0, err
+			}
+
+			p.cur = f
+			p.paths = p.paths[1:]
+		}
+
+		n, err := p.cur.Read(b)
+		if err == io.EOF {
+			p.cur.Close()
+			p.cur = nil
+
+			if n == 0 {
+				continue
+			}
+
+			err = nil
+		}
+
+		return n, err
+	}
+}
+
+func (p *partsReader) Close() error {
+	if p.cur != nil {
+		return p.cur.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,156 @@
+package uploads
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/files"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func setupManager(t *testing.T) (*Manager, files.Storage) {
+	s, err := files.NewLocal(t.TempDir(), 1024)
+	require.NoError(t, err)
+
+	return New(s, time.Hour), s
+}
+
+func TestManagerAssemblesChunks(t *testing.T) {
+	m, _ := setupManager(t)
+
+	u, err := m.Create("1", "test.png", false, 11)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), u.Offset)
+
+	u, err = m.Write(u.ID, 0, strings.NewReader("Hello "))
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), u.Offset)
+	assert.False(t, u.Complete())
+
+	_, _, err = m.Open(u.ID)
+	assert.Equal(t, ErrIncomplete, err)
+
+	// chunks must be sent in order
+	_, err = m.Write(u.ID, 0, strings.NewReader("Hello "))
+	assert.Equal(t, ErrOffsetMismatch, err)
+
+	// chunks can not be larger than the remaining length
+	_, err = m.Write(u.ID, 6, strings.NewReader("World!"))
+	assert.Equal(t, ErrTooLarge, err)
+
+	u, err = m.Write(u.ID, 6, strings.NewReader("World"))
+	require.NoError(t, err)
+	assert.True(t, u.Complete())
+
+	rc, u, err := m.Open(u.ID)
+	require.NoError(t, err)
+	defer rc.Close()
+
+	d, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello World", string(d))
+	assert.Equal(t, "1", u.ProductID)
+	assert.Equal(t, "test.png", u.Filename)
+}
+
+// failingReader returns the data followed by an error
+type failingReader struct {
+	data io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.data.Read(p)
+	if err == io.EOF {
+		return n, xerrors.New("Connection reset")
+	}
+
+	return n, err
+}
+
+func TestManagerKeepsPartialChunk(t *testing.T) {
+	m, _ := setupManager(t)
+
+	u, err := m.Create("1", "test.png", false, 11)
+	require.NoError(t, err)
+
+	// the connection fails after part of the chunk was received
+	u, err = m.Write(u.ID, 0, &failingReader{strings.NewReader("Hello ")})
+	assert.EqualError(t, err, "Connection reset")
+	assert.Equal(t, int64(6), u.Offset)
+
+	u, err = m.Get(u.ID)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), u.Offset)
+
+	// the client resumes from the new offset
+	u, err = m.Write(u.ID, 6, strings.NewReader("World"))
+	require.NoError(t, err)
+
+	rc, _, err := m.Open(u.ID)
+	require.NoError(t, err)
+	defer rc.Close()
+
+	d, err := ioutil.ReadAll(rc)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello World", string(d))
+}
+
+func TestManagerDeletesUpload(t *testing.T) {
+	m, s := setupManager(t)
+
+	u, err := m.Create("1", "test.png", false, 11)
+	require.NoError(t, err)
+	_, err = m.Write(u.ID, 0, bytes.NewBufferString("Hello"))
+	require.NoError(t, err)
+
+	require.NoError(t, m.Delete(u.ID))
+
+	fis, err := s.List("")
+	require.NoError(t, err)
+	assert.Empty(t, fis)
+
+	assert.Equal(t, ErrNotFound, m.Delete(u.ID))
+	_, err = m.Get(u.ID)
+	assert.Equal(t, ErrNotFound, err)
+	_, err = m.Get("../../1/test.png")
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestManagerDeletesExpiredUploads(t *testing.T) {
+	m, s := setupManager(t)
+
+	now := time.Now()
+	m.now = func() time.Time { return now }
+
+	old, err := m.Create("1", "old.png", false, 11)
+	require.NoError(t, err)
+	_, err = m.Write(old.ID, 0, bytes.NewBufferString("Hello"))
+	require.NoError(t, err)
+
+	now = now.Add(30 * time.Minute)
+	active, err := m.Create("1", "active.png", false, 11)
+	require.NoError(t, err)
+
+	// uploads expire an hour after the last chunk
+	now = now.Add(31 * time.Minute)
+
+	_, err = m.Write(old.ID, 5, bytes.NewBufferString(" World"))
+	assert.Equal(t, ErrNotFound, err)
+
+	n, err := m.DeleteExpired()
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	_, err = m.Get(active.ID)
+	assert.NoError(t, err)
+
+	fis, err := s.List("uploads/" + old.ID)
+	require.NoError(t, err)
+	assert.Empty(t, fis)
+}
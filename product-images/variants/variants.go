@@ -0,0 +1,430 @@
+package variants
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/files"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/images"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/logging"
+)
+
+// Job status
+const (
+	StatusPending  = "pending"
+	StatusRunning  = "running"
+	StatusComplete = "complete"
+	StatusFailed   = "failed"
+	StatusCanceled = "canceled"
+)
+
+const (
+	// queueSize is the number of jobs which can wait for a worker
+	queueSize = 1000
+	// retryBackoff is the time before the first retry, it doubles for each
+	// attempt
+	retryBackoff = time.Second
+	// jobTTL is how long finished jobs are kept for the status endpoint
+	jobTTL = time.Hour
+	// quality is the JPEG quality for variants
+	quality = 85
+)
+
+// Variant is a named size which is created for every uploaded image
+type Variant struct {
+	Name   string
+	Width  int
+	Height int
+	Fit    string
+}
+
+var variantRE = regexp.MustCompile(`^([a-z]+)=([0-9]+)x([0-9]+)(?::(contain|cover|fill))?$`)
+
+// Parse reads a comma separated list of variants in the format
+// name=WIDTHxHEIGHT[:fit], i.e. thumb=150x150:cover,card=400x400
+func Parse(s string) ([]Variant, error) {
+	vs := []Variant{}
+	if strings.TrimSpace(s) == "" {
+		return vs, nil
+	}
+
+	for _, v := range strings.Split(s, ",") {
+		m := variantRE.FindStringSubmatch(strings.TrimSpace(v))
+		if m == nil {
+			return nil, fmt.Errorf("Invalid variant %q, expected name=WIDTHxHEIGHT[:contain|cover|fill]", v)
+		}
+
+		w, _ := strconv.Atoi(m[2])
+		h, _ := strconv.Atoi(m[3])
+		if w == 0 || h == 0 {
+			return nil, fmt.Errorf("Invalid variant %q, width and height must be greater than 0", v)
+		}
+
+		fit := m[4]
+		if fit == "" {
+			fit = images.FitContain
+		}
+
+		vs = append(vs, Variant{Name: m[1], Width: w, Height: h, Fit: fit})
+	}
+
+	return vs, nil
+}
+
+// Path returns the path in the store for the variant of the original at fp,
+// variants are stored alongside the original, i.e. 1/thumb/test.png
+func Path(name, fp string) string {
+	return path.Join(path.Dir(fp), name, path.Base(fp))
+}
+
+// Job creates the variants for an uploaded image
+type Job struct {
+	ID       string    `json:"id"`
+	Path     string    `json:"path"`
+	Status   string    `json:"status"`
+	Attempts int       `json:"attempts"`
+	Error    string    `json:"error,omitempty"`
+	Variants []string  `json:"variants"`
+	Created  time.Time `json:"created"`
+	Updated  time.Time `json:"updated"`
+}
+
+// Pipeline creates the variants for uploaded images in the background,
+// failed jobs are retried with a backoff
+type Pipeline struct {
+	log         hclog.Logger
+	store       files.Storage
+	resizer     *images.Resizer
+	variants    []Variant
+	maxAttempts int
+	backoff     time.Duration
+
+	queue chan string
+	wg    sync.WaitGroup
+	done  chan struct{}
+	once  sync.Once
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+}
+
+// New creates a Pipeline, jobs are attempted up to maxAttempts times
+func New(l hclog.Logger, s files.Storage, rz *images.Resizer, vs []Variant, maxAttempts int) *Pipeline {
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	return &Pipeline{
+		log:         l,
+		store:       s,
+		resizer:     rz,
+		variants:    vs,
+		maxAttempts: maxAttempts,
+		backoff:     retryBackoff,
+		queue:       make(chan string, queueSize),
+		done:        make(chan struct{}),
+		jobs:        map[string]*Job{},
+	}
+}
+
+// Start runs the workers which process jobs
+func (p *Pipeline) Start(workers int) {
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+
+		go func() {
+			defer p.wg.Done()
+			p.work()
+		}()
+	}
+}
+
+// Shutdown stops the workers, jobs which are running complete unless ctx is
+// done first
+func (p *Pipeline) Shutdown(ctx context.Context) error {
+	p.once.Do(func() { close(p.done) })
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Variants returns the variants created for each image
+func (p *Pipeline) Variants() []Variant {
+	return p.variants
+}
+
+// Variant returns the variant with the given name
+func (p *Pipeline) Variant(name string) (Variant, bool) {
+	for _, v := range p.variants {
+		if v.Name == name {
+			return v, true
+		}
+	}
+
+	return Variant{}, false
+}
+
+// Submit queues a job to create the variants for the image at fp
+func (p *Pipeline) Submit(ctx context.Context, fp string) Job {
+	now := time.Now()
+
+	j := &Job{
+		ID:       newJobID(),
+		Path:     fp,
+		Status:   StatusPending,
+		Variants: []string{},
+		Created:  now,
+		Updated:  now,
+	}
+
+	for _, v := range p.variants {
+		j.Variants = append(j.Variants, v.Name)
+	}
+
+	p.mu.Lock()
+	p.prune(now)
+	p.jobs[j.ID] = j
+
+	if len(p.variants) == 0 {
+		j.Status = StatusComplete
+	} else {
+		select {
+		case p.queue <- j.ID:
+		default:
+			j.Status = StatusFailed
+			j.Error = "Job queue is full"
+		}
+	}
+
+	job := *j
+	p.mu.Unlock()
+
+	logging.Logger(ctx, p.log).Debug("Submitted variants job", "id", job.ID, "path", fp, "status", job.Status)
+
+	return job
+}
+
+// newJobID returns a random 128 bit hex encoded job id
+func newJobID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// Job returns the job with the given id
+func (p *Pipeline) Job(id string) (Job, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	j, ok := p.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+
+	return *j, true
+}
+
+// Cancel stops the unfinished jobs for the image at fp, it is called when
+// the image is deleted so that variants are not created for it, variants
+// saved by a running job are removed when it completes
+func (p *Pipeline) Cancel(fp string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for _, j := range p.jobs {
+		if j.Path == fp && (j.Status == StatusPending || j.Status == StatusRunning) {
+			j.Status = StatusCanceled
+			j.Error = ""
+			j.Updated = now
+		}
+	}
+}
+
+// prune removes finished jobs older than the TTL, the lock must be held
+func (p *Pipeline) prune(now time.Time) {
+	for id, j := range p.jobs {
+		if (j.Status == StatusComplete || j.Status == StatusFailed || j.Status == StatusCanceled) && now.Sub(j.Updated) > jobTTL {
+			delete(p.jobs, id)
+		}
+	}
+}
+
+func (p *Pipeline) work() {
+	for {
+		select {
+		case <-p.done:
+			return
+		case id := <-p.queue:
+			p.run(id)
+		}
+	}
+}
+
+// run processes the job and schedules a retry when it fails
+func (p *Pipeline) run(id string) {
+	p.mu.Lock()
+	j, ok := p.jobs[id]
+	if !ok || j.Status != StatusPending {
+		// canceled while waiting for a worker or a retry
+		p.mu.Unlock()
+		return
+	}
+
+	j.Status = StatusRunning
+	j.Attempts++
+	j.Updated = time.Now()
+	fp, attempt := j.Path, j.Attempts
+	p.mu.Unlock()
+
+	l := p.log.With("job", id, "path", fp, "attempt", attempt)
+
+	err := p.create(fp)
+
+	// variants saved after the image was deleted are removed once the lock
+	// is released
+	canceled := false
+	defer func() {
+		if canceled {
+			p.remove(fp, l)
+		}
+	}()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if j.Status == StatusCanceled {
+		l.Info("Variants job canceled, the image was deleted")
+
+		canceled = true
+		return
+	}
+
+	j.Updated = time.Now()
+
+	// the image was deleted by another instance, there is nothing to retry
+	if errors.Is(err, files.ErrNotFound) {
+		l.Info("Variants job canceled, the image was deleted")
+
+		j.Status = StatusCanceled
+		canceled = true
+		return
+	}
+
+	if err == nil {
+		l.Info("Created variants")
+
+		j.Status = StatusComplete
+		j.Error = ""
+		return
+	}
+
+	j.Error = err.Error()
+
+	if attempt >= p.maxAttempts {
+		l.Error("Unable to create variants", "error", err)
+
+		j.Status = StatusFailed
+		return
+	}
+
+	backoff := p.backoff * time.Duration(1<<uint(attempt-1))
+	l.Error("Unable to create variants, retrying", "error", err, "backoff", backoff)
+
+	j.Status = StatusPending
+	time.AfterFunc(backoff, func() {
+		select {
+		case p.queue <- id:
+		case <-p.done:
+		}
+	})
+}
+
+// create resizes the original at fp for every variant
+func (p *Pipeline) create(fp string) error {
+	// variants keep the format of the original
+	ct := mime.TypeByExtension(path.Ext(fp))
+	format := images.FormatFor(ct)
+	if ct == "image/gif" {
+		format = images.FormatGIF
+	}
+
+	for _, v := range p.variants {
+		buf := &bytes.Buffer{}
+		err := p.resize(buf, fp, images.Options{Width: v.Width, Height: v.Height, Fit: v.Fit, Format: format, Quality: quality})
+		if err != nil {
+			return fmt.Errorf("Unable to create %s: %w", v.Name, err)
+		}
+
+		// the image may have been deleted while it was resized
+		ok, err := p.store.Exists(fp)
+		if err != nil {
+			return fmt.Errorf("Unable to save %s: %w", v.Name, err)
+		}
+
+		if !ok {
+			return fmt.Errorf("Unable to save %s: %w", v.Name, files.ErrNotFound)
+		}
+
+		err = p.store.Save(Path(v.Name, fp), buf)
+		if err != nil {
+			return fmt.Errorf("Unable to save %s: %w", v.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// remove deletes the variants of the image at fp unless the image has been
+// uploaded again, in which case a new job creates its variants
+func (p *Pipeline) remove(fp string, l hclog.Logger) {
+	ok, err := p.store.Exists(fp)
+	if err != nil {
+		l.Error("Unable to check image exists", "error", err)
+		return
+	}
+
+	if ok {
+		return
+	}
+
+	for _, v := range p.variants {
+		err := p.store.Delete(Path(v.Name, fp))
+		if err != nil && !errors.Is(err, files.ErrNotFound) {
+			l.Error("Unable to delete variant", "variant", v.Name, "error", err)
+		}
+	}
+}
+
+func (p *Pipeline) resize(buf *bytes.Buffer, fp string, o images.Options) error {
+	src, _, err := p.store.Open(fp)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return p.resizer.Resize(buf, src, o)
+}
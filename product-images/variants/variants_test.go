@@ -0,0 +1,187 @@
+package variants
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/png"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/files"
+	"github.com/nicholasjackson/building-microservices-youtube/product-images/images"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/xerrors"
+)
+
+func TestParseReadsVariants(t *testing.T) {
+	vs, err := Parse("thumb=150x150:cover, card=400x300")
+	require.NoError(t, err)
+
+	assert.Equal(t, []Variant{
+		{Name: "thumb", Width: 150, Height: 150, Fit: images.FitCover},
+		{Name: "card", Width: 400, Height: 300, Fit: images.FitContain},
+	}, vs)
+}
+
+func TestParseReturnsErrorForInvalidVariant(t *testing.T) {
+	for _, s := range []string{"thumb", "thumb=150", "thumb=0x10", "Thumb=1x1", "thumb=1x1:crop"} {
+		_, err := Parse(s)
+		assert.Error(t, err, s)
+	}
+}
+
+// failingStore fails to save the first n files, onSave is called before
+// each file is saved
+type failingStore struct {
+	files.Storage
+	n      int
+	onSave func(path string)
+}
+
+func (f *failingStore) Save(path string, r io.Reader) error {
+	if f.onSave != nil {
+		f.onSave(path)
+	}
+
+	if f.n > 0 {
+		f.n--
+		return xerrors.New("Unable to save")
+	}
+
+	return f.Storage.Save(path, r)
+}
+
+func setupPipeline(t *testing.T, fail int, attempts int) (*Pipeline, files.Storage) {
+	l, err := files.NewLocal(t.TempDir(), 1024*1024)
+	require.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, png.Encode(buf, image.NewGray(image.Rect(0, 0, 40, 20))))
+	require.NoError(t, l.Save("1/test.png", buf))
+
+	vs := []Variant{
+		{Name: "thumb", Width: 10, Height: 10, Fit: images.FitCover},
+		{Name: "card", Width: 20, Height: 20, Fit: images.FitContain},
+	}
+
+	p := New(hclog.NewNullLogger(), &failingStore{Storage: l, n: fail}, images.NewResizer(100, 100, nil), vs, attempts)
+	p.backoff = time.Millisecond
+	p.Start(1)
+
+	t.Cleanup(func() { p.Shutdown(context.Background()) })
+
+	return p, l
+}
+
+func waitForJob(t *testing.T, p *Pipeline, id string) Job {
+	var j Job
+	require.Eventually(t, func() bool {
+		j, _ = p.Job(id)
+		return j.Status == StatusComplete || j.Status == StatusFailed || j.Status == StatusCanceled
+	}, 5*time.Second, time.Millisecond)
+
+	return j
+}
+
+func TestPipelineCreatesVariants(t *testing.T) {
+	p, s := setupPipeline(t, 0, 1)
+
+	j := p.Submit(context.Background(), "1/test.png")
+	assert.Equal(t, StatusPending, j.Status)
+	assert.Equal(t, []string{"thumb", "card"}, j.Variants)
+
+	j = waitForJob(t, p, j.ID)
+	assert.Equal(t, StatusComplete, j.Status)
+	assert.Equal(t, 1, j.Attempts)
+
+	for name, size := range map[string]image.Point{"thumb": {10, 10}, "card": {20, 10}} {
+		f, fi, err := s.Open(Path(name, "1/test.png"))
+		require.NoError(t, err)
+
+		cfg, err := png.DecodeConfig(f)
+		f.Close()
+		require.NoError(t, err)
+
+		assert.Equal(t, "image/png", fi.ContentType)
+		assert.Equal(t, size, image.Pt(cfg.Width, cfg.Height), name)
+	}
+}
+
+func TestPipelineRetriesFailedJobs(t *testing.T) {
+	p, s := setupPipeline(t, 2, 3)
+
+	j := waitForJob(t, p, p.Submit(context.Background(), "1/test.png").ID)
+	assert.Equal(t, StatusComplete, j.Status)
+	assert.Equal(t, 3, j.Attempts)
+	assert.Empty(t, j.Error)
+
+	ok, err := s.Exists("1/card/test.png")
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestPipelineFailsJobAfterMaxAttempts(t *testing.T) {
+	p, _ := setupPipeline(t, 10, 2)
+
+	j := waitForJob(t, p, p.Submit(context.Background(), "1/test.png").ID)
+	assert.Equal(t, StatusFailed, j.Status)
+	assert.Equal(t, 2, j.Attempts)
+	assert.Contains(t, j.Error, "Unable to save thumb")
+}
+
+func assertNoVariants(t *testing.T, s files.Storage) {
+	for _, name := range []string{"thumb", "card"} {
+		ok, err := s.Exists(Path(name, "1/test.png"))
+		require.NoError(t, err)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestPipelineCancelsJobsForDeletedImage(t *testing.T) {
+	p, s := setupPipeline(t, 0, 1)
+
+	j := p.Submit(context.Background(), "1/test.png")
+	require.NoError(t, s.Delete("1/test.png"))
+	p.Cancel("1/test.png")
+
+	j = waitForJob(t, p, j.ID)
+	assert.Equal(t, StatusCanceled, j.Status)
+	assertNoVariants(t, s)
+}
+
+func TestPipelineDoesNotRetryDeletedImage(t *testing.T) {
+	p, s := setupPipeline(t, 0, 3)
+	require.NoError(t, s.Delete("1/test.png"))
+
+	j := waitForJob(t, p, p.Submit(context.Background(), "1/test.png").ID)
+	assert.Equal(t, StatusCanceled, j.Status)
+	assert.Equal(t, 1, j.Attempts)
+	assertNoVariants(t, s)
+}
+
+func TestPipelineRemovesVariantsSavedAfterDelete(t *testing.T) {
+	p, s := setupPipeline(t, 0, 1)
+
+	// the image is deleted while the first variant is being saved
+	p.store.(*failingStore).onSave = func(path string) {
+		if path == Path("thumb", "1/test.png") {
+			require.NoError(t, s.Delete("1/test.png"))
+			p.Cancel("1/test.png")
+		}
+	}
+
+	j := waitForJob(t, p, p.Submit(context.Background(), "1/test.png").ID)
+	assert.Equal(t, StatusCanceled, j.Status)
+	assertNoVariants(t, s)
+}
+
+func TestJobReturnsFalseForUnknownJob(t *testing.T) {
+	p, _ := setupPipeline(t, 0, 1)
+
+	_, ok := p.Job("abc")
+	assert.False(t, ok)
+}
@@ -0,0 +1,83 @@
+package apikey
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ErrInvalidKey is returned when an API key is not known
+var ErrInvalidKey = errors.New("Invalid API key")
+
+// Key defines a static key which a client sends in the X-API-Key header
+type Key struct {
+	// Key is the secret value sent by the client
+	Key string `json:"key"`
+	// Subject is the name of the owner of the key
+	Subject string `json:"subject"`
+	// Roles are the roles granted to the owner of the key, services which
+	// do not have roles ignore them
+	Roles []string `json:"roles,omitempty"`
+}
+
+// Keys is a collection of static API keys
+type Keys struct {
+	keys map[[sha256.Size]byte]Key
+}
+
+// New creates a collection from the given keys
+func New(keys []Key) (*Keys, error) {
+	ks := &Keys{keys: map[[sha256.Size]byte]Key{}}
+
+	for _, k := range keys {
+		if k.Key == "" {
+			return nil, fmt.Errorf("API key for subject '%s' must not be empty", k.Subject)
+		}
+
+		if k.Subject == "" {
+			return nil, fmt.Errorf("API key must have a subject")
+		}
+
+		// store a hash of the key so lookups do not leak the key length
+		// or contents through timing
+		h := sha256.Sum256([]byte(k.Key))
+		k.Key = ""
+		ks.keys[h] = k
+	}
+
+	return ks, nil
+}
+
+// Load loads a JSON encoded list of Key from the given file
+func Load(path string) (*Keys, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open API keys file: %s", err)
+	}
+	defer f.Close()
+
+	keys := []Key{}
+	err = json.NewDecoder(f).Decode(&keys)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decode API keys file: %s", err)
+	}
+
+	return New(keys)
+}
+
+// Verify returns the details of the given key or ErrInvalidKey when the key
+// is not known, the secret is not included in the returned Key
+func (ks *Keys) Verify(key string) (Key, error) {
+	h := sha256.Sum256([]byte(key))
+
+	for k, v := range ks.keys {
+		if subtle.ConstantTimeCompare(k[:], h[:]) == 1 {
+			return v, nil
+		}
+	}
+
+	return Key{}, ErrInvalidKey
+}
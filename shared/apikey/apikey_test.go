@@ -0,0 +1,47 @@
+package apikey
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyReturnsKey(t *testing.T) {
+	ks, err := New([]Key{{Key: "abc123", Subject: "ci", Roles: []string{"editor"}}})
+	require.NoError(t, err)
+
+	k, err := ks.Verify("abc123")
+	require.NoError(t, err)
+	assert.Equal(t, Key{Subject: "ci", Roles: []string{"editor"}}, k)
+}
+
+func TestVerifyUnknownKeyReturnsErr(t *testing.T) {
+	ks, err := New([]Key{{Key: "abc123", Subject: "ci"}})
+	require.NoError(t, err)
+
+	_, err = ks.Verify("abc124")
+	assert.Equal(t, ErrInvalidKey, err)
+}
+
+func TestNewReturnsErrForInvalidKeys(t *testing.T) {
+	_, err := New([]Key{{Key: "", Subject: "ci"}})
+	assert.Error(t, err)
+
+	_, err = New([]Key{{Key: "abc123"}})
+	assert.Error(t, err)
+}
+
+func TestLoadReadsKeysFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, ioutil.WriteFile(p, []byte(`[{"key": "abc123", "subject": "frontend"}]`), 0600))
+
+	ks, err := Load(p)
+	require.NoError(t, err)
+
+	k, err := ks.Verify("abc123")
+	require.NoError(t, err)
+	assert.Equal(t, "frontend", k.Subject)
+}
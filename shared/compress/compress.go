@@ -0,0 +1,401 @@
+package compress
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// Content encodings supported by the Middleware
+const (
+	Brotli  = "br"
+	Gzip    = "gzip"
+	Deflate = "deflate"
+)
+
+// DefaultEncodings are the encodings in order of preference, when a client
+// accepts several encodings with the same q-value the first is used
+var DefaultEncodings = []string{Brotli, Gzip, Deflate}
+
+// DefaultMinSize is the smallest response in bytes which is compressed,
+// smaller responses are often larger once compressed
+const DefaultMinSize = 1024
+
+// DefaultTypes are the content types which are compressed, a type ending
+// in /* matches all subtypes
+var DefaultTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// encoder is implemented by the gzip, flate and brotli writers
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// Middleware compresses responses using the encoding negotiated with the
+// Accept-Encoding header of the request
+type Middleware struct {
+	encodings []string
+	minSize   int
+	types     map[string]bool
+	prefixes  []string
+	pools     map[string]*sync.Pool
+}
+
+// New creates a compression Middleware
+// encodings are the supported encodings in order of preference, responses
+// smaller than minSize bytes and content types which are not in types are
+// sent uncompressed, empty entries are ignored so that no encodings disables
+// compression
+func New(encodings []string, minSize int, types []string) (*Middleware, error) {
+	m := &Middleware{minSize: minSize, types: map[string]bool{}, pools: map[string]*sync.Pool{}}
+
+	for _, e := range encodings {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+
+		p, err := newPool(e)
+		if err != nil {
+			return nil, err
+		}
+
+		m.encodings = append(m.encodings, e)
+		m.pools[e] = p
+	}
+
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+
+		switch {
+		case t == "":
+			continue
+		case strings.HasSuffix(t, "/*"):
+			m.prefixes = append(m.prefixes, strings.TrimSuffix(t, "*"))
+		default:
+			m.types[t] = true
+		}
+	}
+
+	return m, nil
+}
+
+// newPool returns a pool of writers for the encoding e
+func newPool(e string) (*sync.Pool, error) {
+	switch e {
+	case Brotli:
+		return &sync.Pool{New: func() interface{} { return brotli.NewWriterLevel(nil, brotli.DefaultCompression) }}, nil
+	case Gzip:
+		return &sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}, nil
+	case Deflate:
+		return &sync.Pool{New: func() interface{} {
+			w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+			return w
+		}}, nil
+	}
+
+	return nil, fmt.Errorf("Unsupported encoding %q, expected one of [br, gzip, deflate]", e)
+}
+
+// MiddlewareCompress compresses the response when the client accepts one
+// of the supported encodings and the content type is compressible
+// the decision is made once the handler has written minSize bytes or
+// flushed the response, partial, not modified and empty responses are never
+// compressed
+func (m *Middleware) MiddlewareCompress(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		addVary(rw.Header())
+
+		enc := m.Negotiate(r.Header.Get("Accept-Encoding"))
+		if enc == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		cw := &responseWriter{rw: rw, m: m, encoding: enc}
+		defer cw.Close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// Negotiate returns the supported encoding with the highest q-value in the
+// Accept-Encoding header ae, or an empty string when the response should
+// not be compressed
+func (m *Middleware) Negotiate(ae string) string {
+	if ae == "" {
+		return ""
+	}
+
+	accepted := parseAccept(ae)
+
+	best, bestQ := "", 0.0
+	for _, e := range m.encodings {
+		q, ok := accepted[e]
+		if !ok {
+			q = accepted["*"]
+		}
+
+		if q > bestQ {
+			best, bestQ = e, q
+		}
+	}
+
+	return best
+}
+
+// parseAccept returns the q-value for each coding in an Accept-Encoding
+// header, codings without a q-value have q=1
+func parseAccept(ae string) map[string]float64 {
+	accepted := map[string]float64{}
+
+	for _, c := range strings.Split(ae, ",") {
+		p := strings.Split(c, ";")
+
+		name := strings.ToLower(strings.TrimSpace(p[0]))
+		if name == "" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range p[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) != 2 || strings.ToLower(strings.TrimSpace(kv[0])) != "q" {
+				continue
+			}
+
+			v, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+			if err != nil || v < 0 || v > 1 {
+				v = 0
+			}
+
+			q = v
+		}
+
+		accepted[name] = q
+	}
+
+	return accepted
+}
+
+// compressible returns true when the content type ct is in the allowlist
+func (m *Middleware) compressible(ct string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+
+	if m.types[mt] {
+		return true
+	}
+
+	for _, p := range m.prefixes {
+		if strings.HasPrefix(mt, p) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addVary adds Accept-Encoding to the Vary header, responses which are not
+// compressed also vary so that caches do not return them to other clients
+func addVary(h http.Header) {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			f = strings.TrimSpace(f)
+			if f == "*" || strings.EqualFold(f, "Accept-Encoding") {
+				return
+			}
+		}
+	}
+
+	h.Add("Vary", "Accept-Encoding")
+}
+
+// responseWriter buffers the start of the response until it knows whether
+// the response should be compressed
+type responseWriter struct {
+	rw       http.ResponseWriter
+	m        *Middleware
+	encoding string
+
+	status  int
+	buf     []byte
+	decided bool
+	enc     encoder
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.rw.Header()
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	// informational responses are sent immediately
+	if status < http.StatusOK {
+		w.rw.WriteHeader(status)
+		return
+	}
+
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *responseWriter) Write(d []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	if !w.decided {
+		w.buf = append(w.buf, d...)
+		if len(w.buf) < w.m.minSize {
+			return len(d), nil
+		}
+
+		return len(d), w.start(true)
+	}
+
+	if w.enc != nil {
+		return w.enc.Write(d)
+	}
+
+	return w.rw.Write(d)
+}
+
+// start writes the headers and the buffered data, the response is
+// compressed when it can be and large is true
+func (w *responseWriter) start(large bool) error {
+	w.decided = true
+
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	h := w.rw.Header()
+	if h.Get("Content-Type") == "" && len(w.buf) > 0 {
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+
+	if large && w.shouldCompress() {
+		h.Del("Content-Length")
+		h.Del("Accept-Ranges")
+		h.Set("Content-Encoding", w.encoding)
+
+		// the compressed bytes differ from the original representation
+		if et := h.Get("ETag"); et != "" && !strings.HasPrefix(et, "W/") {
+			h.Set("ETag", "W/"+et)
+		}
+
+		w.enc = w.m.pools[w.encoding].Get().(encoder)
+		w.enc.Reset(w.rw)
+	}
+
+	w.rw.WriteHeader(w.status)
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if w.enc != nil {
+		_, err = w.enc.Write(w.buf)
+	} else {
+		_, err = w.rw.Write(w.buf)
+	}
+
+	w.buf = nil
+
+	return err
+}
+
+func (w *responseWriter) shouldCompress() bool {
+	switch w.status {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+
+	h := w.rw.Header()
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+
+	if cl, err := strconv.Atoi(h.Get("Content-Length")); err == nil && cl < w.m.minSize {
+		return false
+	}
+
+	return w.m.compressible(h.Get("Content-Type"))
+}
+
+// Flush sends the buffered data to the client, a response which is flushed
+// before it reaches the minimum size is compressed when its type allows it
+// so that streamed responses are compressed
+func (w *responseWriter) Flush() {
+	if !w.decided {
+		w.start(true)
+	}
+
+	if w.enc != nil {
+		w.enc.Flush()
+	}
+
+	if f, ok := w.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Close completes the response and returns the writer to the pool
+func (w *responseWriter) Close() error {
+	if !w.decided {
+		if w.status == 0 {
+			// the handler did not write a response
+			return nil
+		}
+
+		w.start(false)
+	}
+
+	if w.enc == nil {
+		return nil
+	}
+
+	err := w.enc.Close()
+
+	w.enc.Reset(nil)
+	w.m.pools[w.encoding].Put(w.enc)
+	w.enc = nil
+
+	return err
+}
+
+// Hijack allows websocket handlers to take over the connection
+func (w *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.rw.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+
+	return h.Hijack()
+}
+
+// Unwrap returns the original ResponseWriter for http.ResponseController
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.rw
+}
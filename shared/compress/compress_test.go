@@ -0,0 +1,224 @@
+package compress
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var body = strings.Repeat(`{"name":"Latte","price":2.45}`, 100)
+
+func setup(t *testing.T, h http.HandlerFunc) http.Handler {
+	m, err := New(DefaultEncodings, DefaultMinSize, DefaultTypes)
+	require.NoError(t, err)
+
+	return m.MiddlewareCompress(h)
+}
+
+func jsonHandler(d string) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		io.WriteString(rw, d)
+	}
+}
+
+func get(h http.Handler, ae string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	if ae != "" {
+		r.Header.Set("Accept-Encoding", ae)
+	}
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, r)
+
+	return rr
+}
+
+func decode(t *testing.T, enc string, b *bytes.Buffer) string {
+	var r io.Reader
+
+	switch enc {
+	case Gzip:
+		gr, err := gzip.NewReader(b)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		r = gr
+	case Deflate:
+		r = flate.NewReader(b)
+	case Brotli:
+		r = brotli.NewReader(b)
+	default:
+		r = b
+	}
+
+	// assert rather than require as decode is called from goroutines
+	d, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+
+	return string(d)
+}
+
+func TestNegotiate(t *testing.T) {
+	m, err := New(DefaultEncodings, DefaultMinSize, DefaultTypes)
+	require.NoError(t, err)
+
+	tests := map[string]string{
+		"":                          "",
+		"identity":                  "",
+		"gzip":                      Gzip,
+		"GZIP":                      Gzip,
+		"deflate, gzip":             Gzip,
+		"gzip, br":                  Brotli,
+		"br;q=0.5, gzip":            Gzip,
+		"br;q=0, gzip;q=0, deflate": Deflate,
+		"gzip;q=0":                  "",
+		"*":                         Brotli,
+		"*;q=0.1, gzip;q=0.5":       Gzip,
+		"br;q=0, *":                 Gzip,
+		"gzip;q=invalid":            "",
+		"compress, x-gzip":          "",
+	}
+
+	for ae, want := range tests {
+		assert.Equal(t, want, m.Negotiate(ae), ae)
+	}
+}
+
+func TestNewRejectsUnknownEncodings(t *testing.T) {
+	_, err := New([]string{"gzip", "compress"}, 0, DefaultTypes)
+	assert.Error(t, err)
+}
+
+func TestMiddlewareCompressesWithEachEncoding(t *testing.T) {
+	h := setup(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "application/json")
+		rw.Header().Set("Content-Length", "2900")
+		rw.Header().Set("ETag", `"abc"`)
+		io.WriteString(rw, body)
+	})
+
+	for _, enc := range DefaultEncodings {
+		rr := get(h, enc)
+
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, enc, rr.Header().Get("Content-Encoding"))
+		assert.Equal(t, "Accept-Encoding", rr.Header().Get("Vary"))
+		assert.Empty(t, rr.Header().Get("Content-Length"))
+		assert.Equal(t, `W/"abc"`, rr.Header().Get("ETag"))
+		assert.Less(t, rr.Body.Len(), len(body))
+		assert.Equal(t, body, decode(t, enc, rr.Body))
+	}
+}
+
+func TestMiddlewareDoesNotCompress(t *testing.T) {
+	png := func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "image/png")
+		io.WriteString(rw, body)
+	}
+
+	status := func(code int) http.HandlerFunc {
+		return func(rw http.ResponseWriter, r *http.Request) {
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(code)
+		}
+	}
+
+	partial := func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain")
+		rw.Header().Set("Content-Range", "bytes 0-2899/5000")
+		rw.WriteHeader(http.StatusPartialContent)
+		io.WriteString(rw, body)
+	}
+
+	tests := map[string]http.HandlerFunc{
+		"small":        jsonHandler(`{"id":1}`),
+		"image":        png,
+		"not modified": status(http.StatusNotModified),
+		"no content":   status(http.StatusNoContent),
+		"partial":      partial,
+	}
+
+	for name, h := range tests {
+		rr := get(setup(t, h), "gzip, br")
+
+		assert.Empty(t, rr.Header().Get("Content-Encoding"), name)
+		assert.Equal(t, "Accept-Encoding", rr.Header().Get("Vary"), name)
+	}
+
+	rr := get(setup(t, jsonHandler(`{"id":1}`)), "gzip")
+	assert.Equal(t, `{"id":1}`, rr.Body.String())
+
+	rr = get(setup(t, status(http.StatusNotModified)), "gzip")
+	assert.Equal(t, http.StatusNotModified, rr.Code)
+	assert.Zero(t, rr.Body.Len())
+
+	// clients which do not accept an encoding
+	rr = get(setup(t, jsonHandler(body)), "")
+	assert.Empty(t, rr.Header().Get("Content-Encoding"))
+	assert.Equal(t, body, rr.Body.String())
+}
+
+func TestMiddlewareKeepsExistingVary(t *testing.T) {
+	h := setup(t, jsonHandler(body))
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+
+	rr := httptest.NewRecorder()
+	rr.Header().Set("Vary", "Origin")
+	h.ServeHTTP(rr, r)
+
+	assert.Equal(t, []string{"Origin", "Accept-Encoding"}, rr.Header().Values("Vary"))
+}
+
+func TestMiddlewareFlushesStreamedResponses(t *testing.T) {
+	h := setup(t, func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(rw, "data: 1\n\n")
+		rw.(http.Flusher).Flush()
+	})
+
+	rr := get(h, "gzip")
+
+	assert.True(t, rr.Flushed)
+	assert.Equal(t, Gzip, rr.Header().Get("Content-Encoding"))
+	assert.Equal(t, "data: 1\n\n", decode(t, Gzip, rr.Body))
+}
+
+func TestMiddlewareReusesWritersConcurrently(t *testing.T) {
+	h := setup(t, jsonHandler(body))
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(enc string) {
+			defer wg.Done()
+
+			rr := get(h, enc)
+			assert.Equal(t, body, decode(t, enc, rr.Body))
+		}(DefaultEncodings[i%len(DefaultEncodings)])
+	}
+
+	wg.Wait()
+}
+
+func TestEmptyEncodingsDisableCompression(t *testing.T) {
+	m, err := New([]string{""}, DefaultMinSize, DefaultTypes)
+	require.NoError(t, err)
+
+	rr := get(m.MiddlewareCompress(jsonHandler(body)), "gzip")
+	assert.Empty(t, rr.Header().Get("Content-Encoding"))
+	assert.Equal(t, body, rr.Body.String())
+}
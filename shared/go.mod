@@ -0,0 +1,16 @@
+module github.com/nicholasjackson/building-microservices-youtube/shared
+
+go 1.13
+
+require (
+	github.com/andybalholm/brotli v1.1.1
+	github.com/gorilla/mux v1.7.3
+	github.com/hashicorp/go-hclog v0.12.1
+	github.com/prometheus/client_golang v1.5.1
+	github.com/stretchr/testify v1.8.2
+	go.opentelemetry.io/otel v1.14.0
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.14.0
+	go.opentelemetry.io/otel/sdk v1.14.0
+	go.opentelemetry.io/otel/trace v1.14.0
+	google.golang.org/grpc v1.28.0
+)
@@ -0,0 +1,67 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// GRPC returns a check which calls the gRPC health service on conn for the
+// named service, an empty service checks the server as a whole
+func GRPC(conn *grpc.ClientConn, service string) CheckFunc {
+	hc := healthpb.NewHealthClient(conn)
+
+	return func(ctx context.Context) error {
+		resp, err := hc.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+		if err != nil {
+			return err
+		}
+
+		if resp.Status != healthpb.HealthCheckResponse_SERVING {
+			return fmt.Errorf("Service status is %s", resp.Status)
+		}
+
+		return nil
+	}
+}
+
+// Writable returns a check which writes and removes a temporary file in dir
+func Writable(dir string) CheckFunc {
+	return func(ctx context.Context) error {
+		f, err := ioutil.TempFile(dir, ".health-")
+		if err != nil {
+			return err
+		}
+
+		defer os.Remove(f.Name())
+
+		_, err = f.Write([]byte("ok"))
+		if err != nil {
+			f.Close()
+			return err
+		}
+
+		return f.Close()
+	}
+}
+
+// DiskSpace returns a check which fails when the file system containing
+// dir has less than minFree bytes available
+func DiskSpace(dir string, minFree uint64) CheckFunc {
+	return func(ctx context.Context) error {
+		free, err := freeSpace(dir)
+		if err != nil {
+			return err
+		}
+
+		if free < minFree {
+			return fmt.Errorf("%d bytes free, minimum is %d bytes", free, minFree)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,19 @@
+//go:build !windows
+// +build !windows
+
+package health
+
+import "syscall"
+
+// freeSpace returns the bytes available to unprivileged users on the file
+// system containing dir
+func freeSpace(dir string) (uint64, error) {
+	var s syscall.Statfs_t
+
+	err := syscall.Statfs(dir, &s)
+	if err != nil {
+		return 0, err
+	}
+
+	return s.Bavail * uint64(s.Bsize), nil
+}
@@ -0,0 +1,25 @@
+package health
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// freeSpace returns the bytes available to the current user on the volume
+// containing dir
+func freeSpace(dir string) (uint64, error) {
+	p, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+
+	var free uint64
+	proc := syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+	r, _, err := proc.Call(uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(&free)), 0, 0)
+	if r == 0 {
+		return 0, err
+	}
+
+	return free, nil
+}
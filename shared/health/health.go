@@ -0,0 +1,211 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// CheckFunc checks a dependency of the service, a nil error means the
+// dependency is healthy
+type CheckFunc func(ctx context.Context) error
+
+// Status is the result of a check
+type Status string
+
+const (
+	// StatusOK is reported when a check passes
+	StatusOK Status = "ok"
+	// StatusFail is reported when a check fails
+	StatusFail Status = "fail"
+)
+
+// Result is the result of a single check
+type Result struct {
+	Status   Status `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+// Report is returned by the health endpoints
+type Report struct {
+	Status Status            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+type check struct {
+	name string
+	fn   CheckFunc
+}
+
+// Health serves liveness and readiness endpoints for a service
+// Liveness checks report whether the process is working and should be
+// restarted when failing, readiness checks report whether the service can
+// handle requests. Readiness fails once Shutdown has been called so that
+// load balancers stop sending traffic while requests are drained
+type Health struct {
+	log     hclog.Logger
+	timeout time.Duration
+
+	mu       sync.RWMutex
+	live     []check
+	ready    []check
+	shutdown int32
+}
+
+// New creates a Health, each check must complete within timeout
+func New(l hclog.Logger, timeout time.Duration) *Health {
+	return &Health{log: l, timeout: timeout}
+}
+
+// AddLivenessCheck adds a check to the liveness endpoint
+func (h *Health) AddLivenessCheck(name string, fn CheckFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.live = append(h.live, check{name, fn})
+}
+
+// AddReadinessCheck adds a check to the readiness endpoint
+func (h *Health) AddReadinessCheck(name string, fn CheckFunc) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.ready = append(h.ready, check{name, fn})
+}
+
+// Shutdown marks the service as shutting down, all further readiness
+// checks fail
+func (h *Health) Shutdown() {
+	atomic.StoreInt32(&h.shutdown, 1)
+}
+
+// Drain marks the service as shutting down and waits for delay, or until
+// ctx is done, so that load balancers see readiness fail and stop sending
+// new requests before the server stops accepting connections
+func (h *Health) Drain(ctx context.Context, delay time.Duration) error {
+	h.Shutdown()
+
+	t := time.NewTimer(delay)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Live runs the liveness checks
+func (h *Health) Live(ctx context.Context) Report {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.run(ctx, h.live)
+}
+
+// Ready runs the readiness checks
+func (h *Health) Ready(ctx context.Context) Report {
+	if atomic.LoadInt32(&h.shutdown) == 1 {
+		return Report{
+			Status: StatusFail,
+			Checks: map[string]Result{"shutdown": Result{Status: StatusFail, Error: "Service is shutting down", Duration: "0s"}},
+		}
+	}
+
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.run(ctx, h.ready)
+}
+
+// LiveHandler is a http.HandlerFunc which serves the liveness report
+//
+// GET /healthz
+func (h *Health) LiveHandler(rw http.ResponseWriter, r *http.Request) {
+	h.write(rw, h.Live(r.Context()))
+}
+
+// ReadyHandler is a http.HandlerFunc which serves the readiness report
+//
+// GET /readyz
+func (h *Health) ReadyHandler(rw http.ResponseWriter, r *http.Request) {
+	rep := h.Ready(r.Context())
+	if rep.Status != StatusOK {
+		h.log.Warn("Readiness check failed", "checks", rep.Checks)
+	}
+
+	h.write(rw, rep)
+}
+
+func (h *Health) write(rw http.ResponseWriter, rep Report) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+
+	if rep.Status != StatusOK {
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(rw).Encode(rep)
+}
+
+// run executes the checks concurrently
+func (h *Health) run(ctx context.Context, checks []check) Report {
+	rep := Report{Status: StatusOK, Checks: map[string]Result{}}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, c := range checks {
+		wg.Add(1)
+
+		go func(c check) {
+			defer wg.Done()
+
+			res := h.runCheck(ctx, c)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			rep.Checks[c.name] = res
+			if res.Status != StatusOK {
+				rep.Status = StatusFail
+			}
+		}(c)
+	}
+
+	wg.Wait()
+
+	return rep
+}
+
+func (h *Health) runCheck(ctx context.Context, c check) Result {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	st := time.Now()
+	errc := make(chan error, 1)
+
+	go func() { errc <- c.fn(ctx) }()
+
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	res := Result{Status: StatusOK, Duration: time.Since(st).String()}
+	if err != nil {
+		res.Status = StatusFail
+		res.Error = err.Error()
+	}
+
+	return res
+}
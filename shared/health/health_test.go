@@ -0,0 +1,142 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	grpchealth "google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func get(t *testing.T, h http.HandlerFunc) (int, Report) {
+	rr := httptest.NewRecorder()
+	h(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	rep := Report{}
+	require.NoError(t, json.Unmarshal(rr.Body.Bytes(), &rep))
+
+	return rr.Code, rep
+}
+
+func TestReadyReturnsOKWhenChecksPass(t *testing.T) {
+	h := New(hclog.NewNullLogger(), time.Second)
+	h.AddReadinessCheck("storage", func(ctx context.Context) error { return nil })
+
+	code, rep := get(t, h.ReadyHandler)
+
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, StatusOK, rep.Status)
+	assert.Equal(t, StatusOK, rep.Checks["storage"].Status)
+}
+
+func TestReadyReportsFailingCheck(t *testing.T) {
+	h := New(hclog.NewNullLogger(), time.Second)
+	h.AddReadinessCheck("storage", func(ctx context.Context) error { return nil })
+	h.AddReadinessCheck("currency", func(ctx context.Context) error { return fmt.Errorf("connection refused") })
+
+	code, rep := get(t, h.ReadyHandler)
+
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, StatusFail, rep.Status)
+	assert.Equal(t, StatusOK, rep.Checks["storage"].Status)
+	assert.Equal(t, "connection refused", rep.Checks["currency"].Error)
+}
+
+func TestCheckTimesOut(t *testing.T) {
+	h := New(hclog.NewNullLogger(), 10*time.Millisecond)
+	h.AddLivenessCheck("slow", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+
+	code, rep := get(t, h.LiveHandler)
+
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, context.DeadlineExceeded.Error(), rep.Checks["slow"].Error)
+}
+
+func TestReadyFailsAfterShutdown(t *testing.T) {
+	h := New(hclog.NewNullLogger(), time.Second)
+	h.AddReadinessCheck("storage", func(ctx context.Context) error { return nil })
+	h.Shutdown()
+
+	code, _ := get(t, h.ReadyHandler)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	// liveness is not affected by shutdown
+	code, _ = get(t, h.LiveHandler)
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestDrainFailsReadinessBeforeDelay(t *testing.T) {
+	h := New(hclog.NewNullLogger(), time.Second)
+	h.AddReadinessCheck("storage", func(ctx context.Context) error { return nil })
+
+	done := make(chan error)
+	go func() { done <- h.Drain(context.Background(), 50*time.Millisecond) }()
+
+	// readiness fails while the drain is waiting
+	assert.Eventually(t, func() bool {
+		code, _ := get(t, h.ReadyHandler)
+		return code == http.StatusServiceUnavailable
+	}, time.Second, time.Millisecond)
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Expected drain to return after the delay")
+	}
+}
+
+func TestDrainReturnsWhenContextDone(t *testing.T) {
+	h := New(hclog.NewNullLogger(), time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := h.Drain(ctx, time.Hour)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestWritableCheck(t *testing.T) {
+	assert.NoError(t, Writable(t.TempDir())(context.Background()))
+	assert.Error(t, Writable("/does/not/exist")(context.Background()))
+}
+
+func TestDiskSpaceCheck(t *testing.T) {
+	assert.NoError(t, DiskSpace(t.TempDir(), 1)(context.Background()))
+	assert.Error(t, DiskSpace(t.TempDir(), 1<<62)(context.Background()))
+}
+
+func TestGRPCCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	hs := grpchealth.NewServer()
+	hs.SetServingStatus("Currency", healthpb.HealthCheckResponse_SERVING)
+
+	gs := grpc.NewServer()
+	healthpb.RegisterHealthServer(gs, hs)
+	go gs.Serve(l)
+	defer gs.Stop()
+
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	assert.NoError(t, GRPC(conn, "Currency")(context.Background()))
+
+	hs.SetServingStatus("Currency", healthpb.HealthCheckResponse_NOT_SERVING)
+	assert.Error(t, GRPC(conn, "Currency")(context.Background()))
+}
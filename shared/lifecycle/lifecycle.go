@@ -0,0 +1,192 @@
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"google.golang.org/grpc"
+)
+
+// Exit codes returned by Wait
+const (
+	// ExitOK is returned when the service shut down cleanly
+	ExitOK = 0
+	// ExitServerError is returned when a server stopped with an error
+	ExitServerError = 1
+	// ExitShutdownError is returned when a shutdown hook failed or did not
+	// complete before the shutdown timeout
+	ExitShutdownError = 2
+)
+
+// ShutdownFunc is called when the service shuts down, it should stop
+// accepting new work and return once in-flight work has completed or ctx is
+// done
+type ShutdownFunc func(ctx context.Context) error
+
+type hook struct {
+	name string
+	fn   ShutdownFunc
+}
+
+// Lifecycle runs the servers for a service and shuts them down gracefully
+// when the process receives SIGINT or SIGTERM or one of the servers fails
+// Shutdown hooks run in the reverse order they were added, like defer, so
+// servers added after their dependencies are drained first
+type Lifecycle struct {
+	log     hclog.Logger
+	timeout time.Duration
+
+	mu     sync.Mutex
+	hooks  []hook
+	errs   chan error
+	stop   chan os.Signal
+	closed sync.Once
+}
+
+// New creates a Lifecycle, all shutdown hooks must complete within timeout
+func New(l hclog.Logger, timeout time.Duration) *Lifecycle {
+	return &Lifecycle{
+		log:     l,
+		timeout: timeout,
+		errs:    make(chan error, 1),
+		stop:    make(chan os.Signal, 1),
+	}
+}
+
+// OnShutdown adds a hook which is called when the service shuts down
+func (lc *Lifecycle) OnShutdown(name string, fn ShutdownFunc) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	lc.hooks = append(lc.hooks, hook{name, fn})
+}
+
+// Go runs fn in a goroutine, the service shuts down when fn returns an error
+func (lc *Lifecycle) Go(name string, fn func() error) {
+	go func() {
+		err := fn()
+		if err != nil {
+			select {
+			case lc.errs <- fmt.Errorf("%s: %s", name, err):
+			default:
+			}
+		}
+	}()
+}
+
+// ServeHTTP starts the HTTP server using serve, i.e. s.ListenAndServe, and
+// drains the server on shutdown
+func (lc *Lifecycle) ServeHTTP(name string, s *http.Server, serve func() error) {
+	lc.Go(name, func() error {
+		err := serve()
+		if err == http.ErrServerClosed {
+			return nil
+		}
+
+		return err
+	})
+
+	lc.OnShutdown(name, s.Shutdown)
+}
+
+// ServeGRPC starts the gRPC server on l and gracefully stops the server on
+// shutdown, when the server does not stop before the timeout all connections
+// are closed
+func (lc *Lifecycle) ServeGRPC(name string, s *grpc.Server, l net.Listener) {
+	lc.Go(name, func() error {
+		return s.Serve(l)
+	})
+
+	lc.OnShutdown(name, func(ctx context.Context) error {
+		done := make(chan struct{})
+
+		go func() {
+			s.GracefulStop()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			s.Stop()
+			return ctx.Err()
+		}
+	})
+}
+
+// Stop starts the shutdown of the service as if a signal had been received
+func (lc *Lifecycle) Stop() {
+	select {
+	case lc.stop <- syscall.SIGTERM:
+	default:
+	}
+}
+
+// Wait blocks until the process receives SIGINT or SIGTERM, Stop is called
+// or a server fails, it then runs the shutdown hooks and returns the exit
+// code for the process
+func (lc *Lifecycle) Wait() int {
+	signal.Notify(lc.stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(lc.stop)
+
+	code := ExitOK
+
+	select {
+	case sig := <-lc.stop:
+		lc.log.Info("Shutting down", "signal", sig)
+	case err := <-lc.errs:
+		lc.log.Error("Server stopped unexpectedly, shutting down", "error", err)
+		code = ExitServerError
+	}
+
+	err := lc.Shutdown()
+	if err != nil && code == ExitOK {
+		code = ExitShutdownError
+	}
+
+	return code
+}
+
+// Shutdown runs the shutdown hooks in reverse order, all hooks are run
+// even when one fails and the first error is returned
+func (lc *Lifecycle) Shutdown() error {
+	var err error
+
+	lc.closed.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), lc.timeout)
+		defer cancel()
+
+		lc.mu.Lock()
+		hooks := lc.hooks
+		lc.mu.Unlock()
+
+		for i := len(hooks) - 1; i >= 0; i-- {
+			h := hooks[i]
+
+			st := time.Now()
+			herr := h.fn(ctx)
+			if herr != nil {
+				lc.log.Error("Shutdown failed", "name", h.name, "error", herr)
+
+				if err == nil {
+					err = fmt.Errorf("%s: %s", h.name, herr)
+				}
+
+				continue
+			}
+
+			lc.log.Info("Shutdown complete", "name", h.name, "duration", time.Since(st))
+		}
+	})
+
+	return err
+}
@@ -0,0 +1,152 @@
+package lifecycle
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestShutdownRunsHooksInReverseOrder(t *testing.T) {
+	lc := New(hclog.NewNullLogger(), time.Second)
+
+	order := []string{}
+	for _, n := range []string{"tracing", "database", "server"} {
+		n := n
+		lc.OnShutdown(n, func(ctx context.Context) error {
+			order = append(order, n)
+			return nil
+		})
+	}
+
+	lc.Stop()
+	assert.Equal(t, ExitOK, lc.Wait())
+	assert.Equal(t, []string{"server", "database", "tracing"}, order)
+}
+
+func TestWaitReturnsServerErrorCode(t *testing.T) {
+	lc := New(hclog.NewNullLogger(), time.Second)
+	lc.Go("server", func() error { return fmt.Errorf("address already in use") })
+
+	assert.Equal(t, ExitServerError, lc.Wait())
+}
+
+func TestWaitReturnsShutdownErrorCodeOnTimeout(t *testing.T) {
+	lc := New(hclog.NewNullLogger(), 10*time.Millisecond)
+
+	ran := false
+	lc.OnShutdown("tracing", func(ctx context.Context) error {
+		ran = true
+		return nil
+	})
+
+	lc.OnShutdown("server", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	lc.Stop()
+	assert.Equal(t, ExitShutdownError, lc.Wait())
+
+	// later hooks still run when a hook fails
+	assert.True(t, ran)
+}
+
+func TestHTTPInFlightRequestCompletes(t *testing.T) {
+	started := make(chan struct{})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		rw.Write([]byte("done"))
+	})
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s := &http.Server{Handler: mux}
+	lc := New(hclog.NewNullLogger(), 5*time.Second)
+	lc.ServeHTTP("http", s, func() error { return s.Serve(l) })
+
+	type result struct {
+		body string
+		err  error
+	}
+
+	res := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			res <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+
+		d, err := ioutil.ReadAll(resp.Body)
+		res <- result{string(d), err}
+	}()
+
+	// shutdown while the request is being handled
+	<-started
+	lc.Stop()
+	assert.Equal(t, ExitOK, lc.Wait())
+
+	r := <-res
+	require.NoError(t, r.err)
+	assert.Equal(t, "done", r.body)
+
+	// new connections are refused after shutdown
+	_, err = http.Get("http://" + l.Addr().String())
+	assert.Error(t, err)
+}
+
+// slowHealth is a health server which takes time to respond
+type slowHealth struct {
+	healthpb.UnimplementedHealthServer
+	started chan struct{}
+}
+
+func (s *slowHealth) Check(ctx context.Context, r *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	close(s.started)
+	time.Sleep(100 * time.Millisecond)
+
+	return &healthpb.HealthCheckResponse{Status: healthpb.HealthCheckResponse_SERVING}, nil
+}
+
+func TestGRPCInFlightRequestCompletes(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	hs := &slowHealth{started: make(chan struct{})}
+	gs := grpc.NewServer()
+	healthpb.RegisterHealthServer(gs, hs)
+
+	lc := New(hclog.NewNullLogger(), 5*time.Second)
+	lc.ServeGRPC("grpc", gs, l)
+
+	conn, err := grpc.Dial(l.Addr().String(), grpc.WithInsecure())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+		errc <- err
+	}()
+
+	<-hs.started
+	lc.Stop()
+	assert.Equal(t, ExitOK, lc.Wait())
+
+	assert.NoError(t, <-errc)
+}
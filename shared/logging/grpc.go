@@ -0,0 +1,77 @@
+package logging
+
+import (
+	"context"
+	"strings"
+
+	"github.com/hashicorp/go-hclog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// metadataRequestID is the gRPC metadata key used to propagate the request id
+var metadataRequestID = strings.ToLower(HeaderRequestID)
+
+// UnaryClientInterceptor forwards the request id in the context to the
+// server as gRPC metadata
+func UnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	return invoker(outgoingContext(ctx), method, req, reply, cc, opts...)
+}
+
+// StreamClientInterceptor forwards the request id in the context to the
+// server as gRPC metadata
+func StreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	return streamer(outgoingContext(ctx), desc, cc, method, opts...)
+}
+
+// UnaryServerInterceptor adds the request id from the incoming metadata and
+// a request scoped logger to the context, a new id is generated when the
+// client does not send one
+func UnaryServerInterceptor(l hclog.Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		return handler(incomingContext(ctx, l), req)
+	}
+}
+
+// StreamServerInterceptor adds the request id from the incoming metadata and
+// a request scoped logger to the context of the stream
+func StreamServerInterceptor(l hclog.Logger) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		return handler(srv, &serverStream{ServerStream: ss, ctx: incomingContext(ss.Context(), l)})
+	}
+}
+
+func outgoingContext(ctx context.Context) context.Context {
+	id := RequestID(ctx)
+	if id == "" {
+		return ctx
+	}
+
+	return metadata.AppendToOutgoingContext(ctx, metadataRequestID, id)
+}
+
+func incomingContext(ctx context.Context, l hclog.Logger) context.Context {
+	id := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get(metadataRequestID); len(v) > 0 {
+			id = v[0]
+		}
+	}
+
+	if !validRequestID(id) {
+		id = NewRequestID()
+	}
+
+	ctx = WithRequestID(ctx, id)
+	return WithLogger(ctx, l.With("request_id", id))
+}
+
+// serverStream returns the context containing the request id
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
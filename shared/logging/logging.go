@@ -0,0 +1,132 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/nicholasjackson/building-microservices-youtube/shared/middleware"
+)
+
+// HeaderRequestID is the HTTP header used to propagate the request id
+const HeaderRequestID = "X-Request-ID"
+
+// maxRequestIDLength is the longest request id accepted from a client
+const maxRequestIDLength = 128
+
+// KeyRequestID is a key used for the request id in the context
+type KeyRequestID struct{}
+
+// KeyLogger is a key used for the request scoped logger in the context
+type KeyLogger struct{}
+
+// WithRequestID returns a copy of the context containing the given request id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, KeyRequestID{}, id)
+}
+
+// RequestID returns the request id stored in the context, an empty string
+// is returned when the context does not contain a request id
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(KeyRequestID{}).(string)
+	return id
+}
+
+// WithLogger returns a copy of the context containing the given logger
+func WithLogger(ctx context.Context, l hclog.Logger) context.Context {
+	return context.WithValue(ctx, KeyLogger{}, l)
+}
+
+// Logger returns the request scoped logger stored in the context, when
+// the context does not contain a logger fallback is returned
+func Logger(ctx context.Context, fallback hclog.Logger) hclog.Logger {
+	if l, ok := ctx.Value(KeyLogger{}).(hclog.Logger); ok {
+		return l
+	}
+
+	return fallback
+}
+
+// Middleware assigns request ids and writes access logs for HTTP requests
+type Middleware struct {
+	log hclog.Logger
+}
+
+// NewMiddleware creates a new Middleware, request scoped loggers are
+// created from the given logger
+func NewMiddleware(l hclog.Logger) *Middleware {
+	return &Middleware{log: l}
+}
+
+// MiddlewareRequestID adds the request id to the context along with a logger
+// which includes the request id in every log line
+// The id is read from the X-Request-ID header, when the client does not send
+// a valid id a new one is generated. The id is returned in the response header
+func (m *Middleware) MiddlewareRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(HeaderRequestID)
+		if !validRequestID(id) {
+			id = NewRequestID()
+		}
+
+		rw.Header().Set(HeaderRequestID, id)
+
+		ctx := WithRequestID(r.Context(), id)
+		ctx = WithLogger(ctx, m.log.With("request_id", id))
+
+		next.ServeHTTP(rw, r.WithContext(ctx))
+	})
+}
+
+// MiddlewareAccessLog writes a log line for every request containing the
+// method, route, status code, response size and latency
+func (m *Middleware) MiddlewareAccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		st := time.Now()
+		wr := middleware.NewRecorder(rw)
+
+		next.ServeHTTP(wr, r)
+
+		// empty when no route was matched
+		route, _ := middleware.RouteTemplate(r)
+
+		Logger(r.Context(), m.log).Info(
+			"Handled request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", route,
+			"status", wr.Status,
+			"bytes", wr.Size,
+			"duration", time.Since(st),
+		)
+	})
+}
+
+// NewRequestID returns a random 128 bit hex encoded id
+func NewRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+
+	return hex.EncodeToString(b)
+}
+
+// validRequestID checks that an id sent by a client is safe to write
+// to logs and response headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,93 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func setupRouter(out *bytes.Buffer) *mux.Router {
+	m := NewMiddleware(hclog.New(&hclog.LoggerOptions{Output: out}))
+
+	sm := mux.NewRouter()
+	sm.HandleFunc("/products/{id:[0-9]+}", func(rw http.ResponseWriter, r *http.Request) {
+		Logger(r.Context(), hclog.NewNullLogger()).Info("in handler")
+		rw.Write([]byte(RequestID(r.Context())))
+	})
+
+	sm.Use(m.MiddlewareRequestID)
+	sm.Use(m.MiddlewareAccessLog)
+
+	return sm
+}
+
+func TestMiddlewarePropagatesRequestID(t *testing.T) {
+	out := bytes.NewBuffer(nil)
+	sm := setupRouter(out)
+
+	r := httptest.NewRequest(http.MethodGet, "/products/1", nil)
+	r.Header.Set(HeaderRequestID, "abc-123")
+
+	rr := httptest.NewRecorder()
+	sm.ServeHTTP(rr, r)
+
+	assert.Equal(t, "abc-123", rr.Header().Get(HeaderRequestID))
+	assert.Equal(t, "abc-123", rr.Body.String())
+
+	// both the handler log and the access log contain the request id
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "request_id=abc-123")
+	assert.Contains(t, lines[1], "request_id=abc-123")
+	assert.Contains(t, lines[1], "route=/products/{id:[0-9]+}")
+	assert.Contains(t, lines[1], "status=200")
+	assert.Contains(t, lines[1], "bytes=7")
+}
+
+func TestMiddlewareReplacesInvalidRequestID(t *testing.T) {
+	sm := setupRouter(bytes.NewBuffer(nil))
+
+	r := httptest.NewRequest(http.MethodGet, "/products/1", nil)
+	r.Header.Set(HeaderRequestID, "bad\nid")
+
+	rr := httptest.NewRecorder()
+	sm.ServeHTTP(rr, r)
+
+	assert.Len(t, rr.Header().Get(HeaderRequestID), 32)
+}
+
+func TestClientInterceptorAddsMetadata(t *testing.T) {
+	ctx := WithRequestID(context.Background(), "abc-123")
+
+	var md metadata.MD
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, opts ...grpc.CallOption) error {
+		md, _ = metadata.FromOutgoingContext(ctx)
+		return nil
+	}
+
+	UnaryClientInterceptor(ctx, "/Currency/GetRate", nil, nil, nil, invoker)
+	assert.Equal(t, []string{"abc-123"}, md.Get("x-request-id"))
+}
+
+func TestServerInterceptorReadsMetadata(t *testing.T) {
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-request-id", "abc-123"))
+
+	var id string
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		id = RequestID(ctx)
+		return nil, nil
+	}
+
+	UnaryServerInterceptor(hclog.NewNullLogger())(ctx, nil, &grpc.UnaryServerInfo{}, handler)
+	assert.Equal(t, "abc-123", id)
+}
@@ -0,0 +1,80 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/nicholasjackson/building-microservices-youtube/shared/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// HTTP records Prometheus metrics for HTTP requests, requests are labeled
+// with the path template of the matched Gorilla mux route so that paths
+// containing ids do not create a new series for every request
+type HTTP struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	size     *prometheus.HistogramVec
+}
+
+// NewHTTP creates the HTTP metrics and registers them with the given registerer
+// namespace is prefixed to the metric names, i.e. product_api
+func NewHTTP(namespace string, reg prometheus.Registerer) (*HTTP, error) {
+	h := &HTTP{
+		requests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "http_requests_total",
+				Help:      "Total number of HTTP requests by route, method and status code",
+			},
+			[]string{"route", "method", "code"},
+		),
+		duration: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "http_request_duration_seconds",
+				Help:      "Latency of HTTP requests by route and method",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"route", "method"},
+		),
+		size: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "http_response_size_bytes",
+				Help:      "Size of HTTP responses by route and method",
+				Buckets:   prometheus.ExponentialBuckets(100, 10, 6),
+			},
+			[]string{"route", "method"},
+		),
+	}
+
+	for _, c := range []prometheus.Collector{h.requests, h.duration, h.size} {
+		err := reg.Register(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+// Middleware records the count, latency and response size of requests
+func (h *HTTP) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		st := time.Now()
+		wr := middleware.NewRecorder(rw)
+
+		next.ServeHTTP(wr, r)
+
+		route, ok := middleware.RouteTemplate(r)
+		if !ok {
+			route = "unknown"
+		}
+
+		h.requests.WithLabelValues(route, r.Method, strconv.Itoa(wr.Status)).Inc()
+		h.duration.WithLabelValues(route, r.Method).Observe(time.Since(st).Seconds())
+		h.size.WithLabelValues(route, r.Method).Observe(float64(wr.Size))
+	})
+}
@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddlewareRecordsRouteTemplate(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	h, err := NewHTTP("test", reg)
+	require.NoError(t, err)
+
+	sm := mux.NewRouter()
+	sm.HandleFunc("/products/{id:[0-9]+}", func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("not found"))
+	})
+	sm.Use(h.Middleware)
+
+	for _, id := range []string{"1", "2", "3"} {
+		sm.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/products/"+id, nil))
+	}
+
+	c := h.requests.WithLabelValues("/products/{id:[0-9]+}", http.MethodGet, "404")
+	assert.Equal(t, float64(3), testutil.ToFloat64(c))
+
+	// ids must not create new series
+	assert.Equal(t, 1, testutil.CollectAndCount(h.requests))
+}
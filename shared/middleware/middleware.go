@@ -0,0 +1,62 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// RouteTemplate returns the path template for the matched Gorilla mux route
+// i.e. /products/{id:[0-9]+}, ok is false when no route has been matched
+func RouteTemplate(r *http.Request) (string, bool) {
+	if cr := mux.CurrentRoute(r); cr != nil {
+		if t, err := cr.GetPathTemplate(); err == nil {
+			return t, true
+		}
+	}
+
+	return "", false
+}
+
+// Recorder wraps a ResponseWriter and captures the status code and number
+// of bytes written by the handler
+type Recorder struct {
+	http.ResponseWriter
+	Status int
+	Size   int
+}
+
+// NewRecorder creates a Recorder for rw, the status is 200 until the
+// handler writes a header
+func NewRecorder(rw http.ResponseWriter) *Recorder {
+	return &Recorder{ResponseWriter: rw, Status: http.StatusOK}
+}
+
+// WriteHeader records the status code and writes it to the underlying
+// ResponseWriter
+func (r *Recorder) WriteHeader(status int) {
+	r.Status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write counts the bytes written to the underlying ResponseWriter
+func (r *Recorder) Write(d []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(d)
+	r.Size += n
+
+	return n, err
+}
+
+// Flush implements the http.Flusher interface when the underlying
+// ResponseWriter supports it
+func (r *Recorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter so that an
+// http.ResponseController can set deadlines on the connection
+func (r *Recorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
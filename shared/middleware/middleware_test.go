@@ -0,0 +1,58 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteTemplateReturnsMatchedRoute(t *testing.T) {
+	var route string
+	var ok bool
+
+	r := mux.NewRouter()
+	r.HandleFunc("/products/{id:[0-9]+}", func(rw http.ResponseWriter, r *http.Request) {
+		route, ok = RouteTemplate(r)
+	})
+
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/products/1", nil))
+	assert.True(t, ok)
+	assert.Equal(t, "/products/{id:[0-9]+}", route)
+
+	_, ok = RouteTemplate(httptest.NewRequest(http.MethodGet, "/products/1", nil))
+	assert.False(t, ok)
+}
+
+func TestRecorderCapturesStatusAndSize(t *testing.T) {
+	rr := httptest.NewRecorder()
+	wr := NewRecorder(rr)
+
+	wr.WriteHeader(http.StatusCreated)
+	wr.Write([]byte("Hello World"))
+
+	assert.Equal(t, http.StatusCreated, wr.Status)
+	assert.Equal(t, 11, wr.Size)
+	assert.Equal(t, http.StatusCreated, rr.Code)
+}
+
+func TestRecorderSupportsResponseController(t *testing.T) {
+	var err error
+
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		// wrapped twice like a chain of middleware
+		rc := http.NewResponseController(NewRecorder(NewRecorder(rw)))
+		err = rc.SetReadDeadline(time.Now().Add(time.Minute))
+	}))
+	defer s.Close()
+
+	resp, gerr := http.Get(s.URL)
+	require.NoError(t, gerr)
+	resp.Body.Close()
+
+	assert.NoError(t, err)
+}
@@ -0,0 +1,159 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is the minimum time between removing idle buckets
+const sweepInterval = time.Minute
+
+// Result is the outcome of a call to Limiter.Allow
+type Result struct {
+	// Allowed is true when the request can proceed
+	Allowed bool
+	// Limit is the maximum number of requests in a burst
+	Limit int
+	// Remaining is the number of requests which can be made before being limited
+	Remaining int
+	// Reset is the time until the bucket is full again
+	Reset time.Duration
+	// RetryAfter is the time the client should wait before retrying, zero when allowed
+	RetryAfter time.Duration
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Limiter is a token bucket rate limiter which keeps a separate bucket for each key,
+// buckets hold at most burst tokens and are refilled at rate tokens per second
+type Limiter struct {
+	mu        sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// NewLimiter creates a new Limiter
+// rate is the number of tokens added to each bucket per second
+// burst is the maximum number of tokens a bucket can hold
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &Limiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: map[string]*bucket{},
+		now:     time.Now,
+	}
+}
+
+// Allow takes a single token from the bucket for the given key
+func (l *Limiter) Allow(key string) Result {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.refill(key)
+
+	r := Result{Limit: int(l.burst)}
+
+	if b.tokens >= 1 {
+		b.tokens--
+		r.Allowed = true
+	} else {
+		r.RetryAfter = l.durationFor(1 - b.tokens)
+	}
+
+	r.Remaining = int(math.Floor(b.tokens))
+	r.Reset = l.durationFor(l.burst - b.tokens)
+
+	return r
+}
+
+// Take removes n tokens from the bucket for the given key and returns the
+// time the caller must wait before the tokens are available, the bucket
+// can go into debt so that concurrent callers queue behind each other
+func (l *Limiter) Take(key string, n int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.refill(key)
+	b.tokens -= float64(n)
+
+	if b.tokens >= 0 {
+		return 0
+	}
+
+	return l.durationFor(-b.tokens)
+}
+
+// Wait returns the time until a token is available in the bucket for the
+// given key without taking it, zero when a token is available
+func (l *Limiter) Wait(key string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b := l.refill(key)
+	if b.tokens >= 1 {
+		return 0
+	}
+
+	return l.durationFor(1 - b.tokens)
+}
+
+// Burst returns the maximum number of tokens in a bucket
+func (l *Limiter) Burst() int {
+	return int(l.burst)
+}
+
+// refill adds the tokens accrued since the bucket was last used
+// the caller must hold the lock
+func (l *Limiter) refill(key string) *bucket {
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+		return b
+	}
+
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+
+	return b
+}
+
+// sweep removes buckets which would have refilled, these are equivalent
+// to a new bucket and do not need to be kept in memory
+// the caller must hold the lock
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+
+	l.lastSweep = now
+
+	for k, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// durationFor returns the time taken to accrue the given number of tokens
+func (l *Limiter) durationFor(tokens float64) time.Duration {
+	if tokens <= 0 || l.rate <= 0 {
+		return 0
+	}
+
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
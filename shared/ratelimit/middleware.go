@@ -0,0 +1,160 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KeyFunc returns the key used to identify the client making the request,
+// each key has its own token bucket
+type KeyFunc func(r *http.Request) string
+
+// KeyByIP returns a KeyFunc which identifies clients by their IP address
+// when trustForwarded is true the first address in the X-Forwarded-For header
+// is used, this should only be enabled when the service is behind a trusted proxy
+func KeyByIP(trustForwarded bool) KeyFunc {
+	return func(r *http.Request) string {
+		if trustForwarded {
+			if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+				return "ip:" + strings.TrimSpace(strings.Split(xff, ",")[0])
+			}
+		}
+
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return "ip:" + r.RemoteAddr
+		}
+
+		return "ip:" + host
+	}
+}
+
+// Middleware limits the number of requests a client can make, read requests
+// (GET, HEAD, OPTIONS) and write requests have separate limits
+type Middleware struct {
+	read  *Limiter
+	write *Limiter
+	key   KeyFunc
+}
+
+// New creates a new rate limiting Middleware
+// read and write are the limiters for read and write requests, a nil limiter
+// disables rate limiting for that type of request
+func New(read, write *Limiter, key KeyFunc) *Middleware {
+	return &Middleware{read: read, write: write, key: key}
+}
+
+// MiddlewareRateLimit returns a 429 Too Many Requests response when the
+// client has exceeded the rate limit, otherwise calls next
+// RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers are added
+// to all responses
+func (m *Middleware) MiddlewareRateLimit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		l := m.write
+		if isRead(r.Method) {
+			l = m.read
+		}
+
+		if l == nil {
+			next.ServeHTTP(rw, r)
+			return
+		}
+
+		res := l.Allow(m.key(r))
+
+		rw.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+		rw.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+		rw.Header().Set("RateLimit-Reset", seconds(res.Reset))
+
+		if !res.Allowed {
+			rw.Header().Set("Retry-After", seconds(res.RetryAfter))
+			rw.Header().Set("Content-Type", "application/json")
+			rw.WriteHeader(http.StatusTooManyRequests)
+
+			json.NewEncoder(rw).Encode(map[string]string{"message": "Too many requests"})
+			return
+		}
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// Bandwidth limits the rate at which a client can upload data, the limit
+// is shared between all concurrent requests from the same client
+type Bandwidth struct {
+	limiter *Limiter
+	key     KeyFunc
+}
+
+// NewBandwidth creates a new Bandwidth limiter
+// bytesPerSecond is the sustained upload rate for a client
+// burst is the number of bytes a client can send before being throttled
+func NewBandwidth(bytesPerSecond, burst int, key KeyFunc) *Bandwidth {
+	return &Bandwidth{limiter: NewLimiter(float64(bytesPerSecond), burst), key: key}
+}
+
+// MiddlewareLimitBandwidth throttles reads from the request body so that the
+// client can not upload faster than the configured rate
+func (b *Bandwidth) MiddlewareLimitBandwidth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		r.Body = &throttledReader{
+			ReadCloser: r.Body,
+			ctx:        r.Context(),
+			limiter:    b.limiter,
+			key:        b.key(r),
+		}
+
+		next.ServeHTTP(rw, r)
+	})
+}
+
+// throttledReader blocks reads until the client has enough tokens
+type throttledReader struct {
+	io.ReadCloser
+	ctx     context.Context
+	limiter *Limiter
+	key     string
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	// never read more than a full bucket at once
+	if len(p) > t.limiter.Burst() {
+		p = p[:t.limiter.Burst()]
+	}
+
+	n, err := t.ReadCloser.Read(p)
+	if n == 0 {
+		return n, err
+	}
+
+	wait := t.limiter.Take(t.key, n)
+	if wait == 0 {
+		return n, err
+	}
+
+	tm := time.NewTimer(wait)
+	defer tm.Stop()
+
+	select {
+	case <-tm.C:
+		return n, err
+	case <-t.ctx.Done():
+		return n, t.ctx.Err()
+	}
+}
+
+func isRead(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// seconds formats the duration as a whole number of seconds, rounded up
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,118 @@
+package ratelimit
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLimiterAllowsBurstThenLimits(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(1, 2)
+	l.now = func() time.Time { return now }
+
+	assert.True(t, l.Allow("a").Allowed)
+	assert.True(t, l.Allow("a").Allowed)
+
+	r := l.Allow("a")
+	assert.False(t, r.Allowed)
+	assert.Equal(t, time.Second, r.RetryAfter)
+
+	// other keys have their own bucket
+	assert.True(t, l.Allow("b").Allowed)
+
+	// tokens are refilled over time
+	now = now.Add(time.Second)
+	assert.True(t, l.Allow("a").Allowed)
+}
+
+func TestLimiterWaitDoesNotTakeTokens(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(1, 1)
+	l.now = func() time.Time { return now }
+
+	assert.Zero(t, l.Wait("a"))
+	assert.Zero(t, l.Wait("a"))
+
+	l.Take("a", 2)
+	assert.Equal(t, 2*time.Second, l.Wait("a"))
+}
+
+func TestLimiterSweepsIdleBuckets(t *testing.T) {
+	now := time.Now()
+	l := NewLimiter(1, 2)
+	l.now = func() time.Time { return now }
+
+	l.Allow("a")
+	assert.Len(t, l.buckets, 1)
+
+	now = now.Add(2 * sweepInterval)
+	l.Allow("b")
+	assert.Len(t, l.buckets, 1)
+}
+
+func TestMiddlewareReturns429WithHeaders(t *testing.T) {
+	m := New(NewLimiter(1, 1), NewLimiter(1, 1), KeyByIP(false))
+	h := m.MiddlewareRateLimit(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/products", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("RateLimit-Limit"))
+	assert.Equal(t, "0", rr.Header().Get("RateLimit-Remaining"))
+
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/products", nil))
+	assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+	assert.Equal(t, "1", rr.Header().Get("Retry-After"))
+
+	// writes have a separate limit
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/products", nil))
+	assert.Equal(t, http.StatusOK, rr.Code)
+}
+
+func TestMiddlewareWithNilLimiterIsUnlimited(t *testing.T) {
+	m := New(nil, NewLimiter(1, 1), KeyByIP(false))
+	h := m.MiddlewareRateLimit(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {}))
+
+	for i := 0; i < 5; i++ {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/products", nil))
+		assert.Equal(t, http.StatusOK, rr.Code)
+	}
+}
+
+func TestKeyByIPUsesForwardedWhenTrusted(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.RemoteAddr = "10.0.0.1:1234"
+	r.Header.Set("X-Forwarded-For", "192.168.1.1, 10.0.0.2")
+
+	assert.Equal(t, "ip:10.0.0.1", KeyByIP(false)(r))
+	assert.Equal(t, "ip:192.168.1.1", KeyByIP(true)(r))
+}
+
+func TestBandwidthThrottlesUploads(t *testing.T) {
+	// 1000 bytes per second with a 500 byte burst
+	b := NewBandwidth(1000, 500, KeyByIP(false))
+
+	var read int
+	h := b.MiddlewareLimitBandwidth(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		d, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		read = len(d)
+	}))
+
+	st := time.Now()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(make([]byte, 1000))))
+
+	assert.Equal(t, 1000, read)
+	// the first 500 bytes are the burst, the remaining 500 take 0.5s
+	assert.True(t, time.Since(st) >= 400*time.Millisecond)
+}
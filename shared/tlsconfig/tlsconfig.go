@@ -0,0 +1,248 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+)
+
+// Files are the PEM encoded certificates used for a TLS connection
+// CAFile is used by a server to verify client certificates (mutual TLS) and
+// by a client to verify the server, CertFile and KeyFile are the certificate
+// presented to the other side of the connection
+type Files struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// Reloader holds the certificates for a TLS connection, the certificates are
+// reloaded from disk when the files change without restarting the server
+// or recreating the client
+type Reloader struct {
+	log   hclog.Logger
+	files Files
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	modTime time.Time
+}
+
+// NewReloader creates a Reloader and loads the certificates, an error is
+// returned when the files can not be read or parsed
+func NewReloader(l hclog.Logger, f Files) (*Reloader, error) {
+	if (f.CertFile == "") != (f.KeyFile == "") {
+		return nil, fmt.Errorf("Certificate and key files must be set together")
+	}
+
+	r := &Reloader{log: l, files: f}
+
+	err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// Reload reads the certificates from disk, the current certificates are
+// kept when the files can not be loaded
+func (r *Reloader) Reload() error {
+	mt, err := r.latestModTime()
+	if err != nil {
+		return err
+	}
+
+	var cert *tls.Certificate
+	if r.files.CertFile != "" {
+		c, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+		if err != nil {
+			return fmt.Errorf("Unable to load key pair %s, %s: %s", r.files.CertFile, r.files.KeyFile, err)
+		}
+
+		cert = &c
+	}
+
+	var pool *x509.CertPool
+	if r.files.CAFile != "" {
+		d, err := ioutil.ReadFile(r.files.CAFile)
+		if err != nil {
+			return fmt.Errorf("Unable to read CA file %s: %s", r.files.CAFile, err)
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(d) {
+			return fmt.Errorf("Unable to parse CA certificates from %s", r.files.CAFile)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cert = cert
+	r.pool = pool
+	r.modTime = mt
+
+	return nil
+}
+
+// Watch checks the files for changes every interval and reloads the
+// certificates when they are modified, watching stops when ctx is cancelled
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+
+			mt, err := r.latestModTime()
+			if err != nil {
+				r.log.Error("Unable to check certificates for changes", "error", err)
+				continue
+			}
+
+			r.mu.RLock()
+			changed := !mt.Equal(r.modTime)
+			r.mu.RUnlock()
+
+			if !changed {
+				continue
+			}
+
+			err = r.Reload()
+			if err != nil {
+				r.log.Error("Unable to reload certificates, using previous certificates", "error", err)
+				continue
+			}
+
+			r.log.Info("Reloaded certificates", "cert", r.files.CertFile, "ca", r.files.CAFile)
+		}
+	}()
+}
+
+// ServerConfig returns a tls.Config for a server, when a CA file is set
+// clients must present a certificate signed by the CA
+func (r *Reloader) ServerConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.getCertificate,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mu.RLock()
+			defer r.mu.RUnlock()
+
+			c := &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: r.getCertificate,
+			}
+
+			if r.pool != nil {
+				c.ClientCAs = r.pool
+				c.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+
+			return c, nil
+		},
+	}
+}
+
+// ClientConfig returns a tls.Config for a client, the server is verified
+// using the CA file or the system roots when no CA file is set, the
+// certificate is sent to servers which request a client certificate
+// serverName overrides the name used to verify the server certificate
+func (r *Reloader) ClientConfig(serverName string) *tls.Config {
+	c := &tls.Config{
+		MinVersion:           tls.VersionTLS12,
+		ServerName:           serverName,
+		GetClientCertificate: r.getClientCertificate,
+	}
+
+	if r.files.CAFile != "" {
+		// verification is done in VerifyConnection so that the current CA
+		// pool is used after a reload
+		c.InsecureSkipVerify = true
+		c.VerifyConnection = r.verifyServer
+	}
+
+	return c
+}
+
+func (r *Reloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.cert == nil {
+		return nil, fmt.Errorf("No server certificate configured")
+	}
+
+	return r.cert, nil
+}
+
+func (r *Reloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// an empty certificate tells the server the client has no certificate
+	if r.cert == nil {
+		return &tls.Certificate{}, nil
+	}
+
+	return r.cert, nil
+}
+
+func (r *Reloader) verifyServer(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("Server did not present a certificate")
+	}
+
+	r.mu.RLock()
+	pool := r.pool
+	r.mu.RUnlock()
+
+	opts := x509.VerifyOptions{
+		DNSName:       cs.ServerName,
+		Roots:         pool,
+		Intermediates: x509.NewCertPool(),
+	}
+
+	for _, c := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(c)
+	}
+
+	_, err := cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+// latestModTime returns the most recent modification time of the files
+func (r *Reloader) latestModTime() (time.Time, error) {
+	var mt time.Time
+
+	for _, f := range []string{r.files.CAFile, r.files.CertFile, r.files.KeyFile} {
+		if f == "" {
+			continue
+		}
+
+		fi, err := os.Stat(f)
+		if err != nil {
+			return mt, err
+		}
+
+		if fi.ModTime().After(mt) {
+			mt = fi.ModTime()
+		}
+	}
+
+	return mt, nil
+}
@@ -0,0 +1,222 @@
+package tlsconfig
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// testCA is an ephemeral certificate authority used to issue certificates
+// for the tests
+type testCA struct {
+	t    *testing.T
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	d, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(d)
+	require.NoError(t, err)
+
+	ca := &testCA{t: t, dir: t.TempDir(), cert: cert, key: key}
+	ca.write(name+"-ca.pem", "CERTIFICATE", d)
+
+	return ca
+}
+
+func (ca *testCA) caFile(name string) string {
+	return filepath.Join(ca.dir, name+"-ca.pem")
+}
+
+// issue creates a certificate signed by the CA and returns the paths to
+// the certificate and key files
+func (ca *testCA) issue(name string, serial int64) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(ca.t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	d, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(ca.t, err)
+
+	kd, err := x509.MarshalECPrivateKey(key)
+	require.NoError(ca.t, err)
+
+	return ca.write(name+".pem", "CERTIFICATE", d), ca.write(name+"-key.pem", "EC PRIVATE KEY", kd)
+}
+
+func (ca *testCA) write(name, typ string, d []byte) string {
+	p := filepath.Join(ca.dir, name)
+	require.NoError(ca.t, ioutil.WriteFile(p, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: d}), 0600))
+
+	return p
+}
+
+// startServer starts a gRPC health server using the given certificates
+func startServer(t *testing.T, f Files) (string, *Reloader) {
+	r, err := NewReloader(hclog.NewNullLogger(), f)
+	require.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	gs := grpc.NewServer(grpc.Creds(credentials.NewTLS(r.ServerConfig())))
+	healthpb.RegisterHealthServer(gs, health.NewServer())
+
+	go gs.Serve(l)
+	t.Cleanup(gs.Stop)
+
+	return l.Addr().String(), r
+}
+
+func check(t *testing.T, addr string, f Files) error {
+	r, err := NewReloader(hclog.NewNullLogger(), f)
+	require.NoError(t, err)
+
+	conn, err := grpc.Dial(addr, grpc.WithTransportCredentials(credentials.NewTLS(r.ClientConfig("localhost"))))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{})
+	return err
+}
+
+func TestTLSClientVerifiesServer(t *testing.T) {
+	ca := newTestCA(t, "test")
+	sc, sk := ca.issue("server", 2)
+
+	addr, _ := startServer(t, Files{CertFile: sc, KeyFile: sk})
+
+	assert.NoError(t, check(t, addr, Files{CAFile: ca.caFile("test")}))
+}
+
+func TestTLSClientRejectsUnknownServer(t *testing.T) {
+	ca := newTestCA(t, "test")
+	other := newTestCA(t, "other")
+	sc, sk := other.issue("server", 2)
+
+	addr, _ := startServer(t, Files{CertFile: sc, KeyFile: sk})
+
+	assert.Error(t, check(t, addr, Files{CAFile: ca.caFile("test")}))
+}
+
+func TestMutualTLSAcceptsClientSignedByCA(t *testing.T) {
+	ca := newTestCA(t, "test")
+	sc, sk := ca.issue("server", 2)
+	cc, ck := ca.issue("client", 3)
+
+	addr, _ := startServer(t, Files{CAFile: ca.caFile("test"), CertFile: sc, KeyFile: sk})
+
+	assert.NoError(t, check(t, addr, Files{CAFile: ca.caFile("test"), CertFile: cc, KeyFile: ck}))
+}
+
+func TestMutualTLSRejectsClientWithoutCertificate(t *testing.T) {
+	ca := newTestCA(t, "test")
+	sc, sk := ca.issue("server", 2)
+
+	addr, _ := startServer(t, Files{CAFile: ca.caFile("test"), CertFile: sc, KeyFile: sk})
+
+	assert.Error(t, check(t, addr, Files{CAFile: ca.caFile("test")}))
+}
+
+func TestMutualTLSRejectsClientSignedByOtherCA(t *testing.T) {
+	ca := newTestCA(t, "test")
+	other := newTestCA(t, "other")
+	sc, sk := ca.issue("server", 2)
+	cc, ck := other.issue("client", 3)
+
+	addr, _ := startServer(t, Files{CAFile: ca.caFile("test"), CertFile: sc, KeyFile: sk})
+
+	assert.Error(t, check(t, addr, Files{CAFile: ca.caFile("test"), CertFile: cc, KeyFile: ck}))
+}
+
+func TestWatchReloadsChangedCertificates(t *testing.T) {
+	ca := newTestCA(t, "test")
+	sc, sk := ca.issue("server", 2)
+
+	r, err := NewReloader(hclog.NewNullLogger(), Files{CertFile: sc, KeyFile: sk})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r.Watch(ctx, 10*time.Millisecond)
+
+	// replace the certificate with a new one and move the modification time
+	// forward so the change is detected on file systems with coarse times
+	ca.issue("server", 4)
+	future := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(sc, future, future))
+
+	assert.Eventually(t, func() bool {
+		c, err := r.getCertificate(nil)
+		require.NoError(t, err)
+
+		x, err := x509.ParseCertificate(c.Certificate[0])
+		require.NoError(t, err)
+
+		return x.SerialNumber.Int64() == 4
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestReloadKeepsCertificatesOnError(t *testing.T) {
+	ca := newTestCA(t, "test")
+	sc, sk := ca.issue("server", 2)
+
+	r, err := NewReloader(hclog.NewNullLogger(), Files{CertFile: sc, KeyFile: sk})
+	require.NoError(t, err)
+
+	require.NoError(t, ioutil.WriteFile(sc, []byte("invalid"), 0600))
+	assert.Error(t, r.Reload())
+
+	c, err := r.getCertificate(nil)
+	require.NoError(t, err)
+	assert.NotNil(t, c)
+}
@@ -0,0 +1,181 @@
+package tracing
+
+import (
+	"context"
+	"io"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// metadataCarrier adapts gRPC metadata to the OpenTelemetry TextMapCarrier interface
+type metadataCarrier metadata.MD
+
+func (m metadataCarrier) Get(key string) string {
+	v := metadata.MD(m).Get(key)
+	if len(v) == 0 {
+		return ""
+	}
+
+	return v[0]
+}
+
+func (m metadataCarrier) Set(key, value string) {
+	metadata.MD(m).Set(key, value)
+}
+
+func (m metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	return keys
+}
+
+// UnaryClientInterceptor starts a client span for each unary call and
+// injects the trace context into the outgoing metadata
+func UnaryClientInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	ctx, span := startClientSpan(ctx, method)
+	defer span.End()
+
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	setStatus(span, err)
+
+	return err
+}
+
+// StreamClientInterceptor starts a client span for each stream and injects the
+// trace context into the outgoing metadata, the span ends when the stream is closed
+func StreamClientInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	ctx, span := startClientSpan(ctx, method)
+
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		setStatus(span, err)
+		span.End()
+
+		return nil, err
+	}
+
+	return &tracedClientStream{ClientStream: cs, span: span}, nil
+}
+
+// UnaryServerInterceptor starts a server span for each unary call, joining the
+// trace from the incoming metadata when present
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, span := startServerSpan(ctx, info.FullMethod)
+	defer span.End()
+
+	resp, err := handler(ctx, req)
+	setStatus(span, err)
+
+	return resp, err
+}
+
+// StreamServerInterceptor starts a server span for the lifetime of each stream
+func StreamServerInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, span := startServerSpan(ss.Context(), info.FullMethod)
+	defer span.End()
+
+	err := handler(srv, &tracedServerStream{ServerStream: ss, ctx: ctx})
+	setStatus(span, err)
+
+	return err
+}
+
+func startClientSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	ctx, span := otel.Tracer(tracerName).Start(
+		ctx,
+		strings.TrimPrefix(method, "/"),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(rpcAttributes(method)...),
+	)
+
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if !ok {
+		md = metadata.MD{}
+	} else {
+		md = md.Copy()
+	}
+
+	otel.GetTextMapPropagator().Inject(ctx, metadataCarrier(md))
+
+	return metadata.NewOutgoingContext(ctx, md), span
+}
+
+func startServerSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if ok {
+		ctx = otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+	}
+
+	return otel.Tracer(tracerName).Start(
+		ctx,
+		strings.TrimPrefix(method, "/"),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(rpcAttributes(method)...),
+	)
+}
+
+// rpcAttributes returns the semantic convention attributes for the full
+// gRPC method name, i.e. /Currency/GetRate
+func rpcAttributes(method string) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{semconv.RPCSystemGRPC}
+
+	parts := strings.Split(strings.TrimPrefix(method, "/"), "/")
+	if len(parts) == 2 {
+		attrs = append(attrs, semconv.RPCService(parts[0]), semconv.RPCMethod(parts[1]))
+	}
+
+	return attrs
+}
+
+func setStatus(span trace.Span, err error) {
+	s := status.Convert(err)
+	span.SetAttributes(semconv.RPCGRPCStatusCodeKey.Int(int(s.Code())))
+
+	if err != nil {
+		span.SetStatus(codes.Error, s.Message())
+	}
+}
+
+// tracedClientStream ends the span when the stream returns an error or io.EOF
+type tracedClientStream struct {
+	grpc.ClientStream
+	span trace.Span
+	once sync.Once
+}
+
+func (t *tracedClientStream) RecvMsg(m interface{}) error {
+	err := t.ClientStream.RecvMsg(m)
+	if err != nil {
+		t.once.Do(func() {
+			if err != io.EOF {
+				setStatus(t.span, err)
+			}
+
+			t.span.End()
+		})
+	}
+
+	return err
+}
+
+// tracedServerStream returns the context containing the server span
+type tracedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (t *tracedServerStream) Context() context.Context {
+	return t.ctx
+}
@@ -0,0 +1,48 @@
+package tracing
+
+import (
+	"net/http"
+
+	"github.com/nicholasjackson/building-microservices-youtube/shared/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/nicholasjackson/building-microservices-youtube/shared/tracing"
+
+// Middleware starts a server span for each HTTP request, the span joins
+// the trace from the W3C traceparent header when present
+// spans are named with the template of the matched Gorilla mux route
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		route, ok := middleware.RouteTemplate(r)
+		if !ok {
+			route = r.URL.Path
+		}
+
+		ctx, span := otel.Tracer(tracerName).Start(
+			ctx,
+			r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPMethod(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.HTTPTarget(r.URL.RequestURI()),
+			),
+		)
+		defer span.End()
+
+		wr := middleware.NewRecorder(rw)
+		next.ServeHTTP(wr, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPStatusCode(wr.Status))
+		if wr.Status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(wr.Status))
+		}
+	})
+}
@@ -0,0 +1,303 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// OTLP status codes, the values differ from codes.Code
+const (
+	otlpStatusUnset = 0
+	otlpStatusOk    = 1
+	otlpStatusError = 2
+)
+
+// FileExporter writes spans in the OTLP JSON format, each batch of spans is
+// written as a single line containing an ExportTraceServiceRequest, this is
+// the format read by the OpenTelemetry Collector otlpjson file receiver
+type FileExporter struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewFileExporter creates a FileExporter which writes to w
+func NewFileExporter(w io.Writer) *FileExporter {
+	return &FileExporter{enc: json.NewEncoder(w)}
+}
+
+// ExportSpans writes the spans to the file grouped by resource and
+// instrumentation scope
+func (e *FileExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	req := otlpTraces{}
+	resources := map[*resource.Resource]int{}
+	scopes := map[*resource.Resource]map[instrumentation.Scope]int{}
+
+	for _, s := range spans {
+		res := s.Resource()
+
+		ri, ok := resources[res]
+		if !ok {
+			ri = len(req.ResourceSpans)
+			resources[res] = ri
+			scopes[res] = map[instrumentation.Scope]int{}
+
+			rs := otlpResourceSpans{}
+			if res != nil {
+				rs.Resource.Attributes = otlpAttributes(res.Attributes())
+				rs.SchemaURL = res.SchemaURL()
+			}
+
+			req.ResourceSpans = append(req.ResourceSpans, rs)
+		}
+
+		rs := &req.ResourceSpans[ri]
+		sc := s.InstrumentationScope()
+
+		si, ok := scopes[res][sc]
+		if !ok {
+			si = len(rs.ScopeSpans)
+			scopes[res][sc] = si
+
+			rs.ScopeSpans = append(rs.ScopeSpans, otlpScopeSpans{
+				Scope:     otlpScope{Name: sc.Name, Version: sc.Version},
+				SchemaURL: sc.SchemaURL,
+			})
+		}
+
+		rs.ScopeSpans[si].Spans = append(rs.ScopeSpans[si].Spans, otlpSpanFrom(s))
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.enc.Encode(req)
+}
+
+// Shutdown does nothing, the writer is closed by the owner
+func (e *FileExporter) Shutdown(ctx context.Context) error {
+	return nil
+}
+
+// the types below follow the JSON encoding of the OTLP protobuf messages,
+// trace and span ids are hex encoded and 64 bit integers are strings
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	SchemaURL  string           `json:"schemaUrl,omitempty"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope     otlpScope  `json:"scope"`
+	Spans     []otlpSpan `json:"spans"`
+	SchemaURL string     `json:"schemaUrl,omitempty"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID                string         `json:"traceId"`
+	SpanID                 string         `json:"spanId"`
+	TraceState             string         `json:"traceState,omitempty"`
+	ParentSpanID           string         `json:"parentSpanId,omitempty"`
+	Name                   string         `json:"name"`
+	Kind                   int            `json:"kind"`
+	StartTimeUnixNano      string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano        string         `json:"endTimeUnixNano"`
+	Attributes             []otlpKeyValue `json:"attributes,omitempty"`
+	DroppedAttributesCount int            `json:"droppedAttributesCount,omitempty"`
+	Events                 []otlpEvent    `json:"events,omitempty"`
+	DroppedEventsCount     int            `json:"droppedEventsCount,omitempty"`
+	Links                  []otlpLink     `json:"links,omitempty"`
+	DroppedLinksCount      int            `json:"droppedLinksCount,omitempty"`
+	Status                 otlpStatus     `json:"status"`
+}
+
+type otlpEvent struct {
+	TimeUnixNano           string         `json:"timeUnixNano"`
+	Name                   string         `json:"name"`
+	Attributes             []otlpKeyValue `json:"attributes,omitempty"`
+	DroppedAttributesCount int            `json:"droppedAttributesCount,omitempty"`
+}
+
+type otlpLink struct {
+	TraceID                string         `json:"traceId"`
+	SpanID                 string         `json:"spanId"`
+	TraceState             string         `json:"traceState,omitempty"`
+	Attributes             []otlpKeyValue `json:"attributes,omitempty"`
+	DroppedAttributesCount int            `json:"droppedAttributesCount,omitempty"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string         `json:"stringValue,omitempty"`
+	BoolValue   *bool           `json:"boolValue,omitempty"`
+	IntValue    *string         `json:"intValue,omitempty"`
+	DoubleValue *float64        `json:"doubleValue,omitempty"`
+	ArrayValue  *otlpArrayValue `json:"arrayValue,omitempty"`
+}
+
+type otlpArrayValue struct {
+	Values []otlpAnyValue `json:"values"`
+}
+
+func otlpSpanFrom(s sdktrace.ReadOnlySpan) otlpSpan {
+	sc := s.SpanContext()
+
+	// trace.SpanKind has the same values as the OTLP span kind
+	sp := otlpSpan{
+		TraceID:                sc.TraceID().String(),
+		SpanID:                 sc.SpanID().String(),
+		TraceState:             sc.TraceState().String(),
+		Name:                   s.Name(),
+		Kind:                   int(s.SpanKind()),
+		StartTimeUnixNano:      unixNano(s.StartTime()),
+		EndTimeUnixNano:        unixNano(s.EndTime()),
+		Attributes:             otlpAttributes(s.Attributes()),
+		DroppedAttributesCount: s.DroppedAttributes(),
+		DroppedEventsCount:     s.DroppedEvents(),
+		DroppedLinksCount:      s.DroppedLinks(),
+		Status:                 otlpStatusFrom(s.Status()),
+	}
+
+	if p := s.Parent(); p.HasSpanID() {
+		sp.ParentSpanID = p.SpanID().String()
+	}
+
+	for _, ev := range s.Events() {
+		sp.Events = append(sp.Events, otlpEvent{
+			TimeUnixNano:           unixNano(ev.Time),
+			Name:                   ev.Name,
+			Attributes:             otlpAttributes(ev.Attributes),
+			DroppedAttributesCount: ev.DroppedAttributeCount,
+		})
+	}
+
+	for _, l := range s.Links() {
+		sp.Links = append(sp.Links, otlpLink{
+			TraceID:                l.SpanContext.TraceID().String(),
+			SpanID:                 l.SpanContext.SpanID().String(),
+			TraceState:             l.SpanContext.TraceState().String(),
+			Attributes:             otlpAttributes(l.Attributes),
+			DroppedAttributesCount: l.DroppedAttributeCount,
+		})
+	}
+
+	return sp
+}
+
+func otlpStatusFrom(s sdktrace.Status) otlpStatus {
+	switch s.Code {
+	case codes.Ok:
+		return otlpStatus{Code: otlpStatusOk}
+	case codes.Error:
+		return otlpStatus{Code: otlpStatusError, Message: s.Description}
+	}
+
+	return otlpStatus{Code: otlpStatusUnset}
+}
+
+func otlpAttributes(kvs []attribute.KeyValue) []otlpKeyValue {
+	var out []otlpKeyValue
+	for _, kv := range kvs {
+		out = append(out, otlpKeyValue{Key: string(kv.Key), Value: otlpValue(kv.Value)})
+	}
+
+	return out
+}
+
+func otlpValue(v attribute.Value) otlpAnyValue {
+	switch v.Type() {
+	case attribute.BOOL:
+		b := v.AsBool()
+		return otlpAnyValue{BoolValue: &b}
+	case attribute.INT64:
+		i := strconv.FormatInt(v.AsInt64(), 10)
+		return otlpAnyValue{IntValue: &i}
+	case attribute.FLOAT64:
+		f := v.AsFloat64()
+		return otlpAnyValue{DoubleValue: &f}
+	case attribute.BOOLSLICE:
+		vs := []attribute.Value{}
+		for _, b := range v.AsBoolSlice() {
+			vs = append(vs, attribute.BoolValue(b))
+		}
+
+		return otlpArray(vs)
+	case attribute.INT64SLICE:
+		vs := []attribute.Value{}
+		for _, i := range v.AsInt64Slice() {
+			vs = append(vs, attribute.Int64Value(i))
+		}
+
+		return otlpArray(vs)
+	case attribute.FLOAT64SLICE:
+		vs := []attribute.Value{}
+		for _, f := range v.AsFloat64Slice() {
+			vs = append(vs, attribute.Float64Value(f))
+		}
+
+		return otlpArray(vs)
+	case attribute.STRINGSLICE:
+		vs := []attribute.Value{}
+		for _, s := range v.AsStringSlice() {
+			vs = append(vs, attribute.StringValue(s))
+		}
+
+		return otlpArray(vs)
+	}
+
+	s := v.Emit()
+	return otlpAnyValue{StringValue: &s}
+}
+
+func otlpArray(vs []attribute.Value) otlpAnyValue {
+	a := &otlpArrayValue{Values: []otlpAnyValue{}}
+	for _, v := range vs {
+		a.Values = append(a.Values, otlpValue(v))
+	}
+
+	return otlpAnyValue{ArrayValue: a}
+}
+
+func unixNano(t time.Time) string {
+	if t.IsZero() {
+		return "0"
+	}
+
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
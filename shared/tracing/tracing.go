@@ -0,0 +1,92 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+)
+
+// Exporter types which can be passed to Setup
+const (
+	// ExporterNone disables the export of spans, trace context is still propagated
+	ExporterNone = "none"
+	// ExporterStdout writes spans to stdout as JSON
+	ExporterStdout = "stdout"
+	// ExporterFile appends spans to a file in the OTLP JSON format
+	ExporterFile = "file"
+)
+
+// ShutdownFunc flushes any pending spans and stops the exporter
+type ShutdownFunc func(ctx context.Context) error
+
+// Setup configures the global OpenTelemetry TracerProvider and W3C trace context
+// propagator for the service
+// exporter is one of none, stdout or file, path is the file spans are written
+// to when using the file exporter
+// sampleRatio is the fraction of new traces which are sampled, traces started by
+// an upstream service follow the sampling decision of the parent
+func Setup(service, exporter, path string, sampleRatio float64) (ShutdownFunc, error) {
+	// always propagate the trace context, even when spans are not exported,
+	// so that downstream services can join the trace
+	otel.SetTextMapPropagator(
+		propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}),
+	)
+
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceName(service),
+		)),
+	}
+
+	var exp sdktrace.SpanExporter
+	var closer io.Closer
+
+	switch exporter {
+	case ExporterNone, "":
+	case ExporterStdout:
+		e, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, fmt.Errorf("Unable to create trace exporter: %s", err)
+		}
+
+		exp = e
+	case ExporterFile:
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to open trace file: %s", err)
+		}
+
+		exp = NewFileExporter(f)
+		closer = f
+	default:
+		return nil, fmt.Errorf("Unknown trace exporter '%s', expected none, stdout or file", exporter)
+	}
+
+	if exp != nil {
+		opts = append(opts, sdktrace.WithBatcher(exp))
+	}
+
+	tp := sdktrace.NewTracerProvider(opts...)
+
+	otel.SetTracerProvider(tp)
+
+	return func(ctx context.Context) error {
+		err := tp.Shutdown(ctx)
+
+		if closer != nil {
+			closer.Close()
+		}
+
+		return err
+	}, nil
+}
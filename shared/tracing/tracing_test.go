@@ -0,0 +1,131 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func setupRecorder(t *testing.T) *tracetest.SpanRecorder {
+	sr := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	return sr
+}
+
+func TestMiddlewareJoinsIncomingTrace(t *testing.T) {
+	sr := setupRecorder(t)
+
+	sm := mux.NewRouter()
+	sm.HandleFunc("/products/{id:[0-9]+}", func(rw http.ResponseWriter, r *http.Request) {})
+	sm.Use(Middleware)
+
+	r := httptest.NewRequest(http.MethodGet, "/products/1", nil)
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	sm.ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := sr.Ended()
+	require.Len(t, spans, 1)
+	assert.Equal(t, "GET /products/{id:[0-9]+}", spans[0].Name())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spans[0].SpanContext().TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", spans[0].Parent().SpanID().String())
+}
+
+func TestGRPCInterceptorsPropagateTrace(t *testing.T) {
+	sr := setupRecorder(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	gs := grpc.NewServer(grpc.UnaryInterceptor(UnaryServerInterceptor))
+	healthpb.RegisterHealthServer(gs, health.NewServer())
+	go gs.Serve(l)
+	defer gs.Stop()
+
+	conn, err := grpc.Dial(
+		l.Addr().String(),
+		grpc.WithInsecure(),
+		grpc.WithUnaryInterceptor(UnaryClientInterceptor),
+	)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{})
+	require.NoError(t, err)
+
+	spans := sr.Ended()
+	require.Len(t, spans, 2)
+
+	// the server span ends first and must be a child of the client span
+	server, client := spans[0], spans[1]
+	assert.Equal(t, "grpc.health.v1.Health/Check", client.Name())
+	assert.Equal(t, client.SpanContext().TraceID(), server.SpanContext().TraceID())
+	assert.Equal(t, client.SpanContext().SpanID(), server.Parent().SpanID())
+}
+
+func TestFileExporterWritesOTLPJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithSyncer(NewFileExporter(buf)),
+		sdktrace.WithResource(resource.NewSchemaless(attribute.String("service.name", "product-api"))),
+	)
+
+	ctx, parent := tp.Tracer("test").Start(context.Background(), "parent")
+	_, child := tp.Tracer("test").Start(ctx, "child")
+	child.SetAttributes(attribute.Int("http.status_code", 500), attribute.StringSlice("tags", []string{"a"}))
+	child.RecordError(errors.New("boom"))
+	child.SetStatus(codes.Error, "boom")
+	child.End()
+	parent.End()
+
+	dec := json.NewDecoder(buf)
+
+	// the child ends first and is written in its own batch
+	req := map[string]interface{}{}
+	require.NoError(t, dec.Decode(&req))
+
+	rs := req["resourceSpans"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "service.name", rs["resource"].(map[string]interface{})["attributes"].([]interface{})[0].(map[string]interface{})["key"])
+
+	ss := rs["scopeSpans"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "test", ss["scope"].(map[string]interface{})["name"])
+
+	span := ss["spans"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "child", span["name"])
+	assert.Equal(t, child.SpanContext().TraceID().String(), span["traceId"])
+	assert.Equal(t, parent.SpanContext().SpanID().String(), span["parentSpanId"])
+	assert.Equal(t, float64(1), span["kind"])
+	assert.Equal(t, map[string]interface{}{"code": float64(2), "message": "boom"}, span["status"])
+	assert.Equal(t, "exception", span["events"].([]interface{})[0].(map[string]interface{})["name"])
+
+	attrs := span["attributes"].([]interface{})
+	assert.Contains(t, attrs, map[string]interface{}{"key": "http.status_code", "value": map[string]interface{}{"intValue": "500"}})
+	assert.Contains(t, attrs, map[string]interface{}{
+		"key":   "tags",
+		"value": map[string]interface{}{"arrayValue": map[string]interface{}{"values": []interface{}{map[string]interface{}{"stringValue": "a"}}}},
+	})
+
+	require.NoError(t, dec.Decode(&req))
+	assert.False(t, dec.More())
+}